@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,7 +14,6 @@ import (
 	"strings"
 
 	"github.com/cloudfoundry-incubator/bits-service/logger"
-	"github.com/cloudfoundry-incubator/bits-service/util"
 	"github.com/pkg/errors"
 )
 
@@ -37,25 +35,23 @@ func NewAppStashHandlerWithSizeThresholds(blobstore Blobstore, maxBodySizeLimit
 	}
 }
 
-func (handler *AppStashHandler) PostMatches(responseWriter http.ResponseWriter, request *http.Request) {
+func (handler *AppStashHandler) PostMatches(responseWriter http.ResponseWriter, request *http.Request) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
 	body, e := ioutil.ReadAll(request.Body)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not read request body")
+	}
 	var fingerprints []Fingerprint
 	e = json.Unmarshal(body, &fingerprints)
 	if e != nil {
 		logger.From(request).Debugw("Invalid body", "error", e, "body", string(body))
-		responseWriter.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(responseWriter, "Invalid body %s", body)
-		return
+		return newUnprocessableEntityError("Invalid body %s", body)
 	}
 	if len(fingerprints) == 0 {
 		logger.From(request).Debugw("Empty list", "error", e, "body", string(body))
-		responseWriter.WriteHeader(http.StatusUnprocessableEntity)
-		util.FprintDescriptionAsJSON(responseWriter, "The request is semantically invalid: must be a non-empty array.")
-		return
+		return newUnprocessableEntityError("The request is semantically invalid: must be a non-empty array.")
 	}
 	matchedFingerprints := []Fingerprint{} // this must not be nil, because the JSON marshaller will not marshal it correctly in case of []
 	for _, entry := range fingerprints {
@@ -63,39 +59,46 @@ func (handler *AppStashHandler) PostMatches(responseWriter http.ResponseWriter,
 			continue
 		}
 		exists, e := handler.blobstore.Exists(entry.Sha1)
-		util.PanicOnError(e)
+		if e != nil {
+			return errors.Wrapf(e, "Could not check existence of %v", entry.Sha1)
+		}
 		if exists {
 			matchedFingerprints = append(matchedFingerprints, entry)
 		}
 	}
 	response, e := json.Marshal(&matchedFingerprints)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal matched fingerprints")
+	}
 	responseWriter.Write(response)
+	return nil
 }
 
-func (handler *AppStashHandler) PostEntries(responseWriter http.ResponseWriter, request *http.Request) {
+func (handler *AppStashHandler) PostEntries(responseWriter http.ResponseWriter, request *http.Request) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
 	uploadedFile, _, e := request.FormFile("application")
 	if e != nil {
-		badRequest(responseWriter, request, "Could not retrieve 'application' form parameter")
-		return
+		return newBadRequestError("Could not retrieve 'application' form parameter")
 	}
 	defer uploadedFile.Close()
 
 	tempZipFile, e := ioutil.TempFile("", "")
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not create temp file")
+	}
 	defer os.Remove(tempZipFile.Name())
 	defer tempZipFile.Close()
 
 	_, e = io.Copy(tempZipFile, uploadedFile)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not copy uploaded file to temp file")
+	}
 
 	openZipFile, e := zip.OpenReader(tempZipFile.Name())
 	if e != nil {
-		badRequest(responseWriter, request, "Bad Request: Not a valid zip file")
-		return
+		return newBadRequestError("Bad Request: Not a valid zip file")
 	}
 	defer openZipFile.Close()
 
@@ -105,11 +108,9 @@ func (handler *AppStashHandler) PostEntries(responseWriter http.ResponseWriter,
 			continue
 		}
 		sha, e := copyTo(handler.blobstore, zipFileEntry)
-		if _, isNoSpaceLeftError := e.(*NoSpaceLeftError); isNoSpaceLeftError {
-			http.Error(responseWriter, util.DescriptionAndCodeAsJSON(500000, "Request Entity Too Large"), http.StatusInsufficientStorage)
-			return
+		if e != nil {
+			return e
 		}
-		util.PanicOnError(e)
 		logger.From(request).Debugw("Filemode in zip File Entry", "filemode", zipFileEntry.FileInfo().Mode().String())
 		fingerprints = append(fingerprints, Fingerprint{
 			Sha1: sha,
@@ -119,9 +120,12 @@ func (handler *AppStashHandler) PostEntries(responseWriter http.ResponseWriter,
 		})
 	}
 	receipt, e := json.Marshal(fingerprints)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal fingerprints")
+	}
 	responseWriter.WriteHeader(http.StatusCreated)
 	responseWriter.Write(receipt)
+	return nil
 }
 
 func copyTo(blobstore Blobstore, zipFileEntry *zip.File) (sha string, err error) {
@@ -178,9 +182,9 @@ type Fingerprint struct {
 	Mode string `json:"mode"`
 }
 
-func (handler *AppStashHandler) PostBundles(responseWriter http.ResponseWriter, request *http.Request) {
+func (handler *AppStashHandler) PostBundles(responseWriter http.ResponseWriter, request *http.Request) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
 
 	var (
@@ -191,58 +195,63 @@ func (handler *AppStashHandler) PostBundles(responseWriter http.ResponseWriter,
 	if strings.Contains(request.Header.Get("Content-Type"), "multipart/form-data") {
 		resources, _, e = request.FormFile("resources")
 		if e == http.ErrMissingFile {
-			badRequest(responseWriter, request, "Could not retrieve form parameter 'resources")
-			return
+			return newBadRequestError("Could not retrieve form parameter 'resources")
+		}
+		if e != nil {
+			return errors.Wrap(e, "Could not read multipart form")
 		}
-		util.PanicOnError(e)
 		zipFile, fi, e := request.FormFile("application")
 		if e == http.ErrMissingFile {
-			badRequest(responseWriter, request, "Could not retrieve form parameter 'application")
-			return
+			return newBadRequestError("Could not retrieve form parameter 'application")
+		}
+		if e != nil {
+			return errors.Wrap(e, "Could not read multipart form")
 		}
-		util.PanicOnError(e)
 		defer zipFile.Close()
 		zipReader, e = zip.NewReader(zipFile, fi.Size)
-		util.PanicOnError(e)
+		if e != nil {
+			return newUnprocessableEntityError("The request is semantically invalid: application is not a valid zip file")
+		}
 	} else {
 		resources = request.Body
 	}
 
 	body, e := ioutil.ReadAll(resources)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not read resources")
+	}
 
 	var bundlesPayload []Fingerprint
 	e = json.Unmarshal(body, &bundlesPayload)
 	if e != nil {
-		log.Printf("Invalid body %s", body)
-		responseWriter.WriteHeader(http.StatusUnprocessableEntity)
-		util.FprintDescriptionAsJSON(responseWriter, "Invalid body %s", body)
-		return
+		return newUnprocessableEntityError("Invalid body %s", body)
 	}
 
 	if isMissing, key := anyKeyMissingIn(bundlesPayload); isMissing {
-		responseWriter.WriteHeader(http.StatusUnprocessableEntity)
-		util.FprintDescriptionAsJSON(responseWriter, "The request is semantically invalid: key `%v` missing or empty", key)
-		return
+		return newUnprocessableEntityError("The request is semantically invalid: key `%v` missing or empty", key)
 	}
 
 	tempZipFilename, e := CreateTempZipFileFrom(bundlesPayload, zipReader, handler.minimumSize, handler.maximumSize, handler.blobstore, handler.metricsService, logger.From(request))
+	if notFoundError, ok := e.(*NotFoundError); ok {
+		return newNotFoundResponseError("%v not found", notFoundError.MissingKey)
+	}
 	if e != nil {
-		if notFoundError, ok := e.(*NotFoundError); ok {
-			responseWriter.WriteHeader(http.StatusNotFound)
-			util.FprintDescriptionAsJSON(responseWriter, "%v not found", notFoundError.MissingKey)
-			return
-		}
-		panic(e)
+		return e
 	}
 	defer os.Remove(tempZipFilename)
 
 	tempZipFile, e := os.Open(tempZipFilename)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not open bundled zip file")
+	}
 	defer tempZipFile.Close()
 
 	_, e = io.Copy(responseWriter, tempZipFile)
-	util.PanicOnError(e)
+	if e != nil {
+		// The response has already started, so all we can do is to log.
+		logger.From(request).Errorw("Could not write bundled zip file to response", "error", e)
+	}
+	return nil
 }
 
 func anyKeyMissingIn(bundlesPayload []Fingerprint) (bool, string) {
@@ -51,7 +51,7 @@ var _ = Describe("AppStash", func() {
 			})
 
 			It("matches only files where sizes are within thresholds", func() {
-				appStashHandler.PostMatches(responseWriter, httptest.NewRequest(
+				bitsgo.HandlerFunc(appStashHandler.PostMatches).ServeHTTP(responseWriter, httptest.NewRequest(
 					"POST", "http://example.com",
 					strings.NewReader(`[
 						{
@@ -105,7 +105,7 @@ var _ = Describe("AppStash", func() {
 						}
 					]`))
 
-				appStashHandler.PostBundles(responseWriter, r)
+				bitsgo.HandlerFunc(appStashHandler.PostBundles).ServeHTTP(responseWriter, r)
 
 				Expect(responseWriter.Code).To(Equal(http.StatusOK), responseWriter.Body.String())
 				zipReader, e := zip.NewReader(bytes.NewReader(responseWriter.Body.Bytes()), int64(responseWriter.Body.Len()))
@@ -142,7 +142,7 @@ var _ = Describe("AppStash", func() {
 				})
 				Expect(e).NotTo(HaveOccurred())
 
-				appStashHandler.PostBundles(responseWriter, r)
+				bitsgo.HandlerFunc(appStashHandler.PostBundles).ServeHTTP(responseWriter, r)
 
 				Expect(responseWriter.Code).To(Equal(http.StatusOK), responseWriter.Body.String())
 				zipReader, e := zip.NewReader(bytes.NewReader(responseWriter.Body.Bytes()), int64(responseWriter.Body.Len()))
@@ -176,7 +176,7 @@ var _ = Describe("AppStash", func() {
 					})
 					Expect(e).NotTo(HaveOccurred())
 
-					appStashHandler.PostBundles(responseWriter, r)
+					bitsgo.HandlerFunc(appStashHandler.PostBundles).ServeHTTP(responseWriter, r)
 
 					Expect(responseWriter.Code).To(Equal(http.StatusOK), responseWriter.Body.String())
 					zipReader, e := zip.NewReader(bytes.NewReader(responseWriter.Body.Bytes()), int64(responseWriter.Body.Len()))
@@ -187,7 +187,7 @@ var _ = Describe("AppStash", func() {
 					VerifyZipFileEntry(zipReader, "zip-folder/file-in-folder", "folder file content")
 
 					responseWriter = httptest.NewRecorder()
-					appStashHandler.PostBundles(responseWriter, httptest.NewRequest("POST", "http://example.com", strings.NewReader(`[
+					bitsgo.HandlerFunc(appStashHandler.PostBundles).ServeHTTP(responseWriter, httptest.NewRequest("POST", "http://example.com", strings.NewReader(`[
 						{
 							"sha1":"b971c6ef19b1d70ae8f0feb989b106c319b36230",
 							"fn":"anotherFilenameB"
@@ -223,7 +223,7 @@ var _ = Describe("AppStash", func() {
 						]`)}})
 					Expect(e).NotTo(HaveOccurred())
 
-					appStashHandler.PostBundles(responseWriter, r)
+					bitsgo.HandlerFunc(appStashHandler.PostBundles).ServeHTTP(responseWriter, r)
 
 					Expect(responseWriter.Code).To(Equal(http.StatusBadRequest), responseWriter.Body.String())
 				})
@@ -3,6 +3,9 @@ package bitsgo
 import (
 	"fmt"
 	"io"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 type NotFoundError struct {
@@ -37,6 +40,127 @@ func NewNoSpaceLeftError() *NoSpaceLeftError {
 	return &NoSpaceLeftError{fmt.Errorf("NoSpaceLeftError")}
 }
 
+type EntityTooLargeError struct {
+	error
+}
+
+func NewEntityTooLargeError(size int64, maxSize uint64) *EntityTooLargeError {
+	return &EntityTooLargeError{fmt.Errorf("Entity of size %v exceeds maximum size %v", size, maxSize)}
+}
+
+// CorruptBlobError is returned when the content read from a blobstore does not match the digest stored when it was written.
+type CorruptBlobError struct {
+	error
+	Path           string
+	ExpectedDigest string
+	ActualDigest   string
+}
+
+func NewCorruptBlobError(path string, expectedDigest string, actualDigest string) *CorruptBlobError {
+	return &CorruptBlobError{
+		error:          fmt.Errorf("Blob %v is corrupt: expected sha256 %v, but got %v", path, expectedDigest, actualDigest),
+		Path:           path,
+		ExpectedDigest: expectedDigest,
+		ActualDigest:   actualDigest,
+	}
+}
+
+func IsCorruptBlobError(e error) bool {
+	_, corrupt := e.(*CorruptBlobError)
+	return corrupt
+}
+
+// PermissionDeniedError is returned when the blobstore's credentials do not permit the operation.
+type PermissionDeniedError struct {
+	error
+}
+
+func NewPermissionDeniedError(e error) *PermissionDeniedError {
+	return &PermissionDeniedError{e}
+}
+
+// ThrottledError is returned when the blobstore rejects an operation because of the rate of operations.
+// RetryAfter is 0 when the blobstore does not indicate when to retry.
+type ThrottledError struct {
+	error
+	RetryAfter time.Duration
+}
+
+func NewThrottledError(e error, retryAfter time.Duration) *ThrottledError {
+	return &ThrottledError{e, retryAfter}
+}
+
+// ContainerNotFoundError is returned when the bucket or container the blobstore is configured with does not exist.
+type ContainerNotFoundError struct {
+	error
+	Container string
+}
+
+func NewContainerNotFoundError(container string) *ContainerNotFoundError {
+	return &ContainerNotFoundError{fmt.Errorf("Bucket or container not found: %v", container), container}
+}
+
+// PreconditionFailedError is returned when a condition of a conditional operation is not met.
+type PreconditionFailedError struct {
+	error
+}
+
+func NewPreconditionFailedError(e error) *PreconditionFailedError {
+	return &PreconditionFailedError{e}
+}
+
+// UnavailableError is returned when the blobstore is temporarily unable to handle operations.
+// RetryAfter is 0 when it is not known when the blobstore will be available again.
+type UnavailableError struct {
+	error
+	RetryAfter time.Duration
+}
+
+func NewUnavailableError(e error, retryAfter time.Duration) *UnavailableError {
+	return &UnavailableError{e, retryAfter}
+}
+
+// ErrorFromStatusCode translates the HTTP status code of a failed blobstore request into the corresponding typed error
+// wrapping e. It returns e itself for status codes without a corresponding typed error. 404 is not translated,
+// because whether it denotes a missing blob or a missing container is specific to the backend. Only 502, 503 and 504
+// denote a temporarily unavailable blobstore; other 5xx status codes, e.g. 500 or 501, are returned as is.
+func ErrorFromStatusCode(statusCode int, header http.Header, e error) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return NewPermissionDeniedError(e)
+	case statusCode == http.StatusPreconditionFailed:
+		return NewPreconditionFailedError(e)
+	case statusCode == http.StatusTooManyRequests:
+		return NewThrottledError(e, retryAfterFrom(header))
+	case statusCode == http.StatusServiceUnavailable:
+		return NewUnavailableError(e, retryAfterFrom(header))
+	case statusCode == http.StatusBadGateway || statusCode == http.StatusGatewayTimeout:
+		return NewUnavailableError(e, 0)
+	}
+	return e
+}
+
+// retryAfterFrom parses the Retry-After header, which is either a number of seconds or an HTTP date.
+func retryAfterFrom(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, e := strconv.Atoi(value); e == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, e := http.ParseTime(value); e == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+type BlobInfo struct {
+	Path         string
+	Size         int64
+	LastModified time.Time
+}
+
 //go:generate pegomock generate --use-experimental-model-gen --package bitsgo_test Blobstore
 type Blobstore interface {
 	Exists(path string) (bool, error)
@@ -51,4 +175,15 @@ type Blobstore interface {
 	Copy(src, dest string) error
 	Delete(path string) error
 	DeleteDir(prefix string) error
+
+	// List returns all blobs whose path starts with prefix.
+	List(prefix string) ([]BlobInfo, error)
+}
+
+// DigestingBlobstore is implemented by blobstores which store the digests of their blobs.
+type DigestingBlobstore interface {
+	Blobstore
+
+	// Digest returns the hex encoded sha256 digest of the blob stored at path or "" when it is not known.
+	Digest(path string) (string, error)
 }
@@ -44,7 +44,7 @@ func (blobstore *Blobstore) Copy(src string, dest string) error {
 	logger.Log.Debugw("Copy in Alibaba", "bucket", blobstore.bucket.BucketName, "src", src, "dest", dest)
 	_, e := blobstore.bucket.CopyObject(src, dest)
 	if e != nil {
-		return errors.Wrapf(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.bucket.BucketName)
+		return blobstore.handleError(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.bucket.BucketName)
 	}
 	return nil
 }
@@ -52,19 +52,20 @@ func (blobstore *Blobstore) Copy(src string, dest string) error {
 func (blobstore *Blobstore) Delete(path string) error {
 	e := blobstore.bucket.DeleteObject(path)
 	if e != nil {
-		return errors.Wrapf(e, "Path %v", path)
+		return blobstore.handleError(e, "Path %v", path)
 	}
 	return nil
 }
 
+// DeleteDir deletes the objects of each listed page, i.e. up to 1000 keys, with a single DeleteObjects request.
 func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	deletionErrs := []error{}
 	marker := oss.Marker("")
 
 	for {
-		objList, e := blobstore.bucket.ListObjects(oss.MaxKeys(20), marker, oss.Prefix(prefix))
+		objList, e := blobstore.bucket.ListObjects(oss.MaxKeys(1000), marker, oss.Prefix(prefix))
 		if e != nil {
-			return errors.Wrapf(e, "Prefix %v", prefix)
+			return blobstore.handleError(e, "Prefix %v", prefix)
 		}
 		deletionErrs = append(deletionErrs, blobstore.deleteObjects(objList)...)
 		marker = oss.Marker(objList.NextMarker)
@@ -79,30 +80,64 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	return nil
 }
 
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos := []bitsgo.BlobInfo{}
+	marker := oss.Marker("")
+
+	for {
+		objList, e := blobstore.bucket.ListObjects(oss.MaxKeys(1000), marker, oss.Prefix(prefix))
+		if e != nil {
+			return nil, blobstore.handleError(e, "Prefix %v", prefix)
+		}
+		for _, obj := range objList.Objects {
+			blobInfos = append(blobInfos, bitsgo.BlobInfo{Path: obj.Key, Size: obj.Size, LastModified: obj.LastModified})
+		}
+		marker = oss.Marker(objList.NextMarker)
+		if !objList.IsTruncated {
+			break
+		}
+	}
+	return blobInfos, nil
+}
+
 func (blobstore *Blobstore) deleteObjects(objListResult oss.ListObjectsResult) []error {
+	if len(objListResult.Objects) == 0 {
+		return nil
+	}
+	keys := make([]string, len(objListResult.Objects))
+	for i, obj := range objListResult.Objects {
+		keys[i] = obj.Key
+	}
+	result, e := blobstore.bucket.DeleteObjects(keys)
+	if e != nil {
+		return []error{blobstore.handleError(e, "Keys %v to %v", keys[0], keys[len(keys)-1])}
+	}
+	deleted := make(map[string]bool, len(result.DeletedObjects))
+	for _, key := range result.DeletedObjects {
+		deleted[key] = true
+	}
 	deletionErrs := []error{}
-	for _, obj := range objListResult.Objects {
-		e := blobstore.bucket.DeleteObject(obj.Key)
-		if e != nil {
-			deletionErrs = append(deletionErrs, e)
+	for _, key := range keys {
+		if !deleted[key] {
+			deletionErrs = append(deletionErrs, errors.Errorf("Key %v: not deleted", key))
 		}
 	}
 	return deletionErrs
 }
 
 func (blobstore *Blobstore) Exists(path string) (bool, error) {
-	return blobstore.bucket.IsObjectExist(path)
+	exists, e := blobstore.bucket.IsObjectExist(path)
+	if e != nil {
+		return false, blobstore.handleError(e, "Path %v", path)
+	}
+	return exists, nil
 }
 
 func (blobstore *Blobstore) Get(path string) (io.ReadCloser, error) {
 	logger.Log.Debugw("GET", "bucket", blobstore.bucket.BucketName, "path", path)
-	exists, _ := blobstore.Client.IsBucketExist(blobstore.bucket.BucketName)
-	if !exists {
-		return nil, errors.Errorf("Bucket not found: '%v'", blobstore.bucket.BucketName)
-	}
-	obj, err := blobstore.bucket.GetObject(path)
-	if err != nil {
-		return nil, bitsgo.NewNotFoundErrorWithMessage("Could not find object: " + path)
+	obj, e := blobstore.bucket.GetObject(path)
+	if e != nil {
+		return nil, blobstore.handleError(e, "Path %v", path)
 	}
 	return obj, nil
 }
@@ -114,14 +149,14 @@ func (blobstore *Blobstore) GetOrRedirect(path string) (io.ReadCloser, string, e
 
 func (blobstore *Blobstore) Put(path string, rs io.ReadSeeker) error {
 	logger.Log.Debugw("Put", "bucket", blobstore.bucket.BucketName, "path", path)
-	exists, _ := blobstore.Client.IsBucketExist(blobstore.bucket.BucketName)
-	if !exists {
-		return errors.Errorf("Bucket not found: '%v'", blobstore.bucket.BucketName)
+	e := blobstore.bucket.PutObject(path, rs)
+	if e != nil {
+		return blobstore.handleError(e, "Path %v", path)
 	}
-	return blobstore.bucket.PutObject(path, rs)
+	return nil
 }
 
-func (blobstore *Blobstore) Sign(path string, method string, timestamp time.Time) string {
+func (blobstore *Blobstore) Sign(path string, method string, timestamp time.Time) (string, error) {
 	var ossMethod oss.HTTPMethod
 	switch strings.ToLower(method) {
 	case "put":
@@ -130,16 +165,35 @@ func (blobstore *Blobstore) Sign(path string, method string, timestamp time.Time
 		ossMethod = oss.HTTPGet
 
 	default:
-		panic("Supported methods are 'put' and 'get'.Got'" + method + "'")
+		return "", errors.Errorf("Supported methods are 'put' and 'get'. Got '%v'", method)
 	}
 	signedURL, e := blobstore.bucket.SignURL(path, ossMethod, getValidityPeriod(timestamp))
 	if e != nil {
-		panic(e)
+		return "", errors.Wrapf(e, "Could not sign URL for %v", path)
 	}
-	return signedURL
+	return signedURL, nil
 }
 
 func getValidityPeriod(timestamp time.Time) int64 {
 	duration := timestamp.Sub(time.Now()).Seconds()
 	return int64(duration)
 }
+
+func (blobstore *Blobstore) handleError(e error, context string, args ...interface{}) error {
+	var serviceError oss.ServiceError
+	switch typedError := e.(type) {
+	case oss.ServiceError:
+		serviceError = typedError
+	case *oss.ServiceError:
+		serviceError = *typedError
+	default:
+		return errors.Wrapf(e, context, args...)
+	}
+	switch serviceError.Code {
+	case "NoSuchBucket":
+		return bitsgo.NewContainerNotFoundError(blobstore.bucket.BucketName)
+	case "NoSuchKey":
+		return bitsgo.NewNotFoundError()
+	}
+	return bitsgo.ErrorFromStatusCode(serviceError.StatusCode, nil, errors.Wrapf(e, context, args...))
+}
@@ -0,0 +1,81 @@
+package alibaba_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/cloudfoundry-incubator/bits-service/blobstores/alibaba"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAlibabaBlobstore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "AlibabaBlobstore")
+}
+
+var _ = Describe("Blobstore", func() {
+	var (
+		server            *httptest.Server
+		deletedKeys       []string
+		numDeleteRequests int
+		blobstore         *Blobstore
+	)
+
+	BeforeEach(func() {
+		numDeleteRequests = 0
+		server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			_, isDeleteObjects := request.URL.Query()["delete"]
+			switch {
+			case request.Method == "GET":
+				fmt.Fprint(responseWriter, "<ListBucketResult><IsTruncated>false</IsTruncated>"+
+					"<Contents><Key>dir/a</Key></Contents><Contents><Key>dir/b</Key></Contents><Contents><Key>dir/c</Key></Contents>"+
+					"</ListBucketResult>")
+			case request.Method == "POST" && isDeleteObjects:
+				numDeleteRequests++
+				fmt.Fprint(responseWriter, "<DeleteResult>")
+				for _, key := range deletedKeys {
+					fmt.Fprintf(responseWriter, "<Deleted><Key>%v</Key></Deleted>", key)
+				}
+				fmt.Fprint(responseWriter, "</DeleteResult>")
+			default:
+				responseWriter.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(responseWriter, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			}
+		}))
+		// With an IP address as endpoint, the SDK puts the bucket name into the path instead of the host.
+		blobstore = NewBlobstore(config.AlibabaBlobstoreConfig{
+			BucketName: "some-bucket",
+			ApiKey:     "some-api-key",
+			ApiSecret:  "some-api-secret",
+			Endpoint:   server.URL,
+		})
+	})
+
+	AfterEach(func() { server.Close() })
+
+	Context("DeleteDir", func() {
+		It("deletes all listed keys with a single request", func() {
+			deletedKeys = []string{"dir/a", "dir/b", "dir/c"}
+
+			Expect(blobstore.DeleteDir("dir/")).To(Succeed())
+
+			Expect(numDeleteRequests).To(Equal(1))
+		})
+
+		It("returns an error for each key which was not deleted", func() {
+			deletedKeys = []string{"dir/b"}
+
+			e := blobstore.DeleteDir("dir/")
+
+			Expect(e).To(HaveOccurred())
+			Expect(e.Error()).To(SatisfyAll(
+				ContainSubstring("Key dir/a: not deleted"),
+				ContainSubstring("Key dir/c: not deleted"),
+				Not(ContainSubstring("dir/b"))))
+		})
+	})
+})
@@ -1,24 +1,23 @@
 package azure
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/cenkalti/backoff"
-
-	"github.com/Azure/go-autorest/autorest"
-
-	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 
-	"net/http"
-
-	"fmt"
-
 	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 	"github.com/cloudfoundry-incubator/bits-service/blobstores/validate"
 	"github.com/cloudfoundry-incubator/bits-service/config"
@@ -28,62 +27,22 @@ import (
 
 type Blobstore struct {
 	containerName  string
-	client         storage.BlobStorageClient
+	containerURL   azblob.ContainerURL
+	serviceURL     azblob.ServiceURL
+	signer         signer
 	putBlockSize   int64
+	putBlockSlots  chan struct{}
 	maxListResults uint
 	metricsService bitsgo.MetricsService
 }
 
+// NewBlobstore uses blocks of 4MB. With Azure's limit of 50,000 blocks per blob, this still allows blobs of 195GB,
+// while all Puts of a blobstore hold at most put_block_concurrency blocks in memory.
 func NewBlobstore(config config.AzureBlobstoreConfig, metricsService bitsgo.MetricsService) *Blobstore {
-	return NewBlobstoreWithDetails(config, 50<<20, 5000, metricsService)
-}
-
-// NetworkErrorRetryingSender is a replacement for the storage.DefaultSender.
-// storage.DefaultSender does not retry on network errors which is rarely what we want in
-// a production system.
-type NetworkErrorRetryingSender struct{}
-
-var retryableStatusCodes = []int{
-	http.StatusRequestTimeout,      // 408
-	http.StatusInternalServerError, // 500
-	http.StatusBadGateway,          // 502
-	http.StatusServiceUnavailable,  // 503
-	http.StatusGatewayTimeout,      // 504
-}
-
-// Send is mostly emulating storage.DefaultSender.Send, so most code was copied.
-// But we use the backoff library for convenience and retry on errors returned from
-// HTTPClient.Do.
-func (sender *NetworkErrorRetryingSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
-	rr := autorest.NewRetriableRequest(req)
-	var resp *http.Response
-
-	err := backoff.Retry(func() error {
-		err := rr.Prepare()
-		if err != nil {
-			return backoff.Permanent(err)
-		}
-		resp, err = c.HTTPClient.Do(rr.Request())
-		// We deliberately mark errors *not* as permanent, because an error
-		// here means network connectivity or similar. This is different to the
-		// storage.DefaultSender which stops on any error.
-		if err != nil {
-			return err
-		}
-		if !autorest.ResponseHasStatusCode(resp, retryableStatusCodes...) {
-			return backoff.Permanent(err)
-		}
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-		return nil
-	}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 5))
-
-	return resp, err
+	return NewBlobstoreWithDetails(config, 4<<20, 5000, metricsService)
 }
 
 func NewBlobstoreWithDetails(config config.AzureBlobstoreConfig, putBlockSize int64, maxListResults uint, metricsService bitsgo.MetricsService) *Blobstore {
-	validate.NotEmpty(config.AccountKey)
-	validate.NotEmpty(config.AccountName)
 	validate.NotEmpty(config.ContainerName)
 	validate.NotEmpty(config.EnvironmentName())
 	if metricsService == nil {
@@ -94,177 +53,269 @@ func NewBlobstoreWithDetails(config config.AzureBlobstoreConfig, putBlockSize in
 	if e != nil {
 		logger.Log.Fatalw("Could not get Azure Environment from Name", "error", e, "environment", config.EnvironmentName())
 	}
-	client, e := storage.NewBasicClientOnSovereignCloud(config.AccountName, config.AccountKey, environment)
+
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		validate.NotEmpty(config.AccountName)
+		endpoint = fmt.Sprintf("https://%v.blob.%v", config.AccountName, environment.StorageEndpointSuffix)
+	}
+	serviceURL, e := url.Parse(endpoint)
 	if e != nil {
-		logger.Log.Fatalw("Could not instantiate Azure Basic Client", "error", e)
+		logger.Log.Fatalw("Could not parse Azure endpoint", "error", e, "endpoint", endpoint)
+	}
+
+	var (
+		credential azblob.Credential
+		signer     signer
+	)
+	switch {
+	case config.SASToken != "":
+		// The SAS token is part of every URL derived from the service URL.
+		serviceURL.RawQuery = strings.TrimPrefix(config.SASToken, "?")
+		credential = azblob.NewAnonymousCredential()
+		signer = &sasTokenSigner{}
+	case config.AAD != nil:
+		tokenCredential, e := newTokenCredential(*config.AAD, environment)
+		if e != nil {
+			logger.Log.Fatalw("Could not authenticate with Azure Active Directory", "error", e)
+		}
+		credential = tokenCredential
+	default:
+		validate.NotEmpty(config.AccountName)
+		validate.NotEmpty(config.AccountKey)
+		sharedKeyCredential, e := azblob.NewSharedKeyCredential(config.AccountName, config.AccountKey)
+		if e != nil {
+			logger.Log.Fatalw("Could not create Azure shared key credential", "error", e)
+		}
+		credential = sharedKeyCredential
+		signer = &credentialSigner{credential: sharedKeyCredential}
+	}
+
+	// Retries are done by the retry decorator, which all blobstores are wrapped with. Retrying here as well would
+	// multiply the attempts and bypass its circuit breaker.
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{MaxTries: 1},
+	})
+	service := azblob.NewServiceURL(*serviceURL, pipeline)
+	if signer == nil {
+		signer = &userDelegationSigner{serviceURL: service}
 	}
-	client.Sender = &NetworkErrorRetryingSender{}
 	return &Blobstore{
-		client:         client.GetBlobService(),
 		containerName:  config.ContainerName,
+		containerURL:   service.NewContainerURL(config.ContainerName),
+		serviceURL:     service,
+		signer:         signer,
 		putBlockSize:   putBlockSize,
+		putBlockSlots:  make(chan struct{}, config.PutBlockConcurrencyWithDefault()),
 		maxListResults: maxListResults,
 		metricsService: metricsService,
 	}
 }
 
+// storageResource is the resource tokens for Azure Storage must be issued for.
+const storageResource = "https://storage.azure.com/"
+
+// newTokenCredential creates a credential whose token is refreshed in the background before it expires.
+func newTokenCredential(aadConfig config.AzureAADConfig, environment azure.Environment) (azblob.TokenCredential, error) {
+	var (
+		token       *adal.ServicePrincipalToken
+		msiEndpoint string
+		oauthConfig *adal.OAuthConfig
+		e           error
+	)
+	if aadConfig.UseManagedIdentity {
+		msiEndpoint, e = adal.GetMSIVMEndpoint()
+		if e != nil {
+			return nil, errors.Wrap(e, "Could not get managed identity endpoint")
+		}
+		if aadConfig.ClientID != "" {
+			token, e = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, storageResource, aadConfig.ClientID)
+		} else {
+			token, e = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, storageResource)
+		}
+	} else {
+		oauthConfig, e = adal.NewOAuthConfig(environment.ActiveDirectoryEndpoint, aadConfig.TenantID)
+		if e != nil {
+			return nil, errors.Wrap(e, "Could not create OAuth config")
+		}
+		token, e = adal.NewServicePrincipalToken(*oauthConfig, aadConfig.ClientID, aadConfig.ClientSecret, storageResource)
+	}
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not create service principal token")
+	}
+	e = token.Refresh()
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not acquire token")
+	}
+	return azblob.NewTokenCredential(token.Token().AccessToken, func(credential azblob.TokenCredential) time.Duration {
+		e := token.Refresh()
+		if e != nil {
+			logger.Log.Errorw("Could not refresh Azure Active Directory token", "error", e)
+			return 30 * time.Second
+		}
+		credential.SetToken(token.Token().AccessToken)
+		return time.Until(token.Token().Expires()) - 5*time.Minute
+	}), nil
+}
+
 func (blobstore *Blobstore) Exists(path string) (bool, error) {
-	exists, e := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(path).Exists()
+	_, e := blobstore.containerURL.NewBlobURL(path).GetProperties(context.Background(), azblob.BlobAccessConditions{})
 	if e != nil {
-		return false, errors.Wrapf(e, "Failed to check for %v/%v", blobstore.containerName, path)
+		if serviceCode(e) == azblob.ServiceCodeBlobNotFound {
+			return false, nil
+		}
+		return false, blobstore.handleError(e, "Failed to check for %v/%v", blobstore.containerName, path)
 	}
-	return exists, nil
+	return true, nil
 }
 
 func (blobstore *Blobstore) Get(path string) (body io.ReadCloser, err error) {
 	logger.Log.Debugw("Get", "bucket", blobstore.containerName, "path", path)
 
-	reader, e := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(path).Get(nil)
+	response, e := blobstore.containerURL.NewBlobURL(path).Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
 	if e != nil {
 		return nil, blobstore.handleError(e, "Path %v", path)
 	}
-	return reader, nil
+	return response.Body(azblob.RetryReaderOptions{}), nil
 }
 
 func (blobstore *Blobstore) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
-	signedUrl, e := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(path).GetSASURI(storage.BlobSASOptions{
-		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{Read: true},
-		SASOptions:                storage.SASOptions{Expiry: time.Now().Add(time.Hour)},
-	})
-	return nil, signedUrl, e
+	if _, isSASToken := blobstore.signer.(*sasTokenSigner); isSASToken {
+		body, e := blobstore.Get(path)
+		return body, "", e
+	}
+	signedURL, e := blobstore.signedURL(path, azblob.BlobSASPermissions{Read: true}, time.Now().Add(time.Hour))
+	return nil, signedURL, e
 }
 
+// Put stages the blocks of src directly on the blob at path and commits them with a single PutBlockList.
+// Committing the block list replaces the blob's content atomically, so readers never see a partially written blob.
+// Block IDs contain a random ID per Put, so concurrent Puts to the same path do not overwrite each other's
+// uncommitted blocks. Azure discards uncommitted blocks of failed Puts after a week.
+//
+// Blocks are staged in parallel. All Puts of the blobstore share put_block_concurrency slots, which are taken
+// before a block is read into memory, so that concurrent Puts do not multiply the memory used for blocks.
 func (blobstore *Blobstore) Put(path string, src io.ReadSeeker) error {
 	putRequestID := rand.Int63()
 	l := logger.Log.With("put-request-id", putRequestID)
 	l.Debugw("Put", "bucket", blobstore.containerName, "path", path)
 
-	pathWithRequestIDSuffix := fmt.Sprintf("%v_%v", path, putRequestID)
-	blob := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(pathWithRequestIDSuffix)
-
-	e := blob.CreateBlockBlob(nil)
-	if e != nil {
-		return errors.Wrapf(e, "create block blob failed. container: %v, path: %v, put-request-id: %v", blobstore.containerName, pathWithRequestIDSuffix, putRequestID)
+	blob := blobstore.containerURL.NewBlockBlobURL(path)
+
+	var (
+		wg         sync.WaitGroup
+		mutex      sync.Mutex
+		firstError error
+		blockIDs   []string
+	)
+	fail := func(e error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstError == nil {
+			firstError = e
+		}
 	}
-
-	uncommittedBlocksList := make([]storage.Block, 0)
-	eof := false
-	for i := 0; !eof; i++ {
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstError != nil
+	}
+	releaseSlot := func() { <-blobstore.putBlockSlots }
+	for i := 0; !failed(); i++ {
+		blobstore.putBlockSlots <- struct{}{}
+		data := make([]byte, blobstore.putBlockSize)
+		numBytesRead, e := io.ReadFull(src, data)
+		if e == io.EOF {
+			releaseSlot()
+			break
+		}
+		if e != nil && e != io.ErrUnexpectedEOF {
+			releaseSlot()
+			fail(errors.Wrapf(e, "reading block failed. path: %v, put-request-id: %v", path, putRequestID))
+			break
+		}
 		// using information from https://docs.microsoft.com/en-us/rest/api/storageservices/understanding-block-blobs--append-blobs--and-page-blobs
 		if i >= 50000 {
-			return errors.Errorf("block blob cannot have more than 50,000 blocks. path: %v, put-request-id: %v", pathWithRequestIDSuffix, putRequestID)
-		}
-		block := storage.Block{
-			ID:     base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%05d", i))),
-			Status: storage.BlockStatusUncommitted,
+			releaseSlot()
+			fail(errors.Errorf("block blob cannot have more than 50,000 blocks. path: %v, put-request-id: %v", path, putRequestID))
+			break
 		}
-		data := make([]byte, blobstore.putBlockSize)
-		numBytesRead, e := src.Read(data)
-		if e != nil {
-			if e.Error() == "EOF" {
-				eof = true
-			} else {
-				return errors.Wrapf(e, "put block failed. path: %v, put-request-id: %v", pathWithRequestIDSuffix, putRequestID)
+		// All block IDs of a blob must have the same length.
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%016x-%05d", uint64(putRequestID), i)))
+		blockIDs = append(blockIDs, blockID)
+
+		wg.Add(1)
+		go func(i int, blockID string, data []byte) {
+			defer wg.Done()
+			defer releaseSlot()
+			l.Debugw("PutBlock", "block-index", i, "block-id", blockID, "block-size", len(data))
+			_, e := blob.StageBlock(context.Background(), blockID, bytes.NewReader(data), azblob.LeaseAccessConditions{}, nil)
+			if e != nil {
+				fail(blobstore.handleError(e, "put block failed. path: %v, put-request-id: %v", path, putRequestID))
 			}
+		}(i, blockID, data[:numBytesRead])
+
+		if e == io.ErrUnexpectedEOF {
+			break
 		}
-		if numBytesRead == 0 {
-			l.Debugw("Empty read", "block-index", i, "block-id", block.ID, "is-eof", eof)
-			continue
-		}
-		l.Debugw("PutBlock", "block-index", i, "block-id", block.ID, "block-size", numBytesRead, "is-eof", eof)
-		e = backoff.RetryNotify(func() error {
-			return blob.PutBlock(block.ID, data[:numBytesRead], nil)
-		}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 2), func(error, time.Duration) {
-			l.Infow("Retry PutBlock", "block-index", i, "block-id", block.ID, "block-size", numBytesRead, "is-eof", eof)
-			blobstore.metricsService.SendCounterMetric("put-block-retry", 1)
-		})
-		if e != nil {
-			return errors.Wrapf(e, "put block failed. path: %v, put-request-id: %v", pathWithRequestIDSuffix, putRequestID)
-		}
-		uncommittedBlocksList = append(uncommittedBlocksList, block)
-	}
-	l.Debugw("PutBlockList", "uncommitted-block-list", uncommittedBlocksList)
-	e = backoff.RetryNotify(func() error {
-		return blob.PutBlockList(uncommittedBlocksList, nil)
-	}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 2), func(error, time.Duration) {
-		l.Infow("Retry PutBlockList", "uncommitted-block-list", uncommittedBlocksList)
-		blobstore.metricsService.SendCounterMetric("put-block-list-retry", 1)
-	})
-	if e != nil {
-		return errors.Wrapf(e, "put block list failed. path: %v, put-request-id: %v", pathWithRequestIDSuffix, putRequestID)
 	}
-
-	e = backoff.RetryNotify(func() error {
-		return blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(path).Copy(
-			blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(pathWithRequestIDSuffix).GetURL(), nil)
-	}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 100), func(error, time.Duration) {
-		l.Infow("Retry Copy", "src", pathWithRequestIDSuffix, "dest", path)
-		blobstore.metricsService.SendCounterMetric("copy-retry", 1)
-	})
-	if e != nil {
-		return blobstore.handleError(e, "Error while trying to copy src %v to dest %v in bucket %v", pathWithRequestIDSuffix, path, blobstore.containerName)
+	wg.Wait()
+	if firstError != nil {
+		return firstError
 	}
 
-	e = backoff.RetryNotify(func() error {
-		_, e := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(pathWithRequestIDSuffix).DeleteIfExists(nil)
-		return e
-	}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 2), func(error, time.Duration) {
-		l.Infow("Retry DeleteIfExists", "path", pathWithRequestIDSuffix)
-		blobstore.metricsService.SendCounterMetric("delete-retry", 1)
-	})
+	l.Debugw("PutBlockList", "uncommitted-block-list", blockIDs)
+	_, e := blob.CommitBlockList(context.Background(), blockIDs, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{})
 	if e != nil {
-		return blobstore.handleError(e, "Error while trying to delete path %v in bucket %v", pathWithRequestIDSuffix, blobstore.containerName)
+		return blobstore.handleError(e, "put block list failed. path: %v, put-request-id: %v", path, putRequestID)
 	}
-
 	return nil
 }
 
+// Copy starts a server-side copy and waits for it to complete.
 func (blobstore *Blobstore) Copy(src, dest string) error {
 	logger.Log.Debugw("Copy in Azure", "container", blobstore.containerName, "src", src, "dest", dest)
-	e := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(dest).Copy(
-		blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(src).GetURL(), nil)
-
+	ctx := context.Background()
+	destBlob := blobstore.containerURL.NewBlobURL(dest)
+	response, e := destBlob.StartCopyFromURL(ctx, blobstore.containerURL.NewBlobURL(src).URL(), azblob.Metadata{}, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{})
 	if e != nil {
 		return blobstore.handleError(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.containerName)
 	}
+	copyStatus := response.CopyStatus()
+	for copyStatus == azblob.CopyStatusPending {
+		time.Sleep(time.Second)
+		properties, e := destBlob.GetProperties(ctx, azblob.BlobAccessConditions{})
+		if e != nil {
+			return blobstore.handleError(e, "Error while waiting for copy of src %v to dest %v in bucket %v", src, dest, blobstore.containerName)
+		}
+		copyStatus = properties.CopyStatus()
+	}
+	if copyStatus != azblob.CopyStatusSuccess {
+		return errors.Errorf("Copy of src %v to dest %v in bucket %v finished with status %v", src, dest, blobstore.containerName, copyStatus)
+	}
 	return nil
 }
 
 func (blobstore *Blobstore) Delete(path string) error {
-	deleted, e := blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(path).DeleteIfExists(nil)
+	_, e := blobstore.containerURL.NewBlobURL(path).Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
 	if e != nil {
-		return errors.Wrapf(e, "Path %v", path)
-	}
-	if !deleted {
-		return bitsgo.NewNotFoundError()
+		return blobstore.handleError(e, "Path %v", path)
 	}
 	return nil
 }
 
 func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	deletionErrs := []error{}
-	marker := ""
-	for {
-		response, e := blobstore.client.GetContainerReference(blobstore.containerName).ListBlobs(storage.ListBlobsParameters{
-			Prefix:     prefix,
-			MaxResults: blobstore.maxListResults,
-			Marker:     marker,
-		})
+	e := blobstore.forEachBlob(prefix, func(blob azblob.BlobItem) {
+		e := blobstore.Delete(blob.Name)
 		if e != nil {
-			return errors.Wrapf(e, "Prefix %v", prefix)
-		}
-		for _, blob := range response.Blobs {
-			e = blobstore.Delete(blob.Name)
-			if e != nil {
-				if _, isNotFoundError := e.(*bitsgo.NotFoundError); !isNotFoundError {
-					deletionErrs = append(deletionErrs, e)
-				}
+			if _, isNotFoundError := e.(*bitsgo.NotFoundError); !isNotFoundError {
+				deletionErrs = append(deletionErrs, e)
 			}
 		}
-		if response.NextMarker == "" {
-			break
-		}
-		marker = response.NextMarker
+	})
+	if e != nil {
+		return errors.Wrapf(e, "Prefix %v", prefix)
 	}
 
 	if len(deletionErrs) != 0 {
@@ -273,38 +324,146 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	return nil
 }
 
-func (blobstore *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
-	var e error
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos := []bitsgo.BlobInfo{}
+	e := blobstore.forEachBlob(prefix, func(blob azblob.BlobItem) {
+		var size int64
+		if blob.Properties.ContentLength != nil {
+			size = *blob.Properties.ContentLength
+		}
+		blobInfos = append(blobInfos, bitsgo.BlobInfo{
+			Path:         blob.Name,
+			Size:         size,
+			LastModified: blob.Properties.LastModified,
+		})
+	})
+	if e != nil {
+		return nil, errors.Wrapf(e, "Prefix %v", prefix)
+	}
+	return blobInfos, nil
+}
+
+// legacyTempBlobPattern matches the temporary blobs "<path>_<put-request-id>", which previous versions uploaded
+// blocks to before copying them to path. Failed copies or deletes left them behind.
+var legacyTempBlobPattern = regexp.MustCompile(`_[0-9]{10,19}$`)
+
+// containersWithTempBlobCleanup holds the URLs of the containers whose leaked temporary blobs are already being
+// deleted, so that blobstores sharing a container list it only once.
+var containersWithTempBlobCleanup sync.Map
+
+// DeleteLeakedTempBlobsInBackground calls DeleteLeakedTempBlobs once per container.
+func (blobstore *Blobstore) DeleteLeakedTempBlobsInBackground() {
+	containerURL := blobstore.containerURL.URL()
+	if _, started := containersWithTempBlobCleanup.LoadOrStore(containerURL.String(), true); started {
+		return
+	}
+	go func() {
+		e := blobstore.DeleteLeakedTempBlobs()
+		if e != nil {
+			logger.Log.Errorw("Could not delete leaked temporary blobs", "container", blobstore.containerName, "error", e)
+		}
+	}()
+}
+
+// DeleteLeakedTempBlobs deletes the temporary blobs leaked by previous versions. Only blobs older than a day are
+// deleted, since instances still running a previous version might be using younger ones.
+func (blobstore *Blobstore) DeleteLeakedTempBlobs() error {
+	var (
+		numDeleted   int
+		deletionErrs = []error{}
+		cutoff       = time.Now().Add(-24 * time.Hour)
+	)
+	e := blobstore.forEachBlob("", func(blob azblob.BlobItem) {
+		if !legacyTempBlobPattern.MatchString(blob.Name) || blob.Properties.LastModified.After(cutoff) {
+			return
+		}
+		e := blobstore.Delete(blob.Name)
+		if e != nil && !bitsgo.IsNotFoundError(e) {
+			deletionErrs = append(deletionErrs, e)
+			return
+		}
+		numDeleted++
+	})
+	logger.Log.Infow("Deleted leaked temporary blobs", "container", blobstore.containerName, "num-deleted", numDeleted)
+	if e != nil {
+		return e
+	}
+	if len(deletionErrs) != 0 {
+		return errors.Errorf("Errors from deleting leaked temporary blobs: %v", deletionErrs)
+	}
+	return nil
+}
+
+func (blobstore *Blobstore) forEachBlob(prefix string, f func(blob azblob.BlobItem)) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, e := blobstore.containerURL.ListBlobsFlatSegment(context.Background(), marker, azblob.ListBlobsSegmentOptions{
+			Prefix:     prefix,
+			MaxResults: int32(blobstore.maxListResults),
+		})
+		if e != nil {
+			return blobstore.handleError(e, "Prefix %v", prefix)
+		}
+		for _, blob := range response.Segment.BlobItems {
+			f(blob)
+		}
+		marker = response.NextMarker
+	}
+	return nil
+}
+
+func (blobstore *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
 	switch strings.ToLower(method) {
 	case "put":
-		signedURL, e = blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(resource).GetSASURI(storage.BlobSASOptions{
-			BlobServiceSASPermissions: storage.BlobServiceSASPermissions{Write: true, Create: true},
-			SASOptions:                storage.SASOptions{Expiry: expirationTime},
-		})
+		return blobstore.signedURL(resource, azblob.BlobSASPermissions{Write: true, Create: true}, expirationTime)
 	case "get":
-		signedURL, e = blobstore.client.GetContainerReference(blobstore.containerName).GetBlobReference(resource).GetSASURI(storage.BlobSASOptions{
-			BlobServiceSASPermissions: storage.BlobServiceSASPermissions{Read: true},
-			SASOptions:                storage.SASOptions{Expiry: expirationTime},
-		})
+		return blobstore.signedURL(resource, azblob.BlobSASPermissions{Read: true}, expirationTime)
 	default:
-		panic("The only supported methods are 'put' and 'get'")
+		return "", errors.Errorf("The only supported methods are 'put' and 'get', but got '%v'", method)
 	}
+}
+
+func (blobstore *Blobstore) signedURL(path string, permissions azblob.BlobSASPermissions, expirationTime time.Time) (string, error) {
+	blobURL := blobstore.containerURL.NewBlobURL(path).URL()
+	signedURL, e := blobstore.signer.sign(blobURL, azblob.BlobSASSignatureValues{
+		ExpiryTime:    expirationTime,
+		ContainerName: blobstore.containerName,
+		BlobName:      path,
+		Permissions:   permissions.String(),
+	})
 	if e != nil {
-		panic(e)
+		return "", errors.Wrapf(e, "Could not sign URL for %v", path)
 	}
-	return
+	return signedURL, nil
 }
 
+// handleError translates a missing blob into *NotFoundError, a missing container into *ContainerNotFoundError,
+// throttling into *ThrottledError and other failed requests into the typed errors corresponding to their status codes.
 func (blobstore *Blobstore) handleError(e error, context string, args ...interface{}) error {
-	if azse, ok := e.(storage.AzureStorageServiceError); ok && azse.StatusCode == http.StatusNotFound {
-		exists, e := blobstore.client.GetContainerReference(blobstore.containerName).Exists()
-		if e != nil {
-			return errors.Wrapf(e, context, args...)
-		}
-		if !exists {
-			return errors.Errorf("Container does not exist '%v", blobstore.containerName)
-		}
+	switch serviceCode(e) {
+	case azblob.ServiceCodeContainerNotFound:
+		return bitsgo.NewContainerNotFoundError(blobstore.containerName)
+	case azblob.ServiceCodeBlobNotFound:
+		return bitsgo.NewNotFoundError()
+	}
+	storageError, ok := e.(azblob.StorageError)
+	if !ok || storageError.Response() == nil {
+		return errors.Wrapf(e, context, args...)
+	}
+	response := storageError.Response()
+	statusCode := response.StatusCode
+	switch {
+	case statusCode == http.StatusNotFound:
 		return bitsgo.NewNotFoundError()
+	case storageError.ServiceCode() == azblob.ServiceCodeServerBusy:
+		// Azure throttles with 503 Server Busy.
+		statusCode = http.StatusTooManyRequests
+	}
+	return bitsgo.ErrorFromStatusCode(statusCode, response.Header, errors.Wrapf(e, context, args...))
+}
+
+func serviceCode(e error) azblob.ServiceCodeType {
+	if storageError, ok := e.(azblob.StorageError); ok {
+		return storageError.ServiceCode()
 	}
-	return errors.Wrapf(e, context, args...)
+	return ""
 }
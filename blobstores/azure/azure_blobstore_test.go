@@ -0,0 +1,294 @@
+package azure_test
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/cloudfoundry-incubator/bits-service/blobstores/azure"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAzureBlobstore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "AzureBlobstore")
+}
+
+// recordedRequest is a request received by the fake blob service.
+type recordedRequest struct {
+	Method string
+	Query  url.Values
+	Header http.Header
+}
+
+// fakeAzure is a blob service for the container "some-container", which keeps staged blocks and committed
+// block lists in memory.
+type fakeAzure struct {
+	*httptest.Server
+	ListResult     string
+	FailStageBlock bool
+
+	mutex             sync.Mutex
+	requests          []recordedRequest
+	stagedBlocks      map[string]string
+	committedBlobs    map[string][]string
+	deletedBlobs      []string
+	numStaging        int
+	maxNumStaging     int
+	numDelegationKeys int
+}
+
+func newFakeAzure() *fakeAzure {
+	fake := &fakeAzure{
+		stagedBlocks:   make(map[string]string),
+		committedBlobs: make(map[string][]string),
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	return fake
+}
+
+func (fake *fakeAzure) serveHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	defer GinkgoRecover()
+	blobName := strings.TrimPrefix(request.URL.Path, "/devstoreaccount1/some-container/")
+	query := request.URL.Query()
+	fake.mutex.Lock()
+	fake.requests = append(fake.requests, recordedRequest{Method: request.Method, Query: query, Header: request.Header})
+	fake.mutex.Unlock()
+	switch {
+	case request.Method == "PUT" && query.Get("comp") == "block":
+		fake.mutex.Lock()
+		fake.numStaging++
+		if fake.numStaging > fake.maxNumStaging {
+			fake.maxNumStaging = fake.numStaging
+		}
+		fake.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		body, e := ioutil.ReadAll(request.Body)
+		Expect(e).NotTo(HaveOccurred())
+
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.numStaging--
+		if fake.FailStageBlock {
+			writeAzureError(responseWriter, http.StatusForbidden, "AuthorizationFailure")
+			return
+		}
+		fake.stagedBlocks[query.Get("blockid")] = string(body)
+		responseWriter.WriteHeader(http.StatusCreated)
+	case request.Method == "PUT" && query.Get("comp") == "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		Expect(xml.NewDecoder(request.Body).Decode(&blockList)).To(Succeed())
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.committedBlobs[blobName] = blockList.Latest
+		responseWriter.WriteHeader(http.StatusCreated)
+	case request.Method == "GET" && query.Get("comp") == "list":
+		fmt.Fprint(responseWriter, fake.ListResult)
+	case request.Method == "POST" && query.Get("comp") == "userdelegationkey":
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.numDelegationKeys++
+		fmt.Fprintf(responseWriter, `<?xml version="1.0" encoding="utf-8"?><UserDelegationKey>`+
+			`<SignedOid>some-oid</SignedOid><SignedTid>some-tid</SignedTid>`+
+			`<SignedStart>%v</SignedStart><SignedExpiry>%v</SignedExpiry>`+
+			`<SignedService>b</SignedService><SignedVersion>2019-02-02</SignedVersion><Value>%v</Value></UserDelegationKey>`,
+			time.Now().UTC().Format(time.RFC3339), time.Now().UTC().Add(7*24*time.Hour).Format(time.RFC3339),
+			base64.StdEncoding.EncodeToString([]byte("some-delegation-key")))
+	case request.Method == "GET":
+		content, exists := fake.CommittedContent(blobName)
+		if !exists {
+			writeAzureError(responseWriter, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		responseWriter.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(responseWriter, content)
+	case request.Method == "DELETE":
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.deletedBlobs = append(fake.deletedBlobs, blobName)
+		responseWriter.WriteHeader(http.StatusAccepted)
+	default:
+		writeAzureError(responseWriter, http.StatusNotFound, "BlobNotFound")
+	}
+}
+
+// Requests returns all requests received so far.
+func (fake *fakeAzure) Requests() []recordedRequest {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]recordedRequest{}, fake.requests...)
+}
+
+// NumDelegationKeys returns the number of user delegation keys requested so far.
+func (fake *fakeAzure) NumDelegationKeys() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.numDelegationKeys
+}
+
+// CommittedContent returns the content of the blob as committed by its block list.
+func (fake *fakeAzure) CommittedContent(blobName string) (string, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	blockIDs, exists := fake.committedBlobs[blobName]
+	content := ""
+	for _, blockID := range blockIDs {
+		content += fake.stagedBlocks[blockID]
+	}
+	return content, exists
+}
+
+func writeAzureError(responseWriter http.ResponseWriter, statusCode int, code string) {
+	responseWriter.Header().Set("x-ms-error-code", code)
+	responseWriter.WriteHeader(statusCode)
+	fmt.Fprintf(responseWriter, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%v</Code><Message>Some message</Message></Error>`, code)
+}
+
+func listResult(blobs map[string]time.Time) string {
+	result := `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="some-container"><Blobs>`
+	for name, lastModified := range blobs {
+		result += fmt.Sprintf("<Blob><Name>%v</Name><Properties><Last-Modified>%v</Last-Modified><Content-Length>1</Content-Length>"+
+			"<BlobType>BlockBlob</BlobType></Properties></Blob>", name, lastModified.UTC().Format(http.TimeFormat))
+	}
+	return result + "</Blobs><NextMarker /></EnumerationResults>"
+}
+
+type nullMetricsService struct{}
+
+func (service *nullMetricsService) SendTimingMetric(name string, duration time.Duration) {}
+func (service *nullMetricsService) SendGaugeMetric(name string, value int64)             {}
+func (service *nullMetricsService) SendCounterMetric(name string, value int64)           {}
+
+var _ = Describe("Blobstore", func() {
+	var (
+		fake        *fakeAzure
+		azureConfig config.AzureBlobstoreConfig
+		blobstore   *Blobstore
+	)
+
+	BeforeEach(func() {
+		fake = newFakeAzure()
+		azureConfig = config.AzureBlobstoreConfig{
+			ContainerName:       "some-container",
+			AccountName:         "devstoreaccount1",
+			AccountKey:          base64.StdEncoding.EncodeToString([]byte("some-account-key")),
+			Endpoint:            fake.URL + "/devstoreaccount1",
+			PutBlockConcurrency: 2,
+		}
+	})
+
+	JustBeforeEach(func() {
+		blobstore = NewBlobstoreWithDetails(azureConfig, 4, 5000, &nullMetricsService{})
+	})
+
+	AfterEach(func() { fake.Close() })
+
+	Context("Put", func() {
+		It("stages the content in blocks and commits them to the blob in order", func() {
+			Expect(blobstore.Put("some/path", strings.NewReader("0123456789"))).To(Succeed())
+
+			content, committed := fake.CommittedContent("some/path")
+			Expect(committed).To(BeTrue())
+			Expect(content).To(Equal("0123456789"))
+		})
+
+		It("does not stage more blocks in parallel than put_block_concurrency, even for concurrent Puts", func() {
+			var wg sync.WaitGroup
+			for _, path := range []string{"some/path", "other/path", "third/path"} {
+				wg.Add(1)
+				go func(path string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(blobstore.Put(path, strings.NewReader("0123456789abcdefghij"))).To(Succeed())
+				}(path)
+			}
+			wg.Wait()
+
+			fake.mutex.Lock()
+			Expect(fake.maxNumStaging).To(BeNumerically("<=", 2))
+			fake.mutex.Unlock()
+			for _, path := range []string{"some/path", "other/path", "third/path"} {
+				content, _ := fake.CommittedContent(path)
+				Expect(content).To(Equal("0123456789abcdefghij"))
+			}
+		})
+
+		It("does not commit the blob when staging a block fails", func() {
+			fake.FailStageBlock = true
+
+			Expect(blobstore.Put("some/path", strings.NewReader("0123456789"))).NotTo(Succeed())
+
+			_, committed := fake.CommittedContent("some/path")
+			Expect(committed).To(BeFalse())
+		})
+	})
+
+	Context("authentication", func() {
+		It("signs requests with the account key", func() {
+			Expect(blobstore.Put("some/path", strings.NewReader("0123"))).To(Succeed())
+
+			for _, request := range fake.Requests() {
+				Expect(request.Header.Get("Authorization")).To(HavePrefix("SharedKey devstoreaccount1:"))
+				Expect(request.Query.Get("sig")).To(BeEmpty())
+			}
+		})
+
+		Context("SAS token", func() {
+			BeforeEach(func() {
+				azureConfig.AccountKey = ""
+				azureConfig.SASToken = "?sv=2019-02-02&sr=c&sp=racwdl&sig=some-signature"
+			})
+
+			It("adds the SAS token to requests instead of signing them", func() {
+				Expect(blobstore.Put("some/path", strings.NewReader("0123"))).To(Succeed())
+
+				requests := fake.Requests()
+				Expect(requests).NotTo(BeEmpty())
+				for _, request := range requests {
+					Expect(request.Header.Get("Authorization")).To(BeEmpty())
+					Expect(request.Query.Get("sig")).To(Equal("some-signature"))
+					Expect(request.Query.Get("sp")).To(Equal("racwdl"))
+				}
+			})
+
+			It("returns the blob from GetOrRedirect instead of a redirect", func() {
+				Expect(blobstore.Put("some/path", strings.NewReader("0123"))).To(Succeed())
+
+				body, redirectLocation, e := blobstore.GetOrRedirect("some/path")
+
+				Expect(e).NotTo(HaveOccurred())
+				Expect(redirectLocation).To(BeEmpty())
+				defer body.Close()
+				Expect(ioutil.ReadAll(body)).To(Equal([]byte("0123")))
+			})
+		})
+	})
+
+	Context("DeleteLeakedTempBlobs", func() {
+		It("deletes temporary blobs of previous versions which are older than a day", func() {
+			twoDaysAgo := time.Now().Add(-48 * time.Hour)
+			fake.ListResult = listResult(map[string]time.Time{
+				"some/path":                     twoDaysAgo,
+				"some/path_1234567890123456789": twoDaysAgo,
+				"some/path_9876543210987654321": time.Now(),
+				"buildpack_cache/some_app":      twoDaysAgo,
+			})
+
+			Expect(blobstore.DeleteLeakedTempBlobs()).To(Succeed())
+
+			Expect(fake.deletedBlobs).To(ConsistOf("some/path_1234567890123456789"))
+		})
+	})
+})
@@ -0,0 +1,7 @@
+package azure
+
+// UseUserDelegationSigner makes the blobstore sign URLs like it does when authenticating with Azure Active Directory,
+// which tests cannot do.
+func (blobstore *Blobstore) UseUserDelegationSigner() {
+	blobstore.signer = &userDelegationSigner{serviceURL: blobstore.serviceURL}
+}
@@ -0,0 +1,85 @@
+package azure
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/pkg/errors"
+)
+
+// signer creates signed URLs for blobs. Which kind of shared access signature can be created depends on how
+// the blobstore authenticates.
+type signer interface {
+	sign(blobURL url.URL, values azblob.BlobSASSignatureValues) (string, error)
+}
+
+// credentialSigner creates service SAS signed with the account key.
+type credentialSigner struct {
+	credential azblob.StorageAccountCredential
+}
+
+func (signer *credentialSigner) sign(blobURL url.URL, values azblob.BlobSASSignatureValues) (string, error) {
+	sasQueryParameters, e := values.NewSASQueryParameters(signer.credential)
+	if e != nil {
+		return "", e
+	}
+	parts := azblob.NewBlobURLParts(blobURL)
+	parts.SAS = sasQueryParameters
+	signedURL := parts.URL()
+	return signedURL.String(), nil
+}
+
+// sasTokenSigner cannot create signatures, because it does not have a key. Handing out the configured SAS token
+// instead would give every client its permissions on the whole container until it expires, so URLs must be signed
+// for the bits-service, which proxies the requests.
+type sasTokenSigner struct{}
+
+func (signer *sasTokenSigner) sign(blobURL url.URL, values azblob.BlobSASSignatureValues) (string, error) {
+	return "", errors.New("URLs cannot be signed when authenticating with a SAS token")
+}
+
+// maxUserDelegationKeyValidity is the longest validity Azure accepts for user delegation keys.
+const maxUserDelegationKeyValidity = 7 * 24 * time.Hour
+
+// userDelegationSigner creates user delegation SAS signed with a key obtained using the Azure Active Directory
+// credentials. The key is reused until a signature would outlive it.
+type userDelegationSigner struct {
+	serviceURL azblob.ServiceURL
+
+	mutex      sync.Mutex
+	credential *azblob.UserDelegationCredential
+	keyExpiry  time.Time
+}
+
+func (signer *userDelegationSigner) sign(blobURL url.URL, values azblob.BlobSASSignatureValues) (string, error) {
+	credential, e := signer.credentialValidUntil(values.ExpiryTime)
+	if e != nil {
+		return "", e
+	}
+	return (&credentialSigner{credential: credential}).sign(blobURL, values)
+}
+
+func (signer *userDelegationSigner) credentialValidUntil(expiryTime time.Time) (azblob.StorageAccountCredential, error) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+
+	if signer.credential != nil && !expiryTime.After(signer.keyExpiry) {
+		return *signer.credential, nil
+	}
+	now := time.Now().UTC()
+	keyExpiry := now.Add(maxUserDelegationKeyValidity)
+	if expiryTime.After(keyExpiry) {
+		return nil, errors.Errorf("Signatures using Azure Active Directory cannot be valid for more than %v", maxUserDelegationKeyValidity)
+	}
+	// Allows for clock skew between us and Azure.
+	credential, e := signer.serviceURL.GetUserDelegationCredential(context.Background(), azblob.NewKeyInfo(now.Add(-5*time.Minute), keyExpiry), nil, nil)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not get user delegation key")
+	}
+	signer.credential = &credential
+	signer.keyExpiry = keyExpiry
+	return credential, nil
+}
@@ -0,0 +1,100 @@
+package azure_test
+
+import (
+	"encoding/base64"
+	"net/url"
+	"time"
+
+	. "github.com/cloudfoundry-incubator/bits-service/blobstores/azure"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sign", func() {
+	var (
+		fake        *fakeAzure
+		azureConfig config.AzureBlobstoreConfig
+		blobstore   *Blobstore
+		expiry      time.Time
+	)
+
+	BeforeEach(func() {
+		fake = newFakeAzure()
+		azureConfig = config.AzureBlobstoreConfig{
+			ContainerName: "some-container",
+			AccountName:   "devstoreaccount1",
+			AccountKey:    base64.StdEncoding.EncodeToString([]byte("some-account-key")),
+			Endpoint:      fake.URL + "/devstoreaccount1",
+		}
+		expiry = time.Now().Add(time.Hour)
+	})
+
+	JustBeforeEach(func() {
+		blobstore = NewBlobstore(azureConfig, &nullMetricsService{})
+	})
+
+	AfterEach(func() { fake.Close() })
+
+	parse := func(signedURL string, e error) *url.URL {
+		Expect(e).NotTo(HaveOccurred())
+		u, e := url.Parse(signedURL)
+		Expect(e).NotTo(HaveOccurred())
+		return u
+	}
+
+	Context("account key", func() {
+		It("creates a service SAS for the blob restricted to the method and expiry", func() {
+			signedURL := parse(blobstore.Sign("some/path", "get", expiry))
+
+			Expect(signedURL.Path).To(Equal("/devstoreaccount1/some-container/some/path"))
+			Expect(signedURL.Query().Get("sr")).To(Equal("b"))
+			Expect(signedURL.Query().Get("sp")).To(Equal("r"))
+			Expect(signedURL.Query().Get("se")).To(Equal(expiry.UTC().Format("2006-01-02T15:04:05Z")))
+			Expect(signedURL.Query().Get("sig")).NotTo(BeEmpty())
+			Expect(signedURL.Query().Get("skoid")).To(BeEmpty())
+		})
+
+		It("only grants write permissions for put", func() {
+			signedURL := parse(blobstore.Sign("some/path", "put", expiry))
+
+			Expect(signedURL.Query().Get("sp")).To(Equal("cw"))
+		})
+	})
+
+	Context("SAS token", func() {
+		BeforeEach(func() {
+			azureConfig.AccountKey = ""
+			azureConfig.SASToken = "sv=2019-02-02&sr=c&sp=racwdl&sig=some-signature"
+		})
+
+		It("refuses to sign, so that the SAS token is never handed out", func() {
+			_, e := blobstore.Sign("some/path", "get", expiry)
+
+			Expect(e).To(HaveOccurred())
+		})
+	})
+
+	Context("Azure Active Directory", func() {
+		JustBeforeEach(func() { blobstore.UseUserDelegationSigner() })
+
+		It("creates a user delegation SAS and reuses the delegation key while it is valid", func() {
+			signedURL := parse(blobstore.Sign("some/path", "get", expiry))
+			parse(blobstore.Sign("other/path", "put", expiry.Add(24*time.Hour)))
+
+			Expect(signedURL.Query().Get("skoid")).To(Equal("some-oid"))
+			Expect(signedURL.Query().Get("sktid")).To(Equal("some-tid"))
+			Expect(signedURL.Query().Get("sp")).To(Equal("r"))
+			Expect(signedURL.Query().Get("sig")).NotTo(BeEmpty())
+			Expect(fake.NumDelegationKeys()).To(Equal(1))
+		})
+
+		It("refuses to sign URLs which expire after the longest possible validity of a delegation key", func() {
+			_, e := blobstore.Sign("some/path", "get", time.Now().Add(8*24*time.Hour))
+
+			Expect(e).To(HaveOccurred())
+
+			Expect(fake.NumDelegationKeys()).To(Equal(0))
+		})
+	})
+})
@@ -65,6 +65,27 @@ var _ = Describe("Blobstore", func() {
 		})
 	}
 
+	itCanListBlobs := func() {
+		It("can list blobs by prefix", func() {
+			Expect(blobstore.Put("some/path", strings.NewReader("some string"))).To(Succeed())
+			Expect(blobstore.Put("some/other/path", strings.NewReader("other string"))).To(Succeed())
+			Expect(blobstore.Put("someother/path", strings.NewReader("string"))).To(Succeed())
+
+			blobInfos, e := blobstore.List("some/")
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(blobInfos).To(HaveLen(2))
+			sizes := map[string]int64{}
+			for _, blobInfo := range blobInfos {
+				sizes[blobInfo.Path] = blobInfo.Size
+			}
+			Expect(sizes).To(Equal(map[string]int64{"some/path": 11, "some/other/path": 12}))
+
+			Expect(blobstore.List("some")).To(HaveLen(3))
+			Expect(blobstore.List("nothing/")).To(BeEmpty())
+		})
+	}
+
 	Describe("Local", func() {
 		var tempDirname string
 
@@ -78,11 +99,13 @@ var _ = Describe("Blobstore", func() {
 		AfterEach(func() { os.RemoveAll(tempDirname) })
 
 		itCanBeModifiedByItsMethods()
+		itCanListBlobs()
 	})
 
 	Describe("In-memory", func() {
 		BeforeEach(func() { blobstore = inmemory.NewBlobstore() })
 
 		itCanBeModifiedByItsMethods()
+		itCanListBlobs()
 	})
 })
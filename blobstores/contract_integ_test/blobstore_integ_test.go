@@ -1,7 +1,9 @@
 package main_test
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -105,6 +107,16 @@ var _ = Describe("Non-local blobstores", func() {
 				Expect(blobstore.Exists("one")).To(BeFalse())
 				Expect(blobstore.Exists("two")).To(BeFalse())
 			})
+
+			It("Can list by prefix", func() {
+				blobInfos, e := blobstore.List("on")
+				Expect(e).NotTo(HaveOccurred())
+
+				Expect(blobInfos).To(HaveLen(1))
+				Expect(blobInfos[0].Path).To(Equal("one"))
+				Expect(blobInfos[0].Size).To(BeEquivalentTo(len("the file content")))
+				Expect(blobInfos[0].LastModified).To(BeTemporally("~", time.Now(), 5*time.Minute))
+			})
 		})
 
 		Context("Copy", func() {
@@ -155,7 +167,8 @@ var _ = Describe("Non-local blobstores", func() {
 		})
 
 		It("can get a signed PUT URL and upload something to it", func() {
-			signedUrl := blobstore.Sign(filepath, "put", time.Now().Add(1*time.Hour))
+			signedUrl, e := blobstore.Sign(filepath, "put", time.Now().Add(1*time.Hour))
+			Expect(e).NotTo(HaveOccurred())
 
 			r := httputil.NewRequest("PUT", signedUrl, strings.NewReader("the file content"))
 
@@ -344,10 +357,49 @@ var _ = Describe("Non-local blobstores", func() {
 
 		itCanPutAndGetAResourceThere()
 
+		It("can read a range of a resource", func() {
+			Expect(blobstore.Put(filepath, strings.NewReader("the file content"))).To(Succeed())
+
+			body, e := blobstore.Get(filepath)
+			Expect(e).NotTo(HaveOccurred())
+			seeker, isSeeker := body.(io.Seeker)
+			Expect(isSeeker).To(BeTrue())
+			_, e = seeker.Seek(4, io.SeekStart)
+			Expect(e).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(io.LimitReader(body, 4))).To(BeEquivalentTo("file"))
+			Expect(body.Close()).To(Succeed())
+
+			Expect(blobstore.Delete(filepath)).To(Succeed())
+		})
+
+		Context("With objects larger than the segment size", func() {
+			// Swift's default minimum segment size is 1M.
+			BeforeEach(func() { openstackConfig.SegmentSize = "1M" })
+
+			It("stores them as static large objects", func() {
+				content := bytes.Repeat([]byte("0123456789"), 250*1024)
+				Expect(blobstore.Put(filepath, bytes.NewReader(content))).To(Succeed())
+
+				body, e := blobstore.Get(filepath)
+				Expect(e).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(body)).To(Equal(content))
+
+				Expect(blobstore.Copy(filepath, filepath+"-copy")).To(Succeed())
+				Expect(blobstore.Delete(filepath)).To(Succeed())
+
+				body, e = blobstore.Get(filepath + "-copy")
+				Expect(e).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(body)).To(Equal(content))
+				Expect(blobstore.Delete(filepath + "-copy")).To(Succeed())
+			})
+		})
+
 		Context("With non-existing bucket", func() {
-			BeforeEach(func() { openstackConfig.ContainerName += "non-existing" })
+			It("fails at startup", func() {
+				openstackConfig.ContainerName += "non-existing"
 
-			ItDoesNotReturnNotFoundError()
+				Expect(func() { openstack.NewBlobstore(openstackConfig) }).To(Panic())
+			})
 		})
 	})
 
@@ -0,0 +1,312 @@
+package decorator
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/cloudfoundry-incubator/bits-service/util"
+	"github.com/pkg/errors"
+)
+
+var cacheFileName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+// CachingBlobstoreDecorator caches blobs read through Get on local disk. On a miss, the blob is streamed
+// to the client and written to the cache at the same time. It is only added to the cache when it has been
+// read completely. When the cache exceeds maxSize, the least recently used blobs are evicted. Put, Copy,
+// Delete and DeleteDir invalidate the affected cache entries. Invalidation only applies to the local cache,
+// so blobs written by other bits-service instances can be served stale until they are evicted. It must
+// therefore only be used for immutable blobs. Paths for which isCacheable returns false are never cached.
+type CachingBlobstoreDecorator struct {
+	delegate       bitsgo.Blobstore
+	directory      string
+	maxSize        int64
+	isCacheable    func(path string) bool
+	metricsService bitsgo.MetricsService
+	resourceType   string
+
+	mutex         sync.Mutex
+	entries       map[string]*list.Element
+	lru           *list.List
+	size          int64
+	invalidations uint64
+	hits          int64
+	misses        int64
+}
+
+// ForBlobstoreWithCache creates a CachingBlobstoreDecorator. Files left in directory by a previous run are removed,
+// because it cannot be known whether they are still up to date. A nil isCacheable caches all paths.
+func ForBlobstoreWithCache(delegate bitsgo.Blobstore, directory string, maxSize int64, isCacheable func(path string) bool, metricsService bitsgo.MetricsService, resourceType string) *CachingBlobstoreDecorator {
+	util.PanicOnError(errors.Wrapf(os.MkdirAll(directory, 0755), "Could not create cache directory %v", directory))
+	files, e := ioutil.ReadDir(directory)
+	util.PanicOnError(errors.Wrapf(e, "Could not read cache directory %v", directory))
+	for _, file := range files {
+		if cacheFileName.MatchString(file.Name()) || strings.HasPrefix(file.Name(), "tmp-") {
+			os.Remove(filepath.Join(directory, file.Name()))
+		}
+	}
+
+	return &CachingBlobstoreDecorator{
+		delegate:       delegate,
+		directory:      directory,
+		maxSize:        maxSize,
+		isCacheable:    isCacheable,
+		metricsService: metricsService,
+		resourceType:   resourceType,
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+	}
+}
+
+func (decorator *CachingBlobstoreDecorator) Exists(path string) (bool, error) {
+	if decorator.isCached(path) {
+		return true, nil
+	}
+	return decorator.delegate.Exists(path)
+}
+
+func (decorator *CachingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	if decorator.isCacheable != nil && !decorator.isCacheable(path) {
+		return decorator.delegate.Get(path)
+	}
+	body = decorator.getFromCache(path)
+	if body != nil {
+		return body, nil
+	}
+	invalidations := decorator.currentInvalidations()
+	body, e := decorator.delegate.Get(path)
+	if e != nil {
+		return nil, e
+	}
+	return decorator.addToCache(path, body, invalidations)
+}
+
+// GetOrRedirect serves cached blobs from the cache. Otherwise it only caches the blob when the delegate does not redirect.
+func (decorator *CachingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	if decorator.isCacheable != nil && !decorator.isCacheable(path) {
+		return decorator.delegate.GetOrRedirect(path)
+	}
+	body = decorator.getFromCache(path)
+	if body != nil {
+		return body, "", nil
+	}
+	invalidations := decorator.currentInvalidations()
+	body, redirectLocation, e := decorator.delegate.GetOrRedirect(path)
+	if e != nil || redirectLocation != "" {
+		return body, redirectLocation, e
+	}
+	body, e = decorator.addToCache(path, body, invalidations)
+	return body, "", e
+}
+
+func (decorator *CachingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	defer decorator.invalidate(path)
+	return decorator.delegate.Put(path, src)
+}
+
+func (decorator *CachingBlobstoreDecorator) Copy(src, dest string) error {
+	defer decorator.invalidate(dest)
+	return decorator.delegate.Copy(src, dest)
+}
+
+func (decorator *CachingBlobstoreDecorator) Delete(path string) error {
+	defer decorator.invalidate(path)
+	return decorator.delegate.Delete(path)
+}
+
+func (decorator *CachingBlobstoreDecorator) DeleteDir(prefix string) error {
+	defer decorator.invalidatePrefix(prefix)
+	return decorator.delegate.DeleteDir(prefix)
+}
+
+func (decorator *CachingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	return decorator.delegate.List(prefix)
+}
+
+func (decorator *CachingBlobstoreDecorator) isCached(path string) bool {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	_, exists := decorator.entries[path]
+	return exists
+}
+
+func (decorator *CachingBlobstoreDecorator) getFromCache(path string) io.ReadCloser {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+
+	element, exists := decorator.entries[path]
+	if exists {
+		// Evicted files which are still open remain readable until they are closed.
+		file, e := os.Open(decorator.filename(path))
+		if e == nil {
+			decorator.lru.MoveToFront(element)
+			decorator.recordAccess(true)
+			return file
+		}
+		logger.Log.Errorw("Could not open cached blob", "resource-type", decorator.resourceType, "path", path, "error", e)
+		decorator.removeElement(element)
+	}
+	decorator.recordAccess(false)
+	return nil
+}
+
+// addToCache returns a reader which writes body into the cache while it is read. When the blob turns out to be
+// too large for the cache, is not read completely or an invalidation happened in the meantime, it is not cached.
+func (decorator *CachingBlobstoreDecorator) addToCache(path string, body io.ReadCloser, invalidations uint64) (io.ReadCloser, error) {
+	tempFile, e := ioutil.TempFile(decorator.directory, "tmp-")
+	if e != nil {
+		body.Close()
+		return nil, errors.Wrap(e, "Could not create temporary file")
+	}
+	return &cachingReader{
+		decorator:     decorator,
+		path:          path,
+		body:          body,
+		tempFile:      tempFile,
+		invalidations: invalidations,
+	}, nil
+}
+
+// commit adds the completely read blob in tempFile to the cache.
+func (decorator *CachingBlobstoreDecorator) commit(path string, tempFile *os.File, size int64, invalidations uint64) {
+	defer tempFile.Close()
+
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+
+	if invalidations != decorator.invalidations {
+		os.Remove(tempFile.Name())
+		return
+	}
+	if element, exists := decorator.entries[path]; exists {
+		decorator.removeElement(element)
+	}
+	e := os.Rename(tempFile.Name(), decorator.filename(path))
+	if e != nil {
+		logger.Log.Errorw("Could not add blob to cache", "resource-type", decorator.resourceType, "path", path, "error", e)
+		os.Remove(tempFile.Name())
+		return
+	}
+	decorator.entries[path] = decorator.lru.PushFront(&cacheEntry{path: path, size: size})
+	decorator.size += size
+	for decorator.size > decorator.maxSize {
+		decorator.removeElement(decorator.lru.Back())
+	}
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-cache_size", decorator.size)
+}
+
+// cachingReader passes the blob through to the client and writes it into a temporary file, which is added
+// to the cache on Close when the blob has been read completely.
+type cachingReader struct {
+	decorator     *CachingBlobstoreDecorator
+	path          string
+	body          io.ReadCloser
+	tempFile      *os.File
+	size          int64
+	complete      bool
+	invalidations uint64
+}
+
+func (reader *cachingReader) Read(p []byte) (int, error) {
+	n, e := reader.body.Read(p)
+	if reader.tempFile != nil && n > 0 {
+		reader.size += int64(n)
+		if reader.size > reader.decorator.maxSize {
+			reader.discard()
+		} else if _, writeError := reader.tempFile.Write(p[:n]); writeError != nil {
+			logger.Log.Errorw("Could not write blob to cache", "resource-type", reader.decorator.resourceType, "path", reader.path, "error", writeError)
+			reader.discard()
+		}
+	}
+	if e == io.EOF {
+		reader.complete = true
+	}
+	return n, e
+}
+
+func (reader *cachingReader) Close() error {
+	e := reader.body.Close()
+	if reader.tempFile != nil {
+		if reader.complete {
+			reader.decorator.commit(reader.path, reader.tempFile, reader.size, reader.invalidations)
+			reader.tempFile = nil
+		} else {
+			reader.discard()
+		}
+	}
+	return e
+}
+
+func (reader *cachingReader) discard() {
+	reader.tempFile.Close()
+	os.Remove(reader.tempFile.Name())
+	reader.tempFile = nil
+}
+
+func (decorator *CachingBlobstoreDecorator) currentInvalidations() uint64 {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	return decorator.invalidations
+}
+
+func (decorator *CachingBlobstoreDecorator) invalidate(path string) {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	decorator.invalidations++
+	if element, exists := decorator.entries[path]; exists {
+		decorator.removeElement(element)
+	}
+}
+
+func (decorator *CachingBlobstoreDecorator) invalidatePrefix(prefix string) {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	decorator.invalidations++
+	for path, element := range decorator.entries {
+		if strings.HasPrefix(path, prefix) {
+			decorator.removeElement(element)
+		}
+	}
+}
+
+// removeElement must be called with the mutex held.
+func (decorator *CachingBlobstoreDecorator) removeElement(element *list.Element) {
+	entry := decorator.lru.Remove(element).(*cacheEntry)
+	delete(decorator.entries, entry.path)
+	decorator.size -= entry.size
+	e := os.Remove(decorator.filename(entry.path))
+	if e != nil && !os.IsNotExist(e) {
+		logger.Log.Errorw("Could not remove cached blob", "resource-type", decorator.resourceType, "path", entry.path, "error", e)
+	}
+}
+
+// recordAccess must be called with the mutex held.
+func (decorator *CachingBlobstoreDecorator) recordAccess(hit bool) {
+	if hit {
+		decorator.hits++
+		decorator.metricsService.SendCounterMetric(decorator.resourceType+"-cache_hits", 1)
+	} else {
+		decorator.misses++
+		decorator.metricsService.SendCounterMetric(decorator.resourceType+"-cache_misses", 1)
+	}
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-cache_hit_ratio_percent", decorator.hits*100/(decorator.hits+decorator.misses))
+}
+
+func (decorator *CachingBlobstoreDecorator) filename(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return filepath.Join(decorator.directory, hex.EncodeToString(hash[:]))
+}
@@ -0,0 +1,124 @@
+package decorator_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+var _ = Describe("CachingBlobstoreDecorator", func() {
+	var (
+		delegate       *inmemory.Blobstore
+		metricsService *recordingMetricsService
+		cacheDirectory string
+		blobstore      *decorator.CachingBlobstoreDecorator
+	)
+
+	BeforeEach(func() {
+		delegate = inmemory.NewBlobstore()
+		metricsService = newRecordingMetricsService()
+		var e error
+		cacheDirectory, e = ioutil.TempDir("", "bits-cache")
+		Expect(e).NotTo(HaveOccurred())
+		blobstore = decorator.ForBlobstoreWithCache(delegate, cacheDirectory, 10, nil, metricsService, "droplets")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cacheDirectory)
+	})
+
+	readString := func(path string) string {
+		body, e := blobstore.Get(path)
+		Expect(e).NotTo(HaveOccurred())
+		defer body.Close()
+		content, e := ioutil.ReadAll(body)
+		Expect(e).NotTo(HaveOccurred())
+		return string(content)
+	}
+
+	It("serves blobs from the cache once they have been read", func() {
+		Expect(delegate.Put("guid", strings.NewReader("content"))).To(Succeed())
+		Expect(readString("guid")).To(Equal("content"))
+
+		delegate.Entries["guid"] = []byte("changed")
+
+		Expect(readString("guid")).To(Equal("content"))
+		Expect(metricsService.counters["droplets-cache_hits"]).To(BeEquivalentTo(1))
+		Expect(metricsService.counters["droplets-cache_misses"]).To(BeEquivalentTo(1))
+		Expect(metricsService.gauges["droplets-cache_hit_ratio_percent"]).To(BeEquivalentTo(50))
+	})
+
+	It("invalidates cached blobs on Put, Copy and Delete", func() {
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		Expect(readString("guid")).To(Equal("content"))
+
+		Expect(blobstore.Put("guid", strings.NewReader("new"))).To(Succeed())
+		Expect(readString("guid")).To(Equal("new"))
+
+		Expect(blobstore.Put("other", strings.NewReader("other"))).To(Succeed())
+		Expect(blobstore.Copy("other", "guid")).To(Succeed())
+		Expect(readString("guid")).To(Equal("other"))
+
+		Expect(blobstore.Delete("guid")).To(Succeed())
+		_, e := blobstore.Get("guid")
+		Expect(e).To(HaveOccurred())
+	})
+
+	It("evicts the least recently used blobs when the cache is full", func() {
+		Expect(delegate.Put("a", strings.NewReader("aaaa"))).To(Succeed())
+		Expect(delegate.Put("b", strings.NewReader("bbbb"))).To(Succeed())
+		Expect(delegate.Put("c", strings.NewReader("cccc"))).To(Succeed())
+		readString("a")
+		readString("b")
+		readString("a")
+		readString("c")
+
+		delegate.Entries["a"] = []byte("AAAA")
+		delegate.Entries["b"] = []byte("BBBB")
+
+		Expect(readString("a")).To(Equal("aaaa"))
+		Expect(readString("b")).To(Equal("BBBB"))
+		Expect(metricsService.gauges["droplets-cache_size"]).To(BeEquivalentTo(8))
+	})
+
+	It("does not cache blobs which have not been read completely", func() {
+		Expect(delegate.Put("guid", strings.NewReader("content"))).To(Succeed())
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(body.Read(make([]byte, 3))).To(Equal(3))
+		Expect(body.Close()).To(Succeed())
+
+		delegate.Entries["guid"] = []byte("changed")
+
+		Expect(readString("guid")).To(Equal("changed"))
+	})
+
+	It("does not cache paths which are not cacheable", func() {
+		blobstore = decorator.ForBlobstoreWithCache(delegate, cacheDirectory, 10,
+			func(path string) bool { return !strings.HasPrefix(path, "index/") }, metricsService, "droplets")
+		Expect(delegate.Put("index/guid", strings.NewReader("content"))).To(Succeed())
+		Expect(readString("index/guid")).To(Equal("content"))
+
+		delegate.Entries["index/guid"] = []byte("changed")
+
+		Expect(readString("index/guid")).To(Equal("changed"))
+	})
+
+	It("does not cache blobs larger than the cache", func() {
+		Expect(delegate.Put("guid", strings.NewReader("more than 10 bytes"))).To(Succeed())
+		Expect(readString("guid")).To(Equal("more than 10 bytes"))
+
+		delegate.Entries["guid"] = []byte("changed")
+
+		Expect(readString("guid")).To(Equal("changed"))
+		files, e := ioutil.ReadDir(cacheDirectory)
+		Expect(e).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
@@ -0,0 +1,194 @@
+package decorator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/pkg/errors"
+)
+
+// checksumSuffix is appended to a blob's path to form the path of the sidecar object holding its digest.
+const checksumSuffix = ".sha256"
+
+// ChecksumVerifyingBlobstoreDecorator computes the sha256 digest of every blob on Put and stores it in a sidecar
+// object next to the blob. On Get, the blob's content is verified against the stored digest while it is read.
+// When they do not match, reading fails with *bitsgo.CorruptBlobError at the end of the blob.
+// Blobs without a sidecar object, e.g. because they were written before verification was enabled, are not verified.
+// Redirects are not verified, but clients can verify the blob using the digest returned by Digest.
+type ChecksumVerifyingBlobstoreDecorator struct {
+	delegate       bitsgo.Blobstore
+	metricsService bitsgo.MetricsService
+	resourceType   string
+}
+
+func ForBlobstoreWithChecksumVerification(delegate bitsgo.Blobstore, metricsService bitsgo.MetricsService, resourceType string) *ChecksumVerifyingBlobstoreDecorator {
+	return &ChecksumVerifyingBlobstoreDecorator{delegate, metricsService, resourceType}
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) Exists(path string) (bool, error) {
+	return decorator.delegate.Exists(path)
+}
+
+// Get reads the digest before the blob, so that the delegate never has to serve both at the same time.
+// Otherwise, a rate limited delegate with a single slot would block forever.
+func (decorator *ChecksumVerifyingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	expectedDigest, e := decorator.Digest(path)
+	if e != nil {
+		return nil, e
+	}
+	body, e = decorator.delegate.Get(path)
+	if e != nil {
+		return nil, e
+	}
+	return decorator.verifying(path, body, expectedDigest), nil
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	expectedDigest, e := decorator.Digest(path)
+	if e != nil {
+		return nil, "", e
+	}
+	body, redirectLocation, e = decorator.delegate.GetOrRedirect(path)
+	if e != nil || redirectLocation != "" {
+		return body, redirectLocation, e
+	}
+	return decorator.verifying(path, body, expectedDigest), "", nil
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) verifying(path string, body io.ReadCloser, expectedDigest string) io.ReadCloser {
+	if expectedDigest == "" {
+		return body
+	}
+	return &verifyingReader{
+		body:           body,
+		hash:           sha256.New(),
+		path:           path,
+		expectedDigest: expectedDigest,
+		onCorruption: func() {
+			decorator.metricsService.SendCounterMetric(decorator.resourceType+"-corrupt_blobs", 1)
+		},
+	}
+}
+
+// Digest returns the digest stored when the blob was written or "" when the blob has no sidecar object.
+func (decorator *ChecksumVerifyingBlobstoreDecorator) Digest(path string) (string, error) {
+	sidecar, e := decorator.delegate.Get(path + checksumSuffix)
+	if bitsgo.IsNotFoundError(e) {
+		return "", nil
+	}
+	if e != nil {
+		return "", errors.Wrapf(e, "Could not read digest of %v", path)
+	}
+	defer sidecar.Close()
+	digest, e := ioutil.ReadAll(sidecar)
+	if e != nil {
+		return "", errors.Wrapf(e, "Could not read digest of %v", path)
+	}
+	return strings.TrimSpace(string(digest)), nil
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	hash := sha256.New()
+	_, e := io.Copy(hash, src)
+	if e != nil {
+		return errors.Wrapf(e, "Could not compute digest of %v", path)
+	}
+	_, e = src.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrapf(e, "Could not rewind %v", path)
+	}
+	// The old digest is removed first, so that a failure after overwriting the blob leaves it unverified rather than corrupt.
+	e = decorator.deleteDigest(path)
+	if e != nil {
+		return e
+	}
+	e = decorator.delegate.Put(path, src)
+	if e != nil {
+		return e
+	}
+	return decorator.delegate.Put(path+checksumSuffix, strings.NewReader(hex.EncodeToString(hash.Sum(nil))))
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) Copy(src, dest string) error {
+	digest, e := decorator.Digest(src)
+	if e != nil {
+		return e
+	}
+	e = decorator.deleteDigest(dest)
+	if e != nil {
+		return e
+	}
+	e = decorator.delegate.Copy(src, dest)
+	if e != nil {
+		return e
+	}
+	if digest == "" {
+		return nil
+	}
+	return decorator.delegate.Put(dest+checksumSuffix, strings.NewReader(digest))
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) deleteDigest(path string) error {
+	e := decorator.delegate.Delete(path + checksumSuffix)
+	if e != nil && !bitsgo.IsNotFoundError(e) {
+		return errors.Wrapf(e, "Could not delete digest of %v", path)
+	}
+	return nil
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) Delete(path string) error {
+	e := decorator.delegate.Delete(path)
+	if e != nil {
+		return e
+	}
+	return decorator.deleteDigest(path)
+}
+
+func (decorator *ChecksumVerifyingBlobstoreDecorator) DeleteDir(prefix string) error {
+	return decorator.delegate.DeleteDir(prefix)
+}
+
+// List does not return the sidecar objects.
+func (decorator *ChecksumVerifyingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos, e := decorator.delegate.List(prefix)
+	if e != nil {
+		return nil, e
+	}
+	result := make([]bitsgo.BlobInfo, 0, len(blobInfos))
+	for _, blobInfo := range blobInfos {
+		if !strings.HasSuffix(blobInfo.Path, checksumSuffix) {
+			result = append(result, blobInfo)
+		}
+	}
+	return result, nil
+}
+
+type verifyingReader struct {
+	body           io.ReadCloser
+	hash           hash.Hash
+	path           string
+	expectedDigest string
+	onCorruption   func()
+}
+
+func (reader *verifyingReader) Read(p []byte) (int, error) {
+	n, e := reader.body.Read(p)
+	reader.hash.Write(p[:n])
+	if e == io.EOF {
+		actualDigest := hex.EncodeToString(reader.hash.Sum(nil))
+		if actualDigest != reader.expectedDigest {
+			reader.onCorruption()
+			return n, bitsgo.NewCorruptBlobError(reader.path, reader.expectedDigest, actualDigest)
+		}
+	}
+	return n, e
+}
+
+func (reader *verifyingReader) Close() error {
+	return reader.body.Close()
+}
@@ -0,0 +1,91 @@
+package decorator_test
+
+import (
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+var _ = Describe("ChecksumVerifyingBlobstoreDecorator", func() {
+	const helloDigest = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	var (
+		delegate       *inmemory.Blobstore
+		metricsService *recordingMetricsService
+		blobstore      *decorator.ChecksumVerifyingBlobstoreDecorator
+	)
+
+	BeforeEach(func() {
+		delegate = inmemory.NewBlobstore()
+		metricsService = newRecordingMetricsService()
+		blobstore = decorator.ForBlobstoreWithChecksumVerification(delegate, metricsService, "droplets")
+	})
+
+	It("stores the digest next to the blob and verifies it on Get", func() {
+		Expect(blobstore.Put("guid", strings.NewReader("hello"))).To(Succeed())
+
+		Expect(delegate.Entries).To(HaveKeyWithValue("guid.sha256", []byte(helloDigest)))
+		Expect(blobstore.Digest("guid")).To(Equal(helloDigest))
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("hello"))
+	})
+
+	It("fails reading blobs whose content does not match the stored digest", func() {
+		Expect(blobstore.Put("guid", strings.NewReader("hello"))).To(Succeed())
+		delegate.Entries["guid"] = []byte("hallo")
+
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		_, e = ioutil.ReadAll(body)
+
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.CorruptBlobError{}))
+		Expect(e.(*bitsgo.CorruptBlobError).ExpectedDigest).To(Equal(helloDigest))
+		Expect(metricsService.counters["droplets-corrupt_blobs"]).To(BeEquivalentTo(1))
+	})
+
+	It("does not verify blobs stored before verification was enabled", func() {
+		Expect(delegate.Put("guid", strings.NewReader("plain"))).To(Succeed())
+
+		body, e := blobstore.Get("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("plain"))
+		Expect(blobstore.Digest("guid")).To(BeEmpty())
+	})
+
+	It("copies and deletes the digest together with the blob", func() {
+		Expect(blobstore.Put("guid", strings.NewReader("hello"))).To(Succeed())
+
+		Expect(blobstore.Copy("guid", "other")).To(Succeed())
+		Expect(blobstore.Digest("other")).To(Equal(helloDigest))
+
+		Expect(blobstore.Delete("guid")).To(Succeed())
+		Expect(delegate.Entries).NotTo(HaveKey("guid.sha256"))
+	})
+
+	It("does not keep the old digest when overwriting a blob fails", func() {
+		Expect(blobstore.Put("guid", strings.NewReader("hello"))).To(Succeed())
+		blobstore = decorator.ForBlobstoreWithChecksumVerification(&failingPutBlobstore{delegate}, metricsService, "droplets")
+
+		Expect(blobstore.Put("guid", strings.NewReader("new content"))).NotTo(Succeed())
+
+		Expect(blobstore.Digest("guid")).To(BeEmpty())
+	})
+
+	It("does not list digests", func() {
+		Expect(blobstore.Put("guid", strings.NewReader("hello"))).To(Succeed())
+
+		blobInfos, e := blobstore.List("")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(blobInfos).To(HaveLen(1))
+		Expect(blobInfos[0].Path).To(Equal("guid"))
+	})
+})
@@ -0,0 +1,185 @@
+package decorator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+type CompressionCodec byte
+
+const (
+	Gzip CompressionCodec = 1
+	Zstd CompressionCodec = 2
+)
+
+// compressionMagic is followed by one byte identifying the CompressionCodec.
+const compressionMagic = "BITSCMP"
+
+// CompressingBlobstoreDecorator compresses blobs on Put and decompresses them on Get. Compressed blobs
+// start with a header identifying the codec. Blobs without this header are returned as they are, so
+// compression can be enabled for existing blobstores and the codec can be changed at any time.
+type CompressingBlobstoreDecorator struct {
+	delegate       bitsgo.Blobstore
+	codec          CompressionCodec
+	level          int
+	metricsService bitsgo.MetricsService
+	resourceType   string
+}
+
+// ForBlobstoreWithCompression creates a CompressingBlobstoreDecorator. A level of 0 uses the codec's default level.
+func ForBlobstoreWithCompression(delegate bitsgo.Blobstore, codec CompressionCodec, level int, metricsService bitsgo.MetricsService, resourceType string) *CompressingBlobstoreDecorator {
+	return &CompressingBlobstoreDecorator{
+		delegate:       delegate,
+		codec:          codec,
+		level:          level,
+		metricsService: metricsService,
+		resourceType:   resourceType,
+	}
+}
+
+func (decorator *CompressingBlobstoreDecorator) Exists(path string) (bool, error) {
+	return decorator.delegate.Exists(path)
+}
+
+func (decorator *CompressingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	body, e := decorator.delegate.Get(path)
+	if e != nil {
+		return nil, e
+	}
+	bufferedBody := bufio.NewReader(body)
+	header, e := bufferedBody.Peek(len(compressionMagic) + 1)
+	if e != nil || string(header[:len(compressionMagic)]) != compressionMagic {
+		return &readCloser{bufferedBody, body}, nil
+	}
+	bufferedBody.Discard(len(header))
+
+	switch CompressionCodec(header[len(compressionMagic)]) {
+	case Gzip:
+		gzipReader, e := gzip.NewReader(bufferedBody)
+		if e != nil {
+			body.Close()
+			return nil, errors.Wrapf(e, "Could not decompress %v", path)
+		}
+		return &readCloser{gzipReader, body}, nil
+	case Zstd:
+		zstdReader, e := zstd.NewReader(bufferedBody)
+		if e != nil {
+			body.Close()
+			return nil, errors.Wrapf(e, "Could not decompress %v", path)
+		}
+		return &zstdReadCloser{zstdReader, body}, nil
+	default:
+		body.Close()
+		return nil, errors.Errorf("Blob %v is compressed with unknown codec %v", path, header[len(compressionMagic)])
+	}
+}
+
+// GetOrRedirect never redirects, because the redirect location would serve the compressed blob.
+func (decorator *CompressingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	body, e := decorator.Get(path)
+	return body, "", e
+}
+
+func (decorator *CompressingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	// Put requires an io.ReadSeeker, so we need to buffer the compressed blob.
+	tempFile, e := ioutil.TempFile("", "bits-compression")
+	if e != nil {
+		return errors.Wrap(e, "Could not create temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	uncompressedSize, e := decorator.compress(tempFile, src)
+	if e != nil {
+		return errors.Wrapf(e, "Could not compress %v", path)
+	}
+	compressedSize, e := tempFile.Seek(0, io.SeekCurrent)
+	if e != nil {
+		return errors.Wrap(e, "Could not determine size of temporary file")
+	}
+	_, e = tempFile.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrap(e, "Could not rewind temporary file")
+	}
+	e = decorator.delegate.Put(path, tempFile)
+	if e != nil {
+		return e
+	}
+
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-uncompressed_bytes", uncompressedSize)
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-compressed_bytes", compressedSize)
+	if uncompressedSize != 0 {
+		decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-compression_ratio_percent", compressedSize*100/uncompressedSize)
+	}
+	return nil
+}
+
+func (decorator *CompressingBlobstoreDecorator) compress(dst io.Writer, src io.Reader) (uncompressedSize int64, err error) {
+	_, e := dst.Write(append([]byte(compressionMagic), byte(decorator.codec)))
+	if e != nil {
+		return 0, e
+	}
+	var compressor io.WriteCloser
+	switch decorator.codec {
+	case Gzip:
+		level := gzip.DefaultCompression
+		if decorator.level != 0 {
+			level = decorator.level
+		}
+		compressor, e = gzip.NewWriterLevel(dst, level)
+	case Zstd:
+		level := zstd.SpeedDefault
+		if decorator.level != 0 {
+			level = zstd.EncoderLevelFromZstd(decorator.level)
+		}
+		compressor, e = zstd.NewWriter(dst, zstd.WithEncoderLevel(level))
+	default:
+		e = errors.Errorf("Unknown codec %v", decorator.codec)
+	}
+	if e != nil {
+		return 0, e
+	}
+	uncompressedSize, e = io.Copy(compressor, src)
+	if e != nil {
+		compressor.Close()
+		return 0, e
+	}
+	return uncompressedSize, compressor.Close()
+}
+
+func (decorator *CompressingBlobstoreDecorator) Copy(src, dest string) error {
+	return decorator.delegate.Copy(src, dest)
+}
+
+func (decorator *CompressingBlobstoreDecorator) Delete(path string) error {
+	return decorator.delegate.Delete(path)
+}
+
+func (decorator *CompressingBlobstoreDecorator) DeleteDir(prefix string) error {
+	return decorator.delegate.DeleteDir(prefix)
+}
+
+func (decorator *CompressingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	return decorator.delegate.List(prefix)
+}
+
+type zstdReadCloser struct {
+	decoder *zstd.Decoder
+	body    io.Closer
+}
+
+func (reader *zstdReadCloser) Read(p []byte) (int, error) {
+	return reader.decoder.Read(p)
+}
+
+func (reader *zstdReadCloser) Close() error {
+	reader.decoder.Close()
+	return reader.body.Close()
+}
@@ -0,0 +1,74 @@
+package decorator_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+var _ = Describe("CompressingBlobstoreDecorator", func() {
+	var (
+		delegate       *inmemory.Blobstore
+		metricsService *recordingMetricsService
+		content        []byte
+	)
+
+	BeforeEach(func() {
+		delegate = inmemory.NewBlobstore()
+		metricsService = newRecordingMetricsService()
+		content = bytes.Repeat([]byte("some highly compressible content "), 1000)
+	})
+
+	for _, codec := range []decorator.CompressionCodec{decorator.Gzip, decorator.Zstd} {
+		codec := codec
+
+		It("stores blobs compressed and decompresses them on Get", func() {
+			blobstore := decorator.ForBlobstoreWithCompression(delegate, codec, 0, metricsService, "droplets")
+
+			Expect(blobstore.Put("guid", bytes.NewReader(content))).To(Succeed())
+
+			Expect(len(delegate.Entries["guid"])).To(BeNumerically("<", len(content)/10))
+			body, e := blobstore.Get("guid")
+			Expect(e).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(body)).To(Equal(content))
+			Expect(metricsService.counters["droplets-uncompressed_bytes"]).To(BeEquivalentTo(len(content)))
+			Expect(metricsService.counters["droplets-compressed_bytes"]).To(BeEquivalentTo(len(delegate.Entries["guid"])))
+			Expect(metricsService.gauges["droplets-compression_ratio_percent"]).To(BeNumerically("<", 10))
+		})
+	}
+
+	It("decompresses blobs written with a different codec", func() {
+		Expect(decorator.ForBlobstoreWithCompression(delegate, decorator.Gzip, 0, metricsService, "droplets").Put("guid", bytes.NewReader(content))).To(Succeed())
+
+		body, e := decorator.ForBlobstoreWithCompression(delegate, decorator.Zstd, 0, metricsService, "droplets").Get("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(Equal(content))
+	})
+
+	It("returns blobs stored before compression was enabled as they are", func() {
+		Expect(delegate.Put("guid", strings.NewReader("plain"))).To(Succeed())
+
+		body, e := decorator.ForBlobstoreWithCompression(delegate, decorator.Zstd, 0, metricsService, "droplets").Get("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("plain"))
+	})
+
+	It("never redirects", func() {
+		blobstore := decorator.ForBlobstoreWithCompression(delegate, decorator.Gzip, 0, metricsService, "droplets")
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		body, redirectLocation, e := blobstore.GetOrRedirect("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(redirectLocation).To(BeEmpty())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("content"))
+	})
+})
@@ -0,0 +1,307 @@
+package decorator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	encryptionMagic       = "BITSENC1"
+	encryptionChunkSize   = 64 * 1024
+	encryptionNoncePrefix = 8
+	lastChunk             = 1
+)
+
+// EncryptingBlobstoreDecorator encrypts blobs before they are written to the delegate and decrypts them
+// transparently on Get. Every blob is encrypted with its own random data key using AES-GCM in chunks of
+// 64KiB, so that blobs can be decrypted while streaming. The data key is wrapped with the active master
+// key and stored in the blob's header together with the master key's ID, so that master keys can be
+// rotated while blobs encrypted with previous master keys remain readable.
+//
+// Blob format:
+//
+//	"BITSENC1" | uint16 len(key ID) | key ID | uint16 len(wrapped data key) | wrapped data key | nonce prefix (8 bytes) |
+//	chunks of: flags (1 byte, 1 for the last chunk) | uint32 len(sealed chunk) | sealed chunk
+//
+// Blobs without this header are returned as they are, so encryption can be enabled for existing blobstores.
+type EncryptingBlobstoreDecorator struct {
+	delegate    bitsgo.Blobstore
+	masterKeys  map[string][]byte
+	activeKeyID string
+}
+
+func ForBlobstoreWithEncryption(delegate bitsgo.Blobstore, masterKeys map[string][]byte, activeKeyID string) *EncryptingBlobstoreDecorator {
+	return &EncryptingBlobstoreDecorator{delegate, masterKeys, activeKeyID}
+}
+
+func (decorator *EncryptingBlobstoreDecorator) Exists(path string) (bool, error) {
+	return decorator.delegate.Exists(path)
+}
+
+func (decorator *EncryptingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	body, e := decorator.delegate.Get(path)
+	if e != nil {
+		return nil, e
+	}
+	bufferedBody := bufio.NewReader(body)
+	magic, e := bufferedBody.Peek(len(encryptionMagic))
+	if e != nil || string(magic) != encryptionMagic {
+		return &readCloser{bufferedBody, body}, nil
+	}
+	decryptingReader, e := decorator.newDecryptingReader(bufferedBody)
+	if e != nil {
+		body.Close()
+		return nil, errors.Wrapf(e, "Could not decrypt %v", path)
+	}
+	return &readCloser{decryptingReader, body}, nil
+}
+
+// GetOrRedirect never redirects, because the redirect location would serve the encrypted blob.
+func (decorator *EncryptingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	body, e := decorator.Get(path)
+	return body, "", e
+}
+
+func (decorator *EncryptingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	// Put requires an io.ReadSeeker, so we need to buffer the encrypted blob.
+	tempFile, e := ioutil.TempFile("", "bits-encryption")
+	if e != nil {
+		return errors.Wrap(e, "Could not create temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	bufferedWriter := bufio.NewWriter(tempFile)
+	e = decorator.encrypt(bufferedWriter, src)
+	if e != nil {
+		return errors.Wrapf(e, "Could not encrypt %v", path)
+	}
+	e = bufferedWriter.Flush()
+	if e != nil {
+		return errors.Wrap(e, "Could not write temporary file")
+	}
+	_, e = tempFile.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrap(e, "Could not rewind temporary file")
+	}
+	return decorator.delegate.Put(path, tempFile)
+}
+
+func (decorator *EncryptingBlobstoreDecorator) Copy(src, dest string) error {
+	return decorator.delegate.Copy(src, dest)
+}
+
+func (decorator *EncryptingBlobstoreDecorator) Delete(path string) error {
+	return decorator.delegate.Delete(path)
+}
+
+func (decorator *EncryptingBlobstoreDecorator) DeleteDir(prefix string) error {
+	return decorator.delegate.DeleteDir(prefix)
+}
+
+func (decorator *EncryptingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	return decorator.delegate.List(prefix)
+}
+
+func (decorator *EncryptingBlobstoreDecorator) encrypt(dst io.Writer, src io.Reader) error {
+	masterKey, exists := decorator.masterKeys[decorator.activeKeyID]
+	if !exists {
+		return errors.Errorf("Master key %v does not exist", decorator.activeKeyID)
+	}
+	masterAEAD, e := newAEAD(masterKey)
+	if e != nil {
+		return e
+	}
+	dataKey := make([]byte, 32)
+	_, e = rand.Read(dataKey)
+	util.PanicOnError(e)
+	keyNonce := make([]byte, masterAEAD.NonceSize())
+	_, e = rand.Read(keyNonce)
+	util.PanicOnError(e)
+	// The key ID is authenticated as additional data, so that it cannot be exchanged.
+	wrappedDataKey := masterAEAD.Seal(keyNonce, keyNonce, dataKey, []byte(decorator.activeKeyID))
+	noncePrefix := make([]byte, encryptionNoncePrefix)
+	_, e = rand.Read(noncePrefix)
+	util.PanicOnError(e)
+
+	var header bytes.Buffer
+	header.WriteString(encryptionMagic)
+	binary.Write(&header, binary.BigEndian, uint16(len(decorator.activeKeyID)))
+	header.WriteString(decorator.activeKeyID)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrappedDataKey)))
+	header.Write(wrappedDataKey)
+	header.Write(noncePrefix)
+	_, e = dst.Write(header.Bytes())
+	if e != nil {
+		return e
+	}
+
+	dataAEAD, e := newAEAD(dataKey)
+	if e != nil {
+		return e
+	}
+	chunk := make([]byte, encryptionChunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, e := io.ReadFull(src, chunk)
+		if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+			return e
+		}
+		var flags byte
+		if e != nil {
+			flags = lastChunk
+		}
+		sealedChunk := dataAEAD.Seal(nil, chunkNonce(noncePrefix, counter), chunk[:n], []byte{flags})
+		var chunkHeader [5]byte
+		chunkHeader[0] = flags
+		binary.BigEndian.PutUint32(chunkHeader[1:], uint32(len(sealedChunk)))
+		_, e = dst.Write(chunkHeader[:])
+		if e != nil {
+			return e
+		}
+		_, e = dst.Write(sealedChunk)
+		if e != nil {
+			return e
+		}
+		if flags == lastChunk {
+			return nil
+		}
+	}
+}
+
+func (decorator *EncryptingBlobstoreDecorator) newDecryptingReader(src io.Reader) (*decryptingReader, error) {
+	_, e := io.ReadFull(src, make([]byte, len(encryptionMagic)))
+	if e != nil {
+		return nil, e
+	}
+	keyID, e := readLengthPrefixed(src)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not read key ID")
+	}
+	wrappedDataKey, e := readLengthPrefixed(src)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not read data key")
+	}
+	noncePrefix := make([]byte, encryptionNoncePrefix)
+	_, e = io.ReadFull(src, noncePrefix)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not read nonce")
+	}
+
+	masterKey, exists := decorator.masterKeys[string(keyID)]
+	if !exists {
+		return nil, errors.Errorf("Blob is encrypted with unknown master key %v", string(keyID))
+	}
+	masterAEAD, e := newAEAD(masterKey)
+	if e != nil {
+		return nil, e
+	}
+	if len(wrappedDataKey) < masterAEAD.NonceSize() {
+		return nil, errors.New("Data key is invalid")
+	}
+	dataKey, e := masterAEAD.Open(nil, wrappedDataKey[:masterAEAD.NonceSize()], wrappedDataKey[masterAEAD.NonceSize():], keyID)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not unwrap data key")
+	}
+	dataAEAD, e := newAEAD(dataKey)
+	if e != nil {
+		return nil, e
+	}
+	return &decryptingReader{source: src, aead: dataAEAD, noncePrefix: noncePrefix}, nil
+}
+
+type decryptingReader struct {
+	source      io.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	plaintext   []byte
+	done        bool
+}
+
+func (reader *decryptingReader) Read(p []byte) (int, error) {
+	for len(reader.plaintext) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		e := reader.readChunk()
+		if e != nil {
+			return 0, e
+		}
+	}
+	n := copy(p, reader.plaintext)
+	reader.plaintext = reader.plaintext[n:]
+	return n, nil
+}
+
+func (reader *decryptingReader) readChunk() error {
+	var chunkHeader [5]byte
+	_, e := io.ReadFull(reader.source, chunkHeader[:])
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		return errors.New("Encrypted blob is truncated")
+	}
+	if e != nil {
+		return e
+	}
+	// Reject lengths no valid chunk can have, before allocating a buffer for the chunk.
+	sealedChunkLength := binary.BigEndian.Uint32(chunkHeader[1:])
+	if sealedChunkLength > uint32(encryptionChunkSize+reader.aead.Overhead()) {
+		return errors.Errorf("Encrypted chunk length %v exceeds the maximum of %v", sealedChunkLength, encryptionChunkSize+reader.aead.Overhead())
+	}
+	sealedChunk := make([]byte, sealedChunkLength)
+	_, e = io.ReadFull(reader.source, sealedChunk)
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		return errors.New("Encrypted blob is truncated")
+	}
+	if e != nil {
+		return e
+	}
+	reader.plaintext, e = reader.aead.Open(sealedChunk[:0], chunkNonce(reader.noncePrefix, reader.counter), sealedChunk, chunkHeader[:1])
+	if e != nil {
+		return errors.Wrap(e, "Could not decrypt chunk")
+	}
+	reader.counter++
+	reader.done = chunkHeader[0] == lastChunk
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, errors.Wrap(e, "Invalid key")
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(noncePrefix []byte, counter uint32) []byte {
+	nonce := make([]byte, encryptionNoncePrefix+4)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefix:], counter)
+	return nonce
+}
+
+func readLengthPrefixed(src io.Reader) ([]byte, error) {
+	var length uint16
+	e := binary.Read(src, binary.BigEndian, &length)
+	if e != nil {
+		return nil, e
+	}
+	content := make([]byte, length)
+	_, e = io.ReadFull(src, content)
+	return content, e
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,117 @@
+package decorator_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+var _ = Describe("EncryptingBlobstoreDecorator", func() {
+	var (
+		delegate   *inmemory.Blobstore
+		masterKeys map[string][]byte
+	)
+
+	BeforeEach(func() {
+		delegate = inmemory.NewBlobstore()
+		masterKeys = map[string][]byte{
+			"key1": bytes.Repeat([]byte{1}, 32),
+			"key2": bytes.Repeat([]byte{2}, 32),
+		}
+	})
+
+	It("stores blobs encrypted and decrypts them on Get", func() {
+		content := make([]byte, 200*1024+17)
+		_, e := rand.Read(content)
+		Expect(e).NotTo(HaveOccurred())
+		blobstore := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1")
+
+		Expect(blobstore.Put("guid", bytes.NewReader(content))).To(Succeed())
+
+		Expect(bytes.Contains(delegate.Entries["guid"], content[:100])).To(BeFalse())
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(Equal(content))
+	})
+
+	It("encrypts empty blobs", func() {
+		blobstore := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1")
+
+		Expect(blobstore.Put("guid", strings.NewReader(""))).To(Succeed())
+
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(BeEmpty())
+	})
+
+	It("decrypts blobs encrypted with a previous master key", func() {
+		Expect(decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1").Put("guid", strings.NewReader("secret"))).To(Succeed())
+
+		body, e := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key2").Get("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("secret"))
+	})
+
+	It("returns blobs stored before encryption was enabled as they are", func() {
+		Expect(delegate.Put("guid", strings.NewReader("plain"))).To(Succeed())
+
+		body, e := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1").Get("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("plain"))
+	})
+
+	It("fails reading tampered blobs", func() {
+		blobstore := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1")
+		Expect(blobstore.Put("guid", strings.NewReader("secret"))).To(Succeed())
+		delegate.Entries["guid"][len(delegate.Entries["guid"])-1] ^= 1
+
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		_, e = ioutil.ReadAll(body)
+		Expect(e).To(MatchError(ContainSubstring("Could not decrypt chunk")))
+	})
+
+	It("fails reading truncated blobs", func() {
+		blobstore := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1")
+		Expect(blobstore.Put("guid", bytes.NewReader(make([]byte, 100*1024)))).To(Succeed())
+		delegate.Entries["guid"] = delegate.Entries["guid"][:70*1024]
+
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		_, e = ioutil.ReadAll(body)
+		Expect(e).To(MatchError(ContainSubstring("truncated")))
+	})
+
+	It("fails reading blobs with invalid chunk lengths", func() {
+		blobstore := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1")
+		Expect(blobstore.Put("guid", strings.NewReader(""))).To(Succeed())
+		// The only chunk consists of flags, its uint32 length and the 16 bytes GCM tag.
+		entry := delegate.Entries["guid"]
+		copy(entry[len(entry)-20:], []byte{0xff, 0xff, 0xff, 0xff})
+
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		_, e = ioutil.ReadAll(body)
+		Expect(e).To(MatchError(ContainSubstring("exceeds the maximum")))
+	})
+
+	It("never redirects", func() {
+		blobstore := decorator.ForBlobstoreWithEncryption(delegate, masterKeys, "key1")
+		Expect(blobstore.Put("guid", strings.NewReader("secret"))).To(Succeed())
+
+		body, redirectLocation, e := blobstore.GetOrRedirect("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(redirectLocation).To(BeEmpty())
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("secret"))
+	})
+})
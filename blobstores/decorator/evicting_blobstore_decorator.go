@@ -0,0 +1,335 @@
+package decorator
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+// lastAccessSuffix is appended to an entry's path to form the path of the sidecar object recording its last access.
+const lastAccessSuffix = ".last-access"
+
+// lastAccessResolution limits how often reads of the same entry rewrite its sidecar object.
+const lastAccessResolution = time.Minute
+
+// EvictingBlobstoreDecorator rejects entries larger than the maximum entry size and evicts entries which have not
+// been accessed within the TTL or, when the total size exceeds its maximum, the least recently used ones.
+//
+// Accesses are recorded in a sidecar object next to every entry, so that all bits-service instances sharing a
+// blobstore and instances started later see the same access times. The last access of an entry is the modification
+// time of the entry or of its sidecar object, whichever is later. Entries without either, e.g. because they were
+// written before eviction was enabled, are considered accessed when a sweep first sees them.
+type EvictingBlobstoreDecorator struct {
+	delegate       bitsgo.Blobstore
+	metricsService bitsgo.MetricsService
+	resourceType   string
+	maxEntrySize   uint64
+	maxTotalSize   uint64
+	ttl            time.Duration
+	clock          clock.Clock
+
+	mutex sync.Mutex
+	// recordedAccesses holds the accesses this instance recorded last, so that hot entries are not rewritten on every read.
+	recordedAccesses map[string]time.Time
+}
+
+// ForBlobstoreWithEviction creates an EvictingBlobstoreDecorator. A value of 0 for maxEntrySize,
+// maxTotalSize or ttl disables the corresponding limit.
+func ForBlobstoreWithEviction(delegate bitsgo.Blobstore, metricsService bitsgo.MetricsService, resourceType string, maxEntrySize uint64, maxTotalSize uint64, ttl time.Duration, clock clock.Clock) *EvictingBlobstoreDecorator {
+	return &EvictingBlobstoreDecorator{
+		delegate:         delegate,
+		metricsService:   metricsService,
+		resourceType:     resourceType,
+		maxEntrySize:     maxEntrySize,
+		maxTotalSize:     maxTotalSize,
+		ttl:              ttl,
+		clock:            clock,
+		recordedAccesses: make(map[string]time.Time),
+	}
+}
+
+func (decorator *EvictingBlobstoreDecorator) Exists(path string) (bool, error) {
+	exists, e := decorator.delegate.Exists(path)
+	if e == nil && exists {
+		decorator.touch(path)
+	}
+	return exists, e
+}
+
+func (decorator *EvictingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	body, e := decorator.delegate.Get(path)
+	if e == nil {
+		decorator.touch(path)
+	}
+	return body, e
+}
+
+func (decorator *EvictingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	body, redirectLocation, e := decorator.delegate.GetOrRedirect(path)
+	if e == nil {
+		decorator.touch(path)
+	}
+	return body, redirectLocation, e
+}
+
+// Put returns *bitsgo.EntityTooLargeError without writing anything when src exceeds the maximum entry size.
+func (decorator *EvictingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	if decorator.maxEntrySize != 0 {
+		size, e := src.Seek(0, io.SeekEnd)
+		if e != nil {
+			return errors.Wrapf(e, "Could not determine size of %v", path)
+		}
+		if uint64(size) > decorator.maxEntrySize {
+			return bitsgo.NewEntityTooLargeError(size, decorator.maxEntrySize)
+		}
+		_, e = src.Seek(0, io.SeekStart)
+		if e != nil {
+			return errors.Wrapf(e, "Could not rewind %v", path)
+		}
+	}
+	e := decorator.delegate.Put(path, src)
+	if e != nil {
+		return e
+	}
+	decorator.touch(path)
+	return nil
+}
+
+func (decorator *EvictingBlobstoreDecorator) Copy(src, dest string) error {
+	e := decorator.delegate.Copy(src, dest)
+	if e != nil {
+		return e
+	}
+	decorator.touch(dest)
+	return nil
+}
+
+func (decorator *EvictingBlobstoreDecorator) Delete(path string) error {
+	e := decorator.delegate.Delete(path)
+	if e != nil {
+		return e
+	}
+	decorator.forget(path)
+	e = decorator.delegate.Delete(path + lastAccessSuffix)
+	if e != nil && !bitsgo.IsNotFoundError(e) {
+		return errors.Wrapf(e, "Could not delete last access of %v", path)
+	}
+	return nil
+}
+
+// DeleteDir also deletes the sidecar objects, since they are in the same directory as their entries.
+func (decorator *EvictingBlobstoreDecorator) DeleteDir(prefix string) error {
+	e := decorator.delegate.DeleteDir(prefix)
+	if e != nil {
+		return e
+	}
+
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	for path := range decorator.recordedAccesses {
+		if prefix == "" || path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			delete(decorator.recordedAccesses, path)
+		}
+	}
+	return nil
+}
+
+// List does not return the sidecar objects.
+func (decorator *EvictingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos, e := decorator.delegate.List(prefix)
+	if e != nil {
+		return nil, e
+	}
+	result := make([]bitsgo.BlobInfo, 0, len(blobInfos))
+	for _, blobInfo := range blobInfos {
+		if !strings.HasSuffix(blobInfo.Path, lastAccessSuffix) {
+			result = append(result, blobInfo)
+		}
+	}
+	return result, nil
+}
+
+// Digest forwards to the delegate, so that digests remain available when eviction is enabled.
+// It returns "" when the delegate does not store digests.
+func (decorator *EvictingBlobstoreDecorator) Digest(path string) (string, error) {
+	digestingBlobstore, ok := decorator.delegate.(bitsgo.DigestingBlobstore)
+	if !ok {
+		return "", nil
+	}
+	return digestingBlobstore.Digest(path)
+}
+
+// RegularlySweep blocks and calls Sweep in the given interval.
+func (decorator *EvictingBlobstoreDecorator) RegularlySweep(interval time.Duration) {
+	for range decorator.clock.Ticker(interval).C {
+		e := decorator.Sweep()
+		if e != nil {
+			logger.Log.Errorw("Sweep failed", "resource-type", decorator.resourceType, "error", e)
+		}
+	}
+}
+
+// Sweep evicts all entries whose TTL has expired and, if the total size still exceeds the maximum,
+// the least recently used entries until it is within the limit again. It also deletes sidecar objects
+// whose entries do not exist anymore.
+func (decorator *EvictingBlobstoreDecorator) Sweep() error {
+	blobInfos, e := decorator.delegate.List("")
+	if e != nil {
+		return errors.Wrapf(e, "Could not list entries of %v", decorator.resourceType)
+	}
+	var (
+		entries  []bitsgo.BlobInfo
+		sidecars = make(map[string]bitsgo.BlobInfo)
+	)
+	for _, blobInfo := range blobInfos {
+		if strings.HasSuffix(blobInfo.Path, lastAccessSuffix) {
+			sidecars[strings.TrimSuffix(blobInfo.Path, lastAccessSuffix)] = blobInfo
+		} else {
+			entries = append(entries, blobInfo)
+		}
+	}
+	evicted, totalSize := decorator.evictableEntriesOf(entries, sidecars)
+
+	var evictedBytes, evictedCount int64
+	for _, blobInfo := range evicted {
+		e := decorator.Delete(blobInfo.Path)
+		if e != nil && !bitsgo.IsNotFoundError(e) {
+			logger.Log.Errorw("Could not evict entry", "resource-type", decorator.resourceType, "path", blobInfo.Path, "error", e)
+			continue
+		}
+		evictedBytes += blobInfo.Size
+		evictedCount++
+	}
+	for _, entry := range entries {
+		delete(sidecars, entry.Path)
+	}
+	for _, sidecar := range sidecars {
+		e := decorator.delegate.Delete(sidecar.Path)
+		if e != nil && !bitsgo.IsNotFoundError(e) {
+			logger.Log.Errorw("Could not delete orphaned last access", "resource-type", decorator.resourceType, "path", sidecar.Path, "error", e)
+		}
+	}
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-evicted_entries", evictedCount)
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-evicted_bytes", evictedBytes)
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-total_size", totalSize)
+	return nil
+}
+
+func (decorator *EvictingBlobstoreDecorator) evictableEntriesOf(entries []bitsgo.BlobInfo, sidecars map[string]bitsgo.BlobInfo) (evicted []bitsgo.BlobInfo, totalSize int64) {
+	now := decorator.clock.Now()
+	lastAccesses := make(map[string]time.Time, len(entries))
+	var remaining []bitsgo.BlobInfo
+	for _, entry := range entries {
+		lastAccess := decorator.lastAccessOf(entry, sidecars, now)
+		lastAccesses[entry.Path] = lastAccess
+		if decorator.ttl != 0 && now.Sub(lastAccess) > decorator.ttl {
+			evicted = append(evicted, entry)
+			continue
+		}
+		remaining = append(remaining, entry)
+		totalSize += entry.Size
+	}
+	decorator.forgetAllExcept(lastAccesses)
+
+	if decorator.maxTotalSize != 0 && uint64(totalSize) > decorator.maxTotalSize {
+		sort.Slice(remaining, func(i, j int) bool {
+			return lastAccesses[remaining[i].Path].Before(lastAccesses[remaining[j].Path])
+		})
+		for _, blobInfo := range remaining {
+			if uint64(totalSize) <= decorator.maxTotalSize {
+				break
+			}
+			evicted = append(evicted, blobInfo)
+			totalSize -= blobInfo.Size
+		}
+	}
+	return
+}
+
+// lastAccessOf reads the last access from the sidecar object only when the delegate does not report
+// modification times. Entries without any access are recorded as accessed now, so that all instances
+// start their TTL at the same time.
+func (decorator *EvictingBlobstoreDecorator) lastAccessOf(entry bitsgo.BlobInfo, sidecars map[string]bitsgo.BlobInfo, now time.Time) time.Time {
+	lastAccess := entry.LastModified
+	if sidecar, hasSidecar := sidecars[entry.Path]; hasSidecar {
+		recordedAccess := sidecar.LastModified
+		if recordedAccess.IsZero() {
+			var e error
+			recordedAccess, e = decorator.readLastAccess(entry.Path)
+			if e != nil {
+				logger.Log.Errorw("Could not read last access. Considering the entry accessed now.", "resource-type", decorator.resourceType, "path", entry.Path, "error", e)
+				return now
+			}
+		}
+		if recordedAccess.After(lastAccess) {
+			lastAccess = recordedAccess
+		}
+	}
+	if lastAccess.IsZero() {
+		decorator.recordAccess(entry.Path, now)
+		return now
+	}
+	return lastAccess
+}
+
+func (decorator *EvictingBlobstoreDecorator) readLastAccess(path string) (time.Time, error) {
+	body, e := decorator.delegate.Get(path + lastAccessSuffix)
+	if e != nil {
+		return time.Time{}, e
+	}
+	defer body.Close()
+	content, e := ioutil.ReadAll(body)
+	if e != nil {
+		return time.Time{}, e
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content)))
+}
+
+// touch records the access, unless this instance already recorded one within lastAccessResolution.
+func (decorator *EvictingBlobstoreDecorator) touch(path string) {
+	now := decorator.clock.Now()
+	decorator.mutex.Lock()
+	recordedAccess, recorded := decorator.recordedAccesses[path]
+	decorator.mutex.Unlock()
+	if recorded && now.Sub(recordedAccess) < lastAccessResolution {
+		return
+	}
+	decorator.recordAccess(path, now)
+}
+
+// recordAccess does not fail the access itself, since a missing access only makes the entry's eviction more likely.
+func (decorator *EvictingBlobstoreDecorator) recordAccess(path string, now time.Time) {
+	e := decorator.delegate.Put(path+lastAccessSuffix, strings.NewReader(now.UTC().Format(time.RFC3339Nano)))
+	if e != nil {
+		logger.Log.Errorw("Could not record last access", "resource-type", decorator.resourceType, "path", path, "error", e)
+		return
+	}
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	decorator.recordedAccesses[path] = now
+}
+
+func (decorator *EvictingBlobstoreDecorator) forget(path string) {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	delete(decorator.recordedAccesses, path)
+}
+
+// forgetAllExcept only keeps the accesses of entries which still exist, so that recordedAccesses does not grow indefinitely.
+func (decorator *EvictingBlobstoreDecorator) forgetAllExcept(existing map[string]time.Time) {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	for path := range decorator.recordedAccesses {
+		if _, exists := existing[path]; !exists {
+			delete(decorator.recordedAccesses, path)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package decorator_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+func TestDecorator(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Blobstore Decorators")
+}
+
+type recordingMetricsService struct {
+	counters map[string]int64
+	gauges   map[string]int64
+}
+
+func newRecordingMetricsService() *recordingMetricsService {
+	return &recordingMetricsService{counters: make(map[string]int64), gauges: make(map[string]int64)}
+}
+
+func (service *recordingMetricsService) SendTimingMetric(name string, duration time.Duration) {}
+func (service *recordingMetricsService) SendGaugeMetric(name string, value int64) {
+	service.gauges[name] = value
+}
+func (service *recordingMetricsService) SendCounterMetric(name string, value int64) {
+	service.counters[name] += value
+}
+
+// modificationTimeRecordingBlobstore reports modification times in List like real blobstores do.
+type modificationTimeRecordingBlobstore struct {
+	*inmemory.Blobstore
+	clock             clock.Clock
+	modificationTimes map[string]time.Time
+}
+
+func (blobstore *modificationTimeRecordingBlobstore) Put(path string, src io.ReadSeeker) error {
+	blobstore.modificationTimes[path] = blobstore.clock.Now()
+	return blobstore.Blobstore.Put(path, src)
+}
+
+func (blobstore *modificationTimeRecordingBlobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos, e := blobstore.Blobstore.List(prefix)
+	for i := range blobInfos {
+		blobInfos[i].LastModified = blobstore.modificationTimes[blobInfos[i].Path]
+	}
+	return blobInfos, e
+}
+
+var _ = Describe("EvictingBlobstoreDecorator", func() {
+	var (
+		delegate       *inmemory.Blobstore
+		metricsService *recordingMetricsService
+		mockClock      *clock.Mock
+	)
+
+	BeforeEach(func() {
+		delegate = inmemory.NewBlobstore()
+		metricsService = newRecordingMetricsService()
+		mockClock = clock.NewMock()
+	})
+
+	It("evicts entries which have not been accessed within the TTL", func() {
+		blobstore := decorator.ForBlobstoreWithEviction(delegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock)
+		Expect(blobstore.Put("app-guid-1/stack", strings.NewReader("content"))).To(Succeed())
+		Expect(blobstore.Put("app-guid-2/stack", strings.NewReader("content"))).To(Succeed())
+
+		mockClock.Add(50 * time.Minute)
+		_, e := blobstore.Get("app-guid-2/stack")
+		Expect(e).NotTo(HaveOccurred())
+		mockClock.Add(20 * time.Minute)
+
+		Expect(blobstore.Sweep()).To(Succeed())
+
+		Expect(delegate.Exists("app-guid-1/stack")).To(BeFalse())
+		Expect(delegate.Exists("app-guid-2/stack")).To(BeTrue())
+		Expect(metricsService.counters["buildpack_cache-evicted_entries"]).To(BeEquivalentTo(1))
+		Expect(metricsService.counters["buildpack_cache-evicted_bytes"]).To(BeEquivalentTo(len("content")))
+	})
+
+	It("evicts the least recently used entries when the total size exceeds the maximum", func() {
+		blobstore := decorator.ForBlobstoreWithEviction(delegate, metricsService, "buildpack_cache", 0, 10, 0, mockClock)
+		Expect(blobstore.Put("app-guid-1/stack", strings.NewReader("12345"))).To(Succeed())
+		mockClock.Add(time.Minute)
+		Expect(blobstore.Put("app-guid-2/stack", strings.NewReader("12345"))).To(Succeed())
+		mockClock.Add(time.Minute)
+		Expect(blobstore.Exists("app-guid-1/stack")).To(BeTrue())
+		mockClock.Add(time.Minute)
+		Expect(blobstore.Put("app-guid-3/stack", strings.NewReader("12345"))).To(Succeed())
+
+		Expect(blobstore.Sweep()).To(Succeed())
+
+		Expect(delegate.Exists("app-guid-1/stack")).To(BeTrue())
+		Expect(delegate.Exists("app-guid-2/stack")).To(BeFalse())
+		Expect(delegate.Exists("app-guid-3/stack")).To(BeTrue())
+		Expect(metricsService.gauges["buildpack_cache-total_size"]).To(BeEquivalentTo(10))
+	})
+
+	It("evicts entries written through other instances based on their modification time", func() {
+		sharedDelegate := &modificationTimeRecordingBlobstore{Blobstore: delegate, clock: mockClock, modificationTimes: make(map[string]time.Time)}
+		otherInstance := decorator.ForBlobstoreWithEviction(sharedDelegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock)
+		Expect(otherInstance.Put("app-guid-1/stack", strings.NewReader("content"))).To(Succeed())
+		mockClock.Add(50 * time.Minute)
+		Expect(otherInstance.Put("app-guid-2/stack", strings.NewReader("content"))).To(Succeed())
+		mockClock.Add(20 * time.Minute)
+
+		Expect(decorator.ForBlobstoreWithEviction(sharedDelegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock).Sweep()).To(Succeed())
+
+		Expect(delegate.Exists("app-guid-1/stack")).To(BeFalse())
+		Expect(delegate.Exists("app-guid-2/stack")).To(BeTrue())
+	})
+
+	It("takes reads through other instances and before a restart into account", func() {
+		sharedDelegate := &modificationTimeRecordingBlobstore{Blobstore: delegate, clock: mockClock, modificationTimes: make(map[string]time.Time)}
+		sweepingInstance := decorator.ForBlobstoreWithEviction(sharedDelegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock)
+		Expect(sweepingInstance.Put("app-guid/stack", strings.NewReader("content"))).To(Succeed())
+		mockClock.Add(50 * time.Minute)
+		_, e := decorator.ForBlobstoreWithEviction(sharedDelegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock).Get("app-guid/stack")
+		Expect(e).NotTo(HaveOccurred())
+		mockClock.Add(20 * time.Minute)
+
+		restartedInstance := decorator.ForBlobstoreWithEviction(sharedDelegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock)
+		Expect(restartedInstance.Sweep()).To(Succeed())
+
+		Expect(delegate.Exists("app-guid/stack")).To(BeTrue())
+	})
+
+	It("does not list the recorded accesses and deletes them together with their entries", func() {
+		blobstore := decorator.ForBlobstoreWithEviction(delegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock)
+		Expect(blobstore.Put("app-guid/stack", strings.NewReader("content"))).To(Succeed())
+
+		Expect(blobstore.List("")).To(ConsistOf(bitsgo.BlobInfo{Path: "app-guid/stack", Size: int64(len("content"))}))
+
+		Expect(blobstore.Delete("app-guid/stack")).To(Succeed())
+		Expect(delegate.Entries).To(BeEmpty())
+	})
+
+	It("rejects entries larger than the maximum entry size", func() {
+		blobstore := decorator.ForBlobstoreWithEviction(delegate, metricsService, "buildpack_cache", 5, 0, 0, mockClock)
+
+		e := blobstore.Put("app-guid/stack", strings.NewReader("123456"))
+
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.EntityTooLargeError{}))
+		Expect(delegate.Exists("app-guid/stack")).To(BeFalse())
+		Expect(blobstore.Put("app-guid/stack", strings.NewReader("12345"))).To(Succeed())
+		Expect(delegate.Entries["app-guid/stack"]).To(Equal([]byte("12345")))
+	})
+
+	It("starts the TTL of entries without modification time when it first sees them", func() {
+		Expect(delegate.Put("app-guid/stack", strings.NewReader("content"))).To(Succeed())
+		blobstore := decorator.ForBlobstoreWithEviction(delegate, metricsService, "buildpack_cache", 0, 0, time.Hour, mockClock)
+
+		Expect(blobstore.Sweep()).To(Succeed())
+		Expect(delegate.Exists("app-guid/stack")).To(BeTrue())
+
+		mockClock.Add(2 * time.Hour)
+		Expect(blobstore.Sweep()).To(Succeed())
+		Expect(delegate.Exists("app-guid/stack")).To(BeFalse())
+	})
+
+	It("forgets entries removed with DeleteDir", func() {
+		blobstore := decorator.ForBlobstoreWithEviction(delegate, metricsService, "buildpack_cache", 0, 5, 0, mockClock)
+		Expect(blobstore.Put("app-guid-1/stack", strings.NewReader("12345"))).To(Succeed())
+		Expect(blobstore.DeleteDir("app-guid-1")).To(Succeed())
+		Expect(blobstore.Put("app-guid-2/stack", strings.NewReader("12345"))).To(Succeed())
+
+		Expect(blobstore.Sweep()).To(Succeed())
+
+		Expect(delegate.Exists("app-guid-2/stack")).To(BeTrue())
+	})
+})
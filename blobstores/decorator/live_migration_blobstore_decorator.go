@@ -0,0 +1,324 @@
+package decorator
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+// LiveMigrationBlobstoreDecorator allows switching a resource type to a new blobstore without downtime.
+// Writes go to the primary blobstore only. Reads fall back to the legacy blobstore and, if copyOnRead
+// is set, copy the blob into the primary blobstore. Deletes remove blobs from both. Drain moves all
+// remaining blobs from the legacy into the primary blobstore.
+//
+// Every bits-service instance copies blobs on its own, so a blob can be deleted by one instance while
+// another one copies it. To not bring back such a blob, a copy checks whether the blob still exists in
+// the legacy blobstore after writing it to the primary one and deletes the copy otherwise. Delete removes
+// the blob from the legacy blobstore first, so that this check sees every delete which could have missed
+// the copy. Drain only deletes a legacy blob in a later run than the one which found it in the primary
+// blobstore, so that concurrent copies do not mistake a drained blob for a deleted one.
+type LiveMigrationBlobstoreDecorator struct {
+	primary        bitsgo.Blobstore
+	legacy         bitsgo.Blobstore
+	copyOnRead     bool
+	metricsService bitsgo.MetricsService
+	resourceType   string
+	clock          clock.Clock
+	pathLocks      pathLocks
+
+	drainMutex sync.Mutex
+	// copiedPaths are the paths the previous run of Drain found in both blobstores.
+	copiedPaths map[string]bool
+}
+
+func ForBlobstoreWithLiveMigration(primary bitsgo.Blobstore, legacy bitsgo.Blobstore, copyOnRead bool, metricsService bitsgo.MetricsService, resourceType string, clock clock.Clock) *LiveMigrationBlobstoreDecorator {
+	return &LiveMigrationBlobstoreDecorator{
+		primary:        primary,
+		legacy:         legacy,
+		copyOnRead:     copyOnRead,
+		metricsService: metricsService,
+		resourceType:   resourceType,
+		clock:          clock,
+	}
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) Exists(path string) (bool, error) {
+	exists, e := decorator.primary.Exists(path)
+	if e != nil || exists {
+		return exists, e
+	}
+	return decorator.legacy.Exists(path)
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	body, e := decorator.primary.Get(path)
+	if !bitsgo.IsNotFoundError(e) {
+		return body, e
+	}
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-legacy_reads", 1)
+	if !decorator.copyOnRead {
+		return decorator.legacy.Get(path)
+	}
+	e = decorator.copyFromLegacy(path, path)
+	if e != nil {
+		decorator.logCopyOnReadError(path, e)
+		return decorator.legacy.Get(path)
+	}
+	return decorator.primary.Get(path)
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	body, redirectLocation, e := decorator.primary.GetOrRedirect(path)
+	if !bitsgo.IsNotFoundError(e) {
+		return body, redirectLocation, e
+	}
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-legacy_reads", 1)
+	if !decorator.copyOnRead {
+		return decorator.legacy.GetOrRedirect(path)
+	}
+	e = decorator.copyFromLegacy(path, path)
+	if e != nil {
+		decorator.logCopyOnReadError(path, e)
+		return decorator.legacy.GetOrRedirect(path)
+	}
+	return decorator.primary.GetOrRedirect(path)
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) logCopyOnReadError(path string, e error) {
+	if !bitsgo.IsNotFoundError(e) {
+		logger.Log.Errorw("Could not copy blob from legacy blobstore on read. Reading it from legacy blobstore instead.", "resource-type", decorator.resourceType, "path", path, "error", e)
+	}
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	return decorator.primary.Put(path, src)
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) Copy(src, dest string) error {
+	exists, e := decorator.primary.Exists(src)
+	if e != nil {
+		return e
+	}
+	if exists {
+		return decorator.primary.Copy(src, dest)
+	}
+	return decorator.copyFromLegacy(src, dest)
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) Delete(path string) error {
+	unlock := decorator.pathLocks.lock(path)
+	defer unlock()
+
+	legacyError := decorator.legacy.Delete(path)
+	if legacyError != nil && !bitsgo.IsNotFoundError(legacyError) {
+		return legacyError
+	}
+	primaryError := decorator.primary.Delete(path)
+	if primaryError != nil && !bitsgo.IsNotFoundError(primaryError) {
+		return primaryError
+	}
+	if primaryError != nil && legacyError != nil {
+		return primaryError
+	}
+	return nil
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) DeleteDir(prefix string) error {
+	e := decorator.primary.DeleteDir(prefix)
+	if e != nil {
+		return e
+	}
+	return decorator.legacy.DeleteDir(prefix)
+}
+
+// List returns the blobs of both blobstores. For blobs existing in both, the primary one is returned.
+func (decorator *LiveMigrationBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	primaryBlobInfos, e := decorator.primary.List(prefix)
+	if e != nil {
+		return nil, e
+	}
+	legacyBlobInfos, e := decorator.legacy.List(prefix)
+	if e != nil {
+		return nil, e
+	}
+	blobInfos := make(map[string]bitsgo.BlobInfo, len(primaryBlobInfos)+len(legacyBlobInfos))
+	for _, blobInfo := range legacyBlobInfos {
+		blobInfos[blobInfo.Path] = blobInfo
+	}
+	for _, blobInfo := range primaryBlobInfos {
+		blobInfos[blobInfo.Path] = blobInfo
+	}
+	result := make([]bitsgo.BlobInfo, 0, len(blobInfos))
+	for _, blobInfo := range blobInfos {
+		result = append(result, blobInfo)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// RegularlyDrain blocks and calls Drain in the given interval.
+func (decorator *LiveMigrationBlobstoreDecorator) RegularlyDrain(interval time.Duration) {
+	for range decorator.clock.Ticker(interval).C {
+		e := decorator.Drain()
+		if e != nil {
+			logger.Log.Errorw("Draining legacy blobstore failed", "resource-type", decorator.resourceType, "error", e)
+		}
+	}
+}
+
+// Drain copies all blobs from the legacy into the primary blobstore. Blobs which the previous run
+// already found in the primary blobstore are deleted from the legacy one.
+func (decorator *LiveMigrationBlobstoreDecorator) Drain() error {
+	decorator.drainMutex.Lock()
+	defer decorator.drainMutex.Unlock()
+
+	blobInfos, e := decorator.legacy.List("")
+	if e != nil {
+		return errors.Wrap(e, "Could not list legacy blobstore")
+	}
+	copiedPaths := make(map[string]bool)
+	var numDrained, numFailed int64
+	for _, blobInfo := range blobInfos {
+		drained, e := decorator.drain(blobInfo.Path)
+		if e != nil {
+			logger.Log.Errorw("Could not drain blob", "resource-type", decorator.resourceType, "path", blobInfo.Path, "error", e)
+			numFailed++
+			continue
+		}
+		if drained {
+			numDrained++
+		} else {
+			copiedPaths[blobInfo.Path] = true
+		}
+	}
+	decorator.copiedPaths = copiedPaths
+	logger.Log.Infow("Drained legacy blobstore", "resource-type", decorator.resourceType, "num-drained", numDrained, "num-failed", numFailed)
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-drained_blobs", numDrained)
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-legacy_blobs", int64(len(blobInfos))-numDrained)
+	return nil
+}
+
+// drain returns whether the blob was deleted from the legacy blobstore. Otherwise, it is in both blobstores now.
+func (decorator *LiveMigrationBlobstoreDecorator) drain(path string) (drained bool, err error) {
+	exists, e := decorator.primary.Exists(path)
+	if e != nil {
+		return false, e
+	}
+	if !exists {
+		e = decorator.copyFromLegacy(path, path)
+		if bitsgo.IsNotFoundError(e) {
+			// Deleted in the meantime. Nothing left to drain.
+			return true, nil
+		}
+		return false, e
+	}
+	if !decorator.copiedPaths[path] {
+		return false, nil
+	}
+	e = decorator.legacy.Delete(path)
+	if e != nil && !bitsgo.IsNotFoundError(e) {
+		return false, e
+	}
+	return true, nil
+}
+
+func (decorator *LiveMigrationBlobstoreDecorator) copyFromLegacy(src, dest string) error {
+	// Put requires an io.ReadSeeker, so we need to buffer the blob.
+	tempFile, e := ioutil.TempFile("", "bits-live-migration")
+	if e != nil {
+		return errors.Wrap(e, "Could not create temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	body, e := decorator.legacy.Get(src)
+	if e != nil {
+		return e
+	}
+	_, e = io.Copy(tempFile, body)
+	// The body is closed before the legacy blobstore is used again, because it can hold the only rate limiting slot.
+	body.Close()
+	if e != nil {
+		return errors.Wrapf(e, "Could not read %v from legacy blobstore", src)
+	}
+	_, e = tempFile.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrap(e, "Could not rewind temporary file")
+	}
+
+	unlock := decorator.pathLocks.lock(src)
+	defer unlock()
+	exists, e := decorator.legacy.Exists(src)
+	if e != nil {
+		return errors.Wrapf(e, "Could not check existence of %v in legacy blobstore", src)
+	}
+	if !exists {
+		return bitsgo.NewNotFoundErrorWithKey(src)
+	}
+	e = decorator.primary.Put(dest, tempFile)
+	if e != nil {
+		return errors.Wrapf(e, "Could not copy %v from legacy blobstore", src)
+	}
+	if src == dest {
+		// Another instance may have deleted the blob while we were writing it.
+		exists, e = decorator.legacy.Exists(src)
+		if e != nil {
+			return errors.Wrapf(e, "Could not check existence of %v in legacy blobstore", src)
+		}
+		if !exists {
+			e = decorator.primary.Delete(dest)
+			if e != nil && !bitsgo.IsNotFoundError(e) {
+				return errors.Wrapf(e, "Could not delete %v, which was deleted while copying it from legacy blobstore", dest)
+			}
+			return bitsgo.NewNotFoundErrorWithKey(src)
+		}
+	}
+	decorator.metricsService.SendCounterMetric(decorator.resourceType+"-copied_from_legacy", 1)
+	return nil
+}
+
+// pathLocks serializes operations on the same path, while operations on different paths run concurrently.
+// The zero value is ready to use.
+type pathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	numUsers int
+}
+
+func (locks *pathLocks) lock(path string) (unlock func()) {
+	locks.mutex.Lock()
+	if locks.locks == nil {
+		locks.locks = make(map[string]*pathLock)
+	}
+	lock, exists := locks.locks[path]
+	if !exists {
+		lock = &pathLock{}
+		locks.locks[path] = lock
+	}
+	lock.numUsers++
+	locks.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		locks.mutex.Lock()
+		defer locks.mutex.Unlock()
+		lock.numUsers--
+		if lock.numUsers == 0 {
+			delete(locks.locks, path)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package decorator_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/benbjohnson/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+type failingPutBlobstore struct {
+	*inmemory.Blobstore
+}
+
+func (blobstore *failingPutBlobstore) Put(path string, src io.ReadSeeker) error {
+	return errors.New("some put error")
+}
+
+// deletingDuringGetBlobstore runs onGet after returning the body, i.e. while the caller is still reading it.
+type deletingDuringGetBlobstore struct {
+	*inmemory.Blobstore
+	onGet func(path string)
+}
+
+func (blobstore *deletingDuringGetBlobstore) Get(path string) (io.ReadCloser, error) {
+	body, e := blobstore.Blobstore.Get(path)
+	if e == nil {
+		blobstore.onGet(path)
+	}
+	return body, e
+}
+
+// deletingDuringPutBlobstore runs onPut once, before storing the first blob.
+type deletingDuringPutBlobstore struct {
+	*inmemory.Blobstore
+	onPut func(path string)
+}
+
+func (blobstore *deletingDuringPutBlobstore) Put(path string, src io.ReadSeeker) error {
+	if blobstore.onPut != nil {
+		onPut := blobstore.onPut
+		blobstore.onPut = nil
+		onPut(path)
+	}
+	return blobstore.Blobstore.Put(path, src)
+}
+
+var _ = Describe("LiveMigrationBlobstoreDecorator", func() {
+	var (
+		primary        *inmemory.Blobstore
+		legacy         *inmemory.Blobstore
+		metricsService *recordingMetricsService
+	)
+
+	BeforeEach(func() {
+		primary = inmemory.NewBlobstore()
+		legacy = inmemory.NewBlobstore()
+		metricsService = newRecordingMetricsService()
+		Expect(legacy.Put("legacy-guid", strings.NewReader("legacy content"))).To(Succeed())
+	})
+
+	It("writes to the primary blobstore only", func() {
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacy, false, metricsService, "packages", clock.NewMock())
+
+		Expect(blobstore.Put("new-guid", strings.NewReader("new content"))).To(Succeed())
+
+		Expect(primary.Entries).To(HaveKey("new-guid"))
+		Expect(legacy.Entries).NotTo(HaveKey("new-guid"))
+	})
+
+	It("falls back to the legacy blobstore on reads", func() {
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacy, false, metricsService, "packages", clock.NewMock())
+
+		Expect(blobstore.Exists("legacy-guid")).To(BeTrue())
+		body, e := blobstore.Get("legacy-guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(MatchRegexp("legacy content"))
+		Expect(primary.Entries).NotTo(HaveKey("legacy-guid"))
+		Expect(metricsService.counters["packages-legacy_reads"]).To(BeEquivalentTo(1))
+
+		_, e = blobstore.Get("non-existing")
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+	})
+
+	It("copies blobs into the primary blobstore on read when copyOnRead is set", func() {
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacy, true, metricsService, "packages", clock.NewMock())
+
+		body, e := blobstore.Get("legacy-guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(MatchRegexp("legacy content"))
+		Expect(primary.Entries).To(HaveKeyWithValue("legacy-guid", []byte("legacy content")))
+	})
+
+	It("reads from the legacy blobstore when copying on read fails", func() {
+		blobstore := decorator.ForBlobstoreWithLiveMigration(&failingPutBlobstore{primary}, legacy, true, metricsService, "packages", clock.NewMock())
+
+		body, e := blobstore.Get("legacy-guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(MatchRegexp("legacy content"))
+	})
+
+	It("copies blobs from a legacy blobstore which allows only one request in flight", func() {
+		rateLimitedLegacy := decorator.ForBlobstoreWithRateLimit(legacy, 1, 0, 0, metricsService, "packages")
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, rateLimitedLegacy, true, metricsService, "packages", clock.NewMock())
+
+		done := make(chan error)
+		go func() {
+			body, e := blobstore.Get("legacy-guid")
+			if e == nil {
+				body.Close()
+			}
+			done <- e
+		}()
+
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(primary.Entries).To(HaveKeyWithValue("legacy-guid", []byte("legacy content")))
+	})
+
+	It("does not bring back a blob deleted while it is being drained", func() {
+		legacyDeletingDuringGet := &deletingDuringGetBlobstore{Blobstore: legacy}
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacyDeletingDuringGet, false, metricsService, "packages", clock.NewMock())
+		legacyDeletingDuringGet.onGet = func(path string) { Expect(blobstore.Delete(path)).To(Succeed()) }
+
+		Expect(blobstore.Drain()).To(Succeed())
+
+		Expect(primary.Entries).NotTo(HaveKey("legacy-guid"))
+		Expect(legacy.Entries).NotTo(HaveKey("legacy-guid"))
+	})
+
+	It("deletes from both blobstores", func() {
+		Expect(primary.Put("legacy-guid", strings.NewReader("migrated content"))).To(Succeed())
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacy, false, metricsService, "packages", clock.NewMock())
+
+		Expect(blobstore.Delete("legacy-guid")).To(Succeed())
+
+		Expect(primary.Entries).NotTo(HaveKey("legacy-guid"))
+		Expect(legacy.Entries).NotTo(HaveKey("legacy-guid"))
+		Expect(blobstore.Delete("legacy-guid")).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+	})
+
+	It("copies from the legacy blobstore when the source of a copy only exists there", func() {
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacy, false, metricsService, "packages", clock.NewMock())
+
+		Expect(blobstore.Copy("legacy-guid", "copied-guid")).To(Succeed())
+
+		Expect(primary.Entries).To(HaveKeyWithValue("copied-guid", []byte("legacy content")))
+	})
+
+	It("drains the legacy blobstore", func() {
+		Expect(legacy.Put("other-legacy-guid", strings.NewReader("other legacy content"))).To(Succeed())
+		Expect(primary.Put("other-legacy-guid", strings.NewReader("newer content"))).To(Succeed())
+		blobstore := decorator.ForBlobstoreWithLiveMigration(primary, legacy, false, metricsService, "packages", clock.NewMock())
+
+		Expect(blobstore.Drain()).To(Succeed())
+
+		Expect(primary.Entries).To(HaveKeyWithValue("legacy-guid", []byte("legacy content")))
+		Expect(primary.Entries).To(HaveKeyWithValue("other-legacy-guid", []byte("newer content")))
+		Expect(legacy.Entries).To(HaveLen(2))
+
+		Expect(blobstore.Drain()).To(Succeed())
+
+		Expect(legacy.Entries).To(BeEmpty())
+		Expect(primary.Entries).To(HaveKeyWithValue("legacy-guid", []byte("legacy content")))
+		Expect(primary.Entries).To(HaveKeyWithValue("other-legacy-guid", []byte("newer content")))
+		Expect(metricsService.counters["packages-drained_blobs"]).To(BeEquivalentTo(2))
+	})
+
+	Context("multiple instances", func() {
+		It("does not bring back a blob deleted by another instance while copying it", func() {
+			primaryDeletingDuringPut := &deletingDuringPutBlobstore{Blobstore: primary}
+			copyingInstance := decorator.ForBlobstoreWithLiveMigration(primaryDeletingDuringPut, legacy, true, metricsService, "packages", clock.NewMock())
+			deletingInstance := decorator.ForBlobstoreWithLiveMigration(primary, legacy, true, metricsService, "packages", clock.NewMock())
+			primaryDeletingDuringPut.onPut = func(path string) { Expect(deletingInstance.Delete(path)).To(Succeed()) }
+
+			_, e := copyingInstance.Get("legacy-guid")
+
+			Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+			Expect(primary.Entries).NotTo(HaveKey("legacy-guid"))
+			Expect(legacy.Entries).NotTo(HaveKey("legacy-guid"))
+		})
+
+		It("does not delete a blob another instance copied while draining it", func() {
+			primaryDrainingDuringPut := &deletingDuringPutBlobstore{Blobstore: primary}
+			copyingInstance := decorator.ForBlobstoreWithLiveMigration(primaryDrainingDuringPut, legacy, true, metricsService, "packages", clock.NewMock())
+			drainingInstance := decorator.ForBlobstoreWithLiveMigration(primary, legacy, true, metricsService, "packages", clock.NewMock())
+			primaryDrainingDuringPut.onPut = func(path string) { Expect(drainingInstance.Drain()).To(Succeed()) }
+
+			body, e := copyingInstance.Get("legacy-guid")
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(body)).To(Equal([]byte("legacy content")))
+			Expect(primary.Entries).To(HaveKeyWithValue("legacy-guid", []byte("legacy content")))
+			Expect(legacy.Entries).To(HaveKey("legacy-guid"))
+		})
+	})
+})
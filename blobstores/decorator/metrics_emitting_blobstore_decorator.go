@@ -53,6 +53,13 @@ func (decorator *MetricsEmittingBlobstoreDecorator) Delete(path string) error {
 	return e
 }
 
+func (decorator *MetricsEmittingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	startTime := time.Now()
+	blobInfos, e := decorator.delegate.List(prefix)
+	decorator.metricsService.SendTimingMetric(decorator.resourceType+"-list_in_blobstore-time", time.Since(startTime))
+	return blobInfos, e
+}
+
 func (decorator *MetricsEmittingBlobstoreDecorator) DeleteDir(prefix string) error {
 	startTime := time.Now()
 	e := decorator.delegate.DeleteDir(prefix)
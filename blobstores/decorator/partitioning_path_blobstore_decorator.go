@@ -3,6 +3,7 @@ package decorator
 import (
 	"fmt"
 	"io"
+	"strings"
 
 	"time"
 
@@ -49,6 +50,45 @@ func (decorator *PartitioningPathBlobstoreDecorator) DeleteDir(prefix string) er
 	}
 }
 
+// List also returns only blobs whose paths are partitioned. That way, blobs of other resource types
+// sharing the same blobstore under a different path prefix are not included.
+func (decorator *PartitioningPathBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos, e := decorator.delegate.List(partitionedPrefixFor(prefix))
+	if e != nil {
+		return nil, e
+	}
+	result := make([]bitsgo.BlobInfo, 0, len(blobInfos))
+	for _, blobInfo := range blobInfos {
+		identifier, isPartitioned := identifierFor(blobInfo.Path)
+		if isPartitioned && strings.HasPrefix(identifier, prefix) {
+			blobInfo.Path = identifier
+			result = append(result, blobInfo)
+		}
+	}
+	return result, nil
+}
+
+func partitionedPrefixFor(prefix string) string {
+	switch {
+	case len(prefix) >= 4:
+		return pathFor(prefix)
+	case len(prefix) == 3:
+		return fmt.Sprintf("%s/%s", prefix[0:2], prefix[2:3])
+	default:
+		return prefix
+	}
+}
+
+func identifierFor(path string) (identifier string, isPartitioned bool) {
+	if parts := strings.SplitN(path, "/", 3); len(parts) == 3 && pathFor(parts[2]) == path {
+		return parts[2], true
+	}
+	if parts := strings.SplitN(path, "/", 2); len(parts) == 2 && pathFor(parts[1]) == path {
+		return parts[1], true
+	}
+	return "", false
+}
+
 func pathFor(identifier string) string {
 	if len(identifier) >= 4 {
 		return fmt.Sprintf("%s/%s/%s", identifier[0:2], identifier[2:4], identifier)
@@ -70,6 +110,6 @@ type PartitioningPathResourceSigner struct {
 	delegate bitsgo.ResourceSigner
 }
 
-func (signer *PartitioningPathResourceSigner) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
+func (signer *PartitioningPathResourceSigner) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
 	return signer.delegate.Sign(pathFor(resource), method, expirationTime)
 }
@@ -2,6 +2,7 @@ package decorator
 
 import (
 	"io"
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry-incubator/bits-service"
@@ -44,6 +45,17 @@ func (decorator *PrefixingPathBlobstoreDecorator) DeleteDir(prefix string) error
 	return decorator.delegate.DeleteDir(decorator.prefix + prefix)
 }
 
+func (decorator *PrefixingPathBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos, e := decorator.delegate.List(decorator.prefix + prefix)
+	if e != nil {
+		return nil, e
+	}
+	for i := range blobInfos {
+		blobInfos[i].Path = strings.TrimPrefix(blobInfos[i].Path, decorator.prefix)
+	}
+	return blobInfos, nil
+}
+
 type PrefixingPathResourceSigner struct {
 	delegate bitsgo.ResourceSigner
 	prefix   string
@@ -53,6 +65,6 @@ func ForResourceSignerWithPathPrefixing(delegate bitsgo.ResourceSigner, prefix s
 	return &PrefixingPathResourceSigner{delegate, prefix}
 }
 
-func (signer *PrefixingPathResourceSigner) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
+func (signer *PrefixingPathResourceSigner) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
 	return signer.delegate.Sign(signer.prefix+resource, method, expirationTime)
 }
@@ -0,0 +1,131 @@
+package decorator
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitingBlobstoreDecorator limits the number of operations in flight against the delegate and optionally
+// the number of operations started per second. Operations exceeding these limits are queued until they can proceed.
+// A Get holds its slot until its body is closed, because the connection to the backend is in use until then.
+type RateLimitingBlobstoreDecorator struct {
+	delegate       bitsgo.Blobstore
+	inFlight       *semaphore.Weighted
+	limiter        *rate.Limiter
+	metricsService bitsgo.MetricsService
+	resourceType   string
+	queueLength    int64
+}
+
+// ForBlobstoreWithRateLimit creates a RateLimitingBlobstoreDecorator. maxInFlight or requestsPerSecond set to 0
+// disable the respective limit. burst is the number of operations which may be started at once without
+// regard to requestsPerSecond and defaults to 1.
+func ForBlobstoreWithRateLimit(delegate bitsgo.Blobstore, maxInFlight int64, requestsPerSecond float64, burst int, metricsService bitsgo.MetricsService, resourceType string) *RateLimitingBlobstoreDecorator {
+	decorator := &RateLimitingBlobstoreDecorator{
+		delegate:       delegate,
+		metricsService: metricsService,
+		resourceType:   resourceType,
+	}
+	if maxInFlight > 0 {
+		decorator.inFlight = semaphore.NewWeighted(maxInFlight)
+	}
+	if requestsPerSecond > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		decorator.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	}
+	return decorator
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) Exists(path string) (bool, error) {
+	defer decorator.acquire()()
+	return decorator.delegate.Exists(path)
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	release := decorator.acquire()
+	body, e := decorator.delegate.Get(path)
+	if e != nil {
+		release()
+		return nil, e
+	}
+	return &releasingReadCloser{ReadCloser: body, release: release}, nil
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	release := decorator.acquire()
+	body, redirectLocation, e := decorator.delegate.GetOrRedirect(path)
+	if e != nil || body == nil {
+		release()
+		return body, redirectLocation, e
+	}
+	return &releasingReadCloser{ReadCloser: body, release: release}, redirectLocation, nil
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	defer decorator.acquire()()
+	return decorator.delegate.Put(path, src)
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) Copy(src, dest string) error {
+	defer decorator.acquire()()
+	return decorator.delegate.Copy(src, dest)
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) Delete(path string) error {
+	defer decorator.acquire()()
+	return decorator.delegate.Delete(path)
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) DeleteDir(prefix string) error {
+	defer decorator.acquire()()
+	return decorator.delegate.DeleteDir(prefix)
+}
+
+func (decorator *RateLimitingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	defer decorator.acquire()()
+	return decorator.delegate.List(prefix)
+}
+
+// acquire blocks until the operation may proceed and returns a function which must be called when it has finished.
+func (decorator *RateLimitingBlobstoreDecorator) acquire() (release func()) {
+	startTime := time.Now()
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-blobstore_queue_length", atomic.AddInt64(&decorator.queueLength, 1))
+	if decorator.inFlight != nil {
+		// Acquire only fails when the context is done.
+		decorator.inFlight.Acquire(context.Background(), 1)
+	}
+	if decorator.limiter != nil {
+		// Wait only fails when the context is done or the burst is smaller than 1.
+		decorator.limiter.Wait(context.Background())
+	}
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-blobstore_queue_length", atomic.AddInt64(&decorator.queueLength, -1))
+	decorator.metricsService.SendTimingMetric(decorator.resourceType+"-blobstore_queue-time", time.Since(startTime))
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if decorator.inFlight != nil {
+				decorator.inFlight.Release(1)
+			}
+		})
+	}
+}
+
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body *releasingReadCloser) Close() error {
+	defer body.release()
+	return body.ReadCloser.Close()
+}
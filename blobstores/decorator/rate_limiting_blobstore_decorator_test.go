@@ -0,0 +1,111 @@
+package decorator_test
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+type blockingBlobstore struct {
+	*inmemory.Blobstore
+	unblock  chan struct{}
+	inFlight int64
+}
+
+func (blobstore *blockingBlobstore) Put(path string, src io.ReadSeeker) error {
+	atomic.AddInt64(&blobstore.inFlight, 1)
+	defer atomic.AddInt64(&blobstore.inFlight, -1)
+	<-blobstore.unblock
+	return nil
+}
+
+var _ = Describe("RateLimitingBlobstoreDecorator", func() {
+	var metricsService *recordingMetricsService
+
+	BeforeEach(func() {
+		metricsService = newRecordingMetricsService()
+	})
+
+	It("limits the number of operations in flight", func() {
+		delegate := &blockingBlobstore{Blobstore: inmemory.NewBlobstore(), unblock: make(chan struct{})}
+		blobstore := decorator.ForBlobstoreWithRateLimit(delegate, 2, 0, 0, &nullMetricsService{}, "droplets")
+
+		done := make(chan error)
+		for i := 0; i < 3; i++ {
+			go func() { done <- blobstore.Put("guid", strings.NewReader("content")) }()
+		}
+
+		Eventually(func() int64 { return atomic.LoadInt64(&delegate.inFlight) }).Should(BeEquivalentTo(2))
+		Consistently(func() int64 { return atomic.LoadInt64(&delegate.inFlight) }).Should(BeEquivalentTo(2))
+
+		close(delegate.unblock)
+		for i := 0; i < 3; i++ {
+			Eventually(done).Should(Receive(BeNil()))
+		}
+	})
+
+	It("releases the slot of a Get when its body is closed", func() {
+		delegate := inmemory.NewBlobstore()
+		Expect(delegate.Put("guid", strings.NewReader("content"))).To(Succeed())
+		blobstore := decorator.ForBlobstoreWithRateLimit(delegate, 1, 0, 0, metricsService, "droplets")
+
+		body, e := blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		existsDone := make(chan bool)
+		go func() {
+			exists, _ := blobstore.Exists("guid")
+			existsDone <- exists
+		}()
+		Consistently(existsDone).ShouldNot(Receive())
+
+		Expect(body.Close()).To(Succeed())
+		Eventually(existsDone).Should(Receive(BeTrue()))
+	})
+
+	It("does not block verifying checksums with a single slot", func() {
+		delegate := decorator.ForBlobstoreWithRateLimit(inmemory.NewBlobstore(), 1, 0, 0, metricsService, "droplets")
+		blobstore := decorator.ForBlobstoreWithChecksumVerification(delegate, metricsService, "droplets")
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		content := make(chan string)
+		go func() {
+			defer GinkgoRecover()
+			body, e := blobstore.Get("guid")
+			Expect(e).NotTo(HaveOccurred())
+			defer body.Close()
+			c, e := ioutil.ReadAll(body)
+			Expect(e).NotTo(HaveOccurred())
+			content <- string(c)
+		}()
+
+		Eventually(content).Should(Receive(Equal("content")))
+	})
+
+	It("limits the number of requests per second", func() {
+		delegate := inmemory.NewBlobstore()
+		blobstore := decorator.ForBlobstoreWithRateLimit(delegate, 0, 20, 1, metricsService, "droplets")
+
+		startTime := time.Now()
+		for i := 0; i < 5; i++ {
+			_, e := blobstore.Exists("guid")
+			Expect(e).NotTo(HaveOccurred())
+		}
+
+		Expect(time.Since(startTime)).To(BeNumerically(">=", 180*time.Millisecond))
+		Expect(metricsService.gauges["droplets-blobstore_queue_length"]).To(BeZero())
+	})
+})
+
+type nullMetricsService struct{}
+
+func (service *nullMetricsService) SendTimingMetric(name string, duration time.Duration) {}
+func (service *nullMetricsService) SendGaugeMetric(name string, value int64)             {}
+func (service *nullMetricsService) SendCounterMetric(name string, value int64)           {}
@@ -0,0 +1,510 @@
+package decorator
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+// unhealthyReplicaBackoff is the time a replica is skipped for reads after an error.
+const unhealthyReplicaBackoff = 30 * time.Second
+
+// repairMarkerPrefix is the prefix of the marker blobs "<prefix><replica>/<path>", which record that
+// replica missed a write or delete of path.
+const repairMarkerPrefix = "_replication_repairs/"
+
+// dirRepairMarkerPrefix is the prefix of the marker blobs "<prefix><replica>/<dir><dirRepairMarkerSuffix>",
+// which record that replica missed a DeleteDir of dir.
+const dirRepairMarkerPrefix = "_replication_dir_repairs/"
+
+const dirRepairMarkerSuffix = ".deleted-dir"
+
+// ReplicatingBlobstoreDecorator writes every blob to all of its replicas in parallel and succeeds when
+// at least writeQuorum of them succeeded. For replicas which missed a write or delete, a repair marker
+// is stored in the replicas which succeeded, so that pending repairs survive restarts. Repair processes
+// these markers. Reads are served by the first healthy replica that has the blob, unless a replica which
+// does not have it holds a marker recording that the blob was deleted while the serving replica missed it.
+type ReplicatingBlobstoreDecorator struct {
+	replicas       []bitsgo.Blobstore
+	writeQuorum    int
+	metricsService bitsgo.MetricsService
+	resourceType   string
+	clock          clock.Clock
+
+	mutex          sync.Mutex
+	unhealthySince []time.Time
+}
+
+// ForBlobstoreWithReplication creates a ReplicatingBlobstoreDecorator. The order of replicas is the
+// order in which they are used for reads.
+func ForBlobstoreWithReplication(replicas []bitsgo.Blobstore, writeQuorum int, metricsService bitsgo.MetricsService, resourceType string, clock clock.Clock) *ReplicatingBlobstoreDecorator {
+	return &ReplicatingBlobstoreDecorator{
+		replicas:       replicas,
+		writeQuorum:    writeQuorum,
+		metricsService: metricsService,
+		resourceType:   resourceType,
+		clock:          clock,
+		unhealthySince: make([]time.Time, len(replicas)),
+	}
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) Exists(path string) (exists bool, err error) {
+	e := decorator.read(path, func(replica bitsgo.Blobstore) error {
+		var e error
+		exists, e = replica.Exists(path)
+		if e == nil && !exists {
+			return bitsgo.NewNotFoundErrorWithKey(path)
+		}
+		return e
+	})
+	if bitsgo.IsNotFoundError(e) {
+		return false, nil
+	}
+	return exists, e
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	err = decorator.read(path, func(replica bitsgo.Blobstore) error {
+		var e error
+		body, e = replica.Get(path)
+		return e
+	})
+	return
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	err = decorator.read(path, func(replica bitsgo.Blobstore) error {
+		var e error
+		body, redirectLocation, e = replica.GetOrRedirect(path)
+		return e
+	})
+	return
+}
+
+// read calls readFrom for the healthy replicas in order until one succeeds. Replicas returning an error
+// other than *NotFoundError are marked as unhealthy. When all healthy replicas fail, unhealthy ones are tried as well.
+// Once a replica did not find path, replicas which missed a delete of path are skipped. path is empty for reads
+// which are not about a single blob.
+func (decorator *ReplicatingBlobstoreDecorator) read(path string, readFrom func(replica bitsgo.Blobstore) error) error {
+	var healthy, unhealthy []int
+	for i := range decorator.replicas {
+		if decorator.isHealthy(i) {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	var (
+		firstError error
+		notFoundIn []int
+	)
+	for _, i := range append(healthy, unhealthy...) {
+		if path != "" && decorator.missedDelete(i, path, notFoundIn) {
+			continue
+		}
+		e := readFrom(decorator.replicas[i])
+		if e == nil {
+			decorator.markHealthy(i)
+			return nil
+		}
+		if bitsgo.IsNotFoundError(e) {
+			notFoundIn = append(notFoundIn, i)
+		} else {
+			decorator.markUnhealthy(i, e)
+		}
+		if firstError == nil || (bitsgo.IsNotFoundError(firstError) && !bitsgo.IsNotFoundError(e)) {
+			firstError = e
+		}
+	}
+	return firstError
+}
+
+// missedDelete returns whether one of holders has a marker recording that replica missed a Delete or DeleteDir of path.
+// When the markers cannot be read, the replica is assumed to be up to date.
+func (decorator *ReplicatingBlobstoreDecorator) missedDelete(replica int, path string, holders []int) bool {
+	for _, i := range holders {
+		exists, e := decorator.replicas[i].Exists(repairMarkerFor(replica, path))
+		if e != nil {
+			logger.Log.Errorw("Could not check for repair marker", "resource-type", decorator.resourceType, "replica", i, "path", path, "error", e)
+			continue
+		}
+		if exists {
+			return true
+		}
+		markers, e := decorator.replicas[i].List(dirRepairMarkerPrefix + strconv.Itoa(replica) + "/")
+		if e != nil {
+			logger.Log.Errorw("Could not list directory repair markers", "resource-type", decorator.resourceType, "replica", i, "path", path, "error", e)
+			continue
+		}
+		for _, marker := range markers {
+			markedReplica, prefix, ok := parseDirRepairMarker(marker.Path)
+			if ok && markedReplica == replica && strings.HasPrefix(path, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	// Every replica needs its own reader, because the replicas are written to in parallel.
+	readerAt, ok := src.(io.ReaderAt)
+	if !ok {
+		tempFile, e := ioutil.TempFile("", "bits-replication")
+		if e != nil {
+			return errors.Wrap(e, "Could not create temporary file")
+		}
+		defer os.Remove(tempFile.Name())
+		defer tempFile.Close()
+		_, e = src.Seek(0, io.SeekStart)
+		if e != nil {
+			return errors.Wrapf(e, "Could not rewind %v", path)
+		}
+		_, e = io.Copy(tempFile, src)
+		if e != nil {
+			return errors.Wrapf(e, "Could not read %v", path)
+		}
+		readerAt = tempFile
+		src = tempFile
+	}
+	size, e := src.Seek(0, io.SeekEnd)
+	if e != nil {
+		return errors.Wrapf(e, "Could not determine size of %v", path)
+	}
+	return decorator.write(path, func(replica bitsgo.Blobstore) error {
+		return replica.Put(path, io.NewSectionReader(readerAt, 0, size))
+	})
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) Copy(src, dest string) error {
+	return decorator.write(dest, func(replica bitsgo.Blobstore) error {
+		return replica.Copy(src, dest)
+	})
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) Delete(path string) error {
+	var (
+		mutex       sync.Mutex
+		numNotFound int
+	)
+	e := decorator.write(path, func(replica bitsgo.Blobstore) error {
+		e := replica.Delete(path)
+		if bitsgo.IsNotFoundError(e) {
+			mutex.Lock()
+			numNotFound++
+			mutex.Unlock()
+			return nil
+		}
+		return e
+	})
+	if e == nil && numNotFound == len(decorator.replicas) {
+		return bitsgo.NewNotFoundErrorWithKey(path)
+	}
+	return e
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) DeleteDir(prefix string) error {
+	errs := decorator.inParallel(func(replica bitsgo.Blobstore) error {
+		return replica.DeleteDir(prefix)
+	})
+	var (
+		failed, succeeded []int
+		firstError        error
+	)
+	for i, e := range errs {
+		if e != nil {
+			logger.Log.Errorw("DeleteDir on replica failed", "resource-type", decorator.resourceType, "replica", i, "prefix", prefix, "error", e)
+			decorator.metricsService.SendCounterMetric(decorator.resourceType+"-replication_failures", 1)
+			decorator.markUnhealthy(i, e)
+			failed = append(failed, i)
+			if firstError == nil {
+				firstError = e
+			}
+			continue
+		}
+		succeeded = append(succeeded, i)
+	}
+	if len(succeeded) < decorator.writeQuorum {
+		return errors.Wrapf(firstError, "Could not delete %v from enough replicas (%v of %v required)", prefix, len(succeeded), decorator.writeQuorum)
+	}
+	for _, i := range failed {
+		decorator.storeRepairMarker(dirRepairMarkerFor(i, prefix), succeeded)
+	}
+	return nil
+}
+
+// List does not return repair markers.
+func (decorator *ReplicatingBlobstoreDecorator) List(prefix string) (blobInfos []bitsgo.BlobInfo, err error) {
+	err = decorator.read("", func(replica bitsgo.Blobstore) error {
+		var e error
+		blobInfos, e = replica.List(prefix)
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]bitsgo.BlobInfo, 0, len(blobInfos))
+	for _, blobInfo := range blobInfos {
+		if !isRepairMarker(blobInfo.Path) {
+			result = append(result, blobInfo)
+		}
+	}
+	return result, nil
+}
+
+func isRepairMarker(path string) bool {
+	return strings.HasPrefix(path, repairMarkerPrefix) || strings.HasPrefix(path, dirRepairMarkerPrefix)
+}
+
+// inParallel calls do for all replicas concurrently and returns the errors in the order of the replicas.
+func (decorator *ReplicatingBlobstoreDecorator) inParallel(do func(replica bitsgo.Blobstore) error) []error {
+	errs := make([]error, len(decorator.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range decorator.replicas {
+		wg.Add(1)
+		go func(i int, replica bitsgo.Blobstore) {
+			defer wg.Done()
+			errs[i] = do(replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return errs
+}
+
+// write calls writeTo for all replicas in parallel. For replicas for which it fails, repair markers are stored.
+func (decorator *ReplicatingBlobstoreDecorator) write(path string, writeTo func(replica bitsgo.Blobstore) error) error {
+	var (
+		failed, succeeded []int
+		firstError        error
+	)
+	for i, e := range decorator.inParallel(writeTo) {
+		if e != nil {
+			logger.Log.Errorw("Write to replica failed", "resource-type", decorator.resourceType, "replica", i, "path", path, "error", e)
+			decorator.metricsService.SendCounterMetric(decorator.resourceType+"-replication_failures", 1)
+			decorator.markUnhealthy(i, e)
+			failed = append(failed, i)
+			if firstError == nil {
+				firstError = e
+			}
+			continue
+		}
+		succeeded = append(succeeded, i)
+	}
+	if len(succeeded) < decorator.writeQuorum {
+		return errors.Wrapf(firstError, "Could not write %v to enough replicas (%v of %v required)", path, len(succeeded), decorator.writeQuorum)
+	}
+	for _, i := range failed {
+		decorator.storeRepairMarker(repairMarkerFor(i, path), succeeded)
+	}
+	return nil
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) storeRepairMarker(marker string, replicas []int) {
+	numStored := 0
+	for _, i := range replicas {
+		e := decorator.replicas[i].Put(marker, bytes.NewReader(nil))
+		if e != nil {
+			logger.Log.Errorw("Could not store repair marker", "resource-type", decorator.resourceType, "replica", i, "marker", marker, "error", e)
+			continue
+		}
+		numStored++
+	}
+	if numStored == 0 {
+		logger.Log.Errorw("Repair marker could not be stored in any replica. Replica will not be repaired.", "resource-type", decorator.resourceType, "marker", marker)
+	}
+}
+
+func repairMarkerFor(replica int, path string) string {
+	return repairMarkerPrefix + strconv.Itoa(replica) + "/" + path
+}
+
+func dirRepairMarkerFor(replica int, prefix string) string {
+	return dirRepairMarkerPrefix + strconv.Itoa(replica) + "/" + prefix + dirRepairMarkerSuffix
+}
+
+func parseRepairMarker(marker string) (replica int, path string, ok bool) {
+	return parseMarker(repairMarkerPrefix, marker)
+}
+
+func parseDirRepairMarker(marker string) (replica int, prefix string, ok bool) {
+	if !strings.HasSuffix(marker, dirRepairMarkerSuffix) {
+		return 0, "", false
+	}
+	return parseMarker(dirRepairMarkerPrefix, strings.TrimSuffix(marker, dirRepairMarkerSuffix))
+}
+
+func parseMarker(markerPrefix string, marker string) (replica int, path string, ok bool) {
+	if !strings.HasPrefix(marker, markerPrefix) {
+		return 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(marker, markerPrefix), "/", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	replica, e := strconv.Atoi(parts[0])
+	if e != nil {
+		return 0, "", false
+	}
+	return replica, parts[1], true
+}
+
+// RegularlyRepair blocks and calls Repair in the given interval.
+func (decorator *ReplicatingBlobstoreDecorator) RegularlyRepair(interval time.Duration) {
+	for range decorator.clock.Ticker(interval).C {
+		decorator.Repair()
+	}
+}
+
+// Repair processes the repair markers of all replicas. A repair makes the replica which missed a write
+// or delete match the replicas holding the marker: If one of them has the blob, it is copied into the
+// replica, otherwise the blob is deleted from it. For a missed DeleteDir, all blobs in the directory which
+// none of the replicas holding the marker has are deleted. Markers are only removed after a successful repair.
+func (decorator *ReplicatingBlobstoreDecorator) Repair() {
+	markerHolders := map[string][]int{}
+	for i, replica := range decorator.replicas {
+		for _, markerPrefix := range []string{repairMarkerPrefix, dirRepairMarkerPrefix} {
+			blobInfos, e := replica.List(markerPrefix)
+			if e != nil {
+				logger.Log.Errorw("Could not list repair markers", "resource-type", decorator.resourceType, "replica", i, "error", e)
+				continue
+			}
+			for _, blobInfo := range blobInfos {
+				markerHolders[blobInfo.Path] = append(markerHolders[blobInfo.Path], i)
+			}
+		}
+	}
+
+	numPending := 0
+	for marker, holders := range markerHolders {
+		repair := decorator.repair
+		replica, path, ok := parseRepairMarker(marker)
+		if !ok {
+			repair = decorator.repairDir
+			replica, path, ok = parseDirRepairMarker(marker)
+		}
+		if !ok || replica >= len(decorator.replicas) {
+			logger.Log.Errorw("Ignoring invalid repair marker", "resource-type", decorator.resourceType, "marker", marker)
+			continue
+		}
+		e := repair(replica, path, holders)
+		if e != nil {
+			logger.Log.Errorw("Could not repair replica", "resource-type", decorator.resourceType, "replica", replica, "path", path, "error", e)
+			numPending++
+			continue
+		}
+		decorator.metricsService.SendCounterMetric(decorator.resourceType+"-repaired_blobs", 1)
+		for _, i := range holders {
+			e = decorator.replicas[i].Delete(marker)
+			if e != nil && !bitsgo.IsNotFoundError(e) {
+				logger.Log.Errorw("Could not delete repair marker", "resource-type", decorator.resourceType, "replica", i, "marker", marker, "error", e)
+			}
+		}
+	}
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-repair_queue_length", int64(numPending))
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) repair(replica int, path string, sources []int) error {
+	target := decorator.replicas[replica]
+	for _, i := range sources {
+		body, e := decorator.replicas[i].Get(path)
+		if bitsgo.IsNotFoundError(e) {
+			continue
+		}
+		if e != nil {
+			return e
+		}
+		return copyInto(target, path, body)
+	}
+	// The blob has been deleted from the replicas which are up to date.
+	e := target.Delete(path)
+	if e != nil && !bitsgo.IsNotFoundError(e) {
+		return e
+	}
+	return nil
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) repairDir(replica int, prefix string, sources []int) error {
+	target := decorator.replicas[replica]
+	blobInfos, e := target.List(prefix)
+	if e != nil {
+		return e
+	}
+	for _, blobInfo := range blobInfos {
+		if isRepairMarker(blobInfo.Path) {
+			continue
+		}
+		// Blobs written after the DeleteDir exist in the replicas holding the marker as well.
+		existsInSource := false
+		for _, i := range sources {
+			exists, e := decorator.replicas[i].Exists(blobInfo.Path)
+			if e != nil {
+				return e
+			}
+			if exists {
+				existsInSource = true
+				break
+			}
+		}
+		if existsInSource {
+			continue
+		}
+		e = target.Delete(blobInfo.Path)
+		if e != nil && !bitsgo.IsNotFoundError(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+func copyInto(target bitsgo.Blobstore, path string, body io.ReadCloser) error {
+	defer body.Close()
+	// Put requires an io.ReadSeeker, so we need to buffer the blob.
+	tempFile, e := ioutil.TempFile("", "bits-replication")
+	if e != nil {
+		return errors.Wrap(e, "Could not create temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	_, e = io.Copy(tempFile, body)
+	if e != nil {
+		return errors.Wrapf(e, "Could not read %v", path)
+	}
+	_, e = tempFile.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrap(e, "Could not rewind temporary file")
+	}
+	return target.Put(path, tempFile)
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) isHealthy(replica int) bool {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	return decorator.unhealthySince[replica].IsZero() ||
+		decorator.clock.Now().Sub(decorator.unhealthySince[replica]) > unhealthyReplicaBackoff
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) markHealthy(replica int) {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	decorator.unhealthySince[replica] = time.Time{}
+}
+
+func (decorator *ReplicatingBlobstoreDecorator) markUnhealthy(replica int, e error) {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	if decorator.unhealthySince[replica].IsZero() {
+		logger.Log.Errorw("Marking replica as unhealthy", "resource-type", decorator.resourceType, "replica", replica, "error", e)
+	}
+	decorator.unhealthySince[replica] = decorator.clock.Now()
+}
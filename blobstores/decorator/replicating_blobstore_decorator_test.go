@@ -0,0 +1,223 @@
+package decorator_test
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+type unavailableBlobstore struct {
+	*inmemory.Blobstore
+	unavailable bool
+}
+
+func (blobstore *unavailableBlobstore) Get(path string) (io.ReadCloser, error) {
+	if blobstore.unavailable {
+		return nil, errors.New("unavailable")
+	}
+	return blobstore.Blobstore.Get(path)
+}
+
+func (blobstore *unavailableBlobstore) Put(path string, src io.ReadSeeker) error {
+	if blobstore.unavailable {
+		return errors.New("unavailable")
+	}
+	return blobstore.Blobstore.Put(path, src)
+}
+
+func (blobstore *unavailableBlobstore) Delete(path string) error {
+	if blobstore.unavailable {
+		return errors.New("unavailable")
+	}
+	return blobstore.Blobstore.Delete(path)
+}
+
+func (blobstore *unavailableBlobstore) DeleteDir(prefix string) error {
+	if blobstore.unavailable {
+		return errors.New("unavailable")
+	}
+	return blobstore.Blobstore.DeleteDir(prefix)
+}
+
+// barrierBlobstore only completes a Put once all blobstores sharing its barrier have started one.
+type barrierBlobstore struct {
+	*inmemory.Blobstore
+	barrier *sync.WaitGroup
+}
+
+func (blobstore *barrierBlobstore) Put(path string, src io.ReadSeeker) error {
+	blobstore.barrier.Done()
+	passed := make(chan struct{})
+	go func() {
+		blobstore.barrier.Wait()
+		close(passed)
+	}()
+	select {
+	case <-passed:
+		return blobstore.Blobstore.Put(path, src)
+	case <-time.After(time.Second):
+		return errors.New("other replicas were not written concurrently")
+	}
+}
+
+var _ = Describe("ReplicatingBlobstoreDecorator", func() {
+	var (
+		primary        *unavailableBlobstore
+		secondary      *unavailableBlobstore
+		metricsService *recordingMetricsService
+	)
+
+	BeforeEach(func() {
+		primary = &unavailableBlobstore{Blobstore: inmemory.NewBlobstore()}
+		secondary = &unavailableBlobstore{Blobstore: inmemory.NewBlobstore()}
+		metricsService = newRecordingMetricsService()
+	})
+
+	It("writes to all replicas", func() {
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 2, metricsService, "droplets", clock.NewMock())
+
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		Expect(primary.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+		Expect(secondary.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+	})
+
+	It("fails when the write quorum is not reached", func() {
+		secondary.unavailable = true
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 2, metricsService, "droplets", clock.NewMock())
+
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(MatchError(ContainSubstring("1 of 2 required")))
+	})
+
+	It("repairs replicas which missed a write", func() {
+		secondary.unavailable = true
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		Expect(secondary.Entries).NotTo(HaveKey("guid"))
+
+		blobstore.Repair()
+		Expect(secondary.Entries).NotTo(HaveKey("guid"))
+		Expect(metricsService.gauges["droplets-repair_queue_length"]).To(BeEquivalentTo(1))
+
+		secondary.unavailable = false
+		blobstore.Repair()
+		Expect(secondary.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+		Expect(metricsService.gauges["droplets-repair_queue_length"]).To(BeZero())
+		Expect(metricsService.counters["droplets-repaired_blobs"]).To(BeEquivalentTo(1))
+	})
+
+	It("writes to the replicas in parallel", func() {
+		barrier := &sync.WaitGroup{}
+		barrier.Add(2)
+		first := &barrierBlobstore{Blobstore: inmemory.NewBlobstore(), barrier: barrier}
+		second := &barrierBlobstore{Blobstore: inmemory.NewBlobstore(), barrier: barrier}
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{first, second}, 2, metricsService, "droplets", clock.NewMock())
+
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		Expect(first.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+		Expect(second.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+	})
+
+	It("keeps pending repairs across restarts", func() {
+		secondary.unavailable = true
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		secondary.unavailable = false
+		restartedBlobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		restartedBlobstore.Repair()
+
+		Expect(secondary.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+		Expect(primary.Entries).To(HaveLen(1))
+	})
+
+	It("repairs replicas which missed a delete", func() {
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		secondary.unavailable = true
+		Expect(blobstore.Delete("guid")).To(Succeed())
+
+		secondary.unavailable = false
+		blobstore.Repair()
+
+		Expect(secondary.Entries).NotTo(HaveKey("guid"))
+	})
+
+	It("does not read a blob from a replica which missed its delete", func() {
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		secondary.unavailable = true
+		Expect(blobstore.Delete("guid")).To(Succeed())
+		secondary.unavailable = false
+
+		_, e := blobstore.Get("guid")
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+		Expect(blobstore.Exists("guid")).To(BeFalse())
+		Expect(secondary.Entries).To(HaveKey("guid"))
+	})
+
+	It("repairs replicas which missed a DeleteDir, but keeps blobs written afterwards", func() {
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("dir/a", strings.NewReader("content a"))).To(Succeed())
+		Expect(blobstore.Put("dir/b", strings.NewReader("content b"))).To(Succeed())
+		secondary.unavailable = true
+		Expect(blobstore.DeleteDir("dir/")).To(Succeed())
+		secondary.unavailable = false
+
+		_, e := blobstore.Get("dir/a")
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+
+		Expect(blobstore.Put("dir/c", strings.NewReader("content c"))).To(Succeed())
+		blobstore.Repair()
+
+		Expect(secondary.Entries).NotTo(HaveKey("dir/a"))
+		Expect(secondary.Entries).NotTo(HaveKey("dir/b"))
+		Expect(secondary.Entries).To(HaveKeyWithValue("dir/c", []byte("content c")))
+		Expect(primary.Entries).To(HaveLen(1))
+		Expect(metricsService.gauges["droplets-repair_queue_length"]).To(BeZero())
+	})
+
+	It("does not list repair markers", func() {
+		secondary.unavailable = true
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 1, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		blobInfos, e := blobstore.List("")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(blobInfos).To(HaveLen(1))
+		Expect(blobInfos[0].Path).To(Equal("guid"))
+	})
+
+	It("reads from the next replica when one is unavailable", func() {
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 2, metricsService, "droplets", clock.NewMock())
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		primary.unavailable = true
+
+		body, e := blobstore.Get("guid")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(ioutil.ReadAll(body)).To(MatchRegexp("content"))
+	})
+
+	It("returns a NotFoundError when no replica has the blob", func() {
+		blobstore := decorator.ForBlobstoreWithReplication([]bitsgo.Blobstore{primary, secondary}, 2, metricsService, "droplets", clock.NewMock())
+
+		_, e := blobstore.Get("non-existing")
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+		Expect(blobstore.Delete("non-existing")).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+	})
+})
@@ -0,0 +1,270 @@
+package decorator
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cenkalti/backoff"
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is tried, including the first attempt.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// OperationTimeout limits the duration of a single attempt. For Get and GetOrRedirect, it limits the time
+	// until the body is available, not the time it takes to read it. 0 disables timeouts.
+	OperationTimeout time.Duration
+	// CircuitBreakerThreshold is the number of consecutive failed attempts after which the circuit breaker opens.
+	// 0 disables the circuit breaker.
+	CircuitBreakerThreshold int
+	// CircuitBreakerOpenDuration is the time the circuit breaker stays open before the backend is tried again.
+	CircuitBreakerOpenDuration time.Duration
+}
+
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+type timeoutError struct {
+	error
+}
+
+func (e *timeoutError) Timeout() bool { return true }
+
+// RetryingBlobstoreDecorator retries failed operations with exponential backoff, limits the duration of each attempt
+// and stops calling the delegate for some time after it failed repeatedly. While it does, operations fail with
+// *UnavailableError. Errors which a retry cannot fix, e.g. *NotFoundError or *PermissionDeniedError, are not
+// considered failures and are not retried.
+//
+// Since the delegate cannot be cancelled, an attempt which timed out keeps running in the background. Timed out Puts
+// are therefore not retried, because the retry would read the same source concurrently.
+type RetryingBlobstoreDecorator struct {
+	delegate       bitsgo.Blobstore
+	policy         RetryPolicy
+	metricsService bitsgo.MetricsService
+	resourceType   string
+	clock          clock.Clock
+
+	mutex               sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+func ForBlobstoreWithRetries(delegate bitsgo.Blobstore, policy RetryPolicy, metricsService bitsgo.MetricsService, resourceType string, clock clock.Clock) *RetryingBlobstoreDecorator {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return &RetryingBlobstoreDecorator{
+		delegate:       delegate,
+		policy:         policy,
+		metricsService: metricsService,
+		resourceType:   resourceType,
+		clock:          clock,
+	}
+}
+
+func (decorator *RetryingBlobstoreDecorator) Exists(path string) (bool, error) {
+	result, e := decorator.do("exists", path, true, func() (interface{}, error) {
+		return decorator.delegate.Exists(path)
+	}, nil)
+	if e != nil {
+		return false, e
+	}
+	return result.(bool), nil
+}
+
+func (decorator *RetryingBlobstoreDecorator) Get(path string) (body io.ReadCloser, err error) {
+	result, e := decorator.do("get", path, true, func() (interface{}, error) {
+		return decorator.delegate.Get(path)
+	}, closeBody)
+	if e != nil {
+		return nil, e
+	}
+	body, _ = result.(io.ReadCloser)
+	return body, nil
+}
+
+type getOrRedirectResult struct {
+	body             io.ReadCloser
+	redirectLocation string
+}
+
+func (decorator *RetryingBlobstoreDecorator) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
+	result, e := decorator.do("get_or_redirect", path, true, func() (interface{}, error) {
+		body, redirectLocation, e := decorator.delegate.GetOrRedirect(path)
+		return getOrRedirectResult{body, redirectLocation}, e
+	}, func(result interface{}) {
+		closeBody(result.(getOrRedirectResult).body)
+	})
+	if e != nil {
+		return nil, "", e
+	}
+	return result.(getOrRedirectResult).body, result.(getOrRedirectResult).redirectLocation, nil
+}
+
+func (decorator *RetryingBlobstoreDecorator) Put(path string, src io.ReadSeeker) error {
+	_, e := decorator.do("put", path, false, func() (interface{}, error) {
+		_, e := src.Seek(0, io.SeekStart)
+		if e != nil {
+			return nil, backoff.Permanent(errors.Wrapf(e, "Could not rewind %v", path))
+		}
+		return nil, decorator.delegate.Put(path, src)
+	}, nil)
+	return e
+}
+
+func (decorator *RetryingBlobstoreDecorator) Copy(src, dest string) error {
+	_, e := decorator.do("copy", dest, true, func() (interface{}, error) {
+		return nil, decorator.delegate.Copy(src, dest)
+	}, nil)
+	return e
+}
+
+func (decorator *RetryingBlobstoreDecorator) Delete(path string) error {
+	_, e := decorator.do("delete", path, true, func() (interface{}, error) {
+		return nil, decorator.delegate.Delete(path)
+	}, nil)
+	return e
+}
+
+func (decorator *RetryingBlobstoreDecorator) DeleteDir(prefix string) error {
+	_, e := decorator.do("delete_dir", prefix, true, func() (interface{}, error) {
+		return nil, decorator.delegate.DeleteDir(prefix)
+	}, nil)
+	return e
+}
+
+func (decorator *RetryingBlobstoreDecorator) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	result, e := decorator.do("list", prefix, true, func() (interface{}, error) {
+		return decorator.delegate.List(prefix)
+	}, nil)
+	if e != nil {
+		return nil, e
+	}
+	blobInfos, _ := result.([]bitsgo.BlobInfo)
+	return blobInfos, nil
+}
+
+// do calls attempt until it succeeds, fails with an error which is not retried or the maximum number of attempts
+// is reached. discard is called with the result of an attempt which succeeded after it had timed out.
+func (decorator *RetryingBlobstoreDecorator) do(operation string, path string, retryTimeouts bool, attempt func() (interface{}, error), discard func(interface{})) (interface{}, error) {
+	var result interface{}
+	exponentialBackOff := backoff.NewExponentialBackOff()
+	exponentialBackOff.InitialInterval = decorator.policy.InitialBackoff
+	exponentialBackOff.MaxInterval = decorator.policy.MaxBackoff
+	exponentialBackOff.MaxElapsedTime = 0
+	e := backoff.RetryNotify(func() error {
+		if openFor := decorator.remainingOpenDuration(); openFor > 0 {
+			decorator.metricsService.SendCounterMetric(decorator.resourceType+"-circuit_breaker_rejections", 1)
+			return backoff.Permanent(bitsgo.NewUnavailableError(errors.Wrapf(ErrCircuitOpen, "Could not %v %v", operation, path), openFor))
+		}
+		var e error
+		result, e = decorator.withTimeout(attempt, discard)
+		if _, isPermanent := e.(*backoff.PermanentError); isPermanent {
+			return e
+		}
+		if e == nil || isExpectedError(e) {
+			decorator.recordSuccess()
+			if e != nil {
+				return backoff.Permanent(e)
+			}
+			return nil
+		}
+		decorator.recordFailure()
+		if _, isTimeout := e.(*timeoutError); isTimeout && !retryTimeouts {
+			return backoff.Permanent(e)
+		}
+		return e
+	}, backoff.WithMaxRetries(exponentialBackOff, uint64(decorator.policy.MaxAttempts-1)), func(e error, delay time.Duration) {
+		logger.Log.Infow("Retrying blobstore operation", "resource-type", decorator.resourceType, "operation", operation, "path", path, "delay", delay, "error", e)
+		decorator.metricsService.SendCounterMetric(decorator.resourceType+"-"+operation+"-retries", 1)
+	})
+	if e != nil {
+		return nil, e
+	}
+	return result, nil
+}
+
+func (decorator *RetryingBlobstoreDecorator) withTimeout(attempt func() (interface{}, error), discard func(interface{})) (interface{}, error) {
+	if decorator.policy.OperationTimeout == 0 {
+		return attempt()
+	}
+	type outcome struct {
+		result interface{}
+		e      error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, e := attempt()
+		done <- outcome{result, e}
+	}()
+	select {
+	case outcome := <-done:
+		return outcome.result, outcome.e
+	case <-decorator.clock.After(decorator.policy.OperationTimeout):
+		decorator.metricsService.SendCounterMetric(decorator.resourceType+"-timeouts", 1)
+		if discard != nil {
+			go func() {
+				if outcome := <-done; outcome.e == nil {
+					discard(outcome.result)
+				}
+			}()
+		}
+		return nil, &timeoutError{errors.Errorf("Blobstore operation timed out after %v", decorator.policy.OperationTimeout)}
+	}
+}
+
+// remainingOpenDuration returns how long the circuit breaker stays open or 0 when requests are allowed.
+func (decorator *RetryingBlobstoreDecorator) remainingOpenDuration() time.Duration {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	if decorator.policy.CircuitBreakerThreshold == 0 || !decorator.clock.Now().Before(decorator.openUntil) {
+		return 0
+	}
+	return decorator.openUntil.Sub(decorator.clock.Now())
+}
+
+func (decorator *RetryingBlobstoreDecorator) recordSuccess() {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	if decorator.policy.CircuitBreakerThreshold != 0 && decorator.consecutiveFailures >= decorator.policy.CircuitBreakerThreshold {
+		logger.Log.Infow("Closing circuit breaker", "resource-type", decorator.resourceType)
+		decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-circuit_breaker_open", 0)
+	}
+	decorator.consecutiveFailures = 0
+}
+
+// recordFailure opens the circuit breaker when the threshold is reached. While the breaker is half-open,
+// i.e. the open duration has passed, a single failure opens it again.
+func (decorator *RetryingBlobstoreDecorator) recordFailure() {
+	decorator.mutex.Lock()
+	defer decorator.mutex.Unlock()
+	decorator.consecutiveFailures++
+	if decorator.policy.CircuitBreakerThreshold == 0 || decorator.consecutiveFailures < decorator.policy.CircuitBreakerThreshold {
+		return
+	}
+	if decorator.consecutiveFailures == decorator.policy.CircuitBreakerThreshold {
+		logger.Log.Errorw("Opening circuit breaker", "resource-type", decorator.resourceType, "open-duration", decorator.policy.CircuitBreakerOpenDuration)
+	}
+	decorator.openUntil = decorator.clock.Now().Add(decorator.policy.CircuitBreakerOpenDuration)
+	decorator.metricsService.SendGaugeMetric(decorator.resourceType+"-circuit_breaker_open", 1)
+}
+
+func isExpectedError(e error) bool {
+	switch e.(type) {
+	case *bitsgo.NotFoundError, *bitsgo.NoSpaceLeftError, *bitsgo.EntityTooLargeError, *bitsgo.PermissionDeniedError,
+		*bitsgo.PreconditionFailedError, *bitsgo.ContainerNotFoundError, *bitsgo.CorruptBlobError:
+		return true
+	}
+	return false
+}
+
+func closeBody(body interface{}) {
+	if body, ok := body.(io.ReadCloser); ok {
+		body.Close()
+	}
+}
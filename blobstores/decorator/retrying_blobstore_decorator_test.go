@@ -0,0 +1,130 @@
+package decorator_test
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+type flakyBlobstore struct {
+	*inmemory.Blobstore
+	failures int
+	calls    int
+	delay    time.Duration
+}
+
+func (blobstore *flakyBlobstore) Get(path string) (io.ReadCloser, error) {
+	blobstore.calls++
+	time.Sleep(blobstore.delay)
+	if blobstore.failures > 0 {
+		blobstore.failures--
+		return nil, errors.New("temporarily unavailable")
+	}
+	return blobstore.Blobstore.Get(path)
+}
+
+func (blobstore *flakyBlobstore) Put(path string, src io.ReadSeeker) error {
+	blobstore.calls++
+	if blobstore.failures > 0 {
+		blobstore.failures--
+		ioutil.ReadAll(src)
+		return errors.New("temporarily unavailable")
+	}
+	return blobstore.Blobstore.Put(path, src)
+}
+
+var _ = Describe("RetryingBlobstoreDecorator", func() {
+	var (
+		delegate       *flakyBlobstore
+		metricsService *recordingMetricsService
+		mockClock      *clock.Mock
+		policy         decorator.RetryPolicy
+	)
+
+	BeforeEach(func() {
+		delegate = &flakyBlobstore{Blobstore: inmemory.NewBlobstore()}
+		metricsService = newRecordingMetricsService()
+		mockClock = clock.NewMock()
+		policy = decorator.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	})
+
+	It("retries failed operations", func() {
+		delegate.failures = 2
+		blobstore := decorator.ForBlobstoreWithRetries(delegate, policy, metricsService, "droplets", mockClock)
+
+		Expect(blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+
+		Expect(delegate.calls).To(Equal(3))
+		Expect(delegate.Entries).To(HaveKeyWithValue("guid", []byte("content")))
+		Expect(metricsService.counters["droplets-put-retries"]).To(BeEquivalentTo(2))
+	})
+
+	It("gives up after the maximum number of attempts", func() {
+		delegate.failures = 3
+		blobstore := decorator.ForBlobstoreWithRetries(delegate, policy, metricsService, "droplets", mockClock)
+
+		_, e := blobstore.Get("guid")
+
+		Expect(e).To(MatchError("temporarily unavailable"))
+		Expect(delegate.calls).To(Equal(3))
+	})
+
+	It("does not retry NotFoundErrors", func() {
+		blobstore := decorator.ForBlobstoreWithRetries(delegate, policy, metricsService, "droplets", mockClock)
+
+		_, e := blobstore.Get("non-existing")
+
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+		Expect(delegate.calls).To(Equal(1))
+	})
+
+	It("fails fast while the circuit breaker is open", func() {
+		delegate.failures = 3
+		policy.MaxAttempts = 1
+		policy.CircuitBreakerThreshold = 3
+		policy.CircuitBreakerOpenDuration = 30 * time.Second
+		Expect(delegate.Blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		blobstore := decorator.ForBlobstoreWithRetries(delegate, policy, metricsService, "droplets", mockClock)
+		for i := 0; i < 3; i++ {
+			_, e := blobstore.Get("guid")
+			Expect(e).To(MatchError("temporarily unavailable"))
+		}
+		Expect(metricsService.gauges["droplets-circuit_breaker_open"]).To(BeEquivalentTo(1))
+
+		_, e := blobstore.Get("guid")
+		Expect(e).To(BeAssignableToTypeOf(&bitsgo.UnavailableError{}))
+		Expect(e.(*bitsgo.UnavailableError).RetryAfter).To(BeNumerically(">", 0))
+		Expect(e).To(MatchError(ContainSubstring(decorator.ErrCircuitOpen.Error())))
+		Expect(delegate.calls).To(Equal(3))
+		Expect(metricsService.counters["droplets-circuit_breaker_rejections"]).To(BeEquivalentTo(1))
+
+		mockClock.Add(31 * time.Second)
+		_, e = blobstore.Get("guid")
+		Expect(e).NotTo(HaveOccurred())
+		Expect(metricsService.gauges["droplets-circuit_breaker_open"]).To(BeZero())
+	})
+
+	It("times out slow operations", func() {
+		delegate.delay = 200 * time.Millisecond
+		policy.MaxAttempts = 1
+		policy.OperationTimeout = 10 * time.Millisecond
+		Expect(delegate.Blobstore.Put("guid", strings.NewReader("content"))).To(Succeed())
+		blobstore := decorator.ForBlobstoreWithRetries(delegate, policy, metricsService, "droplets", clock.New())
+
+		_, e := blobstore.Get("guid")
+
+		Expect(e).To(MatchError(ContainSubstring("timed out")))
+		Expect(metricsService.counters["droplets-timeouts"]).To(BeEquivalentTo(1))
+	})
+})
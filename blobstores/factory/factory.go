@@ -0,0 +1,495 @@
+package factory
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/benbjohnson/clock"
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/alibaba"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/azure"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/gcp"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/local"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/openstack"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/s3"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/webdav"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	log "github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/cloudfoundry-incubator/bits-service/pathsigner"
+	"go.uber.org/zap"
+)
+
+// CreateBlobstoreAndSignURLHandler creates the blobstore for resourceType including all decorators
+// configured in blobstoreConfig. backgroundWorkers controls whether the blobstore starts its regular
+// maintenance, such as repairing replicas, in the background.
+func CreateBlobstoreAndSignURLHandler(blobstoreConfig config.BlobstoreConfig, publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, resourceType string, logger *zap.SugaredLogger, metricsService bitsgo.MetricsService, backgroundWorkers bool) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	localResourceSigner := createLocalResourceSigner(publicEndpoint, port, secret, signingKeys, activeKeyID, resourceType)
+	return withOptionalDecorators(blobstoreConfig, resourceType, metricsService, backgroundWorkers,
+		bitsgo.NewSignResourceHandler(localResourceSigner, localResourceSigner),
+		func(blobstoreConfig config.BlobstoreConfig) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+			return createBlobstoreAndSignURLHandler(blobstoreConfig, publicEndpoint, port, secret, signingKeys, activeKeyID, resourceType, logger, metricsService, backgroundWorkers)
+		})
+}
+
+func CreateBuildpackCacheBlobstoreAndSignURLHandler(blobstoreConfig config.BlobstoreConfig, publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, logger *zap.SugaredLogger, metricsService bitsgo.MetricsService, backgroundWorkers bool) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	localResourceSigner := createLocalResourceSigner(publicEndpoint, port, secret, signingKeys, activeKeyID, "buildpack_cache/entries")
+	return withOptionalDecorators(blobstoreConfig, "buildpack_cache", metricsService, backgroundWorkers,
+		bitsgo.NewSignResourceHandler(localResourceSigner, localResourceSigner),
+		func(blobstoreConfig config.BlobstoreConfig) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+			return createBuildpackCacheBlobstoreAndSignURLHandler(blobstoreConfig, publicEndpoint, port, secret, signingKeys, activeKeyID, logger, metricsService, backgroundWorkers)
+		})
+}
+
+func CreateAppStashBlobstoreAndSignURLHandler(blobstoreConfig config.BlobstoreConfig, publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, logger *zap.SugaredLogger, metricsService bitsgo.MetricsService, backgroundWorkers bool) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	return withOptionalDecorators(blobstoreConfig, "app_stash", metricsService, backgroundWorkers,
+		nil, // app_stash URLs are always signed for the bits-service itself
+		func(blobstoreConfig config.BlobstoreConfig) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+			return createAppStashBlobstoreAndSignURLHandler(blobstoreConfig, publicEndpoint, port, secret, signingKeys, activeKeyID, logger, metricsService, backgroundWorkers)
+		})
+}
+
+type createFunc func(blobstoreConfig config.BlobstoreConfig) (bitsgo.Blobstore, *bitsgo.SignResourceHandler)
+
+// withOptionalDecorators creates a blobstore using create and wraps it with the decorators enabled in
+// blobstoreConfig. When a decorator makes signed URLs pointing directly to the backend unusable, the
+// returned sign URL handler is replaced by proxyingSignURLHandler, which signs URLs for the bits-service itself.
+// Repairing replicas and draining the legacy blobstore only happen when backgroundWorkers is true, so that
+// short-lived processes like bitsctl do not start them.
+func withOptionalDecorators(blobstoreConfig config.BlobstoreConfig, resourceType string, metricsService bitsgo.MetricsService, backgroundWorkers bool, proxyingSignURLHandler *bitsgo.SignResourceHandler, create createFunc) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	create = withBackendDecorators(create, resourceType, metricsService)
+	blobstore, signURLHandler := create(blobstoreConfig)
+	// Without an account key or Azure Active Directory, the Azure blobstore cannot sign URLs.
+	requiresProxying := blobstoreConfig.BlobstoreType == config.Azure && blobstoreConfig.AzureConfig != nil && blobstoreConfig.AzureConfig.SASToken != ""
+
+	if blobstoreConfig.Replication != nil {
+		replicas := []bitsgo.Blobstore{blobstore}
+		for _, replicaConfig := range blobstoreConfig.Replication.Replicas {
+			log.Log.Infow("Creating replica blobstore", "resource-type", resourceType, "blobstore-type", replicaConfig.BlobstoreType)
+			replica, _ := create(replicaConfig)
+			replicas = append(replicas, replica)
+		}
+		replicatingBlobstore := decorator.ForBlobstoreWithReplication(replicas, blobstoreConfig.Replication.WriteQuorumWithDefault(), metricsService, resourceType, clock.New())
+		if backgroundWorkers {
+			go replicatingBlobstore.RegularlyRepair(blobstoreConfig.Replication.RepairInterval())
+		}
+		blobstore = replicatingBlobstore
+		// Signed URLs of the primary blobstore would not fall back to the other replicas.
+		requiresProxying = true
+	}
+
+	if blobstoreConfig.LiveMigration != nil {
+		log.Log.Infow("Creating legacy blobstore for live migration", "resource-type", resourceType, "blobstore-type", blobstoreConfig.LiveMigration.Legacy.BlobstoreType)
+		legacyBlobstore, _ := create(blobstoreConfig.LiveMigration.Legacy)
+		liveMigrationBlobstore := decorator.ForBlobstoreWithLiveMigration(blobstore, legacyBlobstore, blobstoreConfig.LiveMigration.CopyOnRead, metricsService, resourceType, clock.New())
+		if backgroundWorkers && blobstoreConfig.LiveMigration.DrainInterval() != 0 {
+			go liveMigrationBlobstore.RegularlyDrain(blobstoreConfig.LiveMigration.DrainInterval())
+		}
+		blobstore = liveMigrationBlobstore
+		// Blobs which are only in the legacy blobstore cannot be found using a signed URL of the primary blobstore.
+		requiresProxying = true
+	}
+
+	// The cache is placed inside of encryption and compression, so that cached blobs are stored the same way as in the blobstore.
+	// Every resource type gets its own cache directory, so that caches of different resource types cannot remove each other's files.
+	if blobstoreConfig.Cache != nil {
+		cacheDirectory := filepath.Join(blobstoreConfig.Cache.Directory, resourceType)
+		log.Log.Infow("Enabling cache", "resource-type", resourceType, "directory", cacheDirectory, "max-size", blobstoreConfig.Cache.MaxSizeBytes())
+		blobstore = decorator.ForBlobstoreWithCache(blobstore, cacheDirectory, int64(blobstoreConfig.Cache.MaxSizeBytes()), isCacheableFor(resourceType), metricsService, resourceType)
+	}
+
+	if blobstoreConfig.Encryption != nil {
+		log.Log.Infow("Enabling encryption", "resource-type", resourceType, "active-key-id", blobstoreConfig.Encryption.ActiveKeyID)
+		blobstore = decorator.ForBlobstoreWithEncryption(blobstore, blobstoreConfig.Encryption.MasterKeysMap(), blobstoreConfig.Encryption.ActiveKeyID)
+		// Signed URLs pointing directly to the backend would serve the encrypted blobs.
+		requiresProxying = true
+	}
+
+	// Compression wraps encryption, because encrypted blobs cannot be compressed.
+	if blobstoreConfig.Compression.Enabled() {
+		log.Log.Infow("Enabling compression", "resource-type", resourceType, "codec", blobstoreConfig.Compression.Codec)
+		codec := decorator.Gzip
+		if blobstoreConfig.Compression.Codec == "zstd" {
+			codec = decorator.Zstd
+		}
+		blobstore = decorator.ForBlobstoreWithCompression(blobstore, codec, blobstoreConfig.Compression.Level, metricsService, resourceType)
+		// Signed URLs pointing directly to the backend would serve the compressed blobs.
+		requiresProxying = true
+	}
+
+	// Checksums are computed on the content as it is returned to clients, i.e. after decryption and decompression.
+	if blobstoreConfig.VerifyChecksums {
+		log.Log.Infow("Enabling checksum verification", "resource-type", resourceType)
+		blobstore = decorator.ForBlobstoreWithChecksumVerification(blobstore, metricsService, resourceType)
+	}
+
+	if requiresProxying && proxyingSignURLHandler != nil {
+		signURLHandler = proxyingSignURLHandler
+	}
+	return blobstore, signURLHandler
+}
+
+// isCacheableFor excludes blobs from caching which, unlike the resources themselves, are modified.
+func isCacheableFor(resourceType string) func(path string) bool {
+	if resourceType == "droplets" {
+		return func(path string) bool { return !bitsgo.IsDropletVersionIndexPath(path) }
+	}
+	return nil
+}
+
+// withBackendDecorators wraps every blobstore created by create with rate limiting and retries, so that the primary,
+// replica and legacy blobstores each have their own limits and circuit breaker.
+func withBackendDecorators(create createFunc, resourceType string, metricsService bitsgo.MetricsService) createFunc {
+	return func(blobstoreConfig config.BlobstoreConfig) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+		blobstore, signURLHandler := create(blobstoreConfig)
+		// Rate limiting is applied inside of retries, so that every attempt counts against the limits.
+		if blobstoreConfig.RateLimit != nil {
+			log.Log.Infow("Enabling rate limiting", "resource-type", resourceType, "blobstore-type", blobstoreConfig.BlobstoreType,
+				"max-in-flight", blobstoreConfig.RateLimit.MaxInFlight, "requests-per-second", blobstoreConfig.RateLimit.RequestsPerSecond)
+			blobstore = decorator.ForBlobstoreWithRateLimit(blobstore, blobstoreConfig.RateLimit.MaxInFlight,
+				blobstoreConfig.RateLimit.RequestsPerSecond, blobstoreConfig.RateLimit.Burst, metricsService, resourceType)
+		}
+		// Blobstores do not retry themselves, so retries are always enabled, with the defaults unless configured.
+		retryConfig := blobstoreConfig.Retry
+		if retryConfig == nil {
+			retryConfig = &config.RetryConfig{}
+		}
+		policy := decorator.RetryPolicy{
+			MaxAttempts:      retryConfig.MaxAttemptsWithDefault(),
+			InitialBackoff:   retryConfig.InitialBackoff(),
+			MaxBackoff:       retryConfig.MaxBackoff(),
+			OperationTimeout: retryConfig.OperationTimeout(),
+		}
+		if retryConfig.CircuitBreaker != nil {
+			policy.CircuitBreakerThreshold = retryConfig.CircuitBreaker.FailureThresholdWithDefault()
+			policy.CircuitBreakerOpenDuration = retryConfig.CircuitBreaker.OpenDuration()
+		}
+		log.Log.Infow("Enabling retries", "resource-type", resourceType, "blobstore-type", blobstoreConfig.BlobstoreType, "policy", policy)
+		return decorator.ForBlobstoreWithRetries(blobstore, policy, metricsService, resourceType, clock.New()), signURLHandler
+	}
+}
+
+func createBlobstoreAndSignURLHandler(blobstoreConfig config.BlobstoreConfig, publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, resourceType string, logger *zap.SugaredLogger, metricsService bitsgo.MetricsService, backgroundWorkers bool) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	localResourceSigner := createLocalResourceSigner(publicEndpoint, port, secret, signingKeys, activeKeyID, resourceType)
+	switch blobstoreConfig.BlobstoreType {
+	case config.Local:
+		log.Log.Infow("Creating local blobstore", "path-prefix", blobstoreConfig.LocalConfig.PathPrefix)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithMetricsEmitter(
+					local.NewBlobstore(*blobstoreConfig.LocalConfig),
+					metricsService,
+					resourceType)),
+			bitsgo.NewSignResourceHandler(localResourceSigner, localResourceSigner)
+	case config.AWS:
+		log.Log.Infow("Creating S3 blobstore", "bucket", blobstoreConfig.S3Config.Bucket)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithMetricsEmitter(
+					s3.NewBlobstoreWithLogger(*blobstoreConfig.S3Config, logger),
+					metricsService,
+					resourceType)),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					s3.NewBlobstoreWithLogger(*blobstoreConfig.S3Config, logger)),
+				localResourceSigner)
+	case config.Google:
+		log.Log.Infow("Creating GCP blobstore", "bucket", blobstoreConfig.GCPConfig.Bucket)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithMetricsEmitter(
+					gcp.NewBlobstore(*blobstoreConfig.GCPConfig),
+					metricsService,
+					resourceType)),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					gcp.NewBlobstore(*blobstoreConfig.GCPConfig)),
+				localResourceSigner)
+	case config.Azure:
+		log.Log.Infow("Creating Azure blobstore", "container", blobstoreConfig.AzureConfig.ContainerName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithMetricsEmitter(
+					newAzureBlobstore(*blobstoreConfig.AzureConfig, metricsService, backgroundWorkers),
+					metricsService,
+					resourceType)),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					azure.NewBlobstore(*blobstoreConfig.AzureConfig, metricsService)),
+				localResourceSigner)
+	case config.OpenStack:
+		log.Log.Infow("Creating Openstack blobstore", "container", blobstoreConfig.OpenstackConfig.ContainerName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithMetricsEmitter(
+					openstack.NewBlobstore(*blobstoreConfig.OpenstackConfig),
+					metricsService,
+					resourceType)),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					openstack.NewBlobstore(*blobstoreConfig.OpenstackConfig)),
+				localResourceSigner)
+	case config.WebDAV:
+		log.Log.Infow("Creating Webdav blobstore",
+			"public-endpoint", blobstoreConfig.WebdavConfig.PublicEndpoint,
+			"private-endpoint", blobstoreConfig.WebdavConfig.PrivateEndpoint)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						webdav.NewBlobstore(*blobstoreConfig.WebdavConfig),
+						metricsService,
+						resourceType),
+					blobstoreConfig.WebdavConfig.DirectoryKey+"/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						webdav.NewBlobstore(*blobstoreConfig.WebdavConfig),
+						blobstoreConfig.WebdavConfig.DirectoryKey+"/")),
+				localResourceSigner)
+	case config.Alibaba:
+		log.Log.Infow("Creating Alibaba blobstore", "bucket", blobstoreConfig.AlibabaConfig.BucketName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithMetricsEmitter(
+					alibaba.NewBlobstore(*blobstoreConfig.AlibabaConfig),
+					metricsService,
+					resourceType)),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					alibaba.NewBlobstore(*blobstoreConfig.AlibabaConfig)),
+				localResourceSigner)
+	default:
+		log.Log.Fatalw("blobstoreConfig is invalid.", "blobstore-type", blobstoreConfig.BlobstoreType)
+		return nil, nil // satisfy compiler
+	}
+}
+
+func createBuildpackCacheBlobstoreAndSignURLHandler(blobstoreConfig config.BlobstoreConfig, publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, logger *zap.SugaredLogger, metricsService bitsgo.MetricsService, backgroundWorkers bool) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	localResourceSigner := createLocalResourceSigner(publicEndpoint, port, secret, signingKeys, activeKeyID, "buildpack_cache/entries")
+	switch blobstoreConfig.BlobstoreType {
+	case config.Local:
+		log.Log.Infow("Creating local blobstore", "path-prefix", blobstoreConfig.LocalConfig.PathPrefix)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						local.NewBlobstore(*blobstoreConfig.LocalConfig),
+						metricsService,
+						"buildpack_cache"),
+					"buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(localResourceSigner, localResourceSigner)
+	case config.AWS:
+		log.Log.Infow("Creating S3 blobstore", "bucket", blobstoreConfig.S3Config.Bucket)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						s3.NewBlobstoreWithLogger(*blobstoreConfig.S3Config, logger),
+						metricsService,
+						"buildpack_cache"),
+					"buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						s3.NewBlobstoreWithLogger(*blobstoreConfig.S3Config, logger),
+						"buildpack_cache")),
+				localResourceSigner)
+	case config.Google:
+		log.Log.Infow("Creating GCP blobstore", "bucket", blobstoreConfig.GCPConfig.Bucket)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						gcp.NewBlobstore(*blobstoreConfig.GCPConfig),
+						metricsService,
+						"buildpack_cache"),
+					"buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						gcp.NewBlobstore(*blobstoreConfig.GCPConfig),
+						"buildpack_cache")),
+				localResourceSigner)
+	case config.Azure:
+		log.Log.Infow("Creating Azure blobstore", "container", blobstoreConfig.AzureConfig.ContainerName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						newAzureBlobstore(*blobstoreConfig.AzureConfig, metricsService, backgroundWorkers),
+						metricsService,
+						"buildpack_cache"),
+					"buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						azure.NewBlobstore(*blobstoreConfig.AzureConfig, metricsService),
+						"buildpack_cache")),
+				localResourceSigner)
+	case config.OpenStack:
+		log.Log.Infow("Creating Openstack blobstore", "container", blobstoreConfig.OpenstackConfig.ContainerName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						openstack.NewBlobstore(*blobstoreConfig.OpenstackConfig),
+						metricsService,
+						"buildpack_cache"),
+					"buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						openstack.NewBlobstore(*blobstoreConfig.OpenstackConfig),
+						"buildpack_cache")),
+				localResourceSigner)
+	case config.WebDAV:
+		log.Log.Infow("Creating Webdav blobstore",
+			"public-endpoint", blobstoreConfig.WebdavConfig.PublicEndpoint,
+			"private-endpoint", blobstoreConfig.WebdavConfig.PrivateEndpoint)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						webdav.NewBlobstore(*blobstoreConfig.WebdavConfig),
+						metricsService,
+						"buildpack_cache"),
+					blobstoreConfig.WebdavConfig.DirectoryKey+"/buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						webdav.NewBlobstore(*blobstoreConfig.WebdavConfig),
+						blobstoreConfig.WebdavConfig.DirectoryKey+"/buildpack_cache/")),
+				localResourceSigner)
+	case config.Alibaba:
+		log.Log.Infow("Creating Alibaba blobstore", "bucket", blobstoreConfig.AlibabaConfig.BucketName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						alibaba.NewBlobstore(*blobstoreConfig.AlibabaConfig),
+						metricsService,
+						"buildpack_cache"),
+					"buildpack_cache/")),
+			bitsgo.NewSignResourceHandler(
+				decorator.ForResourceSignerWithPathPartitioning(
+					decorator.ForResourceSignerWithPathPrefixing(
+						alibaba.NewBlobstore(*blobstoreConfig.AlibabaConfig),
+						"buildpack_cache")),
+				localResourceSigner)
+	default:
+		log.Log.Fatalw("blobstoreConfig is invalid.", "blobstore-type", blobstoreConfig.BlobstoreType)
+		return nil, nil // satisfy compiler
+	}
+}
+
+// newAzureBlobstore also deletes the temporary blobs leaked by previous versions of the Azure blobstore,
+// unless backgroundWorkers is false.
+func newAzureBlobstore(azureConfig config.AzureBlobstoreConfig, metricsService bitsgo.MetricsService, backgroundWorkers bool) *azure.Blobstore {
+	blobstore := azure.NewBlobstore(azureConfig, metricsService)
+	if backgroundWorkers {
+		blobstore.DeleteLeakedTempBlobsInBackground()
+	}
+	return blobstore
+}
+
+func createLocalResourceSigner(publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, resourceType string) bitsgo.ResourceSigner {
+	return &local.LocalResourceSigner{
+		DelegateEndpoint: fmt.Sprintf("%v://%v:%v", publicEndpoint.Scheme, publicEndpoint.Host, port),
+		Signer: pathsigner.Validate(&pathsigner.PathSignerValidator{
+			Secret:      secret,
+			Clock:       clock.New(),
+			SigningKeys: signingKeys,
+			ActiveKeyID: activeKeyID,
+		}),
+		ResourcePathPrefix: "/" + resourceType + "/",
+	}
+}
+
+func createAppStashBlobstoreAndSignURLHandler(blobstoreConfig config.BlobstoreConfig, publicEndpoint *url.URL, port int, secret string, signingKeys map[string]string, activeKeyID string, logger *zap.SugaredLogger, metricsService bitsgo.MetricsService, backgroundWorkers bool) (bitsgo.Blobstore, *bitsgo.SignResourceHandler) {
+	signAppStashMatchesHandler := bitsgo.NewSignResourceHandler(
+		nil, // signing for get is not necessary for app_stash
+		&local.LocalResourceSigner{
+			DelegateEndpoint: fmt.Sprintf("%v://%v:%v", publicEndpoint.Scheme, publicEndpoint.Host, port),
+			Signer: pathsigner.Validate(&pathsigner.PathSignerValidator{
+				Secret:      secret,
+				Clock:       clock.New(),
+				SigningKeys: signingKeys,
+				ActiveKeyID: activeKeyID,
+			}),
+			ResourcePathPrefix: "/app_stash/matches",
+		})
+
+	switch blobstoreConfig.BlobstoreType {
+	case config.Local:
+		log.Log.Infow("Creating local blobstore", "path-prefix", blobstoreConfig.LocalConfig.PathPrefix)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						local.NewBlobstore(*blobstoreConfig.LocalConfig),
+						metricsService,
+						"app_stash"),
+					"app_bits_cache/")),
+			signAppStashMatchesHandler
+	case config.AWS:
+		log.Log.Infow("Creating S3 blobstore", "bucket", blobstoreConfig.S3Config.Bucket)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						s3.NewBlobstoreWithLogger(*blobstoreConfig.S3Config, logger),
+						metricsService,
+						"app_stash"),
+					"app_bits_cache/")),
+			signAppStashMatchesHandler
+	case config.Google:
+		log.Log.Infow("Creating GCP blobstore", "bucket", blobstoreConfig.GCPConfig.Bucket)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						gcp.NewBlobstore(*blobstoreConfig.GCPConfig),
+						metricsService,
+						"app_stash"),
+					"app_bits_cache/")),
+			signAppStashMatchesHandler
+	case config.Azure:
+		log.Log.Infow("Creating Azure blobstore", "container", blobstoreConfig.AzureConfig.ContainerName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						newAzureBlobstore(*blobstoreConfig.AzureConfig, metricsService, backgroundWorkers),
+						metricsService,
+						"app_stash"),
+					"app_bits_cache/")),
+			signAppStashMatchesHandler
+	case config.OpenStack:
+		log.Log.Infow("Creating Openstack blobstore", "container", blobstoreConfig.OpenstackConfig.ContainerName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						openstack.NewBlobstore(*blobstoreConfig.OpenstackConfig),
+						metricsService,
+						"app_stash"),
+					"app_bits_cache/")),
+			signAppStashMatchesHandler
+	case config.WebDAV:
+		log.Log.Infow("Creating Webdav blobstore",
+			"public-endpoint", blobstoreConfig.WebdavConfig.PublicEndpoint,
+			"private-endpoint", blobstoreConfig.WebdavConfig.PrivateEndpoint)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						webdav.NewBlobstore(*blobstoreConfig.WebdavConfig),
+						metricsService,
+						"app_stash"),
+					blobstoreConfig.WebdavConfig.DirectoryKey+"/app_bits_cache/")),
+			signAppStashMatchesHandler
+	case config.Alibaba:
+		log.Log.Infow("Creating Alibaba blobstore", "bucket-name", blobstoreConfig.AlibabaConfig.BucketName)
+		return decorator.ForBlobstoreWithPathPartitioning(
+				decorator.ForBlobstoreWithPathPrefixing(
+					decorator.ForBlobstoreWithMetricsEmitter(
+						alibaba.NewBlobstore(*blobstoreConfig.AlibabaConfig),
+						metricsService,
+						"app_stash"),
+					"app_bits_cache/")),
+			signAppStashMatchesHandler
+	default:
+		log.Log.Fatalw("blobstoreConfig is invalid.", "blobstore-type", blobstoreConfig.BlobstoreType)
+		return nil, nil // satisfy compiler
+	}
+}
+
+func CreateRootFSBlobstore(blobstoreConfig config.BlobstoreConfig) bitsgo.Blobstore {
+	if blobstoreConfig.BlobstoreType != config.Local {
+		log.Log.Fatalw("RootFS blobstore currently only allows local blobstores", "blobstore-type", blobstoreConfig.BlobstoreType)
+	}
+	log.Log.Infow("Creating local blobstore", "path-prefix", blobstoreConfig.LocalConfig.PathPrefix)
+	return local.NewBlobstore(*blobstoreConfig.LocalConfig)
+}
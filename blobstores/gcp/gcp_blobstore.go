@@ -2,38 +2,44 @@ package gcp
 
 import (
 	"context"
+	"hash/crc32"
 	"io"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2/jwt"
+	"golang.org/x/sync/semaphore"
 
 	"cloud.google.com/go/storage"
 
-	"github.com/cenkalti/backoff"
 	"github.com/cloudfoundry-incubator/bits-service"
 	"github.com/cloudfoundry-incubator/bits-service/blobstores/validate"
 	"github.com/cloudfoundry-incubator/bits-service/config"
 	"github.com/cloudfoundry-incubator/bits-service/logger"
 	"github.com/cloudfoundry-incubator/bits-service/util"
 	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 type Blobstore struct {
-	client       *storage.Client
-	jwtConfig    *jwt.Config
-	bucket       string
-	retryTimeout time.Duration
+	client          *storage.Client
+	jwtConfig       *jwt.Config
+	bucket          string
+	retryTimeout    time.Duration
+	chunkSize       int
+	signedURLExpiry time.Duration
+	endpoint        *url.URL
 }
 
 func NewBlobstore(config config.GCPBlobstoreConfig) *Blobstore {
 	validate.NotEmpty(config.Bucket)
+	// Email and PrivateKey are needed for signing URLs, even when requests are not authenticated.
 	validate.NotEmpty(config.Email)
 	validate.NotEmpty(config.PrivateKey)
-	validate.NotEmpty(config.PrivateKeyID)
-	validate.NotEmpty(config.TokenURL)
 
 	ctx := context.TODO()
 
@@ -44,7 +50,27 @@ func NewBlobstore(config config.GCPBlobstoreConfig) *Blobstore {
 		Scopes:       []string{storage.ScopeFullControl},
 		TokenURL:     config.TokenURL,
 	}
-	client, err := storage.NewClient(ctx, option.WithTokenSource(jwtConfig.TokenSource(ctx)))
+	var (
+		options  []option.ClientOption
+		endpoint *url.URL
+	)
+	if config.Endpoint != "" {
+		var e error
+		endpoint, e = url.Parse(config.Endpoint)
+		if e != nil {
+			panic(errors.Wrapf(e, "Invalid endpoint %v", config.Endpoint))
+		}
+		options = append(options, option.WithEndpoint(config.Endpoint))
+	}
+	if config.Unauthenticated {
+		validate.NotEmptyMessage(config.Endpoint, "Unauthenticated requires an endpoint")
+		options = append(options, option.WithoutAuthentication())
+	} else {
+		validate.NotEmpty(config.PrivateKeyID)
+		validate.NotEmpty(config.TokenURL)
+		options = append(options, option.WithTokenSource(jwtConfig.TokenSource(ctx)))
+	}
+	client, err := storage.NewClient(ctx, options...)
 	if err != nil {
 		panic(err)
 	}
@@ -52,29 +78,25 @@ func NewBlobstore(config config.GCPBlobstoreConfig) *Blobstore {
 		config.RetryTimeoutSeconds = 5
 	}
 	return &Blobstore{
-		client:       client,
-		bucket:       config.Bucket,
-		jwtConfig:    jwtConfig,
-		retryTimeout: time.Duration(config.RetryTimeoutSeconds) * time.Second,
+		client:          client,
+		bucket:          config.Bucket,
+		jwtConfig:       jwtConfig,
+		retryTimeout:    time.Duration(config.RetryTimeoutSeconds) * time.Second,
+		chunkSize:       config.ChunkSizeBytes(),
+		signedURLExpiry: config.SignedURLExpiry(),
+		endpoint:        endpoint,
 	}
 }
 
-// The Golang GCP API is limited in the way it does retries:
-// By default, it retries forever, with no safe-guard against "hanging" requests. By decorating
-// the context passed to all functions with a timeout, it's now safe-guarded, but there is now
-// no way to cut off connections and retry. It's because the timeout decorator now causes the retry
-// mechanism to break out of the retry loop. The retry mechanism was not written with "hanging"
-// requests in mind, that simply need to be cut off and retried.
-// Therefore, we must add the retry here in all functions ontop of the built-in retry.
+// The Golang GCP API retries forever by default, with no safe-guard against "hanging" requests.
+// Decorating the context passed to all functions with a timeout safe-guards against them.
+// Timed out requests are retried by decorator.RetryingBlobstoreDecorator.
 
 func (blobstore *Blobstore) Exists(path string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), blobstore.retryTimeout)
 	defer cancel()
 
-	e := WithRetries(4, func() error {
-		_, e := blobstore.client.Bucket(blobstore.bucket).Object(path).Attrs(ctx)
-		return TimeoutOrPermanent(e)
-	})
+	_, e := blobstore.client.Bucket(blobstore.bucket).Object(path).Attrs(ctx)
 	if e != nil {
 		e = blobstore.handleError(e, "Failed to check for %v/%v", blobstore.bucket, path)
 		if _, ok := e.(*bitsgo.NotFoundError); ok {
@@ -95,32 +117,46 @@ func (blobstore *Blobstore) Get(path string) (body io.ReadCloser, err error) {
 }
 
 func (blobstore *Blobstore) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
-	signedUrl, e := storage.SignedURL(blobstore.bucket, path, &storage.SignedURLOptions{
-		GoogleAccessID: blobstore.jwtConfig.Email,
-		PrivateKey:     blobstore.jwtConfig.PrivateKey,
-		Method:         "GET",
-		Expires:        time.Now().Add(time.Hour),
-	})
+	signedUrl, e := blobstore.signedURL(path, "GET", time.Now().Add(blobstore.signedURLExpiry))
 	return nil, signedUrl, e
 }
 
+// Put uploads src in chunks of chunkSize using a resumable upload, so that a failed chunk can be retried without
+// uploading the whole blob again. The CRC32C checksum of src is sent along, so GCS rejects the upload when the
+// content it received differs.
 func (blobstore *Blobstore) Put(path string, src io.ReadSeeker) error {
 	logger.Log.Debugw("Put to GCP", "bucket", blobstore.bucket, "path", path)
 	if e := blobstore.bucketExists(); e != nil {
 		return e
 	}
+	checksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	_, e := io.Copy(checksum, src)
+	if e != nil {
+		return errors.Wrapf(e, "Could not compute checksum of %v", path)
+	}
+	_, e = src.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrapf(e, "Could not rewind %v", path)
+	}
+
 	writer := blobstore.client.Bucket(blobstore.bucket).Object(path).NewWriter(context.TODO())
+	writer.ChunkSize = blobstore.chunkSize
+	writer.CRC32C = checksum.Sum32()
+	writer.SendCRC32C = true
 	var safeCloser util.SafeCloser
 	defer safeCloser.Close(writer)
 
-	_, e := io.Copy(writer, src)
+	_, e = io.Copy(writer, src)
 	if e != nil {
-		return errors.Wrapf(e, "Path %v", path)
+		return blobstore.handleError(e, "Path %v", path)
 	}
 
 	e = safeCloser.Close(writer)
 	if e != nil {
-		return errors.Wrapf(e, "Path %v", path)
+		return blobstore.handleError(e, "Path %v", path)
+	}
+	if writer.Attrs().CRC32C != checksum.Sum32() {
+		return errors.Errorf("CRC32C mismatch for %v: expected %x, got %x", path, checksum.Sum32(), writer.Attrs().CRC32C)
 	}
 	return nil
 }
@@ -131,10 +167,7 @@ func (blobstore *Blobstore) Copy(src, dest string) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), blobstore.retryTimeout)
 	defer cancel()
 
-	e := WithRetries(4, func() error {
-		_, e := blobstore.client.Bucket(blobstore.bucket).Object(dest).CopierFrom(blobstore.client.Bucket(blobstore.bucket).Object(src)).Run(ctx)
-		return TimeoutOrPermanent(e)
-	})
+	_, e := blobstore.client.Bucket(blobstore.bucket).Object(dest).CopierFrom(blobstore.client.Bucket(blobstore.bucket).Object(src)).Run(ctx)
 	if e != nil {
 		return blobstore.handleError(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.bucket)
 	}
@@ -145,68 +178,106 @@ func (blobstore *Blobstore) Delete(path string) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), blobstore.retryTimeout)
 	defer cancel()
 
-	e := WithRetries(4, func() error {
-		e := blobstore.client.Bucket(blobstore.bucket).Object(path).Delete(ctx)
-		return TimeoutOrPermanent(e)
-	})
+	e := blobstore.client.Bucket(blobstore.bucket).Object(path).Delete(ctx)
 	if e != nil {
 		return blobstore.handleError(e, "Path %v", path)
 	}
 	return nil
 }
 
+// DeleteDir deletes the objects in parallel, since GCS has no batch delete in its JSON API client.
 func (blobstore *Blobstore) DeleteDir(prefix string) error {
-	deletionErrs := []error{}
-	it := blobstore.client.Bucket(blobstore.bucket).Objects(context.TODO(), &storage.Query{Prefix: prefix})
+	const numWorkers = 10
+	var (
+		errMutex     sync.Mutex
+		deletionErrs = []error{}
+		ctx          = context.TODO()
+		sem          = semaphore.NewWeighted(numWorkers)
+	)
+	it := blobstore.client.Bucket(blobstore.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
 	for {
 		attrs, e := it.Next()
 		if e == iterator.Done {
 			break
 		}
 		if e != nil {
-			return errors.Wrapf(e, "Prefix %v", prefix)
+			util.Must(sem.Acquire(ctx, numWorkers))
+			return blobstore.handleError(e, "Prefix %v, errors from deleting: %v", prefix, deletionErrs)
 		}
-		e = blobstore.Delete(attrs.Name)
-		if e != nil {
-			if _, isNotFoundError := e.(*bitsgo.NotFoundError); !isNotFoundError {
+		util.Must(sem.Acquire(ctx, 1))
+		go func(name string) {
+			defer sem.Release(1)
+			e := blobstore.Delete(name)
+			if e != nil && !bitsgo.IsNotFoundError(e) {
+				errMutex.Lock()
+				defer errMutex.Unlock()
 				deletionErrs = append(deletionErrs, e)
 			}
-		}
+		}(attrs.Name)
 	}
+	util.Must(sem.Acquire(ctx, numWorkers))
 	if len(deletionErrs) != 0 {
 		return errors.Errorf("Prefix %v, errors from deleting: %v", prefix, deletionErrs)
 	}
 	return nil
 }
 
-func (blobstore *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos := []bitsgo.BlobInfo{}
+	it := blobstore.client.Bucket(blobstore.bucket).Objects(context.TODO(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, e := it.Next()
+		if e == iterator.Done {
+			break
+		}
+		if e != nil {
+			return nil, blobstore.handleError(e, "Prefix %v", prefix)
+		}
+		blobInfos = append(blobInfos, bitsgo.BlobInfo{Path: attrs.Name, Size: attrs.Size, LastModified: attrs.Updated})
+	}
+	return blobInfos, nil
+}
+
+func (blobstore *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
 	if strings.ToLower(method) != "get" && method != "put" {
-		panic("The only supported methods are 'put' and 'get'")
+		return "", errors.Errorf("The only supported methods are 'put' and 'get', but got '%v'", method)
+	}
+	signedURL, e := blobstore.signedURL(resource, strings.ToUpper(method), expirationTime)
+	if e != nil {
+		return "", e
 	}
-	signedURL, e := storage.SignedURL(blobstore.bucket, resource, &storage.SignedURLOptions{
+	logger.Log.Debugw("Signed URL", "verb", method, "signed-url", signedURL)
+	return signedURL, nil
+}
+
+// signedURL creates a V4 signed URL, which must not be valid for more than 7 days.
+// With a custom endpoint, the URL points to the endpoint's host instead. Since the host is part of the signature,
+// such URLs only work with servers which do not verify signatures, e.g. fake-gcs-server.
+func (blobstore *Blobstore) signedURL(path string, method string, expirationTime time.Time) (string, error) {
+	signedURL, e := storage.SignedURL(blobstore.bucket, path, &storage.SignedURLOptions{
 		GoogleAccessID: blobstore.jwtConfig.Email,
 		PrivateKey:     blobstore.jwtConfig.PrivateKey,
-		Method:         strings.ToUpper(method),
+		Method:         method,
 		Expires:        expirationTime,
+		Scheme:         storage.SigningSchemeV4,
 	})
 	if e != nil {
-		panic(e)
+		return "", errors.Wrapf(e, "Could not sign URL for %v", path)
 	}
-	logger.Log.Debugw("Signed URL", "verb", method, "signed-url", signedURL)
-	return
-}
-
-func WithRetries(numRetries uint64, f func() error) error {
-	return backoff.Retry(f, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), numRetries))
-}
-
-func TimeoutOrPermanent(e error) error {
-	if timeoutError, isTimeoutError := e.(interface{ Timeout() bool }); isTimeoutError && timeoutError.Timeout() {
-		return e
+	if blobstore.endpoint == nil {
+		return signedURL, nil
+	}
+	u, e := url.Parse(signedURL)
+	if e != nil {
+		return "", errors.Wrapf(e, "Could not parse signed URL for %v", path)
 	}
-	return backoff.Permanent(e)
+	u.Scheme = blobstore.endpoint.Scheme
+	u.Host = blobstore.endpoint.Host
+	return u.String(), nil
 }
 
+// handleError translates a missing object into *NotFoundError, a missing bucket into *ContainerNotFoundError and
+// failed API requests into the typed errors corresponding to their status codes.
 func (blobstore *Blobstore) handleError(e error, context string, args ...interface{}) error {
 	if e == storage.ErrObjectNotExist {
 		e := blobstore.bucketExists()
@@ -215,13 +286,22 @@ func (blobstore *Blobstore) handleError(e error, context string, args ...interfa
 		}
 		return bitsgo.NewNotFoundError()
 	}
+	if e == storage.ErrBucketNotExist {
+		return bitsgo.NewContainerNotFoundError(blobstore.bucket)
+	}
+	if apiError, ok := e.(*googleapi.Error); ok {
+		return bitsgo.ErrorFromStatusCode(apiError.Code, apiError.Header, errors.Wrapf(e, context, args...))
+	}
 	return errors.Wrapf(e, context, args...)
 }
 
 func (blobstore *Blobstore) bucketExists() error {
 	_, e := blobstore.client.Bucket(blobstore.bucket).Attrs(context.TODO())
+	if e == storage.ErrBucketNotExist {
+		return bitsgo.NewContainerNotFoundError(blobstore.bucket)
+	}
 	if e != nil {
-		return errors.Wrapf(e, "Error while checking for bucket existence. Bucket '%v'", blobstore.bucket)
+		return blobstore.handleError(e, "Error while checking for bucket existence. Bucket '%v'", blobstore.bucket)
 	}
 	return nil
 }
@@ -0,0 +1,251 @@
+package gcp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/cloudfoundry-incubator/bits-service/blobstores/gcp"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestGCPBlobstore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GCPBlobstore")
+}
+
+func privateKeyPEM() string {
+	privateKey, e := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(e).NotTo(HaveOccurred())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}))
+}
+
+func crc32cBase64(content []byte) string {
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(checksum)
+}
+
+var _ = Describe("Blobstore", func() {
+	var (
+		server    *httptest.Server
+		respond   http.HandlerFunc
+		gcpConfig config.GCPBlobstoreConfig
+		blobstore *Blobstore
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			defer GinkgoRecover()
+			respond(responseWriter, request)
+		}))
+		gcpConfig = config.GCPBlobstoreConfig{
+			Bucket:          "some-bucket",
+			Email:           "some-email@example.com",
+			PrivateKey:      privateKeyPEM(),
+			Endpoint:        server.URL + "/storage/v1/",
+			Unauthenticated: true,
+		}
+	})
+
+	JustBeforeEach(func() { blobstore = NewBlobstore(gcpConfig) })
+
+	AfterEach(func() { server.Close() })
+
+	Context("NewBlobstore", func() {
+		It("refuses to send unauthenticated requests to GCS itself", func() {
+			withoutEndpoint := gcpConfig
+			withoutEndpoint.Endpoint = ""
+
+			Expect(func() { NewBlobstore(withoutEndpoint) }).To(Panic())
+		})
+	})
+
+	Context("Put", func() {
+		var (
+			mutex           sync.Mutex
+			uploadMetadata  map[string]interface{}
+			chunkRanges     []string
+			uploadedContent []byte
+			returnedCRC32C  string
+		)
+
+		BeforeEach(func() {
+			gcpConfig.ChunkSize = "256K"
+			uploadMetadata = nil
+			chunkRanges = nil
+			uploadedContent = nil
+			returnedCRC32C = ""
+			respond = func(responseWriter http.ResponseWriter, request *http.Request) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				switch {
+				case request.Method == "GET" && request.URL.Path == "/storage/v1/b/some-bucket":
+					fmt.Fprint(responseWriter, `{"name": "some-bucket"}`)
+				case request.Method == "POST" && request.URL.Query().Get("uploadType") == "resumable":
+					Expect(json.NewDecoder(request.Body).Decode(&uploadMetadata)).To(Succeed())
+					responseWriter.Header().Set("Location", server.URL+"/upload-session")
+				case request.Method == "PUT" && request.URL.Path == "/upload-session":
+					chunk, e := ioutil.ReadAll(request.Body)
+					Expect(e).NotTo(HaveOccurred())
+					chunkRanges = append(chunkRanges, request.Header.Get("Content-Range"))
+					uploadedContent = append(uploadedContent, chunk...)
+					if strings.HasSuffix(request.Header.Get("Content-Range"), "/*") {
+						responseWriter.Header().Set("Range", fmt.Sprintf("bytes=0-%v", len(uploadedContent)-1))
+						responseWriter.WriteHeader(http.StatusPermanentRedirect)
+						return
+					}
+					crc32c := returnedCRC32C
+					if crc32c == "" {
+						crc32c = crc32cBase64(uploadedContent)
+					}
+					fmt.Fprintf(responseWriter, `{"name": "some/path", "bucket": "some-bucket", "size": "%v", "crc32c": "%v"}`, len(uploadedContent), crc32c)
+				default:
+					responseWriter.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(responseWriter, `{"error": {"code": 404, "message": "Not Found"}}`)
+				}
+			}
+		})
+
+		It("uploads in chunks of chunk_size and sends the CRC32C checksum along", func() {
+			content := []byte(strings.Repeat("x", 600*1024))
+
+			Expect(blobstore.Put("some/path", strings.NewReader(string(content)))).To(Succeed())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			Expect(uploadMetadata).To(HaveKeyWithValue("crc32c", crc32cBase64(content)))
+			Expect(chunkRanges).To(Equal([]string{
+				"bytes 0-262143/*",
+				"bytes 262144-524287/*",
+				"bytes 524288-614399/614400",
+			}))
+			Expect(uploadedContent).To(Equal(content))
+		})
+
+		It("returns an error when GCS reports a different CRC32C checksum", func() {
+			returnedCRC32C = crc32cBase64([]byte("other content"))
+
+			e := blobstore.Put("some/path", strings.NewReader("some content"))
+
+			Expect(e).To(MatchError(ContainSubstring("CRC32C mismatch for some/path")))
+		})
+	})
+
+	Context("DeleteDir", func() {
+		var (
+			mutex        sync.Mutex
+			deletedPaths []string
+			numListings  int
+		)
+
+		BeforeEach(func() {
+			deletedPaths = nil
+			numListings = 0
+			respond = func(responseWriter http.ResponseWriter, request *http.Request) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				switch {
+				case request.Method == "GET" && request.URL.Path == "/storage/v1/b/some-bucket/o":
+					numListings++
+					if request.URL.Query().Get("pageToken") == "" {
+						fmt.Fprint(responseWriter, `{"items": [{"name": "dir/a"}, {"name": "dir/b"}], "nextPageToken": "page-2"}`)
+						return
+					}
+					responseWriter.WriteHeader(http.StatusForbidden)
+					fmt.Fprint(responseWriter, `{"error": {"code": 403, "message": "Forbidden"}}`)
+				case request.Method == "DELETE":
+					deletedPaths = append(deletedPaths, strings.TrimPrefix(request.URL.Path, "/storage/v1/b/some-bucket/o/"))
+					responseWriter.WriteHeader(http.StatusNoContent)
+				default:
+					responseWriter.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(responseWriter, `{"error": {"code": 404, "message": "Not Found"}}`)
+				}
+			}
+		})
+
+		It("stops listing when the listing fails and returns the error after the started deletions finished", func() {
+			e := blobstore.DeleteDir("dir/")
+
+			Expect(e).To(HaveOccurred())
+			Expect(e.Error()).To(ContainSubstring("Forbidden"))
+			mutex.Lock()
+			defer mutex.Unlock()
+			Expect(numListings).To(Equal(2))
+			Expect(deletedPaths).To(ConsistOf("dir/a", "dir/b"))
+		})
+	})
+
+	Context("Sign", func() {
+		var expiry time.Time
+
+		BeforeEach(func() {
+			expiry = time.Now().Add(time.Hour)
+		})
+
+		parse := func(signedURL string, e error) *url.URL {
+			Expect(e).NotTo(HaveOccurred())
+			u, e := url.Parse(signedURL)
+			Expect(e).NotTo(HaveOccurred())
+			return u
+		}
+
+		It("creates a V4 signed URL valid until the expiration time", func() {
+			signedURL := parse(blobstore.Sign("some/path", "get", expiry))
+
+			Expect(signedURL.Path).To(Equal("/some-bucket/some/path"))
+			Expect(signedURL.Query().Get("X-Goog-Algorithm")).To(Equal("GOOG4-RSA-SHA256"))
+			Expect(signedURL.Query().Get("X-Goog-Credential")).To(HavePrefix("some-email@example.com/"))
+			Expect(signedURL.Query().Get("X-Goog-Signature")).NotTo(BeEmpty())
+			expires, e := strconv.Atoi(signedURL.Query().Get("X-Goog-Expires"))
+			Expect(e).NotTo(HaveOccurred())
+			Expect(expires).To(BeNumerically("~", 3600, 2))
+		})
+
+		It("refuses to sign URLs which are valid for more than 7 days", func() {
+			_, e := blobstore.Sign("some/path", "get", time.Now().Add(8*24*time.Hour))
+
+			Expect(e).To(HaveOccurred())
+		})
+
+		It("points signed URLs to the endpoint", func() {
+			signedURL := parse(blobstore.Sign("some/path", "put", expiry))
+
+			Expect(signedURL.Scheme).To(Equal("http"))
+			Expect(signedURL.Host).To(Equal(strings.TrimPrefix(server.URL, "http://")))
+		})
+
+		Context("without endpoint", func() {
+			BeforeEach(func() {
+				gcpConfig.Endpoint = ""
+				gcpConfig.Unauthenticated = false
+				gcpConfig.PrivateKeyID = "some-private-key-id"
+				gcpConfig.TokenURL = server.URL + "/token"
+			})
+
+			It("points signed URLs to GCS", func() {
+				signedURL := parse(blobstore.Sign("some/path", "get", expiry))
+
+				Expect(signedURL.Scheme).To(Equal("https"))
+				Expect(signedURL.Host).To(Equal("storage.googleapis.com"))
+			})
+		})
+	})
+})
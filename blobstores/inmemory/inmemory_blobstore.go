@@ -3,6 +3,7 @@ package inmemory_blobstore
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/cloudfoundry-incubator/bits-service"
@@ -65,6 +66,17 @@ func (blobstore *Blobstore) Delete(path string) error {
 	return nil
 }
 
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos := []bitsgo.BlobInfo{}
+	for key, value := range blobstore.Entries {
+		if strings.HasPrefix(key, prefix) {
+			blobInfos = append(blobInfos, bitsgo.BlobInfo{Path: key, Size: int64(len(value))})
+		}
+	}
+	sort.Slice(blobInfos, func(i, j int) bool { return blobInfos[i].Path < blobInfos[j].Path })
+	return blobInfos, nil
+}
+
 func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	for key := range blobstore.Entries {
 		if strings.HasPrefix(key, prefix) {
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/cloudfoundry-incubator/bits-service/config"
 
@@ -150,3 +151,32 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	}
 	return nil
 }
+
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos := []bitsgo.BlobInfo{}
+	root := filepath.Join(blobstore.pathPrefix, filepath.Dir(prefix))
+	e := filepath.Walk(root, func(path string, info os.FileInfo, e error) error {
+		if e != nil {
+			if os.IsNotExist(e) {
+				return nil
+			}
+			return e
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relativePath, e := filepath.Rel(blobstore.pathPrefix, path)
+		if e != nil {
+			return e
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if strings.HasPrefix(relativePath, prefix) {
+			blobInfos = append(blobInfos, bitsgo.BlobInfo{Path: relativePath, Size: info.Size(), LastModified: info.ModTime()})
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, errors.Wrapf(e, "Failed to list path %v", root)
+	}
+	return blobInfos, nil
+}
@@ -14,6 +14,6 @@ type LocalResourceSigner struct {
 	DelegateEndpoint   string
 }
 
-func (signer *LocalResourceSigner) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
-	return fmt.Sprintf("%s%s", signer.DelegateEndpoint, signer.Signer.Sign(method, signer.ResourcePathPrefix+resource, expirationTime))
+func (signer *LocalResourceSigner) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
+	return fmt.Sprintf("%s%s", signer.DelegateEndpoint, signer.Signer.Sign(method, signer.ResourcePathPrefix+resource, expirationTime)), nil
 }
@@ -0,0 +1,242 @@
+package openstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/ncw/swift"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/cloudfoundry-incubator/bits-service/util"
+)
+
+// Objects larger than segmentSize are stored as static large objects (SLO): the content is uploaded in segments
+// to the segment container and the object itself is a manifest referencing these segments.
+// See https://docs.openstack.org/swift/latest/overview_large_objects.html
+//
+// Segments of an object are stored under <path>/_segments/<upload-id>/, so that concurrent uploads of the same path
+// do not overwrite each other's segments. When the object is overwritten or deleted, the segments referenced by its
+// manifest are deleted. See segmentsOf.
+
+const segmentsInfix = "/_segments/"
+
+type manifestEntry struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// segmentInfo is an entry of a manifest as returned by GET with ?multipart-manifest=get.
+type segmentInfo struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (blobstore *Blobstore) putLargeObject(path string, src io.ReadSeeker, size int64, previousSegments []string) error {
+	e := blobstore.swiftConn.ContainerCreate(blobstore.segmentContainerName, nil)
+	if e != nil {
+		return errors.Wrapf(e, "Could not create segment container '%v'", blobstore.segmentContainerName)
+	}
+
+	uploadID := uuid.NewV4().String()
+	numSegments := int((size + blobstore.segmentSize - 1) / blobstore.segmentSize)
+	manifest := make([]manifestEntry, numSegments)
+	readerAt, isReaderAt := src.(io.ReaderAt)
+	concurrency := blobstore.segmentUploadConcurrency
+	if !isReaderAt {
+		// Segments must be read one after the other from src.
+		concurrency = 1
+	}
+	logger.Log.Debugw("Put large object", "container", blobstore.containerName, "path", path, "size", size, "num-segments", numSegments, "concurrency", concurrency)
+
+	e = util.InParallel(numSegments, concurrency, func(i int) error {
+		offset := int64(i) * blobstore.segmentSize
+		length := blobstore.segmentSize
+		if offset+length > size {
+			length = size - offset
+		}
+		var segment io.Reader
+		if isReaderAt {
+			segment = io.NewSectionReader(readerAt, offset, length)
+		} else {
+			_, e := src.Seek(offset, io.SeekStart)
+			if e != nil {
+				return errors.Wrapf(e, "Could not seek to segment %v", i)
+			}
+			segment = io.LimitReader(src, length)
+		}
+		segmentName := fmt.Sprintf("%v%v%v/%08d", path, segmentsInfix, uploadID, i)
+		headers, e := blobstore.swiftConn.ObjectPut(blobstore.segmentContainerName, segmentName, segment, true, "", "application/octet-stream", nil)
+		if e != nil {
+			return errors.Wrapf(e, "Could not upload segment %v of %v", i, path)
+		}
+		manifest[i] = manifestEntry{
+			Path:      blobstore.segmentContainerName + "/" + segmentName,
+			Etag:      headers["Etag"],
+			SizeBytes: length,
+		}
+		return nil
+	})
+	if e == nil {
+		e = blobstore.putManifest(path, manifest)
+	}
+	if e != nil {
+		blobstore.deleteSegments(uploadedSegments(manifest))
+		return e
+	}
+	blobstore.deleteSegments(previousSegments)
+	return nil
+}
+
+// copyLargeObject copies the segments of src server-side and creates a new manifest for dest. Copying the manifest
+// only would make both objects share segments, which would then be deleted together with either of them.
+func (blobstore *Blobstore) copyLargeObject(src, dest string, previousSegments []string) error {
+	segments, e := blobstore.readManifest(src)
+	if e != nil {
+		return e
+	}
+	uploadID := uuid.NewV4().String()
+	manifest := make([]manifestEntry, len(segments))
+	e = util.InParallel(len(segments), blobstore.segmentUploadConcurrency, func(i int) error {
+		srcContainer, srcName := splitSegmentPath(segments[i].Name)
+		segmentName := fmt.Sprintf("%v%v%v/%08d", dest, segmentsInfix, uploadID, i)
+		_, e := blobstore.swiftConn.ObjectCopy(srcContainer, srcName, blobstore.segmentContainerName, segmentName, nil)
+		if e != nil {
+			return errors.Wrapf(e, "Could not copy segment %v to %v", segments[i].Name, segmentName)
+		}
+		manifest[i] = manifestEntry{
+			Path:      blobstore.segmentContainerName + "/" + segmentName,
+			Etag:      segments[i].Hash,
+			SizeBytes: segments[i].Bytes,
+		}
+		return nil
+	})
+	if e == nil {
+		e = blobstore.putManifest(dest, manifest)
+	}
+	if e != nil {
+		blobstore.deleteSegments(uploadedSegments(manifest))
+		return e
+	}
+	blobstore.deleteSegments(previousSegments)
+	return nil
+}
+
+// uploadedSegments returns the paths of the segments in manifest which have been uploaded successfully.
+func uploadedSegments(manifest []manifestEntry) []string {
+	var segments []string
+	for _, entry := range manifest {
+		if entry.Path != "" {
+			segments = append(segments, entry.Path)
+		}
+	}
+	return segments
+}
+
+func (blobstore *Blobstore) putManifest(path string, manifest []manifestEntry) error {
+	body, e := json.Marshal(manifest)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal manifest")
+	}
+	_, _, e = blobstore.swiftConn.Call(blobstore.swiftConn.StorageUrl, swift.RequestOpts{
+		Container:  blobstore.containerName,
+		ObjectName: path,
+		Operation:  "PUT",
+		Parameters: url.Values{"multipart-manifest": []string{"put"}},
+		Body:       bytes.NewReader(body),
+		NoResponse: true,
+		OnReAuth:   func() (string, error) { return blobstore.swiftConn.StorageUrl, nil },
+	})
+	if e != nil {
+		return blobstore.handleError(e, path, "Could not put manifest. Container: '%v', path: '%v'", blobstore.containerName, path)
+	}
+	return nil
+}
+
+func (blobstore *Blobstore) readManifest(path string) ([]segmentInfo, error) {
+	response, _, e := blobstore.swiftConn.Call(blobstore.swiftConn.StorageUrl, swift.RequestOpts{
+		Container:  blobstore.containerName,
+		ObjectName: path,
+		Operation:  "GET",
+		Parameters: url.Values{"multipart-manifest": []string{"get"}},
+		OnReAuth:   func() (string, error) { return blobstore.swiftConn.StorageUrl, nil },
+	})
+	if e != nil {
+		return nil, blobstore.handleError(e, path, "Could not get manifest. Container: '%v', path: '%v'", blobstore.containerName, path)
+	}
+	defer response.Body.Close()
+	var segments []segmentInfo
+	e = json.NewDecoder(response.Body).Decode(&segments)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not decode manifest of %v", path)
+	}
+	return segments, nil
+}
+
+func (blobstore *Blobstore) isLargeObject(path string) (bool, error) {
+	_, headers, e := blobstore.swiftConn.Object(blobstore.containerName, path)
+	if e != nil {
+		return false, blobstore.handleError(e, path, "Container: '%v', path: '%v'", blobstore.containerName, path)
+	}
+	return strings.ToLower(headers["X-Static-Large-Object"]) == "true", nil
+}
+
+// segmentsOf returns the paths of the segments referenced by the object at path, if it is a static large object.
+// Callers read them before overwriting or deleting the object and delete them afterwards using deleteSegments.
+// Failures are only logged, since they leave unreferenced segments behind, but do not affect the object itself.
+func (blobstore *Blobstore) segmentsOf(path string) []string {
+	_, headers, e := blobstore.swiftConn.Object(blobstore.containerName, path)
+	if e == swift.ObjectNotFound || e == swift.ContainerNotFound {
+		return nil
+	}
+	if e != nil {
+		logger.Log.Errorw("Could not check for large object", "container", blobstore.containerName, "path", path, "error", e)
+		return nil
+	}
+	if strings.ToLower(headers["X-Static-Large-Object"]) != "true" {
+		return nil
+	}
+	segmentInfos, e := blobstore.readManifest(path)
+	if e != nil {
+		logger.Log.Errorw("Could not read manifest", "container", blobstore.containerName, "path", path, "error", e)
+		return nil
+	}
+	segments := make([]string, len(segmentInfos))
+	for i, segmentInfo := range segmentInfos {
+		segments[i] = segmentInfo.Name
+	}
+	return segments
+}
+
+// deleteSegments deletes the segments given as "container/object" paths.
+// Failures are only logged, since they leave unreferenced segments behind, but do not affect the object itself.
+func (blobstore *Blobstore) deleteSegments(segments []string) {
+	deletionErrs := DeleteInParallel(segments, int64(blobstore.segmentUploadConcurrency), func(segment string) error {
+		container, name := splitSegmentPath(segment)
+		e := blobstore.swiftConn.ObjectDelete(container, name)
+		if e == swift.ObjectNotFound || e == swift.ContainerNotFound {
+			return nil
+		}
+		return e
+	})
+	if len(deletionErrs) != 0 {
+		logger.Log.Errorw("Could not delete segments", "segments", segments, "errors", deletionErrs)
+	}
+}
+
+// splitSegmentPath splits "container/object" as used in manifests into container and object name. Swift strips
+// leading slashes from segment paths and returns them with a leading slash in manifests read back.
+func splitSegmentPath(segmentPath string) (container string, name string) {
+	parts := strings.SplitN(strings.TrimLeft(segmentPath, "/"), "/", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -3,6 +3,7 @@ package openstack
 import (
 	"context"
 	"io"
+	"net/http"
 	"sync"
 	"time"
 
@@ -10,9 +11,7 @@ import (
 
 	"github.com/ncw/swift"
 
-	"io/ioutil"
-
-	"bytes"
+	"fmt"
 
 	"strings"
 
@@ -25,9 +24,12 @@ import (
 )
 
 type Blobstore struct {
-	containerName         string
-	swiftConn             *swift.Connection
-	accountMetaTempURLKey string
+	containerName            string
+	swiftConn                *swift.Connection
+	accountMetaTempURLKey    string
+	segmentContainerName     string
+	segmentSize              int64
+	segmentUploadConcurrency int
 }
 
 func NewBlobstore(config config.OpenstackBlobstoreConfig) *Blobstore {
@@ -58,109 +60,110 @@ func NewBlobstore(config config.OpenstackBlobstoreConfig) *Blobstore {
 	if e != nil {
 		panic(e)
 	}
+	// Container existence is only checked again, when an object cannot be found. See handleError.
+	_, _, e = swiftConn.Container(config.ContainerName)
+	if e != nil {
+		panic(errors.Wrapf(e, "Could not access container '%v'", config.ContainerName))
+	}
 
 	return &Blobstore{
-		swiftConn:             swiftConn,
-		containerName:         config.ContainerName,
-		accountMetaTempURLKey: config.AccountMetaTempURLKey,
+		swiftConn:                swiftConn,
+		containerName:            config.ContainerName,
+		accountMetaTempURLKey:    config.AccountMetaTempURLKey,
+		segmentContainerName:     config.SegmentContainerNameWithDefault(),
+		segmentSize:              int64(config.SegmentSizeBytes()),
+		segmentUploadConcurrency: config.SegmentUploadConcurrencyWithDefault(),
 	}
 }
 
 func (blobstore *Blobstore) Exists(path string) (bool, error) {
-	if !blobstore.containerExists() {
-		return false, errors.Errorf("Container not found: '%v'", blobstore.containerName)
-	}
-
 	_, _, e := blobstore.swiftConn.Object(blobstore.containerName, path)
-	if e == swift.ObjectNotFound {
-		return false, nil
-	}
 	if e != nil {
-		return false, errors.Wrapf(e, "Failed to check for %v/%v", blobstore.containerName, path)
+		e = blobstore.handleError(e, path, "Failed to check for %v/%v", blobstore.containerName, path)
+		if bitsgo.IsNotFoundError(e) {
+			return false, nil
+		}
+		return false, e
 	}
 	return true, nil
 }
 
-func (blobstore *Blobstore) containerExists() bool {
-	_, _, e := blobstore.swiftConn.Container(blobstore.containerName)
-	return e != swift.ContainerNotFound
-}
-
+// Get streams the object. The returned body also implements io.Seeker, where seeking results in a ranged request.
 func (blobstore *Blobstore) Get(path string) (body io.ReadCloser, err error) {
 	logger.Log.Debugw("Get", "bucket", blobstore.containerName, "path", path)
 
-	if !blobstore.containerExists() {
-		return nil, errors.Errorf("Container not found: '%v'", blobstore.containerName)
-	}
-
-	buf, e := blobstore.swiftConn.ObjectGetBytes(blobstore.containerName, path)
-	if e == swift.ObjectNotFound {
-		return nil, bitsgo.NewNotFoundError()
-	}
+	file, _, e := blobstore.swiftConn.ObjectOpen(blobstore.containerName, path, false, nil)
 	if e != nil {
-		return nil, errors.Wrapf(e, "Container: '%v', path: '%v'", blobstore.containerName, path)
+		return nil, blobstore.handleError(e, path, "Container: '%v', path: '%v'", blobstore.containerName, path)
 	}
-	return ioutil.NopCloser(bytes.NewBuffer(buf)), nil
+	return file, nil
 }
 
 func (blobstore *Blobstore) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
 	return nil, blobstore.swiftConn.ObjectTempUrl(blobstore.containerName, path, blobstore.accountMetaTempURLKey, "GET", time.Now().Add(time.Hour)), nil
 }
 
+// Put stores objects larger than the segment size as static large objects. See putLargeObject.
 func (blobstore *Blobstore) Put(path string, src io.ReadSeeker) error {
 	logger.Log.Debugw("Put", "bucket", blobstore.containerName, "path", path)
 
-	if !blobstore.containerExists() {
-		return errors.Errorf("Container not found: '%v'", blobstore.containerName)
+	size, e := src.Seek(0, io.SeekEnd)
+	if e != nil {
+		return errors.Wrapf(e, "Could not determine size of %v", path)
+	}
+	_, e = src.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrapf(e, "Could not rewind %v", path)
+	}
+	// The previous object at path might have been a large object.
+	previousSegments := blobstore.segmentsOf(path)
+	if size > blobstore.segmentSize {
+		return blobstore.putLargeObject(path, src, size, previousSegments)
 	}
 
-	_, e := blobstore.swiftConn.ObjectPut(blobstore.containerName, path, src, false, "", "", nil)
+	_, e = blobstore.swiftConn.ObjectPut(blobstore.containerName, path, src, false, "", "", nil)
 	if e != nil {
-		return errors.Wrapf(e, "Container: '%v', path: '%v'", blobstore.containerName, path)
+		return blobstore.handleError(e, path, "Container: '%v', path: '%v'", blobstore.containerName, path)
 	}
+	blobstore.deleteSegments(previousSegments)
 	return nil
 }
 
 func (blobstore *Blobstore) Copy(src, dest string) error {
 	logger.Log.Debugw("Copy", "container", blobstore.containerName, "src", src, "dest", dest)
 
-	if !blobstore.containerExists() {
-		return errors.Errorf("Container not found: '%v'", blobstore.containerName)
+	isLargeObject, e := blobstore.isLargeObject(src)
+	if e != nil {
+		return e
 	}
-
-	_, e := blobstore.swiftConn.ObjectCopy(blobstore.containerName, src, blobstore.containerName, dest, nil)
-	if e == swift.ObjectNotFound {
-		return bitsgo.NewNotFoundError()
+	previousSegments := blobstore.segmentsOf(dest)
+	if isLargeObject {
+		return blobstore.copyLargeObject(src, dest, previousSegments)
 	}
+
+	_, e = blobstore.swiftConn.ObjectCopy(blobstore.containerName, src, blobstore.containerName, dest, nil)
 	if e != nil {
-		return errors.Wrapf(e, "Container: '%v', src: '%v', dst: '%v'", blobstore.containerName, src, dest)
+		return blobstore.handleError(e, src, "Container: '%v', src: '%v', dst: '%v'", blobstore.containerName, src, dest)
 	}
+	blobstore.deleteSegments(previousSegments)
 	return nil
 }
 
+// Delete deletes the object and, if it is a large object, its segments.
 func (blobstore *Blobstore) Delete(path string) error {
-	if !blobstore.containerExists() {
-		return errors.Errorf("Container not found: '%v'", blobstore.containerName)
-	}
-
+	segments := blobstore.segmentsOf(path)
 	e := blobstore.swiftConn.ObjectDelete(blobstore.containerName, path)
-	if e == swift.ObjectNotFound {
-		return bitsgo.NewNotFoundError()
-	}
 	if e != nil {
-		return errors.Wrapf(e, "Container: '%v', path: '%v'", blobstore.containerName, path)
+		return blobstore.handleError(e, path, "Container: '%v', path: '%v'", blobstore.containerName, path)
 	}
+	blobstore.deleteSegments(segments)
 	return nil
 }
 
 func (blobstore *Blobstore) DeleteDir(prefix string) error {
-	if !blobstore.containerExists() {
-		return errors.Errorf("Container not found: '%v'", blobstore.containerName)
-	}
-
 	names, e := blobstore.swiftConn.ObjectNames(blobstore.containerName, &swift.ObjectsOpts{Prefix: prefix})
 	if e != nil {
-		return errors.Wrapf(e, "Container: '%v', prefix: '%v'", blobstore.containerName, prefix)
+		return blobstore.handleError(e, prefix, "Container: '%v', prefix: '%v'", blobstore.containerName, prefix)
 	}
 	const numWorkers = 10
 	deletionErrs := DeleteInParallel(names, numWorkers, func(name string) error {
@@ -174,6 +177,46 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	return nil
 }
 
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	objects, e := blobstore.swiftConn.ObjectsAll(blobstore.containerName, &swift.ObjectsOpts{Prefix: prefix})
+	if e != nil {
+		return nil, blobstore.handleError(e, prefix, "Container: '%v', prefix: '%v'", blobstore.containerName, prefix)
+	}
+	blobInfos := make([]bitsgo.BlobInfo, 0, len(objects))
+	for _, object := range objects {
+		blobInfos = append(blobInfos, bitsgo.BlobInfo{Path: object.Name, Size: object.Bytes, LastModified: object.LastModified})
+	}
+	return blobInfos, nil
+}
+
+// handleError translates a 404 into *NotFoundError. Since Swift also responds with 404 when the container is missing,
+// the container's existence is checked in that case. Other failed requests are translated into the typed errors
+// corresponding to their status codes.
+func (blobstore *Blobstore) handleError(e error, path string, context string, args ...interface{}) error {
+	if e == swift.ContainerNotFound {
+		return bitsgo.NewContainerNotFoundError(blobstore.containerName)
+	}
+	if e == swift.ObjectNotFound {
+		_, _, e := blobstore.swiftConn.Container(blobstore.containerName)
+		if e == swift.ContainerNotFound {
+			return bitsgo.NewContainerNotFoundError(blobstore.containerName)
+		}
+		if e != nil {
+			return blobstore.handleError(e, path, "Error while checking for container existence. Container: '%v'", blobstore.containerName)
+		}
+		return bitsgo.NewNotFoundErrorWithKey(path)
+	}
+	if swiftError, ok := e.(*swift.Error); ok {
+		statusCode := swiftError.StatusCode
+		if statusCode == swift.RateLimit.StatusCode {
+			// Swift signals rate limiting with the non-standard status code 498.
+			statusCode = http.StatusTooManyRequests
+		}
+		return bitsgo.ErrorFromStatusCode(statusCode, nil, errors.Wrapf(e, context, args...))
+	}
+	return errors.Wrapf(e, context, args...)
+}
+
 // Visible for testing only
 func DeleteInParallel(names []string, numWorkers int64, deletetionFunc func(name string) error) []error {
 	var errMutex sync.Mutex
@@ -202,11 +245,11 @@ func DeleteInParallel(names []string, numWorkers int64, deletetionFunc func(name
 	return deletionErrs
 }
 
-func (blobstore *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
+func (blobstore *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
 	if strings.ToLower(method) != "get" && method != "put" {
-		panic("The only supported methods are 'put' and 'get'")
+		return "", errors.Errorf("The only supported methods are 'put' and 'get', but got '%v'", method)
 	}
 	signedURL = blobstore.swiftConn.ObjectTempUrl(blobstore.containerName, resource, blobstore.accountMetaTempURLKey, strings.ToUpper(method), time.Now().Add(time.Hour))
 	logger.Log.Debugw("Signed URL", "verb", method, "signed-url", signedURL)
-	return
+	return signedURL, nil
 }
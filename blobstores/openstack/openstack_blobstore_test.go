@@ -3,10 +3,19 @@ package openstack_test
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"time"
 
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 	. "github.com/cloudfoundry-incubator/bits-service/blobstores/openstack"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -104,3 +113,154 @@ var _ = Describe("DeleteInParallel", func() {
 	})
 
 })
+
+var _ = Describe("Blobstore", func() {
+	var (
+		server          *swifttest.SwiftServer
+		swiftConn       *swift.Connection
+		openstackConfig config.OpenstackBlobstoreConfig
+		blobstore       *Blobstore
+	)
+
+	BeforeEach(func() {
+		var e error
+		server, e = swifttest.NewSwiftServer("localhost")
+		Expect(e).NotTo(HaveOccurred())
+
+		swiftConn = &swift.Connection{UserName: swifttest.TEST_ACCOUNT, ApiKey: swifttest.TEST_ACCOUNT, AuthUrl: server.AuthURL}
+		Expect(swiftConn.Authenticate()).To(Succeed())
+		Expect(swiftConn.ContainerCreate("bits", nil)).To(Succeed())
+
+		openstackConfig = config.OpenstackBlobstoreConfig{
+			Username:              swifttest.TEST_ACCOUNT,
+			ApiKey:                swifttest.TEST_ACCOUNT,
+			AuthURL:               server.AuthURL,
+			ContainerName:         "bits",
+			AccountMetaTempURLKey: "some-key",
+		}
+	})
+
+	JustBeforeEach(func() { blobstore = NewBlobstore(openstackConfig) })
+
+	AfterEach(func() { server.Close() })
+
+	Context("Get", func() {
+		JustBeforeEach(func() {
+			Expect(blobstore.Put("some-path", strings.NewReader("the file content"))).To(Succeed())
+		})
+
+		It("streams the object", func() {
+			body, e := blobstore.Get("some-path")
+			Expect(e).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(body)).To(BeEquivalentTo("the file content"))
+			Expect(body.Close()).To(Succeed())
+		})
+
+		It("returns a body which can seek to read a range of the object", func() {
+			body, e := blobstore.Get("some-path")
+			Expect(e).NotTo(HaveOccurred())
+			seeker, isSeeker := body.(io.Seeker)
+			Expect(isSeeker).To(BeTrue())
+
+			_, e = seeker.Seek(4, io.SeekStart)
+			Expect(e).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(io.LimitReader(body, 4))).To(BeEquivalentTo("file"))
+			Expect(body.Close()).To(Succeed())
+		})
+
+		It("returns a NotFoundError for a missing object", func() {
+			_, e := blobstore.Get("missing-path")
+			Expect(bitsgo.IsNotFoundError(e)).To(BeTrue())
+		})
+
+		It("returns a ContainerNotFoundError when the container is gone", func() {
+			Expect(swiftConn.ObjectDelete("bits", "some-path")).To(Succeed())
+			Expect(swiftConn.ContainerDelete("bits")).To(Succeed())
+
+			_, e := blobstore.Get("some-path")
+			Expect(e).To(BeAssignableToTypeOf(&bitsgo.ContainerNotFoundError{}))
+		})
+	})
+
+	Context("objects larger than the segment size", func() {
+		const content = "0123456789012345678901234"
+
+		segmentNames := func() []string {
+			names, e := swiftConn.ObjectNames("bits_segments", nil)
+			Expect(e).NotTo(HaveOccurred())
+			return names
+		}
+
+		BeforeEach(func() {
+			openstackConfig.SegmentSize = "10B"
+			Expect(swiftConn.ContainerCreate("bits_segments", nil)).To(Succeed())
+		})
+
+		It("stores them as static large objects", func() {
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+
+			Expect(segmentNames()).To(HaveLen(3))
+			body, e := blobstore.Get("some-path")
+			Expect(e).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(body)).To(BeEquivalentTo(content))
+			Expect(body.Close()).To(Succeed())
+		})
+
+		It("deletes the previous segments when the object is overwritten by a large object", func() {
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+			previousSegmentNames := segmentNames()
+
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+
+			Expect(segmentNames()).To(HaveLen(3))
+			for _, name := range previousSegmentNames {
+				Expect(segmentNames()).NotTo(ContainElement(name))
+			}
+		})
+
+		It("deletes the previous segments when the object is overwritten by a regular object", func() {
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+
+			Expect(blobstore.Put("some-path", strings.NewReader("small"))).To(Succeed())
+
+			Expect(segmentNames()).To(BeEmpty())
+		})
+
+		It("deletes the segments when the object is deleted", func() {
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+
+			Expect(blobstore.Delete("some-path")).To(Succeed())
+
+			Expect(segmentNames()).To(BeEmpty())
+		})
+
+		It("leaves segments alone which are not referenced by the object", func() {
+			_, e := swiftConn.ObjectPut("bits_segments", "some-path/_segments/concurrent-upload/00000000", strings.NewReader("0123456789"), false, "", "", nil)
+			Expect(e).NotTo(HaveOccurred())
+
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).To(Succeed())
+			Expect(blobstore.Delete("some-path")).To(Succeed())
+
+			Expect(segmentNames()).To(ConsistOf("some-path/_segments/concurrent-upload/00000000"))
+		})
+
+		It("deletes the uploaded segments when the manifest cannot be stored", func() {
+			server.SetOverride("/v1/AUTH_swifttest/bits/some-path", func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+				if r.Method == "PUT" {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				for key, values := range recorder.HeaderMap {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(recorder.Code)
+				w.Write(recorder.Body.Bytes())
+			})
+
+			Expect(blobstore.Put("some-path", strings.NewReader(content))).NotTo(Succeed())
+
+			Expect(segmentNames()).To(BeEmpty())
+		})
+	})
+})
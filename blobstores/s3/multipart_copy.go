@@ -0,0 +1,79 @@
+package s3
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/cloudfoundry-incubator/bits-service/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxCopyObjectSize is the largest object CopyObject can copy.
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	maxNumParts       = 10000
+)
+
+// multipartCopy copies src to dest server-side using UploadPartCopy. When a part fails, the multipart upload is aborted.
+func (blobstore *Blobstore) multipartCopy(src, dest string, size int64) error {
+	partSize := blobstore.partSize
+	if size > partSize*maxNumParts {
+		partSize = (size + maxNumParts - 1) / maxNumParts
+	}
+	numParts := int((size + partSize - 1) / partSize)
+	logger.Log.Debugw("Multipart copy in S3", "bucket", blobstore.bucket, "src", src, "dest", dest, "size", size, "num-parts", numParts)
+
+	upload, e := blobstore.s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               &blobstore.bucket,
+		Key:                  &dest,
+		ServerSideEncryption: blobstore.serverSideEncryption,
+		SSEKMSKeyId:          blobstore.sseKMSKeyID,
+	})
+	if e != nil {
+		return blobstore.handleError(e, "Could not create multipart upload for copying src %v to dest %v in bucket %v", src, dest, blobstore.bucket)
+	}
+
+	parts := make([]*s3.CompletedPart, numParts)
+	e = util.InParallel(numParts, blobstore.concurrency, func(i int) error {
+		firstByte := int64(i) * partSize
+		lastByte := firstByte + partSize - 1
+		if lastByte >= size {
+			lastByte = size - 1
+		}
+		output, e := blobstore.s3Client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          &blobstore.bucket,
+			Key:             &dest,
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(int64(i + 1)),
+			CopySource:      aws.String(blobstore.bucket + "/" + src),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%v-%v", firstByte, lastByte)),
+		})
+		if e != nil {
+			return errors.Wrapf(e, "Could not copy part %v", i+1)
+		}
+		parts[i] = &s3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: aws.Int64(int64(i + 1))}
+		return nil
+	})
+	if e == nil {
+		_, e = blobstore.s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          &blobstore.bucket,
+			Key:             &dest,
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if e != nil {
+		_, abortErr := blobstore.s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   &blobstore.bucket,
+			Key:      &dest,
+			UploadId: upload.UploadId,
+		})
+		if abortErr != nil {
+			logger.Log.Errorw("Could not abort multipart upload", "bucket", blobstore.bucket, "key", dest, "upload-id", aws.StringValue(upload.UploadId), "error", abortErr)
+		}
+		return blobstore.handleError(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.bucket)
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/cloudfoundry-incubator/bits-service"
 	"github.com/cloudfoundry-incubator/bits-service/blobstores/s3/signer"
 	"github.com/cloudfoundry-incubator/bits-service/blobstores/validate"
@@ -22,10 +23,13 @@ import (
 
 type Blobstore struct {
 	s3Client             *s3.S3
+	uploader             *s3manager.Uploader
 	bucket               string
 	signer               S3Signer
 	serverSideEncryption *string
 	sseKMSKeyID          *string
+	partSize             int64
+	concurrency          int
 }
 
 type S3Signer interface {
@@ -76,19 +80,28 @@ func NewBlobstoreWithLogger(config config.S3BlobstoreConfig, logger *zap.Sugared
 		}
 	}
 
+	s3Client := newS3Client(config.Region,
+		config.UseIAMProfile,
+		config.AccessKeyID,
+		config.SecretAccessKey,
+		config.Host,
+		logger,
+		config.S3DebugLogLevel,
+		config.Bucket,
+		config.SignatureVersion,
+	)
 	blobstore := &Blobstore{
-		s3Client: newS3Client(config.Region,
-			config.UseIAMProfile,
-			config.AccessKeyID,
-			config.SecretAccessKey,
-			config.Host,
-			logger,
-			config.S3DebugLogLevel,
-			config.Bucket,
-			config.SignatureVersion,
-		),
-		bucket: config.Bucket,
-		signer: s3Signer,
+		s3Client: s3Client,
+		uploader: s3manager.NewUploaderWithClient(s3Client, func(uploader *s3manager.Uploader) {
+			uploader.PartSize = config.PartSizeBytes()
+			uploader.Concurrency = config.UploadConcurrencyWithDefault()
+			// Aborts the multipart upload when a part fails.
+			uploader.LeavePartsOnError = false
+		}),
+		bucket:      config.Bucket,
+		signer:      s3Signer,
+		partSize:    config.PartSizeBytes(),
+		concurrency: config.UploadConcurrencyWithDefault(),
 	}
 
 	if config.ServerSideEncryption != "" {
@@ -115,7 +128,7 @@ func (blobstore *Blobstore) Exists(path string) (bool, error) {
 		if isS3NotFoundError(e) {
 			return false, nil
 		}
-		return false, errors.Wrapf(e, "Failed to check for %v/%v", blobstore.bucket, path)
+		return false, blobstore.handleError(e, "Failed to check for %v/%v", blobstore.bucket, path)
 	}
 	return true, nil
 }
@@ -130,7 +143,7 @@ func (blobstore *Blobstore) Get(path string) (body io.ReadCloser, err error) {
 		if isS3NotFoundError(e) {
 			return nil, bitsgo.NewNotFoundErrorWithKey(path)
 		}
-		return nil, errors.Wrapf(e, "Path %v", path)
+		return nil, blobstore.handleError(e, "Path %v", path)
 	}
 	return output.Body, nil
 }
@@ -144,9 +157,10 @@ func (blobstore *Blobstore) GetOrRedirect(path string) (body io.ReadCloser, redi
 	return nil, signedUrl, e
 }
 
+// Put uses a multipart upload for blobs larger than the configured part size.
 func (blobstore *Blobstore) Put(path string, src io.ReadSeeker) error {
 	logger.Log.Debugw("Put to S3", "bucket", blobstore.bucket, "path", path)
-	_, e := blobstore.s3Client.PutObject(&s3.PutObjectInput{
+	_, e := blobstore.uploader.Upload(&s3manager.UploadInput{
 		Bucket:               &blobstore.bucket,
 		Key:                  &path,
 		Body:                 src,
@@ -154,28 +168,38 @@ func (blobstore *Blobstore) Put(path string, src io.ReadSeeker) error {
 		SSEKMSKeyId:          blobstore.sseKMSKeyID,
 	})
 	if e != nil {
-		return errors.Wrapf(e, "Path %v", path)
+		return blobstore.handleError(e, "Path %v", path)
 	}
 	return nil
 }
 
+// Copy uses CopyObject and falls back to a multipart copy for blobs larger than the 5GB CopyObject supports.
 func (blobstore *Blobstore) Copy(src, dest string) error {
-	// see https://forums.aws.amazon.com/thread.jspa?threadID=55746:
-	src = strings.Replace(src, "+", "%2B", -1)
-
 	logger.Log.Debugw("Copy in S3", "bucket", blobstore.bucket, "src", src, "dest", dest)
+	// see https://forums.aws.amazon.com/thread.jspa?threadID=55746:
+	copySource := strings.Replace(src, "+", "%2B", -1)
 	_, e := blobstore.s3Client.CopyObject(&s3.CopyObjectInput{
 		Key:                  &dest,
-		CopySource:           aws.String(blobstore.bucket + "/" + src),
+		CopySource:           aws.String(blobstore.bucket + "/" + copySource),
 		Bucket:               &blobstore.bucket,
 		ServerSideEncryption: blobstore.serverSideEncryption,
 		SSEKMSKeyId:          blobstore.sseKMSKeyID,
 	})
+	if isS3InvalidRequestError(e) {
+		// S3 rejects copy sources larger than 5GB as invalid request.
+		head, headErr := blobstore.s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: &blobstore.bucket,
+			Key:    &src,
+		})
+		if headErr == nil && aws.Int64Value(head.ContentLength) > maxCopyObjectSize {
+			return blobstore.multipartCopy(copySource, dest, aws.Int64Value(head.ContentLength))
+		}
+	}
 	if e != nil {
 		if isS3NotFoundError(e) {
 			return bitsgo.NewNotFoundErrorWithKey(src)
 		}
-		return errors.Wrapf(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.bucket)
+		return blobstore.handleError(e, "Error while trying to copy src %v to dest %v in bucket %v", src, dest, blobstore.bucket)
 	}
 	return nil
 }
@@ -189,11 +213,12 @@ func (blobstore *Blobstore) Delete(path string) error {
 		if isS3NotFoundError(e) {
 			return bitsgo.NewNotFoundErrorWithKey(path)
 		}
-		return errors.Wrapf(e, "Path %v", path)
+		return blobstore.handleError(e, "Path %v", path)
 	}
 	return nil
 }
 
+// DeleteDir deletes the objects of each listed page, i.e. up to 1000 keys, with a single DeleteObjects request.
 func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	deletionErrs := []error{}
 	e := blobstore.s3Client.ListObjectsPages(
@@ -202,18 +227,11 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 			Prefix: &prefix,
 		},
 		func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool) {
-			for _, object := range p.Contents {
-				e := blobstore.Delete(*object.Key)
-				if e != nil {
-					if _, isNotFoundError := e.(*bitsgo.NotFoundError); !isNotFoundError {
-						deletionErrs = append(deletionErrs, e)
-					}
-				}
-			}
+			deletionErrs = append(deletionErrs, blobstore.deleteObjects(p.Contents)...)
 			return true
 		})
 	if e != nil {
-		return errors.Wrapf(e, "Prefix %v, errors from deleting: %v", prefix, deletionErrs)
+		return blobstore.handleError(e, "Prefix %v, errors from deleting: %v", prefix, deletionErrs)
 	}
 	if len(deletionErrs) != 0 {
 		return errors.Errorf("Prefix %v, errors from deleting: %v", prefix, deletionErrs)
@@ -221,7 +239,59 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	return nil
 }
 
-func (signer *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string) {
+func (blobstore *Blobstore) deleteObjects(objects []*s3.Object) []error {
+	if len(objects) == 0 {
+		return nil
+	}
+	identifiers := make([]*s3.ObjectIdentifier, len(objects))
+	for i, object := range objects {
+		identifiers[i] = &s3.ObjectIdentifier{Key: object.Key}
+	}
+	output, e := blobstore.s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: &blobstore.bucket,
+		Delete: &s3.Delete{
+			Objects: identifiers,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if e != nil {
+		return []error{blobstore.handleError(e, "Keys %v to %v", *objects[0].Key, *objects[len(objects)-1].Key)}
+	}
+	deletionErrs := []error{}
+	for _, deletionErr := range output.Errors {
+		if aws.StringValue(deletionErr.Code) == "NoSuchKey" {
+			continue
+		}
+		deletionErrs = append(deletionErrs, errors.Errorf("Key %v: %v (%v)",
+			aws.StringValue(deletionErr.Key), aws.StringValue(deletionErr.Message), aws.StringValue(deletionErr.Code)))
+	}
+	return deletionErrs
+}
+
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	blobInfos := []bitsgo.BlobInfo{}
+	e := blobstore.s3Client.ListObjectsPages(
+		&s3.ListObjectsInput{
+			Bucket: &blobstore.bucket,
+			Prefix: &prefix,
+		},
+		func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool) {
+			for _, object := range p.Contents {
+				blobInfos = append(blobInfos, bitsgo.BlobInfo{
+					Path:         *object.Key,
+					Size:         aws.Int64Value(object.Size),
+					LastModified: aws.TimeValue(object.LastModified),
+				})
+			}
+			return true
+		})
+	if e != nil {
+		return nil, blobstore.handleError(e, "Prefix %v", prefix)
+	}
+	return blobInfos, nil
+}
+
+func (signer *Blobstore) Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error) {
 	var request *request.Request
 	switch strings.ToLower(method) {
 	case "put":
@@ -237,13 +307,13 @@ func (signer *Blobstore) Sign(resource string, method string, expirationTime tim
 			Key:    aws.String(resource),
 		})
 	default:
-		panic("The only supported methods are 'put' and 'get'. But got '" + method + "'")
+		return "", errors.Errorf("The only supported methods are 'put' and 'get'. But got '%v'", method)
 	}
 	// TODO use clock
 	signedURL, e := signer.signer.Sign(request, signer.bucket, resource, expirationTime)
 	if e != nil {
-		panic(e)
+		return "", errors.Wrapf(e, "Could not sign URL for %v", resource)
 	}
 	logger.Log.Debugw("Signed URL", "verb", method, "signed-url", signedURL)
-	return
+	return signedURL, nil
 }
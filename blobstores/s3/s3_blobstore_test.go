@@ -0,0 +1,276 @@
+package s3_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	. "github.com/cloudfoundry-incubator/bits-service/blobstores/s3"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// recordedRequest is a request received by the fake S3 server.
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  map[string][]string
+	Header http.Header
+	Body   string
+}
+
+func (request recordedRequest) String() string {
+	return request.Method + " " + request.Path
+}
+
+// fakeS3 is an S3 server which records all requests and answers them with Respond.
+type fakeS3 struct {
+	*httptest.Server
+	Respond func(responseWriter http.ResponseWriter, request *http.Request)
+
+	mutex    sync.Mutex
+	requests []recordedRequest
+}
+
+func newFakeS3() *fakeS3 {
+	fake := &fakeS3{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		defer GinkgoRecover()
+		body, e := ioutil.ReadAll(request.Body)
+		Expect(e).NotTo(HaveOccurred())
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, recordedRequest{
+			Method: request.Method,
+			Path:   request.URL.Path,
+			Query:  request.URL.Query(),
+			Header: request.Header,
+			Body:   string(body),
+		})
+		fake.mutex.Unlock()
+		fake.Respond(responseWriter, request)
+	}))
+	return fake
+}
+
+func (fake *fakeS3) Requests() []recordedRequest {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]recordedRequest{}, fake.requests...)
+}
+
+func (fake *fakeS3) RequestsWith(method string, query string) []recordedRequest {
+	var result []recordedRequest
+	for _, request := range fake.Requests() {
+		if _, hasQuery := request.Query[query]; request.Method == method && (query == "" || hasQuery) {
+			result = append(result, request)
+		}
+	}
+	return result
+}
+
+func writeS3Error(responseWriter http.ResponseWriter, statusCode int, code string) {
+	responseWriter.WriteHeader(statusCode)
+	fmt.Fprintf(responseWriter, "<Error><Code>%v</Code><Message>Some message</Message></Error>", code)
+}
+
+var _ = Describe("Blobstore", func() {
+	var (
+		fake      *fakeS3
+		s3Config  config.S3BlobstoreConfig
+		blobstore *Blobstore
+	)
+
+	BeforeEach(func() {
+		fake = newFakeS3()
+		s3Config = config.S3BlobstoreConfig{
+			// Not a DNS compatible bucket name, so that the SDK uses path style requests.
+			Bucket:               "test_bucket",
+			AccessKeyID:          "some-access-key-id",
+			SecretAccessKey:      "some-secret-access-key",
+			Host:                 fake.URL,
+			ServerSideEncryption: AES256,
+			PartSize:             "1G",
+		}
+	})
+
+	JustBeforeEach(func() { blobstore = NewBlobstore(s3Config) })
+
+	AfterEach(func() { fake.Close() })
+
+	Context("Copy", func() {
+		const sixGigabytes = 6 * 1024 * 1024 * 1024
+
+		var (
+			objectSize         int64
+			copyObjectTooLarge bool
+			failingPartNumber  string
+		)
+
+		BeforeEach(func() {
+			objectSize = 1024
+			copyObjectTooLarge = false
+			failingPartNumber = ""
+			fake.Respond = func(responseWriter http.ResponseWriter, request *http.Request) {
+				query := request.URL.Query()
+				_, isCreateMultipartUpload := query["uploads"]
+				switch {
+				case request.Method == "HEAD":
+					responseWriter.Header().Set("Content-Length", strconv.FormatInt(objectSize, 10))
+				case request.Method == "POST" && isCreateMultipartUpload:
+					fmt.Fprint(responseWriter, "<InitiateMultipartUploadResult><UploadId>some-upload-id</UploadId></InitiateMultipartUploadResult>")
+				case request.Method == "PUT" && query.Get("partNumber") != "":
+					if query.Get("partNumber") == failingPartNumber {
+						writeS3Error(responseWriter, http.StatusForbidden, "AccessDenied")
+						return
+					}
+					fmt.Fprintf(responseWriter, "<CopyPartResult><ETag>\"etag-%v\"</ETag></CopyPartResult>", query.Get("partNumber"))
+				case request.Method == "POST" && query.Get("uploadId") != "":
+					fmt.Fprint(responseWriter, "<CompleteMultipartUploadResult><ETag>\"some-etag\"</ETag></CompleteMultipartUploadResult>")
+				case request.Method == "DELETE" && query.Get("uploadId") != "":
+					responseWriter.WriteHeader(http.StatusNoContent)
+				case request.Method == "PUT" && request.Header.Get("X-Amz-Copy-Source") == "test_bucket/src":
+					if copyObjectTooLarge {
+						writeS3Error(responseWriter, http.StatusBadRequest, "InvalidRequest")
+						return
+					}
+					fmt.Fprint(responseWriter, "<CopyObjectResult><ETag>\"some-etag\"</ETag></CopyObjectResult>")
+				default:
+					writeS3Error(responseWriter, http.StatusNotFound, "NoSuchKey")
+				}
+			}
+		})
+
+		It("copies with CopyObject and server side encryption", func() {
+			Expect(blobstore.Copy("src", "dest")).To(Succeed())
+
+			copies := fake.RequestsWith("PUT", "")
+			Expect(copies).To(HaveLen(1))
+			Expect(copies[0].String()).To(Equal("PUT /test_bucket/dest"))
+			Expect(copies[0].Header.Get("X-Amz-Server-Side-Encryption")).To(Equal("AES256"))
+			Expect(fake.RequestsWith("HEAD", "")).To(BeEmpty())
+		})
+
+		It("returns a NotFoundError when src does not exist", func() {
+			e := blobstore.Copy("missing-src", "dest")
+
+			Expect(bitsgo.IsNotFoundError(e)).To(BeTrue())
+		})
+
+		Context("CopyObject rejects src as too large", func() {
+			BeforeEach(func() {
+				copyObjectTooLarge = true
+				objectSize = sixGigabytes
+			})
+
+			It("falls back to a multipart copy with server side encryption", func() {
+				Expect(blobstore.Copy("src", "dest")).To(Succeed())
+
+				Expect(fake.RequestsWith("POST", "uploads")).To(HaveLen(1))
+				Expect(fake.RequestsWith("POST", "uploads")[0].String()).To(Equal("POST /test_bucket/dest"))
+				Expect(fake.RequestsWith("POST", "uploads")[0].Header.Get("X-Amz-Server-Side-Encryption")).To(Equal("AES256"))
+
+				partCopies := fake.RequestsWith("PUT", "partNumber")
+				Expect(partCopies).To(HaveLen(6))
+				ranges := make([]string, len(partCopies))
+				for i, partCopy := range partCopies {
+					Expect(partCopy.Header.Get("X-Amz-Copy-Source")).To(Equal("test_bucket/src"))
+					ranges[i] = partCopy.Query["partNumber"][0] + ": " + partCopy.Header.Get("X-Amz-Copy-Source-Range")
+				}
+				Expect(ranges).To(ConsistOf(
+					"1: bytes=0-1073741823",
+					"2: bytes=1073741824-2147483647",
+					"3: bytes=2147483648-3221225471",
+					"4: bytes=3221225472-4294967295",
+					"5: bytes=4294967296-5368709119",
+					"6: bytes=5368709120-6442450943"))
+
+				completions := fake.RequestsWith("POST", "uploadId")
+				Expect(completions).To(HaveLen(1))
+				Expect(completions[0].Body).To(SatisfyAll(
+					ContainSubstring("<PartNumber>1</PartNumber>"),
+					ContainSubstring("<PartNumber>6</PartNumber>"),
+					ContainSubstring("etag-6")))
+				Expect(fake.RequestsWith("DELETE", "uploadId")).To(BeEmpty())
+			})
+
+			It("aborts the multipart upload when copying a part fails", func() {
+				failingPartNumber = "3"
+
+				Expect(blobstore.Copy("src", "dest")).NotTo(Succeed())
+
+				Expect(fake.RequestsWith("POST", "uploadId")).To(BeEmpty())
+				Expect(fake.RequestsWith("DELETE", "uploadId")).To(HaveLen(1))
+				Expect(fake.RequestsWith("DELETE", "uploadId")[0].Query["uploadId"]).To(ConsistOf("some-upload-id"))
+			})
+
+			It("returns the error of CopyObject when src is not larger than 5GB", func() {
+				objectSize = 1024
+
+				Expect(blobstore.Copy("src", "dest")).NotTo(Succeed())
+
+				Expect(fake.RequestsWith("POST", "uploads")).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("DeleteDir", func() {
+		var deleteResult string
+
+		BeforeEach(func() {
+			fake.Respond = func(responseWriter http.ResponseWriter, request *http.Request) {
+				_, isDeleteObjects := request.URL.Query()["delete"]
+				switch {
+				case request.Method == "GET":
+					fmt.Fprint(responseWriter, "<ListBucketResult><IsTruncated>false</IsTruncated>"+
+						"<Contents><Key>dir/a</Key></Contents><Contents><Key>dir/b</Key></Contents><Contents><Key>dir/c</Key></Contents>"+
+						"</ListBucketResult>")
+				case request.Method == "POST" && isDeleteObjects:
+					fmt.Fprint(responseWriter, deleteResult)
+				default:
+					writeS3Error(responseWriter, http.StatusNotFound, "NoSuchKey")
+				}
+			}
+		})
+
+		It("deletes all listed keys with a single request", func() {
+			deleteResult = "<DeleteResult></DeleteResult>"
+
+			Expect(blobstore.DeleteDir("dir/")).To(Succeed())
+
+			deletions := fake.RequestsWith("POST", "delete")
+			Expect(deletions).To(HaveLen(1))
+			Expect(deletions[0].Body).To(SatisfyAll(
+				ContainSubstring("<Key>dir/a</Key>"),
+				ContainSubstring("<Key>dir/b</Key>"),
+				ContainSubstring("<Key>dir/c</Key>")))
+		})
+
+		It("returns an error for each key which could not be deleted", func() {
+			deleteResult = "<DeleteResult>" +
+				"<Error><Key>dir/a</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>" +
+				"<Error><Key>dir/c</Key><Code>InternalError</Code><Message>We encountered an internal error</Message></Error>" +
+				"</DeleteResult>"
+
+			e := blobstore.DeleteDir("dir/")
+
+			Expect(e).To(HaveOccurred())
+			Expect(e.Error()).To(SatisfyAll(
+				ContainSubstring("Key dir/a: Access Denied (AccessDenied)"),
+				ContainSubstring("Key dir/c: We encountered an internal error (InternalError)"),
+				Not(ContainSubstring("dir/b"))))
+		})
+
+		It("ignores keys which did not exist", func() {
+			deleteResult = "<DeleteResult>" +
+				"<Error><Key>dir/b</Key><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>" +
+				"</DeleteResult>"
+
+			Expect(blobstore.DeleteDir("dir/")).To(Succeed())
+		})
+	})
+})
@@ -28,8 +28,9 @@ var _ = Describe("Signing URLs", func() {
 				Region:          "us-east-1",
 			}))
 
-		signedURL := signer.Sign("myresource", "get", time.Now().Add(time.Hour))
+		signedURL, e := signer.Sign("myresource", "get", time.Now().Add(time.Hour))
 
+		Expect(e).NotTo(HaveOccurred())
 		Expect(signedURL).To(SatisfyAll(
 			ContainSubstring("https://mybucket.s3.amazonaws.com/my/re/myresource"),
 			ContainSubstring("X-Amz-Algorithm="),
@@ -8,7 +8,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 	"github.com/cloudfoundry-incubator/bits-service/blobstores/s3/signer"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -92,6 +94,44 @@ func isS3NotFoundError(e error) bool {
 	return false
 }
 
+// handleError translates a missing bucket into *ContainerNotFoundError, throttling into *ThrottledError and other
+// failed requests into the typed errors corresponding to their status codes.
+func (blobstore *Blobstore) handleError(e error, context string, args ...interface{}) error {
+	wrapped := errors.Wrapf(e, context, args...)
+	cause := errors.Cause(e)
+	// Errors of the s3manager, e.g. of multipart uploads, wrap the error of the failed request.
+	for {
+		if _, isRequestFailure := cause.(awserr.RequestFailure); isRequestFailure {
+			break
+		}
+		ae, isAwsErr := cause.(awserr.Error)
+		if !isAwsErr || ae.OrigErr() == nil {
+			break
+		}
+		cause = ae.OrigErr()
+	}
+	if isS3NoSuchBucketError(cause) {
+		return bitsgo.NewContainerNotFoundError(blobstore.bucket)
+	}
+	requestFailure, isRequestFailure := cause.(awserr.RequestFailure)
+	if !isRequestFailure {
+		return wrapped
+	}
+	if requestFailure.Code() == "SlowDown" {
+		return bitsgo.NewThrottledError(wrapped, 0)
+	}
+	return bitsgo.ErrorFromStatusCode(requestFailure.StatusCode(), nil, wrapped)
+}
+
+func isS3InvalidRequestError(e error) bool {
+	if ae, isAwsErr := e.(awserr.Error); isAwsErr {
+		if ae.Code() == "InvalidRequest" {
+			return true
+		}
+	}
+	return false
+}
+
 func isS3NoSuchBucketError(e error) bool {
 	if ae, isAwsErr := e.(awserr.Error); isAwsErr {
 		if ae.Code() == "NoSuchBucket" {
@@ -0,0 +1,179 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/httputil"
+	"github.com/pkg/errors"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop>
+    <D:resourcetype/>
+    <D:getcontentlength/>
+    <D:getlastmodified/>
+  </D:prop>
+</D:propfind>`
+
+type multistatus struct {
+	Responses []propfindResponse `xml:"DAV: response"`
+}
+
+type propfindResponse struct {
+	Href     string `xml:"DAV: href"`
+	Propstat []struct {
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+			ContentLength string `xml:"DAV: getcontentlength"`
+			LastModified  string `xml:"DAV: getlastmodified"`
+		} `xml:"DAV: prop"`
+		Status string `xml:"DAV: status"`
+	} `xml:"DAV: propstat"`
+}
+
+// List lists the collection containing prefix with a single PROPFIND request of Depth: infinity. Many servers,
+// e.g. nginx, refuse infinite depth. In that case, it falls back to walking the collections with Depth: 1.
+func (blobstore *Blobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	collection := prefix[:strings.LastIndex(prefix, "/")+1]
+	entries, e := blobstore.propfind(collection, "infinity")
+	if isInfiniteDepthRefused(e) {
+		entries, e = blobstore.walk(collection)
+	}
+	if statusError, ok := e.(*propfindStatusError); ok {
+		return nil, statusError.error
+	}
+	if e != nil {
+		return nil, e
+	}
+	blobInfos := []bitsgo.BlobInfo{}
+	for _, entry := range entries {
+		if !entry.isCollection && strings.HasPrefix(entry.Path, prefix) {
+			blobInfos = append(blobInfos, entry.BlobInfo)
+		}
+	}
+	return blobInfos, nil
+}
+
+type propfindEntry struct {
+	bitsgo.BlobInfo
+	isCollection bool
+}
+
+type propfindStatusError struct {
+	error
+	statusCode int
+}
+
+func isInfiniteDepthRefused(e error) bool {
+	statusError, ok := e.(*propfindStatusError)
+	return ok && (statusError.statusCode == http.StatusForbidden || statusError.statusCode == http.StatusBadRequest)
+}
+
+func (blobstore *Blobstore) walk(collection string) ([]propfindEntry, error) {
+	entries, e := blobstore.propfind(collection, "1")
+	if e != nil {
+		return nil, e
+	}
+	result := make([]propfindEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+		if entry.isCollection && entry.Path != collection {
+			children, e := blobstore.walk(entry.Path)
+			if e != nil {
+				return nil, e
+			}
+			result = append(result, children...)
+		}
+	}
+	return result, nil
+}
+
+// propfind returns the entries of collection, which is a path relative to the blobstore's root ending in "/" or "".
+// A missing collection has no entries.
+func (blobstore *Blobstore) propfind(collection string, depth string) ([]propfindEntry, error) {
+	response, e := blobstore.httpClient.Do(
+		httputil.NewRequest("PROPFIND", blobstore.webdavPrivateEndpoint+"/admin/"+collection, strings.NewReader(propfindBody)).
+			WithHeader("Depth", depth).
+			WithHeader("Content-Type", "application/xml").
+			WithBasicAuth(blobstore.webdavUsername, blobstore.webdavPassword).
+			Build())
+	if e != nil {
+		return nil, errors.Wrapf(e, "Request failed. collection=%v", collection)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, &propfindStatusError{
+			error: bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+				errors.Errorf("Expected HTTP status code 207, but got status code: %v. collection=%v", response.Status, collection)),
+			statusCode: response.StatusCode,
+		}
+	}
+	return blobstore.parseMultistatus(response.Body)
+}
+
+func (blobstore *Blobstore) parseMultistatus(body io.Reader) ([]propfindEntry, error) {
+	var result multistatus
+	e := xml.NewDecoder(body).Decode(&result)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not parse PROPFIND response")
+	}
+	root, e := blobstore.adminRootPath()
+	if e != nil {
+		return nil, e
+	}
+	entries := make([]propfindEntry, 0, len(result.Responses))
+	for _, response := range result.Responses {
+		href, e := url.Parse(response.Href)
+		if e != nil {
+			return nil, errors.Wrapf(e, "Invalid href %v in PROPFIND response", response.Href)
+		}
+		if !strings.HasPrefix(href.Path, root) {
+			continue
+		}
+		entry := propfindEntry{BlobInfo: bitsgo.BlobInfo{Path: strings.TrimPrefix(href.Path, root)}}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			entry.isCollection = propstat.Prop.ResourceType.Collection != nil
+			if propstat.Prop.ContentLength != "" {
+				entry.Size, e = strconv.ParseInt(propstat.Prop.ContentLength, 10, 64)
+				if e != nil {
+					return nil, errors.Wrapf(e, "Invalid content length of %v in PROPFIND response", response.Href)
+				}
+			}
+			if propstat.Prop.LastModified != "" {
+				entry.LastModified, e = http.ParseTime(propstat.Prop.LastModified)
+				if e != nil {
+					return nil, errors.Wrapf(e, "Invalid last modified date of %v in PROPFIND response", response.Href)
+				}
+			}
+		}
+		if entry.isCollection && entry.Path != "" && !strings.HasSuffix(entry.Path, "/") {
+			entry.Path += "/"
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// adminRootPath is the URL path under which the WebDAV server exposes the blobstore's content for writing.
+func (blobstore *Blobstore) adminRootPath() (string, error) {
+	privateEndpoint, e := url.Parse(blobstore.webdavPrivateEndpoint)
+	if e != nil {
+		return "", errors.Wrapf(e, "Invalid private endpoint %v", blobstore.webdavPrivateEndpoint)
+	}
+	return strings.TrimSuffix(privateEndpoint.Path, "/") + "/admin/", nil
+}
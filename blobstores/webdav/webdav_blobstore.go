@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"strings"
 
 	"bytes"
@@ -56,36 +57,25 @@ func (blobstore *Blobstore) Exists(path string) (bool, error) {
 }
 
 func (blobstore *Blobstore) Get(path string) (body io.ReadCloser, err error) {
-	exists, e := blobstore.Exists(path)
-	if e != nil {
-		return nil, e
-	}
-	if !exists {
-		return nil, bitsgo.NewNotFoundError()
-	}
-
 	response, e := blobstore.httpClient.Get(blobstore.webdavPrivateEndpoint + "/" + path)
-
 	if e != nil {
 		return nil, errors.Wrapf(e, "path=%v", path)
 	}
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("Unexpected status code %v. Expected status OK", response.Status)
+		defer response.Body.Close()
+		return nil, errorFromStatus(response, path)
 	}
-
 	return response.Body, nil
 }
 
+// GetOrRedirect does not check whether the blob exists, so that a GET does not need an additional request.
+// Redirects to a missing blob result in 404 from the WebDAV server.
 func (blobstore *Blobstore) GetOrRedirect(path string) (body io.ReadCloser, redirectLocation string, err error) {
-	exists, e := blobstore.Exists(path)
+	// TODO use clock instead
+	signedUrl, e := blobstore.signURL(path, "get", time.Now().Add(1*time.Hour))
 	if e != nil {
 		return nil, "", e
 	}
-	if !exists {
-		return nil, "", bitsgo.NewNotFoundError()
-	}
-	// TODO use clock instead
-	signedUrl := blobstore.Sign(path, "get", time.Now().Add(1*time.Hour))
 	return nil, signedUrl, nil
 }
 
@@ -96,7 +86,8 @@ func (blobstore *Blobstore) Put(path string, src io.ReadSeeker) error {
 		return errors.Wrapf(e, "Request failed. path=%v", path)
 	}
 	if response.StatusCode < 200 || response.StatusCode > 204 {
-		return errors.Errorf("Expected StatusCreated, but got status code: " + response.Status)
+		return bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+			errors.Errorf("Expected StatusCreated, but got status code: %v. path=%v", response.Status, path))
 	}
 	return nil
 }
@@ -122,7 +113,8 @@ func (blobstore *Blobstore) Copy(src, dest string) error {
 		return bitsgo.NewNotFoundError()
 	}
 	if response.StatusCode < 200 || response.StatusCode > 204 {
-		return errors.Errorf("Expected HTTP status code 200-204, but got status code: " + response.Status)
+		return bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+			errors.Errorf("Expected HTTP status code 200-204, but got status code: %v. src=%v, dest=%v", response.Status, src, dest))
 	}
 	return nil
 }
@@ -133,8 +125,13 @@ func (blobstore *Blobstore) Delete(path string) error {
 	if e != nil {
 		return errors.Wrapf(e, "Request failed. path=%v", path)
 	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return bitsgo.NewNotFoundErrorWithKey(path)
+	}
 	if response.StatusCode < 200 || response.StatusCode > 204 {
-		return errors.Errorf("Expected HTTP status code 200-204, but got status code: " + response.Status)
+		return bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+			errors.Errorf("Expected HTTP status code 200-204, but got status code: %v. path=%v", response.Status, path))
 	}
 	return nil
 }
@@ -152,7 +149,8 @@ func (blobstore *Blobstore) DeleteDir(prefix string) error {
 	}
 
 	if response.StatusCode < 200 || response.StatusCode > 204 {
-		return errors.Errorf("Expected HTTP status code 200-204, but got status code: " + response.Status)
+		return bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+			errors.Errorf("Expected HTTP status code 200-204, but got status code: %v. prefix=%v", response.Status, prefix))
 	}
 	return nil
 }
@@ -164,7 +162,12 @@ func appendsSuffixIfNeeded(prefix string) string {
 	return prefix
 }
 
-func (signer *Blobstore) Sign(resource string, method string, expirationTime time.Time) string {
+func (signer *Blobstore) Sign(resource string, method string, expirationTime time.Time) (string, error) {
+	return signer.signURL(resource, method, expirationTime)
+}
+
+// signURL asks the WebDAV server to sign the URL and points it to the public endpoint.
+func (signer *Blobstore) signURL(resource string, method string, expirationTime time.Time) (string, error) {
 	var url string
 	switch strings.ToLower(method) {
 	case "put":
@@ -172,36 +175,49 @@ func (signer *Blobstore) Sign(resource string, method string, expirationTime tim
 		url = fmt.Sprintf(signer.webdavPrivateEndpoint+"/sign_for_put?path=/%v&expires=%v", resource, expirationTime.Unix())
 	case "get":
 		url = fmt.Sprintf(signer.webdavPrivateEndpoint+"/sign?path=/%v&expires=%v", resource, expirationTime.Unix())
+	default:
+		return "", errors.Errorf("The only supported methods are 'put' and 'get', but got '%v'", method)
 	}
 	response, e := signer.httpClient.Do(
 		httputil.NewRequest("GET", url, nil).
 			WithBasicAuth(signer.webdavUsername, signer.webdavPassword).
 			Build())
 	if e != nil {
-		return "Error during signing. Error: " + e.Error()
+		return "", errors.Wrapf(e, "Error during signing. resource=%v", resource)
 	}
+	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		return "Error during signing. Error code: " + response.Status
+		return "", bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+			errors.Errorf("Error during signing. resource=%v, status code: %v", resource, response.Status))
 	}
-	defer response.Body.Close()
 	content, e := ioutil.ReadAll(response.Body)
 	if e != nil {
-		return "Error reading response body. Error: " + e.Error()
+		return "", errors.Wrapf(e, "Error reading response body during signing. resource=%v", resource)
 	}
 
-	signedUrl := httputil.MustParse(string(content))
-
+	signedUrl, e := neturl.Parse(strings.TrimSpace(string(content)))
+	if e != nil {
+		return "", errors.Wrapf(e, "Invalid signed URL returned by WebDAV server. resource=%v", resource)
+	}
+	publicEndpoint, e := neturl.Parse(signer.webdavPublicEndpoint)
+	if e != nil {
+		return "", errors.Wrapf(e, "Invalid public endpoint %v", signer.webdavPublicEndpoint)
+	}
 	// TODO Is this really what we want to do?
-	signedUrl.Host = httputil.MustParse(signer.webdavPublicEndpoint).Host
+	signedUrl.Host = publicEndpoint.Host
+	// Clients of signed URLs, e.g. the Stager, must trust the public endpoint's certificate when it uses https.
+	signedUrl.Scheme = publicEndpoint.Scheme
 
-	// TODO: in the legacy bits-service, this is hard-coded to http, although it should probably be:
-	//       httputil.MustParse(signer.webdavPublicEndpoint).Scheme
-	//       However, certificates currently do not work out yet, when Stager (Rep) tries to access the URL.
-	//       It will then error, because it cannot verify the certificate. Hence, keeping the hard-coded value
-	//       for now to be functinally equivalent.
-	signedUrl.Scheme = "http"
+	return signedUrl.String(), nil
+}
 
-	return signedUrl.String()
+// errorFromStatus maps the status code of a failed request to an error.
+func errorFromStatus(response *http.Response, path string) error {
+	if response.StatusCode == http.StatusNotFound {
+		return bitsgo.NewNotFoundErrorWithKey(path)
+	}
+	return bitsgo.ErrorFromStatusCode(response.StatusCode, response.Header,
+		errors.Errorf("Unexpected status code %v for %v. Expected status OK", response.Status, path))
 }
 
 func (blobstore *Blobstore) newRequestWithBasicAuth(method string, urlStr string, body io.Reader) *http.Request {
@@ -1,8 +1,14 @@
 package webdav_test
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"time"
+
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -39,4 +45,180 @@ var _ = Describe("WebdavBlobstore", func() {
 			webdavBlobstore.DeleteDir("path/with/single/slash/suffix/")
 		})
 	})
+
+	Context("with a fake WebDAV server", func() {
+		var (
+			webdavBlobstore *Blobstore
+			testServer      *httptest.Server
+			handler         http.HandlerFunc
+			requests        []string
+		)
+
+		BeforeEach(func() {
+			requests = nil
+			testServer = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				requests = append(requests, req.Method+" "+req.URL.Path)
+				handler(res, req)
+			}))
+			webdavBlobstore = NewBlobstoreWithHttpClient(config.WebdavBlobstoreConfig{
+				PrivateEndpoint: testServer.URL,
+				PublicEndpoint:  "https://public.example.com",
+			}, &http.Client{})
+		})
+
+		AfterEach(func() { testServer.Close() })
+
+		Describe("Get", func() {
+			It("gets the blob with a single request", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { fmt.Fprint(res, "content") }
+
+				body, e := webdavBlobstore.Get("some/path")
+
+				Expect(e).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(body)).To(Equal([]byte("content")))
+				Expect(requests).To(Equal([]string{"GET /some/path"}))
+			})
+
+			It("returns a NotFoundError when the blob does not exist", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusNotFound) }
+
+				_, e := webdavBlobstore.Get("some/path")
+
+				Expect(e).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+			})
+
+			It("returns an error for other status codes", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusInternalServerError) }
+
+				_, e := webdavBlobstore.Get("some/path")
+
+				Expect(e).To(HaveOccurred())
+				Expect(e).NotTo(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+				Expect(e).NotTo(BeAssignableToTypeOf(&bitsgo.UnavailableError{}))
+			})
+
+			It("returns an UnavailableError for gateway errors", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusBadGateway) }
+
+				_, e := webdavBlobstore.Get("some/path")
+
+				Expect(e).To(BeAssignableToTypeOf(&bitsgo.UnavailableError{}))
+			})
+
+			It("returns an UnavailableError with the Retry-After of a 503", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) {
+					res.Header().Set("Retry-After", "7")
+					res.WriteHeader(http.StatusServiceUnavailable)
+				}
+
+				_, e := webdavBlobstore.Get("some/path")
+
+				Expect(e).To(BeAssignableToTypeOf(&bitsgo.UnavailableError{}))
+				Expect(e.(*bitsgo.UnavailableError).RetryAfter).To(Equal(7 * time.Second))
+			})
+		})
+
+		Describe("Delete", func() {
+			It("returns a NotFoundError when the blob does not exist", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusNotFound) }
+
+				Expect(webdavBlobstore.Delete("some/path")).To(BeAssignableToTypeOf(&bitsgo.NotFoundError{}))
+			})
+		})
+
+		Describe("Sign", func() {
+			It("uses the scheme and host of the public endpoint", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) {
+					fmt.Fprint(res, "http://private.example.com/read/some/path?md5=abc&expires=123")
+				}
+
+				Expect(webdavBlobstore.Sign("some/path", "get", time.Now())).To(
+					Equal("https://public.example.com/read/some/path?md5=abc&expires=123"))
+			})
+
+			It("returns an error when signing fails", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusUnauthorized) }
+
+				signedURL, e := webdavBlobstore.Sign("some/path", "get", time.Now())
+
+				Expect(e).To(MatchError(ContainSubstring("401")))
+				Expect(signedURL).To(BeEmpty())
+			})
+
+			It("returns an error from GetOrRedirect when signing fails", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusUnauthorized) }
+
+				_, redirectLocation, e := webdavBlobstore.GetOrRedirect("some/path")
+
+				Expect(e).To(MatchError(ContainSubstring("401")))
+				Expect(redirectLocation).To(BeEmpty())
+			})
+		})
+
+		Describe("List", func() {
+			multistatus := func(entries ...string) string {
+				return `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">` + strings.Join(entries, "") + `</D:multistatus>`
+			}
+			collection := func(href string) string {
+				return `<D:response><D:href>` + href + `</D:href><D:propstat><D:prop><D:resourcetype><D:collection/></D:resourcetype></D:prop>` +
+					`<D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`
+			}
+			file := func(href string, size int) string {
+				return fmt.Sprintf(`<D:response><D:href>%v</D:href><D:propstat><D:prop><D:resourcetype/>`+
+					`<D:getcontentlength>%v</D:getcontentlength><D:getlastmodified>Mon, 02 Jan 2006 15:04:05 GMT</D:getlastmodified></D:prop>`+
+					`<D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`, href, size)
+			}
+
+			It("lists the blobs matching the prefix with Depth: infinity", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) {
+					Expect(req.Method).To(Equal("PROPFIND"))
+					Expect(req.URL.Path).To(Equal("/admin/ab/"))
+					Expect(req.Header.Get("Depth")).To(Equal("infinity"))
+					res.WriteHeader(http.StatusMultiStatus)
+					fmt.Fprint(res, multistatus(
+						collection("/admin/ab/"),
+						collection("/admin/ab/cd/"),
+						file("/admin/ab/cd/abcdef", 3),
+						file("/admin/ab/cd/xyz", 4)))
+				}
+
+				blobInfos, e := webdavBlobstore.List("ab/cd/abc")
+
+				Expect(e).NotTo(HaveOccurred())
+				Expect(blobInfos).To(HaveLen(1))
+				Expect(blobInfos[0].Path).To(Equal("ab/cd/abcdef"))
+				Expect(blobInfos[0].Size).To(Equal(int64(3)))
+				Expect(blobInfos[0].LastModified).To(Equal(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)))
+			})
+
+			It("walks the collections with Depth: 1 when the server refuses Depth: infinity", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) {
+					switch req.Header.Get("Depth") + " " + req.URL.Path {
+					case "infinity /admin/ab/":
+						res.WriteHeader(http.StatusForbidden)
+					case "1 /admin/ab/":
+						res.WriteHeader(http.StatusMultiStatus)
+						fmt.Fprint(res, multistatus(collection("/admin/ab/"), collection("/admin/ab/cd/"), file("/admin/ab/file", 1)))
+					case "1 /admin/ab/cd/":
+						res.WriteHeader(http.StatusMultiStatus)
+						fmt.Fprint(res, multistatus(collection("/admin/ab/cd/"), file("/admin/ab/cd/other", 2)))
+					default:
+						Fail("Unexpected request " + req.Header.Get("Depth") + " " + req.URL.Path)
+					}
+				}
+
+				blobInfos, e := webdavBlobstore.List("ab/")
+
+				Expect(e).NotTo(HaveOccurred())
+				Expect(blobInfos).To(HaveLen(2))
+				Expect([]string{blobInfos[0].Path, blobInfos[1].Path}).To(ConsistOf("ab/file", "ab/cd/other"))
+			})
+
+			It("returns an empty list when the collection does not exist", func() {
+				handler = func(res http.ResponseWriter, req *http.Request) { res.WriteHeader(http.StatusNotFound) }
+
+				Expect(webdavBlobstore.List("ab/")).To(BeEmpty())
+			})
+		})
+	})
 })
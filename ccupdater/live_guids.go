@@ -0,0 +1,130 @@
+package ccupdater
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+// LiveGuidFetcher fetches the guids of all resources the Cloud Controller knows about from its
+// paginated list endpoints. Both, v3 style ("pagination.next.href", "resources[].guid") and
+// v2 style ("next_url", "resources[].metadata.guid") responses are supported.
+type LiveGuidFetcher struct {
+	httpClient HttpClient
+	endpoint   *url.URL
+	paths      map[string]string
+}
+
+type listResponse struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	NextURL   string `json:"next_url"`
+	Resources []struct {
+		Guid     string `json:"guid"`
+		Metadata struct {
+			Guid string `json:"guid"`
+		} `json:"metadata"`
+	} `json:"resources"`
+}
+
+func NewLiveGuidFetcher(endpoint string, paths map[string]string, clientCertFile string, clientKeyFile string, caCertFile string) *LiveGuidFetcher {
+	u, e := url.Parse(endpoint)
+	if e != nil {
+		logger.Log.Fatalw("Could not parse endpoint", "endpoint", endpoint, "error", e)
+	}
+
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" {
+		tlsConfig = loadTLSConfig(clientCertFile, clientKeyFile, caCertFile)
+	}
+	return NewLiveGuidFetcherWithHttpClient(endpoint, paths, &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	})
+}
+
+func NewLiveGuidFetcherWithHttpClient(endpoint string, paths map[string]string, httpClient HttpClient) *LiveGuidFetcher {
+	u, e := url.Parse(endpoint)
+	if e != nil {
+		logger.Log.Fatalw("Could not parse endpoint", "endpoint", endpoint, "error", e)
+	}
+	return &LiveGuidFetcher{
+		httpClient: httpClient,
+		endpoint:   u,
+		paths:      paths,
+	}
+}
+
+func (fetcher *LiveGuidFetcher) LiveGuids(resourceType string) (map[string]bool, error) {
+	path, exists := fetcher.paths[resourceType]
+	if !exists {
+		return nil, errors.Errorf("No path configured for resource type %v", resourceType)
+	}
+	next, e := url.Parse(strings.TrimRight(fetcher.endpoint.String(), "/") + "/" + strings.TrimLeft(path, "/"))
+	if e != nil {
+		return nil, errors.Wrapf(e, "Invalid path %v for resource type %v", path, resourceType)
+	}
+
+	guids := make(map[string]bool)
+	for next != nil {
+		page, e := fetcher.fetchPage(next.String())
+		if e != nil {
+			return nil, e
+		}
+		for _, resource := range page.Resources {
+			if resource.Guid != "" {
+				guids[resource.Guid] = true
+			}
+			if resource.Metadata.Guid != "" {
+				guids[resource.Metadata.Guid] = true
+			}
+		}
+
+		nextHref := page.NextURL
+		if page.Pagination.Next != nil {
+			nextHref = page.Pagination.Next.Href
+		}
+		current := next
+		next = nil
+		if nextHref != "" {
+			next, e = current.Parse(nextHref)
+			if e != nil {
+				return nil, errors.Wrapf(e, "Invalid next page URL %v", nextHref)
+			}
+		}
+	}
+	return guids, nil
+}
+
+func (fetcher *LiveGuidFetcher) fetchPage(pageURL string) (*listResponse, error) {
+	r, e := http.NewRequest("GET", pageURL, nil)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not create request for %v", pageURL)
+	}
+	resp, e := fetcher.httpClient.Do(r)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not make request against CC (URL: \"%v\")", pageURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unexpected status code %v from CC (URL: \"%v\")", resp.StatusCode, pageURL)
+	}
+	content, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not read response from CC (URL: \"%v\")", pageURL)
+	}
+	var page listResponse
+	e = json.Unmarshal(content, &page)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not parse response from CC (URL: \"%v\")", pageURL)
+	}
+	return &page, nil
+}
@@ -0,0 +1,83 @@
+package ccupdater_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/cloudfoundry-incubator/bits-service/ccupdater"
+	. "github.com/cloudfoundry-incubator/bits-service/ccupdater/matchers"
+	. "github.com/petergtz/pegomock"
+)
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+var _ = Describe("LiveGuidFetcher", func() {
+	var (
+		httpClient *MockHttpClient
+		fetcher    *LiveGuidFetcher
+	)
+
+	BeforeEach(func() {
+		httpClient = NewMockHttpClient()
+		fetcher = NewLiveGuidFetcherWithHttpClient("http://example.com/", map[string]string{
+			"packages": "/v3/packages",
+			"droplets": "/v2/apps",
+		}, httpClient)
+	})
+
+	It("follows v3 pagination and collects all guids", func() {
+		When(httpClient.Do(AnyPtrToHttpRequest())).
+			ThenReturn(jsonResponse(`{
+				"pagination": {"next": {"href": "http://example.com/v3/packages?page=2"}},
+				"resources": [{"guid": "guid1"}, {"guid": "guid2"}]
+			}`), nil).
+			ThenReturn(jsonResponse(`{
+				"pagination": {"next": null},
+				"resources": [{"guid": "guid3"}]
+			}`), nil)
+
+		guids, e := fetcher.LiveGuids("packages")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(guids).To(Equal(map[string]bool{"guid1": true, "guid2": true, "guid3": true}))
+		requests := httpClient.VerifyWasCalled(Times(2)).Do(AnyPtrToHttpRequest()).GetAllCapturedArguments()
+		Expect(requests[0].URL.String()).To(Equal("http://example.com/v3/packages"))
+		Expect(requests[1].URL.String()).To(Equal("http://example.com/v3/packages?page=2"))
+	})
+
+	It("supports v2 style responses with relative next URLs", func() {
+		When(httpClient.Do(AnyPtrToHttpRequest())).
+			ThenReturn(jsonResponse(`{
+				"next_url": "/v2/apps?page=2",
+				"resources": [{"metadata": {"guid": "guid1"}}]
+			}`), nil).
+			ThenReturn(jsonResponse(`{
+				"next_url": null,
+				"resources": [{"metadata": {"guid": "guid2"}}]
+			}`), nil)
+
+		guids, e := fetcher.LiveGuids("droplets")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(guids).To(Equal(map[string]bool{"guid1": true, "guid2": true}))
+		requests := httpClient.VerifyWasCalled(Times(2)).Do(AnyPtrToHttpRequest()).GetAllCapturedArguments()
+		Expect(requests[1].URL.String()).To(Equal("http://example.com/v2/apps?page=2"))
+	})
+
+	It("fails on unexpected status codes", func() {
+		When(httpClient.Do(AnyPtrToHttpRequest())).ThenReturn(&http.Response{StatusCode: http.StatusUnauthorized, Body: ioutil.NopCloser(strings.NewReader(""))}, nil)
+
+		_, e := fetcher.LiveGuids("packages")
+
+		Expect(e).To(MatchError(ContainSubstring("Unexpected status code 401")))
+	})
+
+	It("fails for resource types without path", func() {
+		_, e := fetcher.LiveGuids("buildpacks")
+
+		Expect(e).To(HaveOccurred())
+	})
+})
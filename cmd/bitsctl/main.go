@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/factory"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	log "github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/cloudfoundry-incubator/bits-service/migration"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var resourceTypes = []string{"packages", "droplets", "buildpacks", "buildpack_cache", "app_stash"}
+
+var (
+	configPath = kingpin.Flag("config", "specify config to use").Required().Short('c').String()
+
+	listCommand      = kingpin.Command("list", "list resources")
+	listResourceType = listCommand.Arg("resource-type", "resource type").Required().Enum(resourceTypes...)
+	listPrefix       = listCommand.Arg("prefix", "only list resources whose identifier starts with this prefix").String()
+
+	statCommand      = kingpin.Command("stat", "show size and last modification time of a resource")
+	statResourceType = statCommand.Arg("resource-type", "resource type").Required().Enum(resourceTypes...)
+	statIdentifier   = statCommand.Arg("identifier", "guid or path of the resource, e.g. <app-guid>/<stack> for buildpack_cache").Required().String()
+
+	getCommand      = kingpin.Command("get", "download a resource")
+	getResourceType = getCommand.Arg("resource-type", "resource type").Required().Enum(resourceTypes...)
+	getIdentifier   = getCommand.Arg("identifier", "guid or path of the resource").Required().String()
+	getOutput       = getCommand.Flag("output", "file to write to instead of stdout").Short('o').String()
+
+	putCommand      = kingpin.Command("put", "upload a resource")
+	putResourceType = putCommand.Arg("resource-type", "resource type").Required().Enum(resourceTypes...)
+	putIdentifier   = putCommand.Arg("identifier", "guid or path of the resource").Required().String()
+	putFile         = putCommand.Arg("file", "file to upload").Required().ExistingFile()
+
+	copyCommand      = kingpin.Command("copy", "copy a resource")
+	copyResourceType = copyCommand.Arg("resource-type", "resource type").Required().Enum(resourceTypes...)
+	copySource       = copyCommand.Arg("source", "guid or path of the source resource").Required().String()
+	copyDestination  = copyCommand.Arg("destination", "guid or path of the destination resource").Required().String()
+
+	deleteCommand      = kingpin.Command("delete", "delete a resource")
+	deleteResourceType = deleteCommand.Arg("resource-type", "resource type").Required().Enum(resourceTypes...)
+	deleteIdentifier   = deleteCommand.Arg("identifier", "guid or path of the resource").Required().String()
+
+	migrateCommand        = kingpin.Command("migrate", "copy all resources from the blobstores in --config to the blobstores in --target-config")
+	migrateTargetConfig   = migrateCommand.Flag("target-config", "bits-service config containing the target blobstores").Required().ExistingFile()
+	migrateCheckpointFile = migrateCommand.Flag("checkpoint-file", "file recording migrated resources, used to resume an interrupted migration").Default("bits-migration.checkpoint").String()
+	migrateConcurrency    = migrateCommand.Flag("concurrency", "number of resources copied in parallel").Default("10").Int()
+	migrateResourceTypes  = migrateCommand.Arg("resource-types", "resource types to migrate (default: all)").Enums(resourceTypes...)
+)
+
+func main() {
+	command := kingpin.Parse()
+
+	config := loadConfig(*configPath)
+	log.SetLogger(createLogger())
+
+	switch command {
+	case listCommand.FullCommand():
+		kingpin.FatalIfError(list(blobstoreFor(config, *listResourceType), *listPrefix, os.Stdout), "")
+	case statCommand.FullCommand():
+		kingpin.FatalIfError(stat(blobstoreFor(config, *statResourceType), *statIdentifier, os.Stdout), "")
+	case getCommand.FullCommand():
+		kingpin.FatalIfError(get(blobstoreFor(config, *getResourceType), *getIdentifier, *getOutput, os.Stdout), "")
+	case putCommand.FullCommand():
+		kingpin.FatalIfError(put(blobstoreFor(config, *putResourceType), *putIdentifier, *putFile), "")
+	case copyCommand.FullCommand():
+		kingpin.FatalIfError(blobstoreFor(config, *copyResourceType).Copy(*copySource, *copyDestination), "Could not copy %v to %v", *copySource, *copyDestination)
+	case deleteCommand.FullCommand():
+		kingpin.FatalIfError(blobstoreFor(config, *deleteResourceType).Delete(*deleteIdentifier), "Could not delete %v", *deleteIdentifier)
+	case migrateCommand.FullCommand():
+		migrate(config, loadConfig(*migrateTargetConfig), *migrateResourceTypes, *migrateCheckpointFile, *migrateConcurrency)
+	}
+}
+
+func loadConfig(filename string) config.Config {
+	c, e := config.LoadConfig(filename)
+	kingpin.FatalIfError(e, "Could not load config %v", filename)
+	if password := os.Getenv("BITS_BLOBSTORE_PASSWORD"); password != "" {
+		c.Buildpacks.WebdavConfig.Password = password
+		c.Droplets.WebdavConfig.Password = password
+		c.Packages.WebdavConfig.Password = password
+		c.AppStash.WebdavConfig.Password = password
+	}
+	return c
+}
+
+// blobstoreFor creates the blobstore for resourceType decorated exactly like the bits-service does,
+// so that identifiers are partitioned and prefixed the same way. Unlike the bits-service, it does not
+// start background workers like replica repair or draining the legacy blobstore of a live migration.
+func blobstoreFor(c config.Config, resourceType string) bitsgo.Blobstore {
+	var blobstore bitsgo.Blobstore
+	switch resourceType {
+	case "packages":
+		blobstore, _ = factory.CreateBlobstoreAndSignURLHandler(c.Packages, c.PublicEndpointUrl(), c.Port, c.Secret, c.SigningKeysMap(), c.ActiveKeyID, resourceType, log.Log, &nullMetricsService{}, false)
+	case "droplets":
+		blobstore, _ = factory.CreateBlobstoreAndSignURLHandler(c.Droplets, c.PublicEndpointUrl(), c.Port, c.Secret, c.SigningKeysMap(), c.ActiveKeyID, resourceType, log.Log, &nullMetricsService{}, false)
+	case "buildpacks":
+		blobstore, _ = factory.CreateBlobstoreAndSignURLHandler(c.Buildpacks, c.PublicEndpointUrl(), c.Port, c.Secret, c.SigningKeysMap(), c.ActiveKeyID, resourceType, log.Log, &nullMetricsService{}, false)
+	case "buildpack_cache":
+		blobstore, _ = factory.CreateBuildpackCacheBlobstoreAndSignURLHandler(c.BuildpackCacheBlobstoreConfig(), c.PublicEndpointUrl(), c.Port, c.Secret, c.SigningKeysMap(), c.ActiveKeyID, log.Log, &nullMetricsService{}, false)
+	case "app_stash":
+		blobstore, _ = factory.CreateAppStashBlobstoreAndSignURLHandler(c.AppStash, c.PublicEndpointUrl(), c.Port, c.Secret, c.SigningKeysMap(), c.ActiveKeyID, log.Log, &nullMetricsService{}, false)
+	}
+	return blobstore
+}
+
+func list(blobstore bitsgo.Blobstore, prefix string, out io.Writer) error {
+	blobInfos, e := blobstore.List(prefix)
+	if e != nil {
+		return errors.Wrap(e, "Could not list resources")
+	}
+
+	tabWriter := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "IDENTIFIER\tSIZE\tLAST MODIFIED")
+	for _, blobInfo := range blobInfos {
+		fmt.Fprintf(tabWriter, "%v\t%v\t%v\n", blobInfo.Path, blobInfo.Size, formatTime(blobInfo.LastModified))
+	}
+	return tabWriter.Flush()
+}
+
+func stat(blobstore bitsgo.Blobstore, identifier string, out io.Writer) error {
+	exists, e := blobstore.Exists(identifier)
+	if e != nil {
+		return errors.Wrapf(e, "Could not check existence of %v", identifier)
+	}
+	if !exists {
+		return errors.Errorf("%v does not exist", identifier)
+	}
+	fmt.Fprintf(out, "Identifier:    %v\n", identifier)
+
+	// Not all blobstores support listing. In that case, existence is all we know.
+	blobInfos, e := blobstore.List(identifier)
+	if e != nil {
+		return nil
+	}
+	for _, blobInfo := range blobInfos {
+		if blobInfo.Path == identifier {
+			fmt.Fprintf(out, "Size:          %v\n", blobInfo.Size)
+			fmt.Fprintf(out, "Last modified: %v\n", formatTime(blobInfo.LastModified))
+		}
+	}
+	return nil
+}
+
+// get writes the resource to the file output or, if output is empty, to out.
+func get(blobstore bitsgo.Blobstore, identifier string, output string, out io.Writer) error {
+	body, e := blobstore.Get(identifier)
+	if e != nil {
+		return errors.Wrapf(e, "Could not get %v", identifier)
+	}
+	defer body.Close()
+
+	if output != "" {
+		file, e := os.Create(output)
+		if e != nil {
+			return errors.Wrapf(e, "Could not create %v", output)
+		}
+		defer file.Close()
+		out = file
+	}
+	_, e = io.Copy(out, body)
+	if e != nil {
+		return errors.Wrapf(e, "Could not download %v", identifier)
+	}
+	return nil
+}
+
+func put(blobstore bitsgo.Blobstore, identifier string, filename string) error {
+	file, e := os.Open(filename)
+	if e != nil {
+		return errors.Wrapf(e, "Could not open %v", filename)
+	}
+	defer file.Close()
+
+	return errors.Wrapf(blobstore.Put(identifier, file), "Could not put %v", identifier)
+}
+
+func migrate(sourceConfig, targetConfig config.Config, types []string, checkpointFile string, concurrency int) {
+	if len(types) == 0 {
+		types = resourceTypes
+	}
+	checkpoint, e := migration.OpenCheckpoint(checkpointFile)
+	kingpin.FatalIfError(e, "Could not open checkpoint")
+	defer checkpoint.Close()
+
+	tabWriter := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "RESOURCE TYPE\tCOPIED\tSKIPPED\tFAILED")
+	var failed []migration.FailedObject
+	for _, resourceType := range types {
+		summary, e := migration.NewMigrator(
+			resourceType,
+			blobstoreFor(sourceConfig, resourceType),
+			blobstoreFor(targetConfig, resourceType),
+			checkpoint,
+			concurrency).Migrate()
+		if e != nil {
+			fmt.Fprintf(tabWriter, "%v\t-\t-\t%v\n", resourceType, e)
+			failed = append(failed, migration.FailedObject{Path: resourceType, Error: e})
+			continue
+		}
+		fmt.Fprintf(tabWriter, "%v\t%v\t%v\t%v\n", resourceType, summary.Copied, summary.Skipped, len(summary.Failed))
+		failed = append(failed, summary.Failed...)
+	}
+	tabWriter.Flush()
+
+	if len(failed) != 0 {
+		fmt.Println("\nFailed:")
+		for _, failedObject := range failed {
+			fmt.Printf("%v: %v\n", failedObject.Path, failedObject.Error)
+		}
+		checkpoint.Close()
+		os.Exit(1)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// createLogger only logs warnings and errors to stderr, so that output of commands like get is not mixed with log messages.
+func createLogger() *zap.Logger {
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
+	loggerConfig.DisableStacktrace = true
+	logger, e := loggerConfig.Build()
+	kingpin.FatalIfError(e, "Could not create logger")
+	return logger
+}
+
+type nullMetricsService struct{}
+
+func (service *nullMetricsService) SendTimingMetric(name string, duration time.Duration) {}
+func (service *nullMetricsService) SendGaugeMetric(name string, value int64)             {}
+func (service *nullMetricsService) SendCounterMetric(name string, value int64)           {}
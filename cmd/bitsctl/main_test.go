@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/factory"
+	"github.com/cloudfoundry-incubator/bits-service/config"
+	log "github.com/cloudfoundry-incubator/bits-service/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBitsctl(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "bitsctl")
+}
+
+var _ = Describe("bitsctl", func() {
+	var (
+		tempDir   string
+		blobstore bitsgo.Blobstore
+		out       *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		var e error
+		tempDir, e = ioutil.TempDir("", "bitsctl")
+		Expect(e).NotTo(HaveOccurred())
+
+		localConfig := config.BlobstoreConfig{
+			BlobstoreType: config.Local,
+			LocalConfig:   &config.LocalBlobstoreConfig{PathPrefix: tempDir},
+		}
+		blobstore = blobstoreFor(config.Config{
+			PublicEndpoint: "https://bits.example.com",
+			Port:           443,
+			Secret:         "some-secret",
+			Packages:       localConfig,
+		}, "packages")
+		out = &bytes.Buffer{}
+
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "upload"), []byte("some content"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Context("put", func() {
+		It("uploads the file", func() {
+			Expect(put(blobstore, "some-guid", filepath.Join(tempDir, "upload"))).To(Succeed())
+
+			Expect(get(blobstore, "some-guid", "", out)).To(Succeed())
+			Expect(out.String()).To(Equal("some content"))
+		})
+
+		It("returns an error when the file does not exist", func() {
+			Expect(put(blobstore, "some-guid", filepath.Join(tempDir, "non-existing"))).To(
+				MatchError(ContainSubstring("Could not open")))
+		})
+	})
+
+	Context("resources exist", func() {
+		BeforeEach(func() {
+			Expect(put(blobstore, "some-guid", filepath.Join(tempDir, "upload"))).To(Succeed())
+			Expect(put(blobstore, "other-guid", filepath.Join(tempDir, "upload"))).To(Succeed())
+		})
+
+		Context("list", func() {
+			It("lists all resources with their sizes", func() {
+				Expect(list(blobstore, "", out)).To(Succeed())
+
+				Expect(out.String()).To(HavePrefix("IDENTIFIER"))
+				Expect(out.String()).To(MatchRegexp(`some-guid\s+12\s+`))
+				Expect(out.String()).To(MatchRegexp(`other-guid\s+12\s+`))
+			})
+
+			It("only lists resources starting with the prefix", func() {
+				Expect(list(blobstore, "some", out)).To(Succeed())
+
+				Expect(out.String()).To(ContainSubstring("some-guid"))
+				Expect(out.String()).NotTo(ContainSubstring("other-guid"))
+			})
+		})
+
+		Context("stat", func() {
+			It("shows the size of the resource", func() {
+				Expect(stat(blobstore, "some-guid", out)).To(Succeed())
+
+				Expect(out.String()).To(ContainSubstring("Identifier:    some-guid\n"))
+				Expect(out.String()).To(ContainSubstring("Size:          12\n"))
+			})
+
+			It("returns an error when the resource does not exist", func() {
+				Expect(stat(blobstore, "non-existing-guid", out)).To(MatchError("non-existing-guid does not exist"))
+				Expect(out.String()).To(BeEmpty())
+			})
+		})
+
+		Context("buildpack_cache", func() {
+			It("decorates the blobstore like the bits-service does", func() {
+				c := config.Config{
+					PublicEndpoint: "https://bits.example.com",
+					Port:           443,
+					Secret:         "some-secret",
+					Droplets: config.BlobstoreConfig{
+						BlobstoreType: config.Local,
+						LocalConfig:   &config.LocalBlobstoreConfig{PathPrefix: tempDir},
+					},
+					BuildpackCache: config.BlobstoreConfig{Compression: &config.CompressionConfig{Codec: "gzip"}},
+				}
+				serverBlobstore, _ := factory.CreateBuildpackCacheBlobstoreAndSignURLHandler(c.BuildpackCacheBlobstoreConfig(),
+					c.PublicEndpointUrl(), c.Port, c.Secret, c.SigningKeysMap(), c.ActiveKeyID, log.Log, &nullMetricsService{}, false)
+				Expect(serverBlobstore.Put("some-app-guid/some-stack", strings.NewReader("cached content"))).To(Succeed())
+
+				Expect(get(blobstoreFor(c, "buildpack_cache"), "some-app-guid/some-stack", "", out)).To(Succeed())
+
+				Expect(out.String()).To(Equal("cached content"))
+			})
+		})
+
+		Context("get", func() {
+			It("writes the resource to the output file", func() {
+				output := filepath.Join(tempDir, "download")
+
+				Expect(get(blobstore, "some-guid", output, out)).To(Succeed())
+
+				Expect(ioutil.ReadFile(output)).To(Equal([]byte("some content")))
+				Expect(out.String()).To(BeEmpty())
+			})
+
+			It("returns an error when the resource does not exist", func() {
+				e := get(blobstore, "non-existing-guid", "", out)
+
+				Expect(e).To(MatchError(ContainSubstring("Could not get non-existing-guid")))
+			})
+		})
+	})
+})
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,10 +14,14 @@ import (
 
 	"github.com/benbjohnson/clock"
 	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/factory"
 	"github.com/cloudfoundry-incubator/bits-service/config"
+	"github.com/cloudfoundry-incubator/bits-service/inventory"
 	log "github.com/cloudfoundry-incubator/bits-service/logger"
 	"github.com/cloudfoundry-incubator/bits-service/middlewares"
 	"github.com/cloudfoundry-incubator/bits-service/pathsigner"
+	"github.com/cloudfoundry-incubator/bits-service/reconciler"
 	"github.com/cloudfoundry-incubator/bits-service/routes"
 	"github.com/cloudfoundry-incubator/bits-service/statsd"
 	"github.com/urfave/negroni"
@@ -26,10 +31,14 @@ import (
 
 var (
 	configPath = kingpin.Flag("config", "specify config to use").Required().Short('c').String()
+
+	serveCommand     = kingpin.Command("serve", "start the bits-service (default)").Default()
+	inventoryCommand = kingpin.Command("inventory", "print a storage usage and inventory report of all blobstores as JSON")
+	reconcileCommand = kingpin.Command("reconcile", "print a report of orphaned blobs as JSON without deleting them")
 )
 
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	config, e := config.LoadConfig(*configPath)
 	if os.Getenv("BITS_BLOBSTORE_PASSWORD") != "" {
@@ -56,11 +65,47 @@ func main() {
 
 	metricsService := statsd.NewMetricsService()
 
-	appStashBlobstore, signAppStashURLHandler := createAppStashBlobstore(config.AppStash, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, log.Log, metricsService)
-	packageBlobstore, signPackageURLHandler := createBlobstoreAndSignURLHandler(config.Packages, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, "packages", log.Log, metricsService)
-	dropletBlobstore, signDropletURLHandler := createBlobstoreAndSignURLHandler(config.Droplets, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, "droplets", log.Log, metricsService)
-	buildpackBlobstore, signBuildpackURLHandler := createBlobstoreAndSignURLHandler(config.Buildpacks, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, "buildpacks", log.Log, metricsService)
-	buildpackCacheBlobstore, signBuildpackCacheURLHandler := createBuildpackCacheSignURLHandler(config.Droplets, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, log.Log, metricsService)
+	appStashBlobstore, signAppStashURLHandler := factory.CreateAppStashBlobstoreAndSignURLHandler(config.AppStash, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, log.Log, metricsService, true)
+	packageBlobstore, signPackageURLHandler := factory.CreateBlobstoreAndSignURLHandler(config.Packages, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, "packages", log.Log, metricsService, true)
+	dropletBlobstore, signDropletURLHandler := factory.CreateBlobstoreAndSignURLHandler(config.Droplets, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, "droplets", log.Log, metricsService, true)
+	buildpackBlobstore, signBuildpackURLHandler := factory.CreateBlobstoreAndSignURLHandler(config.Buildpacks, config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, "buildpacks", log.Log, metricsService, true)
+	buildpackCacheBlobstore, signBuildpackCacheURLHandler := factory.CreateBuildpackCacheBlobstoreAndSignURLHandler(config.BuildpackCacheBlobstoreConfig(), config.PublicEndpointUrl(), config.Port, config.Secret, config.SigningKeysMap(), config.ActiveKeyID, log.Log, metricsService, true)
+
+	var evictingBuildpackCacheBlobstore *decorator.EvictingBlobstoreDecorator
+	if config.BuildpackCacheConfig.EvictionEnabled() {
+		evictingBuildpackCacheBlobstore = decorator.ForBlobstoreWithEviction(
+			buildpackCacheBlobstore,
+			metricsService,
+			"buildpack_cache",
+			config.BuildpackCacheConfig.MaxEntrySizeBytes(),
+			config.BuildpackCacheConfig.MaxTotalSizeBytes(),
+			config.BuildpackCacheConfig.TTL(),
+			clock.New())
+		buildpackCacheBlobstore = evictingBuildpackCacheBlobstore
+	}
+
+	inventoryReporter := createInventoryReporter(packageBlobstore, dropletBlobstore, buildpackBlobstore, buildpackCacheBlobstore, appStashBlobstore)
+	if command == inventoryCommand.FullCommand() {
+		printInventoryReport(inventoryReporter)
+		return
+	}
+
+	if evictingBuildpackCacheBlobstore != nil {
+		go evictingBuildpackCacheBlobstore.RegularlySweep(config.BuildpackCacheConfig.SweepInterval())
+		log.Log.Infow("Starting with buildpack cache eviction",
+			"max-entry-size", config.BuildpackCacheConfig.MaxEntrySizeBytes(),
+			"max-total-size", config.BuildpackCacheConfig.MaxTotalSizeBytes(),
+			"ttl", config.BuildpackCacheConfig.TTL(),
+			"sweep-interval", config.BuildpackCacheConfig.SweepInterval())
+	}
+
+	// The inventory is opt-in, because listing all blobs is expensive and would be done by every instance.
+	var regularlyRefreshedInventoryReporter *inventory.Reporter
+	if config.Inventory != nil {
+		regularlyRefreshedInventoryReporter = inventoryReporter
+		go regularlyRefreshedInventoryReporter.RegularlyRefresh(config.Inventory.RefreshInterval())
+		log.Log.Infow("Starting with storage inventory", "refresh-interval", config.Inventory.RefreshInterval())
+	}
 
 	go regularlyEmitGoRoutines(metricsService)
 
@@ -72,7 +117,7 @@ func main() {
 	if config.EnableRegistry {
 		ociImageHandler = &oci_registry.ImageHandler{
 			ImageManager: oci_registry.NewBitsImageManager(
-				createRootFSBlobstore(config.RootFS),
+				factory.CreateRootFSBlobstore(config.RootFS),
 				dropletBlobstore,
 				// TODO: We should use a differently decorated blobstore for digestLookupStore:
 				// We want one with a non-partitioned prefix, so real droplets and
@@ -91,6 +136,38 @@ func main() {
 		)
 	}
 
+	dropletHandler := bitsgo.NewResourceHandlerWithArtifactDeleter(
+		dropletBlobstore,
+		appStashBlobstore,
+		"droplet",
+		metricsService,
+		config.Droplets.MaxBodySizeBytes(),
+		config.ShouldProxyGetRequests,
+		dropletArtifactDeleter)
+	var dropletVersionHistory *bitsgo.DropletVersionHistory
+	if config.DropletHistory.MaxVersions > 0 {
+		dropletVersionHistory = bitsgo.NewDropletVersionHistory(dropletBlobstore, config.DropletHistory.MaxVersions, dropletArtifactDeleter)
+		dropletHandler.WithDropletVersionHistory(dropletVersionHistory)
+		log.Log.Infow("Starting with droplet version history", "max-versions", config.DropletHistory.MaxVersions)
+	}
+
+	var orphanReconciler *reconciler.Reconciler
+	if config.Reconciliation != nil {
+		orphanReconciler = createReconciler(config.Reconciliation, packageBlobstore, dropletBlobstore, buildpackBlobstore, dropletVersionHistory, metricsService)
+	}
+	if command == reconcileCommand.FullCommand() {
+		printReconciliationReport(orphanReconciler)
+		return
+	}
+	if orphanReconciler != nil {
+		log.Log.Infow("Starting with orphaned blob reconciliation",
+			"endpoint", config.Reconciliation.Endpoint,
+			"interval", config.Reconciliation.Interval(),
+			"grace-period", config.Reconciliation.GracePeriod(),
+			"dry-run", config.Reconciliation.IsDryRun())
+		go orphanReconciler.RegularlyReconcile(config.Reconciliation.Interval())
+	}
+
 	handler := routes.SetUpAllRoutes(
 		config.PrivateEndpointUrl().Host,
 		config.PublicEndpointUrl().Host,
@@ -121,16 +198,11 @@ func main() {
 			nil,
 		),
 		bitsgo.NewResourceHandler(buildpackBlobstore, appStashBlobstore, "buildpack", metricsService, config.Buildpacks.MaxBodySizeBytes(), config.ShouldProxyGetRequests),
-		bitsgo.NewResourceHandlerWithArtifactDeleter(
-			dropletBlobstore,
-			appStashBlobstore,
-			"droplet",
-			metricsService,
-			config.Droplets.MaxBodySizeBytes(),
-			config.ShouldProxyGetRequests,
-			dropletArtifactDeleter),
+		dropletHandler,
 		bitsgo.NewResourceHandler(buildpackCacheBlobstore, appStashBlobstore, "buildpack_cache", metricsService, config.BuildpackCache.MaxBodySizeBytes(), config.ShouldProxyGetRequests),
 		ociImageHandler,
+		regularlyRefreshedInventoryReporter,
+		orphanReconciler,
 	)
 
 	address := os.Getenv("BITS_LISTEN_ADDR")
@@ -244,6 +316,29 @@ func basicAuthCredentialsFrom(configCredententials []config.Credential) (basicAu
 	return
 }
 
+func printInventoryReport(inventoryReporter *inventory.Reporter) {
+	report, e := json.MarshalIndent(inventoryReporter.Generate(), "", "  ")
+	if e != nil {
+		log.Log.Fatalw("Could not marshal inventory report", "error", e)
+	}
+	fmt.Println(string(report))
+}
+
+func printReconciliationReport(orphanReconciler *reconciler.Reconciler) {
+	if orphanReconciler == nil {
+		log.Log.Fatalw("Reconciliation is not configured. Please provide the \"reconciliation\" config.")
+	}
+	reports, e := orphanReconciler.DryRun()
+	if e != nil {
+		log.Log.Errorw("Reconciliation failed", "error", e)
+	}
+	report, e := json.MarshalIndent(reports, "", "  ")
+	if e != nil {
+		log.Log.Fatalw("Could not marshal reconciliation report", "error", e)
+	}
+	fmt.Println(string(report))
+}
+
 func regularlyEmitGoRoutines(metricsService bitsgo.MetricsService) {
 	for range time.Tick(1 * time.Minute) {
 		metricsService.SendGaugeMetric("numGoRoutines", int64(runtime.NumGoroutine()))
@@ -1,11 +1,14 @@
 package config
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -23,7 +26,7 @@ type Config struct {
 	RootFS BlobstoreConfig `yaml:"rootfs"`
 
 	// BuildpackCache is a Pseudo blobstore, because in reality it is using the Droplets blobstore.
-	// However, we want to be able to control its max_body_size.
+	// However, we want to be able to control its max_body_size and compression.
 	BuildpackCache BlobstoreConfig `yaml:"buildpack_cache"`
 
 	Logging          LoggingConfig
@@ -46,8 +49,16 @@ type Config struct {
 
 	CCUpdater *CCUpdaterConfig `yaml:"cc_updater"`
 
+	Reconciliation *ReconciliationConfig `yaml:"reconciliation"`
+
 	AppStashConfig AppStashConfig `yaml:"app_stash_config"`
 
+	DropletHistory DropletHistoryConfig `yaml:"droplet_history"`
+
+	BuildpackCacheConfig BuildpackCacheConfig `yaml:"buildpack_cache_config"`
+
+	Inventory *InventoryConfig `yaml:"inventory"`
+
 	EnableRegistry bool `yaml:"enable_registry"`
 
 	ShouldProxyGetRequests bool `yaml:"proxy_get_requests"`
@@ -76,6 +87,18 @@ func validateEndpoint(endpoint string, endpointType string) *url.URL {
 	return u
 }
 
+// BuildpackCacheBlobstoreConfig returns the config of the droplets blobstore, which is used for the buildpack cache.
+// A compression configured for buildpack_cache replaces the one of droplets.
+func (config *Config) BuildpackCacheBlobstoreConfig() BlobstoreConfig {
+	blobstoreConfig := config.Droplets
+	// Buildpack cache entries are overwritten, so they must not be cached.
+	blobstoreConfig.Cache = nil
+	if config.BuildpackCache.Compression != nil {
+		blobstoreConfig.Compression = config.BuildpackCache.Compression
+	}
+	return blobstoreConfig
+}
+
 func (config *Config) SigningKeysMap() map[string]string {
 	result := make(map[string]string, 3)
 	for _, signingKey := range config.SigningKeys {
@@ -95,6 +118,166 @@ type BlobstoreConfig struct {
 	AlibabaConfig     *AlibabaBlobstoreConfig   `yaml:"alibaba_config"`
 	MaxBodySize       string                    `yaml:"max_body_size"`
 	GlobalMaxBodySize string                    // Not to be set by yaml
+
+	LiveMigration *LiveMigrationConfig `yaml:"live_migration"`
+	Replication   *ReplicationConfig   `yaml:"replication"`
+	Encryption    *EncryptionConfig    `yaml:"encryption"`
+	Compression   *CompressionConfig   `yaml:"compression"`
+	Cache         *CacheConfig         `yaml:"cache"`
+	// VerifyChecksums enables storing and verifying sha256 digests. See decorator.ChecksumVerifyingBlobstoreDecorator.
+	VerifyChecksums bool             `yaml:"verify_checksums"`
+	Retry           *RetryConfig     `yaml:"retry"`
+	RateLimit       *RateLimitConfig `yaml:"rate_limit"`
+}
+
+// RateLimitConfig limits the load put on the blobstore. See decorator.RateLimitingBlobstoreDecorator.
+type RateLimitConfig struct {
+	// MaxInFlight is the maximum number of concurrent operations. 0 means unlimited.
+	MaxInFlight int64 `yaml:"max_in_flight"`
+	// RequestsPerSecond is the maximum number of operations started per second. 0 means unlimited.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is the number of operations that may be started at once regardless of RequestsPerSecond. Defaults to 1.
+	Burst int `yaml:"burst"`
+}
+
+// RetryConfig configures retries, timeouts and the circuit breaker for the blobstore. See decorator.RetryingBlobstoreDecorator.
+// Retries are enabled with the defaults when no retry config is given.
+type RetryConfig struct {
+	// MaxAttempts defaults to 3.
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoffMilliseconds defaults to 100.
+	InitialBackoffMilliseconds int `yaml:"initial_backoff_milliseconds"`
+	// MaxBackoffMilliseconds defaults to 5000.
+	MaxBackoffMilliseconds int `yaml:"max_backoff_milliseconds"`
+	// OperationTimeoutSeconds limits the duration of a single attempt. 0 disables timeouts.
+	OperationTimeoutSeconds int                   `yaml:"operation_timeout_seconds"`
+	CircuitBreaker          *CircuitBreakerConfig `yaml:"circuit_breaker"`
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures after which the circuit breaker opens. Defaults to 5.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenDurationSeconds defaults to 30.
+	OpenDurationSeconds int `yaml:"open_duration_seconds"`
+}
+
+func (config *RetryConfig) MaxAttemptsWithDefault() int {
+	return intWithDefault(config.MaxAttempts, 3)
+}
+
+func (config *RetryConfig) InitialBackoff() time.Duration {
+	return time.Duration(intWithDefault(config.InitialBackoffMilliseconds, 100)) * time.Millisecond
+}
+
+func (config *RetryConfig) MaxBackoff() time.Duration {
+	return time.Duration(intWithDefault(config.MaxBackoffMilliseconds, 5000)) * time.Millisecond
+}
+
+func (config *RetryConfig) OperationTimeout() time.Duration {
+	return time.Duration(config.OperationTimeoutSeconds) * time.Second
+}
+
+func (config *CircuitBreakerConfig) FailureThresholdWithDefault() int {
+	return intWithDefault(config.FailureThreshold, 5)
+}
+
+func (config *CircuitBreakerConfig) OpenDuration() time.Duration {
+	return time.Duration(intWithDefault(config.OpenDurationSeconds, 30)) * time.Second
+}
+
+func intWithDefault(value int, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// CacheConfig configures a local disk cache for blobs read from the blobstore. See decorator.CachingBlobstoreDecorator.
+// Caching is only supported for resource types whose blobs are immutable, i.e. not for packages and buildpack_cache.
+type CacheConfig struct {
+	// Directory may be shared by resource types, because each of them uses its own subdirectory.
+	Directory string
+	// MaxSize defaults to 1G.
+	MaxSize string `yaml:"max_size"`
+}
+
+func (config *CacheConfig) MaxSizeBytes() uint64 {
+	return parseSizeProperty(config.MaxSize, 1024*1024*1024)
+}
+
+// CompressionConfig configures compression of blobs. See decorator.CompressingBlobstoreDecorator.
+type CompressionConfig struct {
+	// Codec is either "gzip", "zstd" or "none". "none" disables compression, e.g. for buildpack_cache
+	// when compression is configured for droplets.
+	Codec string
+	// Level is the codec specific compression level: 1 to 9 for gzip, 1 to 22 for zstd. 0 uses the codec's default level.
+	Level int
+}
+
+func (config *CompressionConfig) Enabled() bool {
+	return config != nil && config.Codec != "none"
+}
+
+// EncryptionConfig configures client-side encryption of blobs. See decorator.EncryptingBlobstoreDecorator.
+// Keys no longer used for encryption must be kept as long as blobs encrypted with them exist.
+type EncryptionConfig struct {
+	MasterKeys []struct {
+		KeyID string `yaml:"key_id"`
+		// Key is a base64 encoded AES key of 16, 24 or 32 bytes.
+		Key string
+	} `yaml:"master_keys"`
+	ActiveKeyID string `yaml:"active_key_id"`
+}
+
+func (config *EncryptionConfig) MasterKeysMap() map[string][]byte {
+	result := make(map[string][]byte, len(config.MasterKeys))
+	for _, masterKey := range config.MasterKeys {
+		key, e := base64.StdEncoding.DecodeString(masterKey.Key)
+		if e != nil {
+			panic("Unexpected error: " + e.Error())
+		}
+		result[masterKey.KeyID] = key
+	}
+	return result
+}
+
+// LiveMigrationConfig configures the blobstore a resource type is being migrated away from.
+// See decorator.LiveMigrationBlobstoreDecorator.
+type LiveMigrationConfig struct {
+	Legacy     BlobstoreConfig
+	CopyOnRead bool `yaml:"copy_on_read"`
+	// DrainIntervalSeconds is the interval in which blobs are moved from the legacy blobstore
+	// into the primary one. 0 disables draining. A blob is deleted from the legacy blobstore one
+	// interval after it was copied, so the interval must be longer than copying the largest blob takes.
+	DrainIntervalSeconds int `yaml:"drain_interval_seconds"`
+}
+
+func (config *LiveMigrationConfig) DrainInterval() time.Duration {
+	return time.Duration(config.DrainIntervalSeconds) * time.Second
+}
+
+// ReplicationConfig configures additional blobstores every blob of a resource type is written to.
+// See decorator.ReplicatingBlobstoreDecorator.
+type ReplicationConfig struct {
+	Replicas []BlobstoreConfig
+	// WriteQuorum is the number of blobstores, including the primary one, a write must succeed on.
+	// Defaults to all blobstores.
+	WriteQuorum           int `yaml:"write_quorum"`
+	RepairIntervalSeconds int `yaml:"repair_interval_seconds"`
+}
+
+func (config *ReplicationConfig) WriteQuorumWithDefault() int {
+	if config.WriteQuorum == 0 {
+		return len(config.Replicas) + 1
+	}
+	return config.WriteQuorum
+}
+
+func (config *ReplicationConfig) RepairInterval() time.Duration {
+	if config.RepairIntervalSeconds == 0 {
+		return time.Minute
+	}
+	return time.Duration(config.RepairIntervalSeconds) * time.Second
 }
 
 type BlobstoreType string
@@ -152,6 +335,18 @@ type S3BlobstoreConfig struct {
 	SSEKMSKeyID          string `yaml:"server_side_encryption_aws_kms_key_id"`
 	UseIAMProfile        bool   `yaml:"use_iam_profile"`
 	SignatureVersion     int    `yaml:"signature_version"`
+	// PartSize is the size of the parts of multipart uploads and copies. Defaults to 64M. Must be at least 5M.
+	PartSize string `yaml:"part_size"`
+	// UploadConcurrency is the number of parts uploaded or copied in parallel. Defaults to 5.
+	UploadConcurrency int `yaml:"upload_concurrency"`
+}
+
+func (config *S3BlobstoreConfig) PartSizeBytes() int64 {
+	return int64(parseSizeProperty(config.PartSize, 64*1024*1024))
+}
+
+func (config *S3BlobstoreConfig) UploadConcurrencyWithDefault() int {
+	return intWithDefault(config.UploadConcurrency, 5)
 }
 
 type GCPBlobstoreConfig struct {
@@ -161,13 +356,54 @@ type GCPBlobstoreConfig struct {
 	Email               string
 	TokenURL            string `yaml:"token_url"`
 	RetryTimeoutSeconds int    `yaml:"retry_timeout_seconds"`
+	// ChunkSize is the size of the chunks of resumable uploads. Defaults to 16M.
+	ChunkSize string `yaml:"chunk_size"`
+	// SignedURLExpirySeconds is the validity of URLs GetOrRedirect redirects to. Defaults to 3600.
+	SignedURLExpirySeconds int `yaml:"signed_url_expiry_seconds"`
+	// Endpoint overrides the GCS JSON API endpoint, e.g. http://localhost:4443/storage/v1/ for fake-gcs-server.
+	Endpoint string `yaml:"endpoint"`
+	// Unauthenticated sends requests to Endpoint without credentials, e.g. for fake-gcs-server. It requires Endpoint,
+	// so that requests to GCS itself are always authenticated.
+	Unauthenticated bool `yaml:"unauthenticated"`
+}
+
+func (config *GCPBlobstoreConfig) ChunkSizeBytes() int {
+	return int(parseSizeProperty(config.ChunkSize, 16*1024*1024))
 }
 
+func (config *GCPBlobstoreConfig) SignedURLExpiry() time.Duration {
+	return time.Duration(intWithDefault(config.SignedURLExpirySeconds, 3600)) * time.Second
+}
+
+// AzureBlobstoreConfig authenticates with exactly one of AccountKey, SASToken or AAD.
 type AzureBlobstoreConfig struct {
 	ContainerName string `yaml:"container_name"`
 	AccountName   string `yaml:"account_name"`
 	AccountKey    string `yaml:"account_key"`
-	Environment   string
+	// SASToken is a shared access signature granting access to the container, e.g. "sv=...&sig=...".
+	// It cannot sign URLs, so signed URLs point to the bits-service, which proxies the blobs.
+	SASToken string `yaml:"sas_token"`
+	// AAD enables authentication with Azure Active Directory.
+	AAD *AzureAADConfig `yaml:"aad"`
+	// Endpoint overrides the blob service endpoint derived from AccountName and Environment,
+	// e.g. http://127.0.0.1:10000/devstoreaccount1 for the Azurite emulator.
+	Endpoint    string `yaml:"endpoint"`
+	Environment string
+	// PutBlockConcurrency is the number of blocks uploaded in parallel. Defaults to 4.
+	PutBlockConcurrency int `yaml:"put_block_concurrency"`
+}
+
+// AzureAADConfig authenticates either as a service principal with a client secret or with a managed identity.
+type AzureAADConfig struct {
+	TenantID     string `yaml:"tenant_id"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// UseManagedIdentity uses the managed identity of the VM. When ClientID is set, it selects a user-assigned identity.
+	UseManagedIdentity bool `yaml:"use_managed_identity"`
+}
+
+func (c *AzureBlobstoreConfig) PutBlockConcurrencyWithDefault() int {
+	return intWithDefault(c.PutBlockConcurrency, 4)
 }
 
 func (c *AzureBlobstoreConfig) EnvironmentName() string {
@@ -195,6 +431,30 @@ type OpenstackBlobstoreConfig struct {
 	TrustId        string `yaml:"trust_id"`         // Id of the trust (v3 auth only)
 
 	AccountMetaTempURLKey string `yaml:"account_meta_temp_url_key"` // used as secret for signed URLs
+
+	// Objects larger than SegmentSize are stored as static large objects. Defaults to 1G and must not exceed 5G.
+	SegmentSize string `yaml:"segment_size"`
+	// SegmentContainerName is the container segments of static large objects are stored in. Defaults to ContainerName + "_segments".
+	SegmentContainerName string `yaml:"segment_container_name"`
+	// SegmentUploadConcurrency is the number of segments uploaded in parallel. Defaults to 4.
+	SegmentUploadConcurrency int `yaml:"segment_upload_concurrency"`
+}
+
+const maxSwiftObjectSize = 5 * 1024 * 1024 * 1024
+
+func (config *OpenstackBlobstoreConfig) SegmentSizeBytes() uint64 {
+	return parseSizeProperty(config.SegmentSize, 1024*1024*1024)
+}
+
+func (config *OpenstackBlobstoreConfig) SegmentContainerNameWithDefault() string {
+	if config.SegmentContainerName == "" {
+		return config.ContainerName + "_segments"
+	}
+	return config.SegmentContainerName
+}
+
+func (config *OpenstackBlobstoreConfig) SegmentUploadConcurrencyWithDefault() int {
+	return intWithDefault(config.SegmentUploadConcurrency, 4)
 }
 
 type WebdavBlobstoreConfig struct {
@@ -239,6 +499,51 @@ type CCUpdaterConfig struct {
 	CACertFile     string `yaml:"ca_cert_file"`
 }
 
+type ReconciliationConfig struct {
+	// Endpoint is the base URL of a Cloud Controller-style API listing the live resources.
+	Endpoint       string
+	ClientCertFile string `yaml:"client_cert_file"`
+	ClientKeyFile  string `yaml:"client_key_file"`
+	CACertFile     string `yaml:"ca_cert_file"`
+	// Paths maps the resource types "packages", "droplets" and "buildpacks" to the list endpoints
+	// relative to Endpoint. Defaults to the corresponding Cloud Controller v3 endpoints.
+	Paths              map[string]string
+	IntervalSeconds    int   `yaml:"interval_seconds"`
+	GracePeriodSeconds int   `yaml:"grace_period_seconds"`
+	DryRun             *bool `yaml:"dry_run"`
+}
+
+func (config *ReconciliationConfig) PathsWithDefaults() map[string]string {
+	paths := map[string]string{
+		"packages":   "/v3/packages",
+		"droplets":   "/v3/droplets",
+		"buildpacks": "/v3/buildpacks",
+	}
+	for resourceType, path := range config.Paths {
+		paths[resourceType] = path
+	}
+	return paths
+}
+
+func (config *ReconciliationConfig) Interval() time.Duration {
+	if config.IntervalSeconds == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(config.IntervalSeconds) * time.Second
+}
+
+func (config *ReconciliationConfig) GracePeriod() time.Duration {
+	if config.GracePeriodSeconds == 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(config.GracePeriodSeconds) * time.Second
+}
+
+// IsDryRun defaults to true, so that nothing gets deleted unless explicitly configured.
+func (config *ReconciliationConfig) IsDryRun() bool {
+	return config.DryRun == nil || *config.DryRun
+}
+
 type AppStashConfig struct {
 	MinimumSize string `yaml:"minimum_size"`
 	MaximumSize string `yaml:"maximum_size"`
@@ -251,6 +556,54 @@ func (config *AppStashConfig) MaximumSizeBytes() uint64 {
 	return parseSizeProperty(config.MaximumSize, math.MaxUint64)
 }
 
+type DropletHistoryConfig struct {
+	// MaxVersions is the number of droplets kept per app guid. 0 disables the droplet history.
+	MaxVersions int `yaml:"max_versions"`
+}
+
+type InventoryConfig struct {
+	RefreshIntervalSeconds int `yaml:"refresh_interval_seconds"`
+}
+
+func (config *InventoryConfig) RefreshInterval() time.Duration {
+	if config.RefreshIntervalSeconds == 0 {
+		return time.Hour
+	}
+	return time.Duration(config.RefreshIntervalSeconds) * time.Second
+}
+
+// BuildpackCacheConfig configures the size caps and the eviction of buildpack cache entries.
+type BuildpackCacheConfig struct {
+	// MaxEntrySize rejects entries larger than it, e.g. when they are copied rather than uploaded.
+	MaxEntrySize         string `yaml:"max_entry_size"`
+	MaxTotalSize         string `yaml:"max_total_size"`
+	TTLSeconds           int    `yaml:"ttl_seconds"`
+	SweepIntervalSeconds int    `yaml:"sweep_interval_seconds"`
+}
+
+func (config *BuildpackCacheConfig) MaxEntrySizeBytes() uint64 {
+	return parseSizeProperty(config.MaxEntrySize, 0)
+}
+
+func (config *BuildpackCacheConfig) MaxTotalSizeBytes() uint64 {
+	return parseSizeProperty(config.MaxTotalSize, 0)
+}
+
+func (config *BuildpackCacheConfig) TTL() time.Duration {
+	return time.Duration(config.TTLSeconds) * time.Second
+}
+
+func (config *BuildpackCacheConfig) SweepInterval() time.Duration {
+	if config.SweepIntervalSeconds == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(config.SweepIntervalSeconds) * time.Second
+}
+
+func (config *BuildpackCacheConfig) EvictionEnabled() bool {
+	return config.MaxEntrySizeBytes() != 0 || config.MaxTotalSizeBytes() != 0 || config.TTLSeconds != 0
+}
+
 func parseSizeProperty(size string, defaultValue uint64) uint64 {
 	if size == "" {
 		return defaultValue
@@ -370,6 +723,16 @@ func LoadConfig(filename string) (config Config, err error) {
 	verifyBlobstoreConfig(config.Buildpacks, "buildpacks", &errs)
 	verifyBlobstoreConfig(config.AppStash, "app_stash", &errs)
 
+	verifyBlobstoreDecoratorConfigs(&config.Droplets, "droplets", &errs)
+	verifyBlobstoreDecoratorConfigs(&config.Packages, "packages", &errs)
+	verifyBlobstoreDecoratorConfigs(&config.Buildpacks, "buildpacks", &errs)
+	verifyBlobstoreDecoratorConfigs(&config.AppStash, "app_stash", &errs)
+	verifyBlobstoreDecoratorConfigs(&config.BuildpackCache, "buildpack_cache", &errs)
+
+	if config.Packages.Cache != nil {
+		errs = append(errs, "packages cache is not supported, because packages can be overwritten.")
+	}
+
 	if len(errs) > 0 {
 		// returning here already, because follow-up checks are difficult if not even basic checks succeed
 		return Config{}, errors.New("error in config values: " + strings.Join(errs, "; "))
@@ -385,6 +748,16 @@ func LoadConfig(filename string) (config Config, err error) {
 		errs = append(errs, "buildpack_cache must not have a blobstore configured, as it only exists to allow to configure max_body_size. "+
 			"As blobstore, the droplet blobstore is used.")
 	}
+	if config.BuildpackCache.LiveMigration != nil ||
+		config.BuildpackCache.Replication != nil ||
+		config.BuildpackCache.Encryption != nil ||
+		config.BuildpackCache.Cache != nil ||
+		config.BuildpackCache.VerifyChecksums ||
+		config.BuildpackCache.Retry != nil ||
+		config.BuildpackCache.RateLimit != nil {
+		errs = append(errs, "buildpack_cache only supports configuring max_body_size and compression. "+
+			"All other settings are taken from the droplet blobstore.")
+	}
 
 	if config.Packages.BlobstoreType == WebDAV && config.Packages.WebdavConfig.DirectoryKey == "" {
 		errs = append(errs, "Packages WebDAV blobstore must have a directory_key configured.")
@@ -434,6 +807,144 @@ func verifyBlobstoreConfig(blobstoreConfig BlobstoreConfig, resourceType string,
 	}
 	if blobstoreConfigIsNil(blobstoreConfig) {
 		*errs = append(*errs, resourceType+" blobstore config is missing "+string(blobstoreConfig.BlobstoreType)+" config")
+		return
+	}
+	if blobstoreConfig.BlobstoreType == AWS && blobstoreConfig.S3Config.PartSize != "" {
+		partSize, e := bytefmt.ToBytes(blobstoreConfig.S3Config.PartSize)
+		if e != nil {
+			*errs = append(*errs, resourceType+" s3_config.part_size is invalid. Caused by: "+e.Error())
+		} else if partSize < 5*1024*1024 {
+			*errs = append(*errs, resourceType+" s3_config.part_size must be at least 5M.")
+		}
+	}
+	if blobstoreConfig.BlobstoreType == Google && blobstoreConfig.GCPConfig.SignedURLExpiry() > 7*24*time.Hour {
+		*errs = append(*errs, resourceType+" gcp_config.signed_url_expiry_seconds must not exceed 7 days.")
+	}
+	if blobstoreConfig.BlobstoreType == Google && blobstoreConfig.GCPConfig.Unauthenticated && blobstoreConfig.GCPConfig.Endpoint == "" {
+		*errs = append(*errs, resourceType+" gcp_config.unauthenticated requires gcp_config.endpoint.")
+	}
+	if blobstoreConfig.BlobstoreType == Azure {
+		verifyAzureAuthentication(blobstoreConfig.AzureConfig, resourceType, errs)
+	}
+	if blobstoreConfig.BlobstoreType == OpenStack && blobstoreConfig.OpenstackConfig.SegmentSize != "" {
+		segmentSize, e := bytefmt.ToBytes(blobstoreConfig.OpenstackConfig.SegmentSize)
+		if e != nil {
+			*errs = append(*errs, resourceType+" openstack_config.segment_size is invalid. Caused by: "+e.Error())
+		} else if segmentSize == 0 || segmentSize > maxSwiftObjectSize {
+			*errs = append(*errs, resourceType+" openstack_config.segment_size must be between 1B and 5G.")
+		}
+	}
+}
+
+func verifyAzureAuthentication(azureConfig *AzureBlobstoreConfig, resourceType string, errs *[]string) {
+	numMethods := 0
+	for _, isSet := range []bool{azureConfig.AccountKey != "", azureConfig.SASToken != "", azureConfig.AAD != nil} {
+		if isSet {
+			numMethods++
+		}
+	}
+	if numMethods != 1 {
+		*errs = append(*errs, resourceType+" azure_config must have exactly one of account_key, sas_token or aad configured.")
+	}
+	if azureConfig.Endpoint == "" && azureConfig.AccountName == "" {
+		*errs = append(*errs, resourceType+" azure_config must have account_name or endpoint configured.")
+	}
+	if azureConfig.AAD != nil && !azureConfig.AAD.UseManagedIdentity &&
+		(azureConfig.AAD.TenantID == "" || azureConfig.AAD.ClientID == "" || azureConfig.AAD.ClientSecret == "") {
+		*errs = append(*errs, resourceType+" azure_config.aad must have tenant_id, client_id and client_secret configured or use_managed_identity enabled.")
+	}
+}
+
+// verifyBlobstoreDecoratorConfigs verifies the configuration of the optional blobstore decorators.
+func verifyBlobstoreDecoratorConfigs(blobstoreConfig *BlobstoreConfig, resourceType string, errs *[]string) {
+	if blobstoreConfig.LiveMigration != nil {
+		verifyNestedBlobstoreConfig(&blobstoreConfig.LiveMigration.Legacy, resourceType+" live_migration.legacy", errs)
+	}
+	if blobstoreConfig.Replication != nil {
+		if len(blobstoreConfig.Replication.Replicas) == 0 {
+			*errs = append(*errs, resourceType+" replication must have at least one replica configured.")
+		}
+		for i := range blobstoreConfig.Replication.Replicas {
+			verifyNestedBlobstoreConfig(&blobstoreConfig.Replication.Replicas[i], fmt.Sprintf("%v replication.replicas[%v]", resourceType, i), errs)
+		}
+		if quorum := blobstoreConfig.Replication.WriteQuorumWithDefault(); quorum < 1 || quorum > len(blobstoreConfig.Replication.Replicas)+1 {
+			*errs = append(*errs, resourceType+" replication.write_quorum must be between 1 and the number of blobstores including the primary one.")
+		}
+	}
+	if blobstoreConfig.Encryption != nil {
+		verifyEncryptionConfig(blobstoreConfig.Encryption, resourceType, errs)
+	}
+	if blobstoreConfig.Compression != nil {
+		blobstoreConfig.Compression.Codec = strings.ToLower(blobstoreConfig.Compression.Codec)
+		switch blobstoreConfig.Compression.Codec {
+		case "gzip":
+			if blobstoreConfig.Compression.Level < 0 || blobstoreConfig.Compression.Level > 9 {
+				*errs = append(*errs, resourceType+" compression.level must be between 1 and 9 for gzip.")
+			}
+		case "zstd":
+			if blobstoreConfig.Compression.Level < 0 || blobstoreConfig.Compression.Level > 22 {
+				*errs = append(*errs, resourceType+" compression.level must be between 1 and 22 for zstd.")
+			}
+		case "none":
+		default:
+			*errs = append(*errs, resourceType+" compression.codec must be either gzip, zstd or none.")
+		}
+	}
+	if blobstoreConfig.Retry != nil {
+		if blobstoreConfig.Retry.MaxAttempts < 0 || blobstoreConfig.Retry.InitialBackoffMilliseconds < 0 ||
+			blobstoreConfig.Retry.MaxBackoffMilliseconds < 0 || blobstoreConfig.Retry.OperationTimeoutSeconds < 0 {
+			*errs = append(*errs, resourceType+" retry settings must not be negative.")
+		}
+		if blobstoreConfig.Retry.CircuitBreaker != nil &&
+			(blobstoreConfig.Retry.CircuitBreaker.FailureThreshold < 0 || blobstoreConfig.Retry.CircuitBreaker.OpenDurationSeconds < 0) {
+			*errs = append(*errs, resourceType+" retry.circuit_breaker settings must not be negative.")
+		}
+	}
+	if blobstoreConfig.RateLimit != nil &&
+		(blobstoreConfig.RateLimit.MaxInFlight < 0 || blobstoreConfig.RateLimit.RequestsPerSecond < 0 || blobstoreConfig.RateLimit.Burst < 0) {
+		*errs = append(*errs, resourceType+" rate_limit settings must not be negative.")
+	}
+	if blobstoreConfig.Cache != nil {
+		if blobstoreConfig.Cache.Directory == "" {
+			*errs = append(*errs, resourceType+" cache.directory must not be empty.")
+		}
+		if blobstoreConfig.Cache.MaxSize != "" {
+			_, e := bytefmt.ToBytes(blobstoreConfig.Cache.MaxSize)
+			if e != nil {
+				*errs = append(*errs, resourceType+" cache.max_size is invalid. Caused by: "+e.Error())
+			}
+		}
+	}
+}
+
+func verifyEncryptionConfig(encryptionConfig *EncryptionConfig, resourceType string, errs *[]string) {
+	activeKeyFound := false
+	for _, masterKey := range encryptionConfig.MasterKeys {
+		key, e := base64.StdEncoding.DecodeString(masterKey.Key)
+		if e != nil {
+			*errs = append(*errs, resourceType+" encryption master key "+masterKey.KeyID+" is not valid base64. Caused by: "+e.Error())
+		} else if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			*errs = append(*errs, resourceType+" encryption master key "+masterKey.KeyID+" must be 16, 24 or 32 bytes long.")
+		}
+		if masterKey.KeyID == encryptionConfig.ActiveKeyID {
+			activeKeyFound = true
+		}
+	}
+	if !activeKeyFound {
+		*errs = append(*errs, resourceType+" encryption.active_key_id must refer to one of the configured master_keys.")
+	}
+}
+
+func verifyNestedBlobstoreConfig(blobstoreConfig *BlobstoreConfig, name string, errs *[]string) {
+	blobstoreConfig.BlobstoreType = BlobstoreType(strings.ToLower(string(blobstoreConfig.BlobstoreType)))
+	verifyBlobstoreType(blobstoreConfig.BlobstoreType, name, errs)
+	verifyBlobstoreConfig(*blobstoreConfig, name, errs)
+	if blobstoreConfigIsNil(*blobstoreConfig) {
+		return
+	}
+	setSignatureVersionDefault(blobstoreConfig)
+	if blobstoreConfig.BlobstoreType == WebDAV && blobstoreConfig.WebdavConfig.DirectoryKey == "" {
+		*errs = append(*errs, name+" WebDAV blobstore must have a directory_key configured.")
 	}
 }
 
@@ -201,6 +201,242 @@ app_stash_config:
 		})
 	})
 
+	It("returns an error when the legacy blobstore of a live migration is invalid", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+  live_migration:
+    copy_on_read: true
+    legacy:
+      blobstore_type: webdav
+droplets:
+  blobstore_type: google
+  gcp_config:
+    bucket: dummy
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		_, e := LoadConfig(configFile.Name())
+
+		Expect(e).To(MatchError(ContainSubstring("packages live_migration.legacy blobstore config is missing webdav config")))
+	})
+
+	It("returns an error when the compression codec is unknown", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+droplets:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+  compression:
+    codec: lz4
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		_, e := LoadConfig(configFile.Name())
+
+		Expect(e).To(MatchError(ContainSubstring("droplets compression.codec must be either gzip, zstd or none")))
+	})
+
+	It("returns an error when the compression level is out of range", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+droplets:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+buildpack_cache:
+  compression:
+    codec: gzip
+    level: 12
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		_, e := LoadConfig(configFile.Name())
+
+		Expect(e).To(MatchError(ContainSubstring("buildpack_cache compression.level must be between 1 and 9 for gzip")))
+	})
+
+	It("configures the compression of buildpack_cache separately from droplets", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+droplets:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+  compression:
+    codec: zstd
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+buildpack_cache:
+  compression:
+    codec: none
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		config, e := LoadConfig(configFile.Name())
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(config.Droplets.Compression.Enabled()).To(BeTrue())
+		Expect(config.BuildpackCacheBlobstoreConfig().LocalConfig.PathPrefix).To(Equal("dummy"))
+		Expect(config.BuildpackCacheBlobstoreConfig().Compression.Enabled()).To(BeFalse())
+	})
+
+	It("returns an error when a cache is configured for packages", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+  cache:
+    directory: /tmp/cache
+droplets:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		_, e := LoadConfig(configFile.Name())
+
+		Expect(e).To(MatchError(ContainSubstring("packages cache is not supported")))
+	})
+
+	It("returns an error when Azure is configured with more than one authentication method", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: azure
+  azure_config:
+    container_name: dummy
+    account_name: dummy
+    account_key: dummy
+    sas_token: sv=dummy&sig=dummy
+droplets:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		_, e := LoadConfig(configFile.Name())
+
+		Expect(e).To(MatchError(ContainSubstring("packages azure_config must have exactly one of account_key, sas_token or aad configured")))
+	})
+
+	It("returns an error when GCP is configured without authentication but with the default endpoint", func() {
+		fmt.Fprintf(configFile, "%s", `
+packages:
+  blobstore_type: google
+  gcp_config:
+    bucket: dummy
+    email: dummy
+    private_key: dummy
+    unauthenticated: true
+droplets:
+  blobstore_type: local
+  local_config:
+    path_prefix: dummy
+buildpacks:
+  blobstore_type: aws
+  s3_config:
+    bucket: dummy
+app_stash:
+  blobstore_type: webdav
+  webdav_config:
+    directory_key: dummy
+public_endpoint: https://public.127.0.0.1.nip.io
+private_endpoint: https://internal.127.0.0.1.nip.io
+secret: geheim
+port: 8000
+key_file: /some/path
+cert_file: /some/path
+`)
+		_, e := LoadConfig(configFile.Name())
+
+		Expect(e).To(MatchError(ContainSubstring("packages gcp_config.unauthenticated requires gcp_config.endpoint")))
+	})
+
 	It("returns an error when blobstores are not configured", func() {
 		fmt.Fprintf(configFile, "%s", `
 privatebuildpacks:
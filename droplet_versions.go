@@ -0,0 +1,328 @@
+package bitsgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dropletVersionIndexPrefix is the path prefix of the blobs of the droplet version history. All of them
+// share it, so that they can be listed without listing all droplets.
+const dropletVersionIndexPrefix = "droplet-versions/"
+
+// IsDropletVersionIndexPath returns true for the paths of the blobs of the droplet version history, which,
+// unlike droplets, are modified.
+func IsDropletVersionIndexPath(path string) bool {
+	return strings.HasPrefix(path, dropletVersionIndexPrefix)
+}
+
+type DropletVersion struct {
+	DropletGuid string    `json:"droplet_guid"`
+	Hash        string    `json:"hash"`
+	CreatedAt   time.Time `json:"created_at"`
+	Current     bool      `json:"current"`
+	// Retained is true when the Cloud Controller has already deleted this droplet,
+	// but bits-service still keeps it around to allow rolling back to it.
+	Retained bool `json:"retained"`
+}
+
+func (version *DropletVersion) path() string {
+	return version.DropletGuid + "/" + version.Hash
+}
+
+// versionRecord is the content of a version blob.
+type versionRecord struct {
+	CreatedAt time.Time `json:"created_at"`
+	// CurrentSince is the time the version was recorded or last promoted. The version with the latest
+	// CurrentSince is the current one.
+	CurrentSince time.Time `json:"current_since"`
+}
+
+// retentionRecord is the content of a retention marker blob.
+type retentionRecord struct {
+	RetainedAt time.Time `json:"retained_at"`
+}
+
+// DropletVersionHistory keeps the history of the droplets stored as "<droplet-guid>/<hash>" which
+// were uploaded for an app in the droplet blobstore. Droplets in the history are not deleted from the
+// blobstore when the Cloud Controller deletes them, but only once they fall out of the history.
+//
+// Every version is a blob of its own ("droplet-versions/<app-guid>/versions/<droplet-guid>/<hash>"),
+// and the deletion by the Cloud Controller is recorded by a separate marker blob
+// ("droplet-versions/<app-guid>/retained/<droplet-guid>/<hash>"). Each write therefore only touches the
+// blob of a single version, so that bits-service instances updating the history of the same app
+// concurrently cannot lose each other's versions.
+type DropletVersionHistory struct {
+	blobstore              Blobstore
+	maxVersions            int
+	dropletArtifactDeleter DropletArtifactDeleter
+	mutex                  sync.Mutex
+	lastCurrentSince       time.Time
+}
+
+// NewDropletVersionHistory creates a DropletVersionHistory. dropletArtifactDeleter is optional and
+// used to delete the OCI artifacts of retained droplets once they fall out of the history.
+func NewDropletVersionHistory(blobstore Blobstore, maxVersions int, dropletArtifactDeleter DropletArtifactDeleter) *DropletVersionHistory {
+	if maxVersions < 1 {
+		panic("maxVersions must be greater than 0")
+	}
+	return &DropletVersionHistory{
+		blobstore:              blobstore,
+		maxVersions:            maxVersions,
+		dropletArtifactDeleter: dropletArtifactDeleter,
+	}
+}
+
+func (history *DropletVersionHistory) Record(appGuid string, dropletGuid string, hash string) error {
+	now := history.now()
+	e := history.saveVersion(appGuid, dropletGuid, hash, versionRecord{CreatedAt: now, CurrentSince: now})
+	if e != nil {
+		return e
+	}
+	return history.prune(appGuid)
+}
+
+// prune deletes the versions which fell out of the history. Instances pruning concurrently might delete
+// the same versions, which is why missing blobs are ignored.
+func (history *DropletVersionHistory) prune(appGuid string) error {
+	versions, e := history.Versions(appGuid)
+	if e != nil {
+		return e
+	}
+	for i := history.maxVersions; i < len(versions); i++ {
+		e = history.deleteVersion(appGuid, versions[i])
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// deleteVersion deletes the version blob last, so that a version whose deletion failed is pruned again.
+func (history *DropletVersionHistory) deleteVersion(appGuid string, version DropletVersion) error {
+	if version.Retained {
+		e := history.deleteDroplet(version)
+		if e != nil {
+			return e
+		}
+	}
+	for _, path := range []string{retentionPathFor(appGuid, version.DropletGuid, version.Hash), versionPathFor(appGuid, version.DropletGuid, version.Hash)} {
+		e := history.blobstore.Delete(path)
+		if e != nil && !IsNotFoundError(e) {
+			return errors.Wrapf(e, "Could not delete %v of pruned droplet version %v", path, version.path())
+		}
+	}
+	return nil
+}
+
+func (history *DropletVersionHistory) deleteDroplet(version DropletVersion) error {
+	if history.dropletArtifactDeleter != nil {
+		e := history.dropletArtifactDeleter.DeleteArtifacts(version.DropletGuid, version.Hash)
+		if e != nil {
+			return errors.Wrapf(e, "Could not delete OCI artifacts of pruned droplet version %v", version.path())
+		}
+	}
+	e := history.blobstore.Delete(version.path())
+	if e != nil && !IsNotFoundError(e) {
+		return errors.Wrapf(e, "Could not delete pruned droplet version %v", version.path())
+	}
+	return nil
+}
+
+// Versions returns the versions of the app, the current one first.
+func (history *DropletVersionHistory) Versions(appGuid string) ([]DropletVersion, error) {
+	blobInfos, e := history.blobstore.List(dropletVersionIndexPrefix + appGuid + "/")
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not list droplet versions of app %v", appGuid)
+	}
+	var (
+		versions     = []DropletVersion{}
+		currentSince = make(map[string]time.Time)
+		retainedAt   = make(map[string]time.Time)
+	)
+	for _, blobInfo := range blobInfos {
+		kind, dropletGuid, hash, ok := parseDropletVersionPath(blobInfo.Path)
+		if !ok || kind != "versions" {
+			continue
+		}
+		var record versionRecord
+		e = history.loadJSON(blobInfo.Path, &record)
+		if IsNotFoundError(e) {
+			continue // pruned in the meantime
+		}
+		if e != nil {
+			return nil, e
+		}
+		version := DropletVersion{DropletGuid: dropletGuid, Hash: hash, CreatedAt: record.CreatedAt}
+		currentSince[version.path()] = record.CurrentSince
+		versions = append(versions, version)
+	}
+	for _, blobInfo := range blobInfos {
+		kind, dropletGuid, hash, ok := parseDropletVersionPath(blobInfo.Path)
+		if !ok || kind != "retained" {
+			continue
+		}
+		if _, isVersion := currentSince[dropletGuid+"/"+hash]; !isVersion {
+			continue
+		}
+		var record retentionRecord
+		e = history.loadJSON(blobInfo.Path, &record)
+		if IsNotFoundError(e) {
+			continue
+		}
+		if e != nil {
+			return nil, e
+		}
+		retainedAt[dropletGuid+"/"+hash] = record.RetainedAt
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return currentSince[versions[i].path()].After(currentSince[versions[j].path()])
+	})
+	for i := range versions {
+		retainedTime, retained := retainedAt[versions[i].path()]
+		versions[i].Retained = retained
+		// A droplet deleted by the Cloud Controller is only current again once it was promoted after its deletion.
+		versions[i].Current = i == 0 && (!retained || currentSince[versions[i].path()].After(retainedTime))
+	}
+	return versions, nil
+}
+
+// RetainOnDelete marks the droplet as deleted by the Cloud Controller. It returns true when
+// the droplet is part of the app's history and must therefore not be deleted from the blobstore.
+func (history *DropletVersionHistory) RetainOnDelete(appGuid string, dropletGuid string, hash string) (retained bool, err error) {
+	exists, e := history.blobstore.Exists(versionPathFor(appGuid, dropletGuid, hash))
+	if e != nil {
+		return false, errors.Wrapf(e, "Could not check droplet version %v/%v of app %v", dropletGuid, hash, appGuid)
+	}
+	if !exists {
+		return false, nil
+	}
+	e = history.saveJSON(retentionPathFor(appGuid, dropletGuid, hash), retentionRecord{RetainedAt: history.now()})
+	if e != nil {
+		return false, e
+	}
+	return true, nil
+}
+
+// Promote makes an older droplet version the current one again. A retained droplet stays retained,
+// because the Cloud Controller does not know about it anymore and will therefore never delete it.
+func (history *DropletVersionHistory) Promote(appGuid string, dropletGuid string, hash string) (*DropletVersion, error) {
+	var record versionRecord
+	e := history.loadJSON(versionPathFor(appGuid, dropletGuid, hash), &record)
+	if IsNotFoundError(e) {
+		return nil, NewNotFoundErrorWithKey(dropletGuid + "/" + hash)
+	}
+	if e != nil {
+		return nil, e
+	}
+	version := DropletVersion{DropletGuid: dropletGuid, Hash: hash, CreatedAt: record.CreatedAt, Current: true}
+	exists, e := history.blobstore.Exists(version.path())
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not check existence of droplet version %v", version.path())
+	}
+	if !exists {
+		return nil, NewNotFoundErrorWithKey(version.path())
+	}
+	version.Retained, e = history.blobstore.Exists(retentionPathFor(appGuid, dropletGuid, hash))
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not check retention of droplet version %v", version.path())
+	}
+
+	record.CurrentSince = history.now()
+	e = history.saveVersion(appGuid, dropletGuid, hash, record)
+	if e != nil {
+		return nil, e
+	}
+	return &version, nil
+}
+
+// RetainedPaths returns the paths of all blobs of the history and of all droplets referenced by them.
+// Those blobs must be kept, even though the Cloud Controller might not know about them.
+func (history *DropletVersionHistory) RetainedPaths() (map[string]bool, error) {
+	blobInfos, e := history.blobstore.List(dropletVersionIndexPrefix)
+	if e != nil {
+		return nil, errors.Wrap(e, "Could not list droplet versions")
+	}
+	paths := make(map[string]bool)
+	for _, blobInfo := range blobInfos {
+		paths[blobInfo.Path] = true
+		kind, dropletGuid, hash, ok := parseDropletVersionPath(blobInfo.Path)
+		if ok && kind == "versions" {
+			paths[dropletGuid+"/"+hash] = true
+		}
+	}
+	return paths, nil
+}
+
+// now returns the current time, but always later than the times returned before, so that versions
+// recorded in quick succession by this instance are ordered correctly.
+func (history *DropletVersionHistory) now() time.Time {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	now := time.Now()
+	if !now.After(history.lastCurrentSince) {
+		now = history.lastCurrentSince.Add(time.Nanosecond)
+	}
+	history.lastCurrentSince = now
+	return now
+}
+
+func (history *DropletVersionHistory) saveVersion(appGuid string, dropletGuid string, hash string, record versionRecord) error {
+	return history.saveJSON(versionPathFor(appGuid, dropletGuid, hash), record)
+}
+
+func (history *DropletVersionHistory) loadJSON(path string, v interface{}) error {
+	body, e := history.blobstore.Get(path)
+	if IsNotFoundError(e) {
+		return e
+	}
+	if e != nil {
+		return errors.Wrapf(e, "Could not get %v", path)
+	}
+	defer body.Close()
+	content, e := ioutil.ReadAll(body)
+	if e != nil {
+		return errors.Wrapf(e, "Could not read %v", path)
+	}
+	e = json.Unmarshal(content, v)
+	if e != nil {
+		return errors.Wrapf(e, "%v is invalid", path)
+	}
+	return nil
+}
+
+func (history *DropletVersionHistory) saveJSON(path string, v interface{}) error {
+	content, e := json.Marshal(v)
+	if e != nil {
+		return errors.Wrapf(e, "Could not marshal %v", path)
+	}
+	e = history.blobstore.Put(path, bytes.NewReader(content))
+	if e != nil {
+		return errors.Wrapf(e, "Could not put %v", path)
+	}
+	return nil
+}
+
+func versionPathFor(appGuid string, dropletGuid string, hash string) string {
+	return dropletVersionIndexPrefix + appGuid + "/versions/" + dropletGuid + "/" + hash
+}
+
+func retentionPathFor(appGuid string, dropletGuid string, hash string) string {
+	return dropletVersionIndexPrefix + appGuid + "/retained/" + dropletGuid + "/" + hash
+}
+
+// parseDropletVersionPath splits "droplet-versions/<app-guid>/<kind>/<droplet-guid>/<hash>" into its parts.
+func parseDropletVersionPath(path string) (kind string, dropletGuid string, hash string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, dropletVersionIndexPrefix), "/")
+	if len(parts) != 4 {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
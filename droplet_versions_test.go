@@ -0,0 +1,192 @@
+package bitsgo_test
+
+import (
+	"io"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+)
+
+type recordingArtifactDeleter struct {
+	deleted []string
+}
+
+func (deleter *recordingArtifactDeleter) DeleteArtifacts(dropletGUID string, dropletHash string) error {
+	deleter.deleted = append(deleter.deleted, dropletGUID+"/"+dropletHash)
+	return nil
+}
+
+// interleavingBlobstore calls beforeNextPut once before its next Put, which allows to interleave
+// the operations of two bits-service instances.
+type interleavingBlobstore struct {
+	*inmemory.Blobstore
+	beforeNextPut func()
+}
+
+func (blobstore *interleavingBlobstore) Put(path string, src io.ReadSeeker) error {
+	if beforeNextPut := blobstore.beforeNextPut; beforeNextPut != nil {
+		blobstore.beforeNextPut = nil
+		beforeNextPut()
+	}
+	return blobstore.Blobstore.Put(path, src)
+}
+
+var _ = Describe("DropletVersionHistory", func() {
+	var (
+		blobstore       *inmemory.Blobstore
+		artifactDeleter *recordingArtifactDeleter
+		history         *bitsgo.DropletVersionHistory
+	)
+
+	BeforeEach(func() {
+		blobstore = inmemory.NewBlobstore()
+		artifactDeleter = &recordingArtifactDeleter{}
+		history = bitsgo.NewDropletVersionHistory(blobstore, 2, artifactDeleter)
+	})
+
+	putDroplet := func(appGuid string, dropletGuid string, hash string) {
+		Expect(blobstore.Put(dropletGuid+"/"+hash, strings.NewReader("content of "+hash))).To(Succeed())
+		Expect(history.Record(appGuid, dropletGuid, hash)).To(Succeed())
+	}
+
+	pathsOf := func(versions []bitsgo.DropletVersion) []string {
+		var paths []string
+		for _, version := range versions {
+			paths = append(paths, version.DropletGuid+"/"+version.Hash)
+		}
+		return paths
+	}
+
+	versionPaths := func(appGuid string) []string {
+		versions, e := history.Versions(appGuid)
+		Expect(e).NotTo(HaveOccurred())
+		return pathsOf(versions)
+	}
+
+	It("returns an empty history for unknown app guids", func() {
+		Expect(history.Versions("unknown-app-guid")).To(BeEmpty())
+	})
+
+	It("lists the droplets of an app with the most recent one as current", func() {
+		putDroplet("the-app", "droplet1", "hash1")
+		putDroplet("the-app", "droplet2", "hash2")
+		putDroplet("other-app", "droplet3", "hash3")
+
+		versions, e := history.Versions("the-app")
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(pathsOf(versions)).To(Equal([]string{"droplet2/hash2", "droplet1/hash1"}))
+		Expect(versions[0].Current).To(BeTrue())
+		Expect(versions[1].Current).To(BeFalse())
+	})
+
+	Context("droplet was deleted by the Cloud Controller", func() {
+		It("retains it in the blobstore as long as it is part of the history", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+			putDroplet("the-app", "droplet2", "hash2")
+
+			Expect(history.RetainOnDelete("the-app", "droplet1", "hash1")).To(BeTrue())
+			Expect(blobstore.Exists("droplet1/hash1")).To(BeTrue())
+
+			putDroplet("the-app", "droplet3", "hash3")
+
+			Expect(blobstore.Exists("droplet1/hash1")).To(BeFalse())
+			Expect(artifactDeleter.deleted).To(Equal([]string{"droplet1/hash1"}))
+			Expect(versionPaths("the-app")).To(Equal([]string{"droplet3/hash3", "droplet2/hash2"}))
+		})
+
+		It("does not retain droplets which are not part of the history", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+
+			Expect(history.RetainOnDelete("the-app", "droplet1", "other-hash")).To(BeFalse())
+			Expect(history.RetainOnDelete("other-app", "droplet1", "hash1")).To(BeFalse())
+		})
+	})
+
+	It("does not delete pruned droplets which were not deleted by the Cloud Controller", func() {
+		putDroplet("the-app", "droplet1", "hash1")
+		putDroplet("the-app", "droplet2", "hash2")
+		putDroplet("the-app", "droplet3", "hash3")
+
+		Expect(blobstore.Exists("droplet1/hash1")).To(BeTrue())
+		Expect(artifactDeleter.deleted).To(BeEmpty())
+	})
+
+	Describe("Promote", func() {
+		It("makes an older version the current one again", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+			putDroplet("the-app", "droplet2", "hash2")
+
+			version, e := history.Promote("the-app", "droplet1", "hash1")
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(version.DropletGuid).To(Equal("droplet1"))
+			Expect(version.Hash).To(Equal("hash1"))
+			Expect(version.Current).To(BeTrue())
+			Expect(versionPaths("the-app")).To(Equal([]string{"droplet1/hash1", "droplet2/hash2"}))
+		})
+
+		It("keeps a droplet deleted by the Cloud Controller retained, so that it is deleted once pruned", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+			putDroplet("the-app", "droplet2", "hash2")
+			Expect(history.RetainOnDelete("the-app", "droplet1", "hash1")).To(BeTrue())
+
+			version, e := history.Promote("the-app", "droplet1", "hash1")
+			Expect(e).NotTo(HaveOccurred())
+			Expect(version.Retained).To(BeTrue())
+
+			putDroplet("the-app", "droplet3", "hash3")
+			putDroplet("the-app", "droplet4", "hash4")
+
+			Expect(blobstore.Exists("droplet1/hash1")).To(BeFalse())
+		})
+
+		It("returns a NotFoundError when the version is not in the history", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+
+			_, e := history.Promote("the-app", "droplet1", "other-hash")
+
+			Expect(bitsgo.IsNotFoundError(e)).To(BeTrue())
+		})
+
+		It("returns a NotFoundError when the droplet does not exist anymore", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+			Expect(blobstore.Delete("droplet1/hash1")).To(Succeed())
+
+			_, e := history.Promote("the-app", "droplet1", "hash1")
+
+			Expect(bitsgo.IsNotFoundError(e)).To(BeTrue())
+		})
+	})
+
+	It("does not lose versions recorded concurrently by another instance", func() {
+		interleaving := &interleavingBlobstore{Blobstore: blobstore}
+		history = bitsgo.NewDropletVersionHistory(interleaving, 2, artifactDeleter)
+		otherInstance := bitsgo.NewDropletVersionHistory(blobstore, 2, artifactDeleter)
+		interleaving.beforeNextPut = func() {
+			Expect(otherInstance.Record("the-app", "droplet2", "hash2")).To(Succeed())
+		}
+
+		Expect(history.Record("the-app", "droplet1", "hash1")).To(Succeed())
+
+		Expect(versionPaths("the-app")).To(ConsistOf("droplet1/hash1", "droplet2/hash2"))
+	})
+
+	Describe("RetainedPaths", func() {
+		It("returns the blobs of the history and the droplets referenced by them", func() {
+			putDroplet("the-app", "droplet1", "hash1")
+			putDroplet("other-app", "droplet2", "hash2")
+			Expect(history.RetainOnDelete("other-app", "droplet2", "hash2")).To(BeTrue())
+			Expect(blobstore.Put("droplet3/hash3", strings.NewReader("not part of any history"))).To(Succeed())
+
+			Expect(history.RetainedPaths()).To(Equal(map[string]bool{
+				"droplet-versions/the-app/versions/droplet1/hash1":   true,
+				"droplet-versions/other-app/versions/droplet2/hash2": true,
+				"droplet-versions/other-app/retained/droplet2/hash2": true,
+				"droplet1/hash1": true,
+				"droplet2/hash2": true,
+			}))
+		})
+	})
+})
@@ -0,0 +1,142 @@
+package bitsgo
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/cloudfoundry-incubator/bits-service/util"
+	"github.com/pkg/errors"
+)
+
+// Codes of the {"description": ..., "code": ...} bodies of error responses. Clients may rely on them, so they must not
+// change. See the "Errors" section of api-doc/source/index.html.md for which endpoint returns which code.
+const (
+	codeUnknown             = 10001
+	codeUnprocessableEntity = 10008
+	codeNotFound            = 10010
+	codeBadRequest          = 290003
+	codeStateForbidden      = 290008
+	codePermissionDenied    = 403000
+	codeConflict            = 409000
+	codePreconditionFailed  = 412000
+	codeEntityTooLarge      = 413000
+	codeThrottled           = 429000
+	codeNoSpaceLeft         = 500000
+	codeCorruptBlob         = 500001
+	codeUnavailable         = 503000
+	codeContainerNotFound   = 503001
+	codeTimeout             = 503002
+)
+
+// HandlerFunc is an HTTP handler that returns errors instead of writing error responses itself.
+// Errors are written by WriteErrorResponse.
+type HandlerFunc func(responseWriter http.ResponseWriter, request *http.Request) error
+
+func (handler HandlerFunc) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	e := handler(responseWriter, request)
+	if e != nil {
+		WriteErrorResponse(responseWriter, request, e)
+	}
+}
+
+// ResponseError is an error caused by the request. It results in a response with StatusCode and a body with Code and
+// Description.
+type ResponseError struct {
+	StatusCode  int
+	Code        int
+	Description string
+}
+
+func NewResponseError(statusCode int, code int, description string, args ...interface{}) *ResponseError {
+	return &ResponseError{
+		StatusCode:  statusCode,
+		Code:        code,
+		Description: fmt.Sprintf(description, args...),
+	}
+}
+
+func (e *ResponseError) Error() string {
+	return e.Description
+}
+
+func NewServiceUnavailableError(description string, args ...interface{}) *ResponseError {
+	return NewResponseError(http.StatusServiceUnavailable, codeUnavailable, description, args...)
+}
+
+func newBadRequestError(description string, args ...interface{}) *ResponseError {
+	return NewResponseError(http.StatusBadRequest, codeBadRequest, description, args...)
+}
+
+func newUnprocessableEntityError(description string, args ...interface{}) *ResponseError {
+	return NewResponseError(http.StatusUnprocessableEntity, codeUnprocessableEntity, description, args...)
+}
+
+func newNotFoundResponseError(description string, args ...interface{}) *ResponseError {
+	return NewResponseError(http.StatusNotFound, codeNotFound, description, args...)
+}
+
+// WriteErrorResponse maps e to a response with a JSON body containing a stable error code and a description.
+// Errors without a dedicated mapping result in 500 Internal Server Error. Their details are only logged.
+func WriteErrorResponse(responseWriter http.ResponseWriter, request *http.Request, e error) {
+	switch cause := errors.Cause(e).(type) {
+	case *ResponseError:
+		logger.From(request).Infow("Request failed", "status-code", cause.StatusCode, "error", e)
+		writeError(responseWriter, cause.StatusCode, cause.Code, cause.Description)
+	case *NotFoundError:
+		writeError(responseWriter, http.StatusNotFound, codeNotFound, "Not found")
+	case *StateForbiddenError:
+		writeError(responseWriter, http.StatusBadRequest, codeStateForbidden, "Cannot update an existing package.")
+	case *NoSpaceLeftError:
+		writeError(responseWriter, http.StatusInsufficientStorage, codeNoSpaceLeft, "Request Entity Too Large")
+	case *EntityTooLargeError:
+		writeError(responseWriter, http.StatusRequestEntityTooLarge, codeEntityTooLarge, e.Error())
+	case *PermissionDeniedError:
+		logger.From(request).Errorw("Permission denied by blobstore", "error", e)
+		writeError(responseWriter, http.StatusForbidden, codePermissionDenied, "Permission denied by blobstore")
+	case *PreconditionFailedError:
+		writeError(responseWriter, http.StatusPreconditionFailed, codePreconditionFailed, "Precondition failed")
+	case *ThrottledError:
+		logger.From(request).Infow("Throttled by blobstore", "error", e)
+		setRetryAfter(responseWriter, cause.RetryAfter)
+		writeError(responseWriter, http.StatusTooManyRequests, codeThrottled, "Too many requests to blobstore")
+	case *UnavailableError:
+		logger.From(request).Errorw("Blobstore unavailable", "error", e)
+		setRetryAfter(responseWriter, cause.RetryAfter)
+		writeError(responseWriter, http.StatusServiceUnavailable, codeUnavailable, "Blobstore unavailable")
+	case *ContainerNotFoundError:
+		logger.From(request).Errorw("Blobstore bucket or container not found", "error", e)
+		writeError(responseWriter, http.StatusServiceUnavailable, codeContainerNotFound, "Blobstore bucket or container not found")
+	case *CorruptBlobError:
+		logger.From(request).Errorw("Corrupt blob", "error", e)
+		writeError(responseWriter, http.StatusInternalServerError, codeCorruptBlob, "Blob is corrupt")
+	case interface{ Timeout() bool }:
+		if cause.Timeout() {
+			logger.From(request).Errorw("Blobstore operation timed out", "error", e)
+			writeError(responseWriter, http.StatusServiceUnavailable, codeTimeout, "Blobstore operation timed out")
+			return
+		}
+		writeInternalServerError(responseWriter, request, e)
+	default:
+		writeInternalServerError(responseWriter, request, e)
+	}
+}
+
+func writeInternalServerError(responseWriter http.ResponseWriter, request *http.Request, e error) {
+	logger.From(request).Errorw("Internal Server Error.", "error", fmt.Sprintf("%+v", e))
+	writeError(responseWriter, http.StatusInternalServerError, codeUnknown, "Internal Server Error")
+}
+
+func setRetryAfter(responseWriter http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		responseWriter.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(retryAfter.Seconds()))))
+	}
+}
+
+func writeError(responseWriter http.ResponseWriter, statusCode int, code int, description string) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(statusCode)
+	fmt.Fprint(responseWriter, util.DescriptionAndCodeAsJSON(code, "%s", description))
+}
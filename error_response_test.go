@@ -0,0 +1,80 @@
+package bitsgo_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/pkg/errors"
+)
+
+type timeoutError struct{ error }
+
+func (timeoutError) Timeout() bool { return true }
+
+var _ = Describe("WriteErrorResponse", func() {
+	var responseWriter *httptest.ResponseRecorder
+
+	BeforeEach(func() {
+		responseWriter = httptest.NewRecorder()
+	})
+
+	writeErrorResponse := func(e error) {
+		bitsgo.WriteErrorResponse(responseWriter, httptest.NewRequest("GET", "/irrelevant", nil), e)
+	}
+
+	It("writes status code, code and description of a ResponseError", func() {
+		writeErrorResponse(errors.Wrap(bitsgo.NewResponseError(http.StatusConflict, 409000, "Resource %v was deleted", "some-guid"), "context"))
+
+		Expect(responseWriter.Code).To(Equal(http.StatusConflict))
+		Expect(responseWriter.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":409000,"description":"Resource some-guid was deleted"}`))
+	})
+
+	It("translates NotFoundError into StatusNotFound", func() {
+		writeErrorResponse(bitsgo.NewNotFoundErrorWithKey("some-key"))
+
+		Expect(responseWriter.Code).To(Equal(http.StatusNotFound))
+		Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":10010,"description":"Not found"}`))
+	})
+
+	It("translates timeouts into StatusServiceUnavailable", func() {
+		writeErrorResponse(timeoutError{fmt.Errorf("i/o timeout")})
+
+		Expect(responseWriter.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":503002,"description":"Blobstore operation timed out"}`))
+	})
+
+	It("translates unknown errors into StatusInternalServerError without exposing their details", func() {
+		writeErrorResponse(fmt.Errorf("some secret detail"))
+
+		Expect(responseWriter.Code).To(Equal(http.StatusInternalServerError))
+		Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":10001,"description":"Internal Server Error"}`))
+	})
+})
+
+var _ = Describe("HandlerFunc", func() {
+	It("writes the returned error with WriteErrorResponse", func() {
+		responseWriter := httptest.NewRecorder()
+
+		bitsgo.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) error {
+			return bitsgo.NewResponseError(http.StatusBadRequest, 290003, "Bad")
+		}).ServeHTTP(responseWriter, httptest.NewRequest("GET", "/irrelevant", nil))
+
+		Expect(responseWriter.Code).To(Equal(http.StatusBadRequest))
+		Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":290003,"description":"Bad"}`))
+	})
+
+	It("leaves the response alone when there is no error", func() {
+		responseWriter := httptest.NewRecorder()
+
+		bitsgo.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) error {
+			responseWriter.WriteHeader(http.StatusNoContent)
+			return nil
+		}).ServeHTTP(responseWriter, httptest.NewRequest("GET", "/irrelevant", nil))
+
+		Expect(responseWriter.Code).To(Equal(http.StatusNoContent))
+		Expect(responseWriter.Body.String()).To(BeEmpty())
+	})
+})
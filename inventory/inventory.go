@@ -0,0 +1,164 @@
+package inventory
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+// Source is a set of blobs reported as one resource type.
+type Source struct {
+	ResourceType string
+	Blobstore    bitsgo.Blobstore
+	// Prefix limits the blobs listed from Blobstore.
+	Prefix string
+	// Includes decides whether a listed blob belongs to this resource type. nil includes all blobs.
+	Includes func(path string) bool
+}
+
+type Object struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type HistogramBucket struct {
+	// MaxSize is the exclusive upper bound of this bucket. nil means unbounded.
+	MaxSize *int64 `json:"max_size"`
+	Count   int64  `json:"count"`
+}
+
+type ResourceTypeReport struct {
+	Count         int64             `json:"count"`
+	TotalBytes    int64             `json:"total_bytes"`
+	SizeHistogram []HistogramBucket `json:"size_histogram"`
+	Oldest        *Object           `json:"oldest,omitempty"`
+	Newest        *Object           `json:"newest,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+type Report struct {
+	GeneratedAt   time.Time                      `json:"generated_at"`
+	ResourceTypes map[string]*ResourceTypeReport `json:"resource_types"`
+}
+
+var histogramBucketMaxSizes = []int64{1 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+// Reporter generates storage usage and inventory reports. Since listing all blobs is expensive, it
+// caches the latest report, which can be refreshed in the background using RegularlyRefresh.
+type Reporter struct {
+	sources []Source
+	clock   clock.Clock
+
+	mutex        sync.RWMutex
+	latestReport *Report
+}
+
+func NewReporter(sources []Source, clock clock.Clock) *Reporter {
+	return &Reporter{sources: sources, clock: clock}
+}
+
+func (reporter *Reporter) Generate() *Report {
+	report := &Report{
+		GeneratedAt:   reporter.clock.Now(),
+		ResourceTypes: make(map[string]*ResourceTypeReport, len(reporter.sources)),
+	}
+	for _, source := range reporter.sources {
+		report.ResourceTypes[source.ResourceType] = reportFor(source)
+	}
+	return report
+}
+
+func reportFor(source Source) *ResourceTypeReport {
+	report := &ResourceTypeReport{SizeHistogram: newHistogram()}
+	blobInfos, e := source.Blobstore.List(source.Prefix)
+	if e != nil {
+		logger.Log.Errorw("Could not list blobs for inventory", "resource-type", source.ResourceType, "error", e)
+		report.Error = e.Error()
+		return report
+	}
+	for _, blobInfo := range blobInfos {
+		if source.Includes != nil && !source.Includes(blobInfo.Path) {
+			continue
+		}
+		report.Count++
+		report.TotalBytes += blobInfo.Size
+		addToHistogram(report.SizeHistogram, blobInfo.Size)
+		if report.Oldest == nil || blobInfo.LastModified.Before(report.Oldest.LastModified) {
+			report.Oldest = &Object{Path: blobInfo.Path, Size: blobInfo.Size, LastModified: blobInfo.LastModified}
+		}
+		if report.Newest == nil || blobInfo.LastModified.After(report.Newest.LastModified) {
+			report.Newest = &Object{Path: blobInfo.Path, Size: blobInfo.Size, LastModified: blobInfo.LastModified}
+		}
+	}
+	return report
+}
+
+func newHistogram() []HistogramBucket {
+	histogram := make([]HistogramBucket, len(histogramBucketMaxSizes)+1)
+	for i := range histogramBucketMaxSizes {
+		histogram[i].MaxSize = &histogramBucketMaxSizes[i]
+	}
+	return histogram
+}
+
+func addToHistogram(histogram []HistogramBucket, size int64) {
+	for i := range histogram {
+		if histogram[i].MaxSize == nil || size < *histogram[i].MaxSize {
+			histogram[i].Count++
+			return
+		}
+	}
+}
+
+func (reporter *Reporter) Refresh() {
+	report := reporter.Generate()
+
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+	reporter.latestReport = report
+}
+
+// RegularlyRefresh blocks, refreshes the report immediately and then in the given interval.
+func (reporter *Reporter) RegularlyRefresh(interval time.Duration) {
+	reporter.Refresh()
+	for range reporter.clock.Ticker(interval).C {
+		reporter.Refresh()
+	}
+}
+
+// LatestReport returns nil when no report has been generated yet.
+func (reporter *Reporter) LatestReport() *Report {
+	reporter.mutex.RLock()
+	defer reporter.mutex.RUnlock()
+	return reporter.latestReport
+}
+
+func (reporter *Reporter) ServeLatestReport(responseWriter http.ResponseWriter, request *http.Request) error {
+	report := reporter.LatestReport()
+	if report == nil {
+		return bitsgo.NewServiceUnavailableError("Inventory report is not available yet")
+	}
+	response, e := json.Marshal(report)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal inventory report")
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(response)
+	return nil
+}
+
+func IsOCIDigestPath(path string) bool {
+	return strings.HasPrefix(path, "sha256:")
+}
+
+func IsNotOCIDigestPath(path string) bool {
+	return !IsOCIDigestPath(path)
+}
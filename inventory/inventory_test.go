@@ -0,0 +1,114 @@
+package inventory_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+	"github.com/cloudfoundry-incubator/bits-service/inventory"
+)
+
+func TestInventory(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Inventory")
+}
+
+type listingBlobstore struct {
+	*inmemory.Blobstore
+	blobInfos []bitsgo.BlobInfo
+	listError error
+}
+
+func (blobstore *listingBlobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	return blobstore.blobInfos, blobstore.listError
+}
+
+var _ = Describe("Reporter", func() {
+	var (
+		droplets  *listingBlobstore
+		packages  *listingBlobstore
+		mockClock *clock.Mock
+		reporter  *inventory.Reporter
+		t0        time.Time
+	)
+
+	BeforeEach(func() {
+		t0 = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+		droplets = &listingBlobstore{
+			Blobstore: inmemory.NewBlobstore(),
+			blobInfos: []bitsgo.BlobInfo{
+				{Path: "droplet-a/hash", Size: 100, LastModified: t0.Add(time.Hour)},
+				{Path: "droplet-b/hash", Size: 2 << 20, LastModified: t0},
+				{Path: "droplet-c/hash", Size: 2 << 30, LastModified: t0.Add(2 * time.Hour)},
+				{Path: "sha256:abc", Size: 5000, LastModified: t0},
+			},
+		}
+		packages = &listingBlobstore{Blobstore: inmemory.NewBlobstore(), listError: errors.New("List is not supported")}
+		mockClock = clock.NewMock()
+		reporter = inventory.NewReporter([]inventory.Source{
+			{ResourceType: "droplets", Blobstore: droplets, Includes: inventory.IsNotOCIDigestPath},
+			{ResourceType: "oci_digests", Blobstore: droplets, Includes: inventory.IsOCIDigestPath},
+			{ResourceType: "packages", Blobstore: packages},
+		}, mockClock)
+	})
+
+	It("reports count, total size, histogram and oldest and newest objects per resource type", func() {
+		report := reporter.Generate()
+
+		droplets := report.ResourceTypes["droplets"]
+		Expect(droplets.Count).To(BeEquivalentTo(3))
+		Expect(droplets.TotalBytes).To(BeEquivalentTo(100 + 2<<20 + 2<<30))
+		Expect(droplets.Oldest.Path).To(Equal("droplet-b/hash"))
+		Expect(droplets.Newest.Path).To(Equal("droplet-c/hash"))
+		Expect(droplets.SizeHistogram).To(HaveLen(6))
+		Expect(droplets.SizeHistogram[0].Count).To(BeEquivalentTo(1))
+		Expect(droplets.SizeHistogram[2].Count).To(BeEquivalentTo(1))
+		Expect(droplets.SizeHistogram[5].Count).To(BeEquivalentTo(1))
+		Expect(droplets.SizeHistogram[5].MaxSize).To(BeNil())
+
+		Expect(report.ResourceTypes["oci_digests"].Count).To(BeEquivalentTo(1))
+		Expect(report.ResourceTypes["oci_digests"].TotalBytes).To(BeEquivalentTo(5000))
+	})
+
+	It("reports listing errors per resource type without failing the whole report", func() {
+		report := reporter.Generate()
+
+		Expect(report.ResourceTypes["packages"].Error).To(ContainSubstring("List is not supported"))
+		Expect(report.ResourceTypes["packages"].Count).To(BeZero())
+		Expect(report.ResourceTypes["droplets"].Error).To(BeEmpty())
+	})
+
+	Context("serving HTTP", func() {
+		It("responds with 503 until a report has been generated", func() {
+			responseWriter := httptest.NewRecorder()
+			bitsgo.HandlerFunc(reporter.ServeLatestReport).ServeHTTP(responseWriter, httptest.NewRequest("GET", "/inventory", nil))
+
+			Expect(responseWriter.Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("responds with the cached report", func() {
+			reporter.Refresh()
+			droplets.blobInfos = nil
+
+			responseWriter := httptest.NewRecorder()
+			bitsgo.HandlerFunc(reporter.ServeLatestReport).ServeHTTP(responseWriter, httptest.NewRequest("GET", "/inventory", nil))
+
+			Expect(responseWriter.Code).To(Equal(http.StatusOK))
+			var report inventory.Report
+			Expect(json.Unmarshal(responseWriter.Body.Bytes(), &report)).To(Succeed())
+			Expect(report.ResourceTypes["droplets"].Count).To(BeEquivalentTo(3))
+		})
+	})
+})
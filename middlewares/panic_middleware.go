@@ -23,6 +23,10 @@ type internalServerErrorResponseBody struct {
 func (middleware *PanicMiddleware) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request, next http.HandlerFunc) {
 	defer func() {
 		if e := recover(); e != nil {
+			if e == http.ErrAbortHandler {
+				// Handlers use it to abort a response which has already been started, see net/http.
+				panic(e)
+			}
 			if _, ok := e.(interface {
 				StackTrace() errors.StackTrace
 			}); ok {
@@ -34,6 +34,19 @@ var _ = Describe("PanicMiddleWare", func() {
 		})
 	})
 
+	Context("Handler aborts the response", func() {
+		It("lets net/http abort the connection", func() {
+			Expect(func() {
+				(&middlewares.PanicMiddleware{}).ServeHTTP(
+					httptest.NewRecorder(),
+					httptest.NewRequest("GET", "http://example.com/some/request", nil),
+					func(http.ResponseWriter, *http.Request) {
+						panic(http.ErrAbortHandler)
+					})
+			}).To(Panic())
+		})
+	})
+
 	Context("Handler succeeds", func() {
 		It("responds with handler's response", func() {
 			responseWriter := httptest.NewRecorder()
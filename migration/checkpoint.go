@@ -0,0 +1,77 @@
+package migration
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint records which objects have already been migrated and verified, so that an interrupted
+// migration can be resumed. It is persisted as an append-only file with one line per object in the
+// format "<resource type> <sha256> <path>".
+type Checkpoint struct {
+	mutex    sync.Mutex
+	file     *os.File
+	migrated map[string]bool
+}
+
+func OpenCheckpoint(filename string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{migrated: make(map[string]bool)}
+	file, e := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not open checkpoint file %v", filename)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		checkpoint.migrated[key(fields[0], fields[2])] = true
+	}
+	if e = scanner.Err(); e != nil {
+		file.Close()
+		return nil, errors.Wrapf(e, "Could not read checkpoint file %v", filename)
+	}
+	checkpoint.file = file
+	return checkpoint, nil
+}
+
+// NewInMemoryCheckpoint creates a Checkpoint which is not persisted.
+func NewInMemoryCheckpoint() *Checkpoint {
+	return &Checkpoint{migrated: make(map[string]bool)}
+}
+
+func (checkpoint *Checkpoint) IsMigrated(resourceType, path string) bool {
+	checkpoint.mutex.Lock()
+	defer checkpoint.mutex.Unlock()
+	return checkpoint.migrated[key(resourceType, path)]
+}
+
+func (checkpoint *Checkpoint) MarkMigrated(resourceType, path, checksum string) error {
+	checkpoint.mutex.Lock()
+	defer checkpoint.mutex.Unlock()
+	if checkpoint.file != nil {
+		_, e := fmt.Fprintf(checkpoint.file, "%v %v %v\n", resourceType, checksum, path)
+		if e != nil {
+			return errors.Wrap(e, "Could not write checkpoint")
+		}
+	}
+	checkpoint.migrated[key(resourceType, path)] = true
+	return nil
+}
+
+func (checkpoint *Checkpoint) Close() error {
+	if checkpoint.file == nil {
+		return nil
+	}
+	return checkpoint.file.Close()
+}
+
+func key(resourceType, path string) string {
+	return resourceType + " " + path
+}
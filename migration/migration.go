@@ -0,0 +1,154 @@
+package migration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+type FailedObject struct {
+	Path  string
+	Error error
+}
+
+type Summary struct {
+	ResourceType string
+	Copied       int
+	Skipped      int
+	Failed       []FailedObject
+}
+
+// Migrator copies all objects of one resource type from a source to a target blobstore. After copying,
+// each object is read back from the target and its checksum compared to the one of the source.
+// Verified objects are recorded in the checkpoint and skipped when the migration is run again.
+type Migrator struct {
+	resourceType string
+	source       bitsgo.Blobstore
+	target       bitsgo.Blobstore
+	checkpoint   *Checkpoint
+	concurrency  int
+}
+
+func NewMigrator(resourceType string, source, target bitsgo.Blobstore, checkpoint *Checkpoint, concurrency int) *Migrator {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Migrator{
+		resourceType: resourceType,
+		source:       source,
+		target:       target,
+		checkpoint:   checkpoint,
+		concurrency:  concurrency,
+	}
+}
+
+func (migrator *Migrator) Migrate() (*Summary, error) {
+	blobInfos, e := migrator.source.List("")
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not list source blobs of resource type %v", migrator.resourceType)
+	}
+
+	summary := &Summary{ResourceType: migrator.resourceType}
+	var (
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+		paths = make(chan string)
+	)
+	for i := 0; i < migrator.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				e := migrator.migrate(path)
+
+				mutex.Lock()
+				if e != nil {
+					logger.Log.Errorw("Could not migrate blob", "resource-type", migrator.resourceType, "path", path, "error", e)
+					summary.Failed = append(summary.Failed, FailedObject{Path: path, Error: e})
+				} else {
+					summary.Copied++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, blobInfo := range blobInfos {
+		if migrator.checkpoint.IsMigrated(migrator.resourceType, blobInfo.Path) {
+			summary.Skipped++
+			continue
+		}
+		paths <- blobInfo.Path
+	}
+	close(paths)
+	wg.Wait()
+	return summary, nil
+}
+
+func (migrator *Migrator) migrate(path string) error {
+	tempFile, sourceChecksum, e := migrator.download(path)
+	if e != nil {
+		return e
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	e = migrator.target.Put(path, tempFile)
+	if e != nil {
+		return errors.Wrap(e, "Could not put blob into target")
+	}
+
+	targetChecksum, e := checksumOf(migrator.target, path)
+	if e != nil {
+		return errors.Wrap(e, "Could not verify blob in target")
+	}
+	if targetChecksum != sourceChecksum {
+		return errors.Errorf("Checksum mismatch: source %v, target %v", sourceChecksum, targetChecksum)
+	}
+	return migrator.checkpoint.MarkMigrated(migrator.resourceType, path, sourceChecksum)
+}
+
+// download copies the source blob into a temporary file, because Put requires an io.ReadSeeker.
+func (migrator *Migrator) download(path string) (*os.File, string, error) {
+	body, e := migrator.source.Get(path)
+	if e != nil {
+		return nil, "", errors.Wrap(e, "Could not get blob from source")
+	}
+	defer body.Close()
+
+	tempFile, e := ioutil.TempFile("", "bits-migration")
+	if e != nil {
+		return nil, "", errors.Wrap(e, "Could not create temporary file")
+	}
+	hash := sha256.New()
+	_, e = io.Copy(io.MultiWriter(tempFile, hash), body)
+	if e == nil {
+		_, e = tempFile.Seek(0, io.SeekStart)
+	}
+	if e != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, "", errors.Wrap(e, "Could not download blob from source")
+	}
+	return tempFile, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func checksumOf(blobstore bitsgo.Blobstore, path string) (string, error) {
+	body, e := blobstore.Get(path)
+	if e != nil {
+		return "", e
+	}
+	defer body.Close()
+	hash := sha256.New()
+	_, e = io.Copy(hash, body)
+	if e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
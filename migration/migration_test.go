@@ -0,0 +1,97 @@
+package migration_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+	"github.com/cloudfoundry-incubator/bits-service/migration"
+)
+
+func TestMigration(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Migration")
+}
+
+type corruptingBlobstore struct {
+	*inmemory.Blobstore
+}
+
+func (blobstore *corruptingBlobstore) Put(path string, src io.ReadSeeker) error {
+	return blobstore.Blobstore.Put(path, strings.NewReader("corrupted"))
+}
+
+var _ = Describe("Migrator", func() {
+	var (
+		source  *inmemory.Blobstore
+		target  *inmemory.Blobstore
+		tempDir string
+	)
+
+	BeforeEach(func() {
+		source = inmemory.NewBlobstore()
+		target = inmemory.NewBlobstore()
+		Expect(source.Put("guid-1", strings.NewReader("content 1"))).To(Succeed())
+		Expect(source.Put("guid-2", strings.NewReader("content 2"))).To(Succeed())
+		Expect(source.Put("guid-3", strings.NewReader("content 3"))).To(Succeed())
+
+		var e error
+		tempDir, e = ioutil.TempDir("", "migration")
+		Expect(e).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("copies all objects into the target", func() {
+		summary, e := migration.NewMigrator("packages", source, target, migration.NewInMemoryCheckpoint(), 1).Migrate()
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(summary.Copied).To(Equal(3))
+		Expect(summary.Skipped).To(BeZero())
+		Expect(summary.Failed).To(BeEmpty())
+		Expect(target.Entries).To(Equal(source.Entries))
+	})
+
+	It("resumes from the checkpoint file", func() {
+		checkpointFile := filepath.Join(tempDir, "checkpoint")
+		checkpoint, e := migration.OpenCheckpoint(checkpointFile)
+		Expect(e).NotTo(HaveOccurred())
+		Expect(checkpoint.MarkMigrated("packages", "guid-1", "some-checksum")).To(Succeed())
+		Expect(checkpoint.Close()).To(Succeed())
+
+		checkpoint, e = migration.OpenCheckpoint(checkpointFile)
+		Expect(e).NotTo(HaveOccurred())
+		defer checkpoint.Close()
+		summary, e := migration.NewMigrator("packages", source, target, checkpoint, 1).Migrate()
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(summary.Copied).To(Equal(2))
+		Expect(summary.Skipped).To(Equal(1))
+		Expect(target.Entries).NotTo(HaveKey("guid-1"))
+
+		content, e := ioutil.ReadFile(checkpointFile)
+		Expect(e).NotTo(HaveOccurred())
+		Expect(strings.Split(strings.TrimSpace(string(content)), "\n")).To(HaveLen(3))
+	})
+
+	It("reports objects whose checksum in the target does not match as failed", func() {
+		summary, e := migration.NewMigrator("packages", source, &corruptingBlobstore{target}, migration.NewInMemoryCheckpoint(), 1).Migrate()
+
+		Expect(e).NotTo(HaveOccurred())
+		Expect(summary.Copied).To(BeZero())
+		Expect(summary.Failed).To(HaveLen(3))
+		Expect(summary.Failed[0].Error.Error()).To(ContainSubstring("Checksum mismatch"))
+	})
+})
@@ -4,6 +4,7 @@
 package bitsgo_test
 
 import (
+	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 	pegomock "github.com/petergtz/pegomock"
 	io "io"
 	"reflect"
@@ -157,6 +158,25 @@ func (mock *MockBlobstore) DeleteDir(prefix string) error {
 	return ret0
 }
 
+func (mock *MockBlobstore) List(prefix string) ([]bitsgo.BlobInfo, error) {
+	if mock == nil {
+		panic("mock must not be nil. Use myMock := NewMockBlobstore().")
+	}
+	params := []pegomock.Param{prefix}
+	result := pegomock.GetGenericMockFrom(mock).Invoke("List", params, []reflect.Type{reflect.TypeOf((*[]bitsgo.BlobInfo)(nil)).Elem(), reflect.TypeOf((*error)(nil)).Elem()})
+	var ret0 []bitsgo.BlobInfo
+	var ret1 error
+	if len(result) != 0 {
+		if result[0] != nil {
+			ret0 = result[0].([]bitsgo.BlobInfo)
+		}
+		if result[1] != nil {
+			ret1 = result[1].(error)
+		}
+	}
+	return ret0, ret1
+}
+
 func (mock *MockBlobstore) VerifyWasCalledOnce() *VerifierBlobstore {
 	return &VerifierBlobstore{mock, pegomock.Times(1), nil}
 }
@@ -398,3 +418,30 @@ func (c *Blobstore_DeleteDir_OngoingVerification) GetAllCapturedArguments() (_pa
 	}
 	return
 }
+
+func (verifier *VerifierBlobstore) List(prefix string) *Blobstore_List_OngoingVerification {
+	params := []pegomock.Param{prefix}
+	methodInvocations := pegomock.GetGenericMockFrom(verifier.mock).Verify(verifier.inOrderContext, verifier.invocationCountMatcher, "List", params)
+	return &Blobstore_List_OngoingVerification{mock: verifier.mock, methodInvocations: methodInvocations}
+}
+
+type Blobstore_List_OngoingVerification struct {
+	mock              *MockBlobstore
+	methodInvocations []pegomock.MethodInvocation
+}
+
+func (c *Blobstore_List_OngoingVerification) GetCapturedArguments() string {
+	prefix := c.GetAllCapturedArguments()
+	return prefix[len(prefix)-1]
+}
+
+func (c *Blobstore_List_OngoingVerification) GetAllCapturedArguments() (_param0 []string) {
+	params := pegomock.GetGenericMockFrom(c.mock).GetInvocationParams(c.methodInvocations)
+	if len(params) > 0 {
+		_param0 = make([]string, len(params[0]))
+		for u, param := range params[0] {
+			_param0[u] = param.(string)
+		}
+	}
+	return
+}
@@ -17,19 +17,23 @@ func NewMockResourceSigner() *MockResourceSigner {
 	return &MockResourceSigner{fail: pegomock.GlobalFailHandler}
 }
 
-func (mock *MockResourceSigner) Sign(resource string, method string, expirationTime time.Time) string {
+func (mock *MockResourceSigner) Sign(resource string, method string, expirationTime time.Time) (string, error) {
 	if mock == nil {
 		panic("mock must not be nil. Use myMock := NewMockMockResourceSigner().")
 	}
 	params := []pegomock.Param{resource, method, expirationTime}
-	result := pegomock.GetGenericMockFrom(mock).Invoke("Sign", params, []reflect.Type{reflect.TypeOf((*string)(nil)).Elem()})
+	result := pegomock.GetGenericMockFrom(mock).Invoke("Sign", params, []reflect.Type{reflect.TypeOf((*string)(nil)).Elem(), reflect.TypeOf((*error)(nil)).Elem()})
 	var ret0 string
+	var ret1 error
 	if len(result) != 0 {
 		if result[0] != nil {
 			ret0 = result[0].(string)
 		}
+		if result[1] != nil {
+			ret1 = result[1].(error)
+		}
 	}
-	return ret0
+	return ret0, ret1
 }
 
 func (mock *MockResourceSigner) VerifyWasCalledOnce() *VerifierResourceSigner {
@@ -19,6 +19,7 @@ import (
 
 	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 
+	"github.com/cloudfoundry-incubator/bits-service/logger"
 	"github.com/cloudfoundry-incubator/bits-service/oci_registry/models/docker"
 	"github.com/cloudfoundry-incubator/bits-service/oci_registry/models/docker/mediatype"
 	"github.com/cloudfoundry-incubator/bits-service/util"
@@ -30,47 +31,65 @@ type ImageHandler struct {
 	ImageManager *BitsImageManager
 }
 
-func (m *ImageHandler) ServeAPIVersion(w http.ResponseWriter, r *http.Request) {
+func (m *ImageHandler) ServeAPIVersion(w http.ResponseWriter, r *http.Request) error {
 	w.Write([]byte("Pong"))
+	return nil
 }
 
-func (m *ImageHandler) ServeManifest(w http.ResponseWriter, r *http.Request) {
+func (m *ImageHandler) ServeManifest(w http.ResponseWriter, r *http.Request) error {
 	// TODO (pego): this is a hack to address to quickly find out if this should serve a manifest or manifest list. Should be improved.
-	if m.ImageManager.GetBlob("not used", mux.Vars(r)["tag"]) != nil {
+	blob, e := m.ImageManager.GetBlob("not used", mux.Vars(r)["tag"])
+	if e != nil {
+		return e
+	}
+	if blob != nil {
+		blob.Close()
 		mux.Vars(r)["digest"] = mux.Vars(r)["tag"]
-		m.ServeBlob(w, r)
-		return
+		return m.ServeBlob(w, r)
 	}
 
-	manifestList := m.ImageManager.GetManifestList(strings.TrimPrefix(mux.Vars(r)["name"], "cloudfoundry/"), mux.Vars(r)["tag"])
-
+	manifestList, e := m.ImageManager.GetManifestList(strings.TrimPrefix(mux.Vars(r)["name"], "cloudfoundry/"), mux.Vars(r)["tag"])
+	if e != nil {
+		return e
+	}
 	if manifestList == nil {
 		http.NotFound(w, r)
-		return
+		return nil
 	}
 
 	manifestListJson, e := json.Marshal(manifestList)
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return errors.WithStack(e)
+	}
 
-	manifestListDigest, manifestListSize := shaAndSize(bytes.NewReader(manifestListJson))
+	manifestListDigest, manifestListSize, e := shaAndSize(bytes.NewReader(manifestListJson))
+	if e != nil {
+		return e
+	}
 	e = m.ImageManager.digestLookupStore.Put(manifestListDigest, bytes.NewReader(manifestListJson))
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return errors.WithStack(e)
+	}
 
 	w.Header().Add("Content-Type", mediatype.DistributionManifestListV2Json)
 	w.Header().Add("Docker-Content-Digest", manifestListDigest)
 	w.Header().Add("Content-Length", fmt.Sprintf("%d", manifestListSize))
 
 	w.Write(manifestListJson)
+	return nil
 }
 
-func (m *ImageHandler) ServeBlob(w http.ResponseWriter, r *http.Request) {
+func (m *ImageHandler) ServeBlob(w http.ResponseWriter, r *http.Request) error {
 	digest := mux.Vars(r)["digest"]
-	layer := m.ImageManager.GetBlob(mux.Vars(r)["name"], digest)
-
+	layer, e := m.ImageManager.GetBlob(mux.Vars(r)["name"], digest)
+	if e != nil {
+		return e
+	}
 	if layer == nil {
 		http.NotFound(w, r)
-		return
+		return nil
 	}
+	defer layer.Close()
 
 	// TODO (pego): this is a hack to find out if we should serve a layer or a manifest blob. Should be improved.
 	if mux.Vars(r)["digest"] == mux.Vars(r)["tag"] {
@@ -80,9 +99,12 @@ func (m *ImageHandler) ServeBlob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Add("Docker-Content-Digest", digest)
-	_, e := io.Copy(w, layer)
-
-	util.PanicOnError(errors.WithStack(e))
+	_, e = io.Copy(w, layer)
+	if e != nil {
+		// The response has already started, so all we can do is to log.
+		logger.From(r).Errorw("Could not write blob to response", "digest", digest, "error", e)
+	}
+	return nil
 }
 
 type BitsImageManager struct {
@@ -104,7 +126,9 @@ func NewBitsImageManager(
 			"Please make sure that copy it to the root FS blobstore as part of your deployment."))
 	}
 	util.PanicOnError(errors.WithStack(e))
-	rootfsDigest, rootfsSize := shaAndSize(rootfsReader)
+	defer rootfsReader.Close()
+	rootfsDigest, rootfsSize, e := shaAndSize(rootfsReader)
+	util.PanicOnError(e)
 
 	return &BitsImageManager{
 		rootFSBlobstore:   rootFSBlobstore,
@@ -115,18 +139,26 @@ func NewBitsImageManager(
 	}
 }
 
-func (b *BitsImageManager) GetManifestList(dropletGUID string, dropletHash string) *docker.ManifestList {
-	manifest := b.GetManifest(dropletGUID, dropletHash)
-	if manifest == nil {
-		return nil
+// GetManifestList returns nil when the droplet does not exist.
+func (b *BitsImageManager) GetManifestList(dropletGUID string, dropletHash string) (*docker.ManifestList, error) {
+	manifest, e := b.GetManifest(dropletGUID, dropletHash)
+	if e != nil || manifest == nil {
+		return nil, e
 	}
 	manifestJson, e := json.Marshal(manifest)
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
-	manifestDigest, manifestSize := shaAndSize(bytes.NewReader(manifestJson))
+	manifestDigest, manifestSize, e := shaAndSize(bytes.NewReader(manifestJson))
+	if e != nil {
+		return nil, e
+	}
 
 	e = b.digestLookupStore.Put(manifestDigest, bytes.NewReader(manifestJson))
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
 	return &docker.ManifestList{
 		Versioned: docker.Versioned{
@@ -146,42 +178,67 @@ func (b *BitsImageManager) GetManifestList(dropletGUID string, dropletHash strin
 				},
 			},
 		},
-	}
+	}, nil
 }
 
-func (b *BitsImageManager) GetManifest(dropletGUID string, dropletHash string) *docker.Manifest {
+// GetManifest returns nil when the droplet does not exist.
+func (b *BitsImageManager) GetManifest(dropletGUID string, dropletHash string) (*docker.Manifest, error) {
 	dropletReader, e := b.dropletBlobstore.Get(dropletGUID + "/" + dropletHash)
 
 	if bitsgo.IsNotFoundError(e) {
-		return nil
+		return nil, nil
+	}
+	if e != nil {
+		return nil, errors.WithStack(e)
 	}
-	util.PanicOnError(errors.WithStack(e))
 	defer dropletReader.Close()
 
 	ociDropletFile, e := ioutil.TempFile("", "oci-droplet")
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
 	defer os.Remove(ociDropletFile.Name())
 	defer ociDropletFile.Close()
 
-	preFixDroplet(dropletReader, ociDropletFile)
+	e = preFixDroplet(dropletReader, ociDropletFile)
+	if e != nil {
+		return nil, e
+	}
 
 	_, e = ociDropletFile.Seek(0, 0)
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
-	dropletDigest, dropletSize := shaAndSize(ociDropletFile)
+	dropletDigest, dropletSize, e := shaAndSize(ociDropletFile)
+	if e != nil {
+		return nil, e
+	}
 
 	_, e = ociDropletFile.Seek(0, 0)
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
 	e = b.digestLookupStore.Put(dropletDigest, ociDropletFile)
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
-	configJSON := b.configMetadata(b.rootfsDigest, dropletDigest)
-	configDigest, configSize := shaAndSize(bytes.NewReader(configJSON))
+	configJSON, e := b.configMetadata(b.rootfsDigest, dropletDigest)
+	if e != nil {
+		return nil, e
+	}
+	configDigest, configSize, e := shaAndSize(bytes.NewReader(configJSON))
+	if e != nil {
+		return nil, e
+	}
 
 	e = b.digestLookupStore.Put(configDigest, bytes.NewReader(configJSON))
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
 
 	return &docker.Manifest{
 		Versioned: docker.Versioned{
@@ -205,14 +262,16 @@ func (b *BitsImageManager) GetManifest(dropletGUID string, dropletHash string) *
 				Size:      dropletSize,
 			},
 		},
-	}
+	}, nil
 }
 
-func preFixDroplet(cfDroplet io.Reader, ociDroplet io.Writer) {
+func preFixDroplet(cfDroplet io.Reader, ociDroplet io.Writer) error {
 	layer := tar.NewWriter(ociDroplet)
 
 	gz, e := gzip.NewReader(cfDroplet)
-	util.PanicOnError(errors.WithStack(e))
+	if e != nil {
+		return errors.WithStack(e)
+	}
 
 	t := tar.NewReader(gz)
 	for {
@@ -220,44 +279,57 @@ func preFixDroplet(cfDroplet io.Reader, ociDroplet io.Writer) {
 		if e == io.EOF {
 			break
 		}
-		util.PanicOnError(errors.WithStack(e))
+		if e != nil {
+			return errors.WithStack(e)
+		}
 
 		hdr.Name = filepath.Join("/home/vcap", hdr.Name)
 		hdr.Mode = 0777
 		hdr.Uname = "vcap"
 		hdr.Gname = "vcap"
 		e = layer.WriteHeader(hdr)
-		util.PanicOnError(errors.WithStack(e))
+		if e != nil {
+			return errors.WithStack(e)
+		}
 		_, e = io.Copy(layer, t)
-		util.PanicOnError(errors.WithStack(e))
+		if e != nil {
+			return errors.WithStack(e)
+		}
 	}
+	return nil
 }
 
-func shaAndSize(reader io.Reader) (sha string, size int64) {
+func shaAndSize(reader io.Reader) (sha string, size int64, err error) {
 	sha256Hash := sha256.New()
 	configSize, e := io.Copy(sha256Hash, reader)
-	util.PanicOnError(errors.WithStack(e))
-	return "sha256:" + hex.EncodeToString(sha256Hash.Sum([]byte{})), configSize
+	if e != nil {
+		return "", 0, errors.WithStack(e)
+	}
+	return "sha256:" + hex.EncodeToString(sha256Hash.Sum([]byte{})), configSize, nil
 }
 
+// GetBlob returns nil when there is no blob with the given digest.
 // NOTE: name is currently not used.
-func (b *BitsImageManager) GetBlob(name string, digest string) io.ReadCloser {
+func (b *BitsImageManager) GetBlob(name string, digest string) (io.ReadCloser, error) {
 	if digest == b.rootfsDigest {
 		r, e := b.rootFSBlobstore.Get("assets/eirinifs.tar")
-		util.PanicOnError(errors.WithStack(e))
-		return r
+		if e != nil {
+			return nil, errors.WithStack(e)
+		}
+		return r, nil
 	}
 
 	r, e := b.digestLookupStore.Get(digest)
 	if _, notFound := e.(*bitsgo.NotFoundError); notFound {
-		return nil
+		return nil, nil
 	}
-
-	util.PanicOnError(errors.WithStack(e))
-	return r
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
+	return r, nil
 }
 
-func (b *BitsImageManager) configMetadata(rootfsDigest string, dropletDigest string) []byte {
+func (b *BitsImageManager) configMetadata(rootfsDigest string, dropletDigest string) ([]byte, error) {
 	config, e := json.Marshal(map[string]interface{}{
 		"config": map[string]interface{}{
 			"user": "vcap",
@@ -270,13 +342,18 @@ func (b *BitsImageManager) configMetadata(rootfsDigest string, dropletDigest str
 			},
 		},
 	})
-	util.PanicOnError(errors.WithStack(e))
-	return config
+	if e != nil {
+		return nil, errors.WithStack(e)
+	}
+	return config, nil
 }
 
 func (b *BitsImageManager) DeleteArtifacts(dropletGUID, dropletHash string) error {
 	var errs []string
-	manifestList := b.GetManifestList(dropletGUID, dropletHash)
+	manifestList, e := b.GetManifestList(dropletGUID, dropletHash)
+	if e != nil {
+		return errors.Wrap(e, "Could not get manifest index")
+	}
 	if manifestList == nil {
 		return nil
 	}
@@ -289,22 +366,24 @@ func (b *BitsImageManager) DeleteArtifacts(dropletGUID, dropletHash string) erro
 	if e != nil {
 		errs = append(errs, "Could not marshal manifest index struct into JSON: "+e.Error())
 	} else {
-		manifestListDigest, _ := shaAndSize(bytes.NewReader(manifestListJSON))
+		manifestListDigest, _, _ := shaAndSize(bytes.NewReader(manifestListJSON))
 		e = b.digestLookupStore.Delete(manifestListDigest)
 		if e != nil {
 			errs = append(errs, "Could not delete manifest index JSON file from digest lookup store: "+e.Error())
 		}
 	}
 
-	manifest := b.GetManifest(dropletGUID, dropletHash)
-	if manifest == nil {
+	manifest, e := b.GetManifest(dropletGUID, dropletHash)
+	if e != nil {
+		errs = append(errs, "Could not get OCI manifest: "+e.Error())
+	} else if manifest == nil {
 		errs = append(errs, "Could not find OCI manifest with droplet GUID "+dropletGUID+" and droplet hash "+dropletHash)
 	} else {
 		manifestJSON, e := json.Marshal(manifest)
 		if e != nil {
 			errs = append(errs, "Could not marshal manifest struct into JSON: "+e.Error())
 		} else {
-			manifestDigest, _ := shaAndSize(bytes.NewReader(manifestJSON))
+			manifestDigest, _, _ := shaAndSize(bytes.NewReader(manifestJSON))
 
 			e = b.digestLookupStore.Delete(manifestDigest)
 			if e != nil {
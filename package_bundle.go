@@ -71,28 +71,11 @@ func CreateTempZipFileFrom(bundlesPayload []Fingerprint,
 			if e != nil {
 				return "", errors.Wrap(e, "Could not close zip entry reader")
 			}
-			e = backoff.RetryNotify(func() error {
-				tempFile, e = os.Open(tempFile.Name())
+			if uint64(tempFileSize) >= minimumSize && uint64(tempFileSize) <= maximumSize {
+				e = putFile(blobstore, hex.EncodeToString(sha.Sum(nil)), tempFile.Name())
 				if e != nil {
-					return errors.Wrap(e, "Could not open temp file for reading")
+					return "", e
 				}
-				defer tempFile.Close()
-				if uint64(tempFileSize) >= minimumSize && uint64(tempFileSize) <= maximumSize {
-					sha := hex.EncodeToString(sha.Sum(nil))
-					e = blobstore.Put(sha, tempFile)
-					if e != nil {
-						if _, ok := e.(*NoSpaceLeftError); ok {
-							return backoff.Permanent(e)
-						}
-						return errors.Wrapf(e, "Could not upload file to blobstore. SHA: '%v'", sha)
-					}
-				}
-				return nil
-			}, backoff.NewExponentialBackOff(), func(e error, backOffDelay time.Duration) {
-				metricsService.SendCounterMetric("appStashPutRetries", 1)
-			})
-			if e != nil {
-				return "", e
 			}
 			os.Remove(tempFile.Name())
 		}
@@ -104,34 +87,91 @@ func CreateTempZipFileFrom(bundlesPayload []Fingerprint,
 			return "", errors.Wrap(e, "Could create header in zip file")
 		}
 
-		e = backoff.RetryNotify(func() error {
-			b, e := blobstore.Get(entry.Sha1)
+		e = copyFileInto(zipEntry, blobstore, entry.Sha1, metricsService)
+		if e != nil {
+			return "", e
+		}
+	}
+	e = zipWriter.Close()
+	if e != nil {
+		return "", errors.Wrap(e, "Could not close zip file")
+	}
+	return tempZipFile.Name(), nil
+}
+
+// maxReadAttempts is the number of times copyFileInto downloads a file when reading it fails.
+const maxReadAttempts = 3
 
-			if e != nil {
-				if _, ok := e.(*NotFoundError); ok {
-					return backoff.Permanent(NewNotFoundErrorWithKey(entry.Sha1))
-				}
-				return errors.Wrapf(e, "Could not get file from blobstore. SHA: '%v'", entry.Sha1)
-			}
-			defer b.Close()
+// copyFileInto downloads the file into a temp file before writing it to zipEntry, so that a download which
+// fails while reading the body can be started over. Errors of Blobstore.Get itself are not retried here,
+// because the blobstore retries them already, see decorator.RetryingBlobstoreDecorator.
+func copyFileInto(zipEntry io.Writer, blobstore Blobstore, sha string, metricsService MetricsService) error {
+	tempFile, e := ioutil.TempFile("", "app-stash")
+	if e != nil {
+		return errors.Wrap(e, "Could not create tempfile")
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
 
-			_, e = io.Copy(zipEntry, b)
-			if e != nil {
-				return errors.Wrapf(e, "Could not copy file to zip entry. SHA: %v", entry.Sha1)
+	e = backoff.RetryNotify(func() error {
+		b, e := blobstore.Get(sha)
+		if e != nil {
+			if _, ok := e.(*NotFoundError); ok {
+				return backoff.Permanent(NewNotFoundErrorWithKey(sha))
 			}
-			return nil
-		},
-			backoff.NewExponentialBackOff(),
-			func(e error, backOffDelay time.Duration) {
-				metricsService.SendCounterMetric("appStashGetRetries", 1)
-			},
-		)
+			return backoff.Permanent(errors.Wrapf(e, "Could not get file from blobstore. SHA: '%v'", sha))
+		}
+		defer b.Close()
+
+		_, e = tempFile.Seek(0, io.SeekStart)
 		if e != nil {
-			return "", e
+			return backoff.Permanent(errors.Wrap(e, "Could not rewind tempfile"))
+		}
+		e = tempFile.Truncate(0)
+		if e != nil {
+			return backoff.Permanent(errors.Wrap(e, "Could not truncate tempfile"))
+		}
+		_, e = io.Copy(tempFile, b)
+		if IsCorruptBlobError(e) {
+			return backoff.Permanent(e)
+		}
+		if e != nil {
+			return errors.Wrapf(e, "Could not read file from blobstore. SHA: %v", sha)
 		}
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), maxReadAttempts-1), func(e error, backOffDelay time.Duration) {
+		metricsService.SendCounterMetric("appStashGetRetries", 1)
+	})
+	if e != nil {
+		return e
 	}
-	zipWriter.Close()
-	return tempZipFile.Name(), nil
+
+	_, e = tempFile.Seek(0, io.SeekStart)
+	if e != nil {
+		return errors.Wrap(e, "Could not rewind tempfile")
+	}
+	_, e = io.Copy(zipEntry, tempFile)
+	if e != nil {
+		return errors.Wrapf(e, "Could not copy file to zip entry. SHA: %v", sha)
+	}
+	return nil
+}
+
+// putFile uploads the file at filename. Retries are done by the blobstore, see decorator.RetryingBlobstoreDecorator.
+func putFile(blobstore Blobstore, sha string, filename string) error {
+	file, e := os.Open(filename)
+	if e != nil {
+		return errors.Wrap(e, "Could not open temp file for reading")
+	}
+	defer file.Close()
+	e = blobstore.Put(sha, file)
+	if e != nil {
+		if _, ok := e.(*NoSpaceLeftError); ok {
+			return e
+		}
+		return errors.Wrapf(e, "Could not upload file to blobstore. SHA: '%v'", sha)
+	}
+	return nil
 }
 
 func fileModeFrom(s string) os.FileMode {
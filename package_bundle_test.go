@@ -108,25 +108,20 @@ var _ = Describe("CreateTempZipFileFrom", func() {
 			blobstore = NewMockBlobstore()
 		})
 
+		// Retries are done by decorator.RetryingBlobstoreDecorator.
 		Context("Error in Blobstore.Get", func() {
-			It("Retries and creates the zip successfully", func() {
-				When(blobstore.Get("abc")).
-					ThenReturn(nil, errors.New("Some error")).
-					ThenReturn(ioutil.NopCloser(strings.NewReader("filename1 content")), nil)
+			It("returns the error without retrying", func() {
+				When(blobstore.Get("abc")).ThenReturn(nil, errors.New("Some error"))
 
-				tempFileName, e := bitsgo.CreateTempZipFileFrom([]bitsgo.Fingerprint{
+				_, e := bitsgo.CreateTempZipFileFrom([]bitsgo.Fingerprint{
 					bitsgo.Fingerprint{
 						Sha1: "abc",
 						Fn:   "filename1",
 						Mode: "644",
 					},
 				}, nil, 0, math.MaxUint64, blobstore, NewMockMetricsService(), logger.Log)
-				Expect(e).NotTo(HaveOccurred())
-
-				reader, e := zip.OpenReader(tempFileName)
-				Expect(e).NotTo(HaveOccurred())
-				Expect(reader.File).To(HaveLen(1))
-				VerifyZipFileEntry(&reader.Reader, "filename1", "filename1 content")
+				Expect(e).To(MatchError(ContainSubstring("Some error")))
+				blobstore.VerifyWasCalledOnce().Get("abc")
 			})
 		})
 
@@ -0,0 +1,230 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/logger"
+	"github.com/pkg/errors"
+)
+
+type LiveGuidFetcher interface {
+	LiveGuids(resourceType string) (map[string]bool, error)
+}
+
+// RetainedBlobs knows blobs which must be kept, although the Cloud Controller does not know about them (anymore).
+type RetainedBlobs interface {
+	RetainedPaths() (map[string]bool, error)
+}
+
+type Orphan struct {
+	Path         string    `json:"path"`
+	Guid         string    `json:"guid"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+}
+
+type Report struct {
+	ResourceType  string   `json:"resource_type"`
+	Orphans       []Orphan `json:"orphans"`
+	OrphanedBytes int64    `json:"orphaned_bytes"`
+	NumDeleted    int      `json:"num_deleted"`
+}
+
+// Result is the outcome of reconciling all resource types.
+type Result struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	DryRun      bool      `json:"dry_run"`
+	Reports     []Report  `json:"reports"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Reconciler finds blobs whose guids the Cloud Controller does not know about (anymore) and, unless
+// in dry-run mode, deletes those which have not been modified within the grace period. The grace
+// period protects blobs which have been uploaded, but are not yet known to the Cloud Controller.
+type Reconciler struct {
+	blobstores     map[string]bitsgo.Blobstore
+	retainedBlobs  map[string]RetainedBlobs
+	fetcher        LiveGuidFetcher
+	gracePeriod    time.Duration
+	dryRun         bool
+	metricsService bitsgo.MetricsService
+	clock          clock.Clock
+
+	mutex        sync.RWMutex
+	latestResult *Result
+}
+
+// NewReconciler creates a Reconciler. blobstores maps resource types as understood by fetcher to the
+// blobstores containing the blobs of that resource type.
+func NewReconciler(blobstores map[string]bitsgo.Blobstore, fetcher LiveGuidFetcher, gracePeriod time.Duration, dryRun bool, metricsService bitsgo.MetricsService, clock clock.Clock) *Reconciler {
+	return &Reconciler{
+		blobstores:     blobstores,
+		retainedBlobs:  make(map[string]RetainedBlobs),
+		fetcher:        fetcher,
+		gracePeriod:    gracePeriod,
+		dryRun:         dryRun,
+		metricsService: metricsService,
+		clock:          clock,
+	}
+}
+
+// WithRetainedBlobs makes the reconciler keep the blobs of resourceType which retainedBlobs reports as retained.
+func (reconciler *Reconciler) WithRetainedBlobs(resourceType string, retainedBlobs RetainedBlobs) *Reconciler {
+	reconciler.retainedBlobs[resourceType] = retainedBlobs
+	return reconciler
+}
+
+// RegularlyReconcile blocks and calls Reconcile in the given interval. The result of the latest run
+// is available through LatestResult.
+func (reconciler *Reconciler) RegularlyReconcile(interval time.Duration) {
+	for range reconciler.clock.Ticker(interval).C {
+		generatedAt := reconciler.clock.Now()
+		reports, e := reconciler.Reconcile()
+		result := &Result{GeneratedAt: generatedAt, DryRun: reconciler.dryRun, Reports: reports}
+		if e != nil {
+			logger.Log.Errorw("Reconciliation failed", "error", e)
+			result.Error = e.Error()
+		}
+
+		reconciler.mutex.Lock()
+		reconciler.latestResult = result
+		reconciler.mutex.Unlock()
+	}
+}
+
+// LatestResult returns nil when RegularlyReconcile has not completed a run yet.
+func (reconciler *Reconciler) LatestResult() *Result {
+	reconciler.mutex.RLock()
+	defer reconciler.mutex.RUnlock()
+	return reconciler.latestResult
+}
+
+func (reconciler *Reconciler) ServeLatestResult(responseWriter http.ResponseWriter, request *http.Request) error {
+	result := reconciler.LatestResult()
+	if result == nil {
+		return bitsgo.NewServiceUnavailableError("Reconciliation report is not available yet")
+	}
+	response, e := json.Marshal(result)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal reconciliation report")
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(response)
+	return nil
+}
+
+// Reconcile deletes orphans, unless the reconciler is in dry-run mode.
+func (reconciler *Reconciler) Reconcile() ([]Report, error) {
+	return reconciler.reconcileAll(reconciler.dryRun)
+}
+
+// DryRun reports orphans like Reconcile, but never deletes them.
+func (reconciler *Reconciler) DryRun() ([]Report, error) {
+	return reconciler.reconcileAll(true)
+}
+
+func (reconciler *Reconciler) reconcileAll(dryRun bool) ([]Report, error) {
+	var (
+		reports []Report
+		errs    []error
+	)
+	for resourceType, blobstore := range reconciler.blobstores {
+		report, e := reconciler.reconcile(resourceType, blobstore, dryRun)
+		if e != nil {
+			errs = append(errs, e)
+			continue
+		}
+		reports = append(reports, *report)
+	}
+	if len(errs) != 0 {
+		return reports, errors.Errorf("Errors during reconciliation: %v", errs)
+	}
+	return reports, nil
+}
+
+func (reconciler *Reconciler) reconcile(resourceType string, blobstore bitsgo.Blobstore, dryRun bool) (*Report, error) {
+	blobInfos, e := blobstore.List("")
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not list blobs of resource type %v", resourceType)
+	}
+	liveGuids, e := reconciler.fetcher.LiveGuids(resourceType)
+	if e != nil {
+		return nil, errors.Wrapf(e, "Could not fetch live guids of resource type %v", resourceType)
+	}
+
+	retainedPaths := map[string]bool{}
+	if reconciler.retainedBlobs[resourceType] != nil {
+		retainedPaths, e = reconciler.retainedBlobs[resourceType].RetainedPaths()
+		if e != nil {
+			return nil, errors.Wrapf(e, "Could not determine retained blobs of resource type %v", resourceType)
+		}
+	}
+
+	deletionAllowed := !dryRun
+	if len(liveGuids) == 0 && len(blobInfos) != 0 {
+		logger.Log.Warnw("Cloud Controller does not know about any resources, but blobs exist. Not deleting anything.", "resource-type", resourceType)
+		deletionAllowed = false
+	}
+
+	report := &Report{ResourceType: resourceType}
+	for _, blobInfo := range blobInfos {
+		// OCI artifacts are content-addressed and not tracked by the Cloud Controller.
+		if strings.HasPrefix(blobInfo.Path, "sha256:") {
+			continue
+		}
+		if retainedPaths[blobInfo.Path] {
+			continue
+		}
+		guid := guidFor(blobInfo.Path)
+		if liveGuids[guid] {
+			continue
+		}
+		orphan := Orphan{Path: blobInfo.Path, Guid: guid, Size: blobInfo.Size, LastModified: blobInfo.LastModified}
+		if deletionAllowed && reconciler.clock.Now().Sub(blobInfo.LastModified) > reconciler.gracePeriod {
+			e = blobstore.Delete(blobInfo.Path)
+			if e != nil && !bitsgo.IsNotFoundError(e) {
+				logger.Log.Errorw("Could not delete orphaned blob", "resource-type", resourceType, "path", blobInfo.Path, "error", e)
+			} else {
+				orphan.Deleted = true
+				report.NumDeleted++
+			}
+		}
+		logger.Log.Infow("Orphaned blob",
+			"resource-type", resourceType,
+			"path", orphan.Path,
+			"size", orphan.Size,
+			"last-modified", orphan.LastModified,
+			"deleted", orphan.Deleted)
+		report.Orphans = append(report.Orphans, orphan)
+		report.OrphanedBytes += orphan.Size
+	}
+
+	logger.Log.Infow("Reconciliation completed",
+		"resource-type", resourceType,
+		"dry-run", dryRun,
+		"num-orphans", len(report.Orphans),
+		"orphaned-bytes", report.OrphanedBytes,
+		"num-deleted", report.NumDeleted)
+	reconciler.metricsService.SendGaugeMetric(resourceType+"-orphaned_blobs", int64(len(report.Orphans)))
+	reconciler.metricsService.SendGaugeMetric(resourceType+"-orphaned_bytes", report.OrphanedBytes)
+	reconciler.metricsService.SendCounterMetric(resourceType+"-deleted_orphans", int64(report.NumDeleted))
+	return report, nil
+}
+
+// guidFor extracts the resource guid from paths like "<guid>", "<guid>/<hash>", "<guid>_<hash>",
+// "<guid>-metadata" or "uncommitted/<guid>".
+func guidFor(path string) string {
+	path = strings.TrimPrefix(path, "uncommitted/")
+	path = strings.TrimSuffix(path, "-metadata")
+	if i := strings.IndexAny(path, "/_"); i != -1 {
+		path = path[:i]
+	}
+	return path
+}
@@ -0,0 +1,173 @@
+package reconciler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry-incubator/bits-service"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
+	"github.com/cloudfoundry-incubator/bits-service/reconciler"
+)
+
+func TestReconciler(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Reconciler")
+}
+
+type fakeLiveGuidFetcher map[string]map[string]bool
+
+func (fetcher fakeLiveGuidFetcher) LiveGuids(resourceType string) (map[string]bool, error) {
+	return fetcher[resourceType], nil
+}
+
+type nullMetricsService struct{}
+
+func (service *nullMetricsService) SendTimingMetric(name string, duration time.Duration) {}
+func (service *nullMetricsService) SendGaugeMetric(name string, value int64)             {}
+func (service *nullMetricsService) SendCounterMetric(name string, value int64)           {}
+
+var _ = Describe("Reconciler", func() {
+	var (
+		packages  *inmemory.Blobstore
+		droplets  *inmemory.Blobstore
+		fetcher   fakeLiveGuidFetcher
+		mockClock *clock.Mock
+	)
+
+	BeforeEach(func() {
+		packages = inmemory.NewBlobstore()
+		droplets = inmemory.NewBlobstore()
+		Expect(packages.Put("live-package", strings.NewReader("content"))).To(Succeed())
+		Expect(packages.Put("orphaned-package", strings.NewReader("orphan"))).To(Succeed())
+		Expect(droplets.Put("live-droplet/somehash", strings.NewReader("content"))).To(Succeed())
+		Expect(droplets.Put("orphaned-droplet/somehash", strings.NewReader("orphan"))).To(Succeed())
+		Expect(droplets.Put("sha256:abc", strings.NewReader("oci layer"))).To(Succeed())
+		fetcher = fakeLiveGuidFetcher{
+			"packages": {"live-package": true},
+			"droplets": {"live-droplet": true},
+		}
+		mockClock = clock.NewMock()
+		mockClock.Add(365 * 24 * time.Hour)
+	})
+
+	newReconciler := func(dryRun bool) *reconciler.Reconciler {
+		return reconciler.NewReconciler(
+			map[string]bitsgo.Blobstore{"packages": packages, "droplets": droplets},
+			fetcher, time.Hour, dryRun, &nullMetricsService{}, mockClock)
+	}
+
+	orphanedPathsIn := func(reports []reconciler.Report, resourceType string) []string {
+		var paths []string
+		for _, report := range reports {
+			if report.ResourceType == resourceType {
+				for _, orphan := range report.Orphans {
+					paths = append(paths, orphan.Path)
+				}
+			}
+		}
+		return paths
+	}
+
+	Context("dry-run", func() {
+		It("reports orphans, but does not delete them", func() {
+			reports, e := newReconciler(true).Reconcile()
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(orphanedPathsIn(reports, "packages")).To(ConsistOf("orphaned-package"))
+			Expect(orphanedPathsIn(reports, "droplets")).To(ConsistOf("orphaned-droplet/somehash"))
+			Expect(packages.Exists("orphaned-package")).To(BeTrue())
+			Expect(droplets.Exists("orphaned-droplet/somehash")).To(BeTrue())
+		})
+	})
+
+	Context("not dry-run", func() {
+		It("deletes orphans past the grace period and keeps live blobs", func() {
+			reports, e := newReconciler(false).Reconcile()
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(reports).To(HaveLen(2))
+			Expect(packages.Exists("orphaned-package")).To(BeFalse())
+			Expect(packages.Exists("live-package")).To(BeTrue())
+			Expect(droplets.Exists("orphaned-droplet/somehash")).To(BeFalse())
+			Expect(droplets.Exists("live-droplet/somehash")).To(BeTrue())
+			Expect(droplets.Exists("sha256:abc")).To(BeTrue())
+		})
+
+		It("keeps droplets and indexes of the droplet version history", func() {
+			history := bitsgo.NewDropletVersionHistory(droplets, 2, nil)
+			Expect(droplets.Put("deleted-droplet/somehash", strings.NewReader("retained"))).To(Succeed())
+			Expect(history.Record("some-app", "deleted-droplet", "somehash")).To(Succeed())
+			Expect(history.Record("some-app", "live-droplet", "somehash")).To(Succeed())
+			Expect(history.RetainOnDelete("some-app", "deleted-droplet", "somehash")).To(BeTrue())
+
+			reports, e := newReconciler(false).WithRetainedBlobs("droplets", history).Reconcile()
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(orphanedPathsIn(reports, "droplets")).To(ConsistOf("orphaned-droplet/somehash"))
+			Expect(droplets.Exists("deleted-droplet/somehash")).To(BeTrue())
+			Expect(droplets.Exists("droplet-versions/some-app/versions/deleted-droplet/somehash")).To(BeTrue())
+		})
+
+		It("does not delete anything when the Cloud Controller reports no live resources", func() {
+			fetcher["packages"] = map[string]bool{}
+
+			reports, e := newReconciler(false).Reconcile()
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(orphanedPathsIn(reports, "packages")).To(ConsistOf("live-package", "orphaned-package"))
+			Expect(packages.Exists("orphaned-package")).To(BeTrue())
+		})
+	})
+
+	Describe("DryRun", func() {
+		It("reports orphans, but does not delete them, even when the reconciler is not in dry-run mode", func() {
+			reports, e := newReconciler(false).DryRun()
+
+			Expect(e).NotTo(HaveOccurred())
+			Expect(orphanedPathsIn(reports, "packages")).To(ConsistOf("orphaned-package"))
+			Expect(packages.Exists("orphaned-package")).To(BeTrue())
+		})
+	})
+
+	Describe("ServeLatestResult", func() {
+		var responseWriter *httptest.ResponseRecorder
+
+		BeforeEach(func() {
+			responseWriter = httptest.NewRecorder()
+		})
+
+		It("responds with StatusServiceUnavailable before the first reconciliation", func() {
+			bitsgo.HandlerFunc(newReconciler(true).ServeLatestResult).ServeHTTP(responseWriter, httptest.NewRequest("GET", "/reconciliation", nil))
+
+			Expect(responseWriter.Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("responds with the result of the latest reconciliation", func() {
+			r := newReconciler(true)
+			go r.RegularlyReconcile(time.Hour)
+			Eventually(func() *reconciler.Result {
+				mockClock.Add(time.Hour)
+				return r.LatestResult()
+			}).ShouldNot(BeNil())
+
+			bitsgo.HandlerFunc(r.ServeLatestResult).ServeHTTP(responseWriter, httptest.NewRequest("GET", "/reconciliation", nil))
+
+			Expect(responseWriter.Code).To(Equal(http.StatusOK))
+			var result reconciler.Result
+			Expect(json.Unmarshal(responseWriter.Body.Bytes(), &result)).To(Succeed())
+			Expect(result.DryRun).To(BeTrue())
+			Expect(orphanedPathsIn(result.Reports, "packages")).To(ConsistOf("orphaned-package"))
+		})
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -21,9 +22,7 @@ import (
 
 	"go.uber.org/zap"
 
-	"github.com/cenkalti/backoff"
 	"github.com/cloudfoundry-incubator/bits-service/logger"
-	"github.com/cloudfoundry-incubator/bits-service/util"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
@@ -63,6 +62,7 @@ type ResourceHandler struct {
 	maximumSize            uint64
 	shouldProxyGetRequests bool
 	dropletArtifactDeleter DropletArtifactDeleter
+	dropletVersionHistory  *DropletVersionHistory
 }
 
 type ResponseBody struct {
@@ -129,71 +129,72 @@ func NewResourceHandlerWithUpdaterAndSizeThresholds(blobstore Blobstore, appStas
 	}
 }
 
+func (handler *ResourceHandler) WithDropletVersionHistory(dropletVersionHistory *DropletVersionHistory) *ResourceHandler {
+	handler.dropletVersionHistory = dropletVersionHistory
+	return handler
+}
+
 // TODO: instead of params, we could use `identifier string` to make the interface more type-safe.
 //       Here and in the other methods.
-func (handler *ResourceHandler) AddOrReplaceWithDigestInHeader(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *ResourceHandler) AddOrReplaceWithDigestInHeader(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
 	logger.From(request).Debugw("Octet-Stream")
 
 	digest := request.Header.Get("Digest")
 	if digest == "" {
-		badRequest(responseWriter, request, "No Digest header")
-		return
+		return newBadRequestError("No Digest header")
 	}
 	parts := strings.Split(digest, "=")
 	if len(parts) != 2 {
-		badRequest(responseWriter, request, "Digest must have format sha256=value, but is "+digest)
-		return
+		return newBadRequestError("Digest must have format sha256=value, but is %v", digest)
 	}
 	alg, value := strings.ToLower(parts[0]), parts[1]
 	if alg != "sha256" {
-		badRequest(responseWriter, request, "Digest must have format sha256=value, but is "+digest)
-		return
+		return newBadRequestError("Digest must have format sha256=value, but is %v", digest)
 	}
 	if value == "" {
-		badRequest(responseWriter, request, "Digest must have format sha256=value. Value cannot be empty")
-		return
+		return newBadRequestError("Digest must have format sha256=value. Value cannot be empty")
 	}
 
 	// TODO this can cause an out of memory panic. Should be smart about writing big files to disk instead.
 	content, e := ioutil.ReadAll(request.Body)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not read request body")
+	}
 
-	e = backoff.RetryNotify(func() error {
-		e := handler.blobstore.Put(params["identifier"]+"/"+value, bytes.NewReader(content))
-		if e != nil {
-			if _, noSpaceLeft := e.(*NoSpaceLeftError); noSpaceLeft {
-				return backoff.Permanent(e)
-			}
-			return errors.Wrap(e, "Could not upload bits to blobstore")
+	// Retries are done by the blobstore, see decorator.RetryingBlobstoreDecorator.
+	e = handler.blobstore.Put(params["identifier"]+"/"+value, bytes.NewReader(content))
+	if e != nil {
+		switch e.(type) {
+		case *NoSpaceLeftError, *EntityTooLargeError:
+			return e
 		}
-		return nil
-
-	}, retryPolicy(), func(e error, delay time.Duration) {
-		handler.metricsService.SendCounterMetric("upload"+handler.resourceType, 1)
-	})
+		return errors.Wrap(e, "Could not upload bits to blobstore")
+	}
+	handler.recordDropletVersion(params["identifier"]+"/"+value, request)
 
 	// TODO use Clock instead:
-	writeResponseBasedOn("", e, responseWriter, request, http.StatusCreated, nil, &ResponseBody{Guid: params["identifier"], State: "READY", Type: "bits", CreatedAt: time.Now()}, "")
+	return writeResponse(responseWriter, request, http.StatusCreated, "", nil, &ResponseBody{Guid: params["identifier"], State: "READY", Type: "bits", CreatedAt: time.Now()}, "")
 }
 
 // TODO: instead of params, we could use `identifier string` to make the interface more type-safe.
 //       Here and in the other methods.
-func (handler *ResourceHandler) AddOrReplace(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *ResourceHandler) AddOrReplace(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
 	file, fileInfo, e := request.FormFile(handler.resourceType)
 	if e == http.ErrMissingFile {
 		file, fileInfo, e = request.FormFile("bits")
 	}
 	if e == http.ErrMissingFile {
-		badRequest(responseWriter, request, "Could not retrieve form parameter '%s' or 'bits", handler.resourceType)
-		return
+		return newBadRequestError("Could not retrieve form parameter '%s' or 'bits", handler.resourceType)
+	}
+	if e != nil {
+		return errors.Wrap(e, "Could not read multipart form")
 	}
-	util.PanicOnError(e)
 	defer file.Close()
 
 	var tempFilename string
@@ -201,34 +202,28 @@ func (handler *ResourceHandler) AddOrReplace(responseWriter http.ResponseWriter,
 	//       The reason it's necessary right now is that we need zip handling only for packages. We treat other resources opaque.
 	if handler.resourceType == "package" {
 		tempFilename, e = handler.completePackageWithResources(request.FormValue("resources"), file, fileInfo.Size, logger.From(request))
-		switch e.(type) {
-		case *inputError:
-			logger.From(request).Infow(e.Error())
-			responseWriter.WriteHeader(http.StatusUnprocessableEntity)
-			util.FprintDescriptionAsJSON(responseWriter, e.Error())
-			return
-		case *NoSpaceLeftError:
-			http.Error(responseWriter, util.DescriptionAndCodeAsJSON(500000, "Request Entity Too Large"), http.StatusInsufficientStorage)
-			return
-		case error:
-			panic(e)
-		}
 	} else {
 		tempFilename, e = CreateTempFileWithContent(file)
-		util.PanicOnError(e)
+	}
+	if e != nil {
+		return e
 	}
 
 	sha1, sha256, e := ShaSums(tempFilename)
-	util.PanicOnError(e)
+	if e != nil {
+		os.Remove(tempFilename)
+		return e
+	}
 
 	e = handler.updater.NotifyProcessingUpload(params["identifier"])
-	if handleNotificationError(e, responseWriter, request) {
-		return
+	if e != nil {
+		os.Remove(tempFilename)
+		return notificationError(e)
 	}
 
 	if request.URL.Query().Get("async") == "true" {
 		go handler.uploadResource(tempFilename, request, params["identifier"], true, sha1, sha256)
-		writeResponseBasedOn("", nil, responseWriter, request, http.StatusAccepted, nil, &ResponseBody{
+		return writeResponse(responseWriter, request, http.StatusAccepted, "", nil, &ResponseBody{
 			Guid:      params["identifier"],
 			State:     "PROCESSING_UPLOAD",
 			Type:      "bits",
@@ -236,21 +231,22 @@ func (handler *ResourceHandler) AddOrReplace(responseWriter http.ResponseWriter,
 			Sha1:      hex.EncodeToString(sha1),
 			Sha256:    hex.EncodeToString(sha256),
 		}, "")
-	} else {
-		e = handler.uploadResource(tempFilename, request, params["identifier"], false, sha1, sha256)
-		if IsNotFoundError(e) {
-			writeResponseBasedOn("", nil, responseWriter, request, http.StatusConflict, nil, nil, "")
-			return
-		}
-		writeResponseBasedOn("", e, responseWriter, request, http.StatusCreated, nil, &ResponseBody{
-			Guid:      params["identifier"],
-			State:     "READY",
-			Type:      "bits",
-			CreatedAt: time.Now(),
-			Sha1:      hex.EncodeToString(sha1),
-			Sha256:    hex.EncodeToString(sha256),
-		}, "")
 	}
+	e = handler.uploadResource(tempFilename, request, params["identifier"], false, sha1, sha256)
+	if IsNotFoundError(e) {
+		return NewResponseError(http.StatusConflict, codeConflict, "Resource %v was deleted during upload", params["identifier"])
+	}
+	if e != nil {
+		return e
+	}
+	return writeResponse(responseWriter, request, http.StatusCreated, "", nil, &ResponseBody{
+		Guid:      params["identifier"],
+		State:     "READY",
+		Type:      "bits",
+		CreatedAt: time.Now(),
+		Sha1:      hex.EncodeToString(sha1),
+		Sha256:    hex.EncodeToString(sha256),
+	}, "")
 }
 
 type BuildpackMetadata struct {
@@ -261,31 +257,37 @@ type BuildpackMetadata struct {
 	Key      string `json:"key"`
 }
 
-func (handler *ResourceHandler) AddBuildpack(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *ResourceHandler) AddBuildpack(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
 	file, fileInfo, e := request.FormFile(handler.resourceType)
 	if e == http.ErrMissingFile {
 		file, fileInfo, e = request.FormFile("bits")
 	}
 	if e == http.ErrMissingFile {
-		badRequest(responseWriter, request, "Could not retrieve form parameter '%s' or 'bits", handler.resourceType)
-		return
+		return newBadRequestError("Could not retrieve form parameter '%s' or 'bits", handler.resourceType)
+	}
+	if e != nil {
+		return errors.Wrap(e, "Could not read multipart form")
 	}
-	util.PanicOnError(e)
 	defer file.Close()
 
 	tempFilename, e := CreateTempFileWithContent(file)
-	util.PanicOnError(e)
+	if e != nil {
+		return e
+	}
+	// uploadResource removes the file as well, but only when it gets that far.
+	defer os.Remove(tempFilename)
 
 	sha1, sha256, e := ShaSums(tempFilename)
-	util.PanicOnError(e)
+	if e != nil {
+		return e
+	}
 
 	stack, e := extractStackFromZipFile(tempFilename)
 	if e != nil {
-		badRequest(responseWriter, request, "Invalid buildpack zip file: %v", e.Error())
-		return
+		return e
 	}
 
 	// TODO (pego, eli): do we want to re-introduce async upload here?
@@ -293,7 +295,9 @@ func (handler *ResourceHandler) AddBuildpack(responseWriter http.ResponseWriter,
 	identifier := uuid.NewV4().String()
 
 	e = handler.uploadResource(tempFilename, request, identifier, false, sha1, sha256)
-	util.PanicOnError(e)
+	if e != nil {
+		return e
+	}
 
 	buildpackMetadata := BuildpackMetadata{
 		Filename: fileInfo.Filename,
@@ -304,12 +308,18 @@ func (handler *ResourceHandler) AddBuildpack(responseWriter http.ResponseWriter,
 	}
 
 	bpMetadataJson, e := json.Marshal(buildpackMetadata)
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal buildpack metadata")
+	}
 	e = handler.blobstore.Put(identifier+"-metadata", bytes.NewReader(bpMetadataJson))
-	util.PanicOnError(e)
+	if e != nil {
+		return errors.Wrapf(e, "Could not upload metadata of buildpack %v", identifier)
+	}
 	e = handler.blobstore.Put("uncommitted/"+identifier, strings.NewReader(time.Now().String()))
-	util.PanicOnError(e)
-	writeResponseBasedOn("", e, responseWriter, request, http.StatusCreated, nil, &ResponseBody{
+	if e != nil {
+		return errors.Wrapf(e, "Could not mark buildpack %v as uncommitted", identifier)
+	}
+	return writeResponse(responseWriter, request, http.StatusCreated, "", nil, &ResponseBody{
 		Guid:      buildpackMetadata.Key,
 		State:     "READY",
 		Type:      "bits",
@@ -319,70 +329,75 @@ func (handler *ResourceHandler) AddBuildpack(responseWriter http.ResponseWriter,
 	}, "")
 }
 
+// extractStackFromZipFile returns a ResponseError when the buildpack zip file itself is invalid.
 func extractStackFromZipFile(tempFilename string) (string, error) {
 	buildpackFile, e := zip.OpenReader(tempFilename)
 	switch e {
+	case nil:
 	case zip.ErrFormat, zip.ErrAlgorithm, zip.ErrChecksum:
-		return "", e
+		return "", newBadRequestError("Invalid buildpack zip file: %v", e.Error())
 	default:
-		util.PanicOnError(e)
+		return "", errors.Wrap(e, "Could not open buildpack zip file")
 	}
+	defer buildpackFile.Close()
 	for _, zipEntry := range buildpackFile.File {
 		if zipEntry.FileInfo().IsDir() || zipEntry.Name != "manifest.yml" {
 			continue
 		}
 		manifestReader, e := zipEntry.Open()
-		util.PanicOnError(e)
+		if e != nil {
+			return "", newBadRequestError("Invalid buildpack zip file: %v", e.Error())
+		}
+		defer manifestReader.Close()
 
 		manifestCOntent, e := ioutil.ReadAll(manifestReader)
-		util.PanicOnError(e)
+		if e != nil {
+			return "", newBadRequestError("Invalid buildpack zip file: %v", e.Error())
+		}
 
 		var buildpackManifest struct {
 			Stack string `yaml:"stack"`
 		}
 		e = yaml.Unmarshal(manifestCOntent, &buildpackManifest)
 		if e != nil {
-			return "", errors.New("manifest.yml is an invalid YAML file")
+			return "", newBadRequestError("Invalid buildpack zip file: manifest.yml is an invalid YAML file")
 		}
 		if buildpackManifest.Stack == "" {
-			return "", errors.New("missing key \"stack\" in manifest.yml")
+			return "", newBadRequestError("Invalid buildpack zip file: missing key \"stack\" in manifest.yml")
 		}
 		return buildpackManifest.Stack, nil
 	}
 
-	return "", errors.New("no manifest.yml found in zip")
+	return "", newBadRequestError("Invalid buildpack zip file: no manifest.yml found in zip")
 }
 
-type inputError struct {
-	error
-}
-
-// returns inputError or NoSpaceLeftError in case of error
+// returns a ResponseError with status UnprocessableEntity when the request is invalid
 func (handler *ResourceHandler) completePackageWithResources(resources string, file multipart.File, fileSize int64, logger *zap.SugaredLogger) (tempfileName string, err error) {
 	var bundlesPayload []Fingerprint
 	if resources != "" {
 		e := json.Unmarshal([]byte(resources), &bundlesPayload)
 		if e != nil {
-			return "", &inputError{fmt.Errorf("The request is semantically invalid: JSON payload could not be parsed: '%s'", resources)}
+			return "", newUnprocessableEntityError("The request is semantically invalid: JSON payload could not be parsed: '%s'", resources)
 		}
 		if isMissing, key := anyKeyMissingIn(bundlesPayload); isMissing {
-			return "", &inputError{fmt.Errorf("The request is semantically invalid: key \"%v\" missing or empty", key)}
+			return "", newUnprocessableEntityError("The request is semantically invalid: key \"%v\" missing or empty", key)
 		}
 	}
 	zipReader, e := zip.NewReader(file, fileSize)
 	if e != nil && strings.Contains(e.Error(), "not a valid zip file") {
-		return "", &inputError{fmt.Errorf("The request is semantically invalid: bits uploaded is not a valid zip file")}
+		return "", newUnprocessableEntityError("The request is semantically invalid: bits uploaded is not a valid zip file")
+	}
+	if e != nil {
+		return "", errors.Wrap(e, "Could not read uploaded zip file")
 	}
-	util.PanicOnError(e)
 
 	tempFilename, e := CreateTempZipFileFrom(bundlesPayload, zipReader, handler.minimumSize, handler.maximumSize, handler.appStashBlobstore, handler.metricsService, logger)
-	if _, noSpaceLeft := e.(*NoSpaceLeftError); noSpaceLeft {
-		return "", e
-	}
 	if notFoundErr, ok := e.(*NotFoundError); ok {
-		return "", &inputError{fmt.Errorf("The request is semantically invalid: not all specified sha1s could be found in app-stash. Missing sha1: \"%v\"", notFoundErr.MissingKey)}
+		return "", newUnprocessableEntityError("The request is semantically invalid: not all specified sha1s could be found in app-stash. Missing sha1: \"%v\"", notFoundErr.MissingKey)
+	}
+	if e != nil {
+		return "", e
 	}
-	util.PanicOnError(e)
 	return tempFilename, nil
 }
 
@@ -403,33 +418,12 @@ func CreateTempFileWithContent(reader io.Reader) (string, error) {
 
 func (handler *ResourceHandler) uploadResource(tempFilename string, request *http.Request, identifier string, async bool, sha1Sum []byte, sha256Sum []byte) error {
 	defer os.Remove(tempFilename)
-	e := backoff.RetryNotify(func() error {
-		tempFile, e := os.Open(tempFilename)
-		if e != nil {
-			return backoff.Permanent(errors.Wrapf(e, "Could not open temporary file '%v'", tempFilename))
-		}
-		defer tempFile.Close()
-
-		logger.From(request).Debugw("Starting upload to blobstore", "identifier", identifier)
-		e = handler.blobstore.Put(identifier, tempFile)
-		logger.From(request).Debugw("Completed upload to blobstore", "identifier", identifier)
-
-		if e != nil {
-			if _, noSpaceLeft := e.(*NoSpaceLeftError); noSpaceLeft {
-				return backoff.Permanent(e)
-			}
-
-			return errors.Wrapf(e, "Could not upload temporary file to blobstore %v", tempFilename)
-		}
-		return nil
-	}, retryPolicy(), func(e error, delay time.Duration) {
-		handler.metricsService.SendCounterMetric("upload"+handler.resourceType, 1)
-	})
-
+	e := handler.putTempFile(tempFilename, request, identifier)
 	if e != nil {
 		handler.notifyUploadFailed(identifier, e, request)
 		return handle(e, async, request)
 	}
+	handler.recordDropletVersion(identifier, request)
 	e = handler.updater.NotifyUploadSucceeded(identifier, hex.EncodeToString(sha1Sum), hex.EncodeToString(sha256Sum))
 	if IsNotFoundError(e) {
 		return e
@@ -440,6 +434,28 @@ func (handler *ResourceHandler) uploadResource(tempFilename string, request *htt
 	return nil
 }
 
+// putTempFile uploads the temporary file. Retries are done by the blobstore, see decorator.RetryingBlobstoreDecorator.
+func (handler *ResourceHandler) putTempFile(tempFilename string, request *http.Request, identifier string) error {
+	tempFile, e := os.Open(tempFilename)
+	if e != nil {
+		return errors.Wrapf(e, "Could not open temporary file '%v'", tempFilename)
+	}
+	defer tempFile.Close()
+
+	logger.From(request).Debugw("Starting upload to blobstore", "identifier", identifier)
+	e = handler.blobstore.Put(identifier, tempFile)
+	logger.From(request).Debugw("Completed upload to blobstore", "identifier", identifier)
+
+	if e != nil {
+		switch e.(type) {
+		case *NoSpaceLeftError, *EntityTooLargeError:
+			return e
+		}
+		return errors.Wrapf(e, "Could not upload temporary file to blobstore %v", tempFilename)
+	}
+	return nil
+}
+
 // TODO(pego): find better name for this function
 func handle(e error, async bool, request *http.Request) error {
 	if async {
@@ -448,12 +464,6 @@ func handle(e error, async bool, request *http.Request) error {
 	return e
 }
 
-func retryPolicy() *backoff.ExponentialBackOff {
-	retryPolicy := backoff.NewExponentialBackOff()
-	retryPolicy.MaxElapsedTime = time.Second
-	return retryPolicy
-}
-
 func (handler *ResourceHandler) notifyUploadFailed(identifier string, e error, request *http.Request) {
 	notifyErr := handler.updater.NotifyUploadFailed(identifier, e)
 	if notifyErr != nil {
@@ -476,154 +486,339 @@ func ShaSums(filename string) (sha1Sum []byte, sha256Sum []byte, e error) {
 	return sha1Hash.Sum(nil), sha256Hash.Sum(nil), nil
 }
 
-func handleNotificationError(e error, responseWriter http.ResponseWriter, request *http.Request) (wasError bool) {
+// notificationError maps errors of Updater.NotifyProcessingUpload to errors that WriteErrorResponse understands.
+func notificationError(e error) error {
 	switch e.(type) {
 	case *StateForbiddenError:
-		responseWriter.WriteHeader(http.StatusBadRequest)
-		util.FprintDescriptionAndCodeAsJSON(responseWriter, 290008, "Cannot update an existing package.")
-		return true
+		return e
 	case *NotFoundError:
-		responseWriter.WriteHeader(http.StatusNotFound)
-		util.FprintDescriptionAndCodeAsJSON(responseWriter, 10010, e.Error())
-		return true
-	case error:
-		panic(e)
+		return newNotFoundResponseError(e.Error())
 	}
-	return false
+	return errors.Wrap(e, "Could not notify Cloud Controller about processing upload")
 }
 
-func (handler *ResourceHandler) CopySourceGuid(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *ResourceHandler) CopySourceGuid(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	if !HandleBodySizeLimits(responseWriter, request, handler.maxBodySizeLimit) {
-		return
+		return nil
 	}
-	sourceGuid := sourceGuidFrom(request, responseWriter)
-	if sourceGuid == "" {
-		return // response is already handled in sourceGuidFrom
+	sourceGuid, e := sourceGuidFrom(request)
+	if e != nil {
+		return e
+	}
+	e = handler.blobstore.Copy(sourceGuid, params["identifier"])
+	if e != nil {
+		return e
 	}
-	e := handler.blobstore.Copy(sourceGuid, params["identifier"])
+	handler.recordDropletVersion(params["identifier"], request)
 	// TODO use Clock instead:
-	writeResponseBasedOn("", e, responseWriter, request, http.StatusCreated, nil, &ResponseBody{Guid: params["identifier"], State: "READY", Type: "bits", CreatedAt: time.Now()}, "")
+	return writeResponse(responseWriter, request, http.StatusCreated, "", nil, &ResponseBody{Guid: params["identifier"], State: "READY", Type: "bits", CreatedAt: time.Now()}, "")
 }
 
-func sourceGuidFrom(request *http.Request, responseWriter http.ResponseWriter) string {
+func sourceGuidFrom(request *http.Request) (string, error) {
 	content, e := ioutil.ReadAll(request.Body)
-	util.PanicOnError(e)
+	if e != nil {
+		return "", errors.Wrap(e, "Could not read request body")
+	}
 	var payload struct {
 		SourceGuid string `json:"source_guid"`
 	}
 	e = json.Unmarshal(content, &payload)
 	if e != nil {
-		badRequest(responseWriter, request, "Body must be valid JSON when request is not multipart/form-data. %+v", e)
-		return ""
+		return "", newBadRequestError("Body must be valid JSON when request is not multipart/form-data. %+v", e)
+	}
+	if payload.SourceGuid == "" {
+		return "", newBadRequestError("Body must contain a non-empty source_guid")
 	}
-	return payload.SourceGuid
+	return payload.SourceGuid, nil
 }
 
-func (handler *ResourceHandler) Head(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *ResourceHandler) Head(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	exists, e := handler.blobstore.Exists(params["identifier"])
-	util.PanicOnError(e)
-	if exists {
-		responseWriter.WriteHeader(http.StatusOK)
-	} else {
+	if e != nil {
+		return e
+	}
+	if !exists {
 		responseWriter.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	e = handler.setDigestHeaders(responseWriter, params["identifier"])
+	if e != nil {
+		return e
 	}
+	responseWriter.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func (handler *ResourceHandler) Get(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *ResourceHandler) Get(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	var (
 		redirectLocation string
 		e                error
 		body             io.ReadCloser
 	)
+	// The digest is read first, so that the blobstore does not have to serve it while the body is open.
+	e = handler.setDigestHeaders(responseWriter, params["identifier"])
+	if e != nil {
+		return e
+	}
 	if handler.shouldProxyGetRequests {
 		body, e = handler.blobstore.Get(params["identifier"])
 	} else {
 		body, redirectLocation, e = handler.blobstore.GetOrRedirect(params["identifier"])
 	}
-	writeResponseBasedOn(redirectLocation, e, responseWriter, request, http.StatusOK, body, nil, request.Header.Get("If-None-Modify"))
+	if e != nil {
+		responseWriter.Header().Del("Digest")
+		responseWriter.Header().Del("ETag")
+		return e
+	}
+	return writeResponse(responseWriter, request, http.StatusOK, redirectLocation, body, nil, request.Header.Get("If-None-Modify"))
 }
 
-func (handler *ResourceHandler) BuildpackMetadata(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+// setDigestHeaders sets the Digest and ETag headers to the digest stored with the blob, when the blobstore stores digests.
+func (handler *ResourceHandler) setDigestHeaders(responseWriter http.ResponseWriter, path string) error {
+	digestingBlobstore, ok := handler.blobstore.(DigestingBlobstore)
+	if !ok {
+		return nil
+	}
+	digest, e := digestingBlobstore.Digest(path)
+	if e != nil {
+		return errors.Wrapf(e, "Could not get digest of %v", path)
+	}
+	if digest == "" {
+		return nil
+	}
+	rawDigest, e := hex.DecodeString(digest)
+	if e != nil {
+		return errors.Wrapf(e, "Invalid digest of %v", path)
+	}
+	// RFC 3230 requires the SHA-256 digest to be base64 encoded.
+	responseWriter.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(rawDigest))
+	responseWriter.Header().Set("ETag", digest)
+	return nil
+}
+
+func (handler *ResourceHandler) BuildpackMetadata(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	body, e := handler.blobstore.Get(params["identifier"] + "-metadata")
-	writeResponseBasedOn("", e, responseWriter, request, http.StatusOK, body, nil, request.Header.Get("If-None-Modify"))
+	if e != nil {
+		return e
+	}
+	return writeResponse(responseWriter, request, http.StatusOK, "", body, nil, request.Header.Get("If-None-Modify"))
 }
 
-func (handler *ResourceHandler) Delete(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+type BuildpackCacheEntry struct {
+	AppGuid      string    `json:"app_guid"`
+	Stack        string    `json:"stack"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type BuildpackCacheEntries struct {
+	Entries    []BuildpackCacheEntry `json:"entries"`
+	TotalCount int                   `json:"total_count"`
+	TotalSize  int64                 `json:"total_size"`
+}
+
+// ListBuildpackCacheEntries lists all buildpack cache entries or only those of the app given by
+// params["identifier"].
+func (handler *ResourceHandler) ListBuildpackCacheEntries(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
+	prefix := ""
+	if params["identifier"] != "" {
+		prefix = params["identifier"] + "/"
+	}
+	blobInfos, e := handler.blobstore.List(prefix)
+	if e != nil {
+		return e
+	}
+
+	entries := BuildpackCacheEntries{Entries: []BuildpackCacheEntry{}}
+	for _, blobInfo := range blobInfos {
+		parts := strings.SplitN(blobInfo.Path, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		entries.Entries = append(entries.Entries, BuildpackCacheEntry{
+			AppGuid:      parts[0],
+			Stack:        parts[1],
+			Size:         blobInfo.Size,
+			LastModified: blobInfo.LastModified,
+		})
+		entries.TotalSize += blobInfo.Size
+	}
+	entries.TotalCount = len(entries.Entries)
+
+	response, e := json.Marshal(entries)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal buildpack cache entries")
+	}
+	responseWriter.Write(response)
+	return nil
+}
+
+func (handler *ResourceHandler) Delete(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	// TODO nothing should be S3 specific here
 	// this check is needed, because S3 does not return a NotFound on a Delete request:
 	exists, e := handler.blobstore.Exists(params["identifier"])
-	util.PanicOnError(e)
+	if e != nil {
+		return e
+	}
 	if !exists {
 		responseWriter.WriteHeader(http.StatusNotFound)
-		return
+		return nil
 	}
 
-	if handler.resourceType == "droplet" && handler.dropletArtifactDeleter != nil {
+	if handler.resourceType == "droplet" {
 		parts := strings.Split(params["identifier"], "/")
 		if len(parts) != 2 {
-			logger.From(request).Debugw("Not deleting OCI artifacts, because no droplet hash provided in DELETE request", "droplet-identifier", params["identifier"])
+			logger.From(request).Debugw("Not checking droplet version history and not deleting OCI artifacts, because no droplet hash provided in DELETE request", "droplet-identifier", params["identifier"])
 		} else {
-			e := handler.dropletArtifactDeleter.DeleteArtifacts(parts[0], parts[1])
-			if e != nil {
-				logger.From(request).Errorw("Could not delete OCI artifacts", "droplet-identifier", params["identifier"], "error", e)
+			if handler.dropletVersionHistory != nil && appGuidFrom(request) != "" {
+				retained, e := handler.dropletVersionHistory.RetainOnDelete(appGuidFrom(request), parts[0], parts[1])
+				if e != nil {
+					return errors.Wrapf(e, "Could not check droplet version history for %v", params["identifier"])
+				}
+				if retained {
+					logger.From(request).Debugw("Retaining droplet as part of the droplet version history", "droplet-identifier", params["identifier"], "app-guid", appGuidFrom(request))
+					responseWriter.WriteHeader(http.StatusNoContent)
+					return nil
+				}
+			}
+			if handler.dropletArtifactDeleter != nil {
+				e := handler.dropletArtifactDeleter.DeleteArtifacts(parts[0], parts[1])
+				if e != nil {
+					logger.From(request).Errorw("Could not delete OCI artifacts", "droplet-identifier", params["identifier"], "error", e)
+				}
 			}
 		}
 	}
 
 	e = handler.blobstore.Delete(params["identifier"])
+	if e != nil {
+		return e
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+	return nil
+}
 
-	writeResponseBasedOn("", e, responseWriter, request, http.StatusNoContent, nil, nil, "")
+func (handler *ResourceHandler) ListDropletVersions(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
+	if handler.dropletVersionHistory == nil {
+		return newNotFoundResponseError("Droplet version history is not enabled")
+	}
+	versions, e := handler.dropletVersionHistory.Versions(params["app_guid"])
+	if e != nil {
+		return errors.Wrapf(e, "Could not list droplet versions of app %v", params["app_guid"])
+	}
+	if len(versions) == 0 {
+		return newNotFoundResponseError("App %v has no droplet versions", params["app_guid"])
+	}
+	response, e := json.Marshal(versions)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal droplet versions")
+	}
+	responseWriter.Write(response)
+	return nil
 }
 
-func (handler *ResourceHandler) DeleteDir(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
-	e := handler.blobstore.DeleteDir(params["identifier"])
+func (handler *ResourceHandler) PromoteDropletVersion(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
+	if handler.dropletVersionHistory == nil {
+		return newNotFoundResponseError("Droplet version history is not enabled")
+	}
+	version, e := handler.dropletVersionHistory.Promote(params["app_guid"], params["droplet_guid"], params["hash"])
+	if IsNotFoundError(e) {
+		return newNotFoundResponseError("Droplet version %v/%v of app %v not found", params["droplet_guid"], params["hash"], params["app_guid"])
+	}
+	if e != nil {
+		return errors.Wrapf(e, "Could not promote droplet version %v/%v of app %v", params["droplet_guid"], params["hash"], params["app_guid"])
+	}
+	response, e := json.Marshal(version)
+	if e != nil {
+		return errors.Wrap(e, "Could not marshal droplet version")
+	}
+	responseWriter.Write(response)
+	return nil
+}
 
-	switch e.(type) {
-	case *NotFoundError:
-		responseWriter.WriteHeader(http.StatusNoContent)
+// recordDropletVersion adds the droplet to the version history of the app given by the app_guid query parameter.
+// Droplets uploaded without app_guid are not part of any history.
+func (handler *ResourceHandler) recordDropletVersion(identifier string, request *http.Request) {
+	if handler.resourceType != "droplet" || handler.dropletVersionHistory == nil {
+		return
+	}
+	if appGuidFrom(request) == "" {
+		logger.From(request).Debugw("Not recording droplet version, because no app_guid provided", "droplet-identifier", identifier)
 		return
 	}
-	writeResponseBasedOn("", e, responseWriter, request, http.StatusNoContent, nil, nil, "")
+	parts := strings.Split(identifier, "/")
+	if len(parts) != 2 {
+		logger.From(request).Debugw("Not recording droplet version, because no droplet hash provided", "droplet-identifier", identifier)
+		return
+	}
+	e := handler.dropletVersionHistory.Record(appGuidFrom(request), parts[0], parts[1])
+	if e != nil {
+		logger.From(request).Errorw("Could not record droplet version", "droplet-identifier", identifier, "app-guid", appGuidFrom(request), "error", e)
+	}
 }
 
-var emptyReader = ioutil.NopCloser(bytes.NewReader(nil))
+func appGuidFrom(request *http.Request) string {
+	return request.URL.Query().Get("app_guid")
+}
 
-// TODO: this function probably does too many things and should be refactored
-func writeResponseBasedOn(redirectLocation string, e error, responseWriter http.ResponseWriter, request *http.Request, statusCode int, body io.ReadCloser, jsonBody *ResponseBody, ifNoneModify string) {
-	switch e.(type) {
-	case *NotFoundError:
-		responseWriter.WriteHeader(http.StatusNotFound)
-		return
-	case *NoSpaceLeftError:
-		http.Error(responseWriter, util.DescriptionAndCodeAsJSON(500000, "Request Entity Too Large"), http.StatusInsufficientStorage)
-		return
-	case error:
-		panic(e)
+func (handler *ResourceHandler) DeleteDir(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
+	e := handler.blobstore.DeleteDir(params["identifier"])
+	if e != nil && !IsNotFoundError(e) {
+		return e
 	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+var emptyReader = ioutil.NopCloser(bytes.NewReader(nil))
+
+// writeResponse writes the response of a successful request. Errors are left to WriteErrorResponse.
+func writeResponse(responseWriter http.ResponseWriter, request *http.Request, statusCode int, redirectLocation string, body io.ReadCloser, jsonBody *ResponseBody, ifNoneModify string) error {
 	if redirectLocation != "" {
 		redirect(responseWriter, redirectLocation)
-		return
+		return nil
 	}
 	if body != nil {
-		buffer, eTag := bufferAndEtagFrom(body)
+		defer body.Close()
+		// With a stored digest, the ETag is known upfront and the body can be streamed.
+		// Otherwise the body must be read completely to compute the ETag before writing the headers.
+		eTag := responseWriter.Header().Get("ETag")
+		if eTag == "" {
+			buffer, sha1Digest, e := bufferAndEtagFrom(body)
+			if e != nil {
+				return e
+			}
+			defer os.Remove(buffer.Name())
+			defer buffer.Close()
+			body, eTag = buffer, sha1Digest
+		}
 		logger.From(request).Debugw("Cache check", "if-none-modify", ifNoneModify, "etag", eTag)
 		responseWriter.Header().Set("ETag", eTag)
 		if ifNoneModify == eTag {
 			responseWriter.WriteHeader(http.StatusNotModified)
-			return
+			return nil
 		}
 		responseWriter.WriteHeader(statusCode)
-		io.Copy(responseWriter, buffer)
-		return
+		_, e := io.Copy(responseWriter, body)
+		if e != nil {
+			// The status code has already been sent. Aborting the connection is the only way to tell the client
+			// that the body is incomplete, e.g. when the blob turned out to be corrupt while streaming it.
+			logger.From(request).Errorw("Could not write response body. Aborting connection.", "error", e)
+			panic(http.ErrAbortHandler)
+		}
+		return nil
 	}
 	if jsonBody != nil {
-		respBody, marshallingErr := json.Marshal(jsonBody)
-		util.PanicOnError(marshallingErr)
+		respBody, e := json.Marshal(jsonBody)
+		if e != nil {
+			return errors.Wrap(e, "Could not marshal response body")
+		}
 		responseWriter.WriteHeader(statusCode)
 		responseWriter.Write(respBody)
-		return
+		return nil
 	}
 	responseWriter.WriteHeader(statusCode)
+	return nil
 }
 
 func redirect(responseWriter http.ResponseWriter, redirectLocation string) {
@@ -632,19 +827,25 @@ func redirect(responseWriter http.ResponseWriter, redirectLocation string) {
 }
 
 func badRequest(responseWriter http.ResponseWriter, request *http.Request, message string, args ...interface{}) {
-	responseBody := fmt.Sprintf(message, args...)
-	logger.From(request).Infow("Bad request", "body", responseBody)
-	responseWriter.WriteHeader(http.StatusBadRequest)
-	util.FprintDescriptionAndCodeAsJSON(responseWriter, 290003, message, args...)
+	WriteErrorResponse(responseWriter, request, newBadRequestError(message, args...))
 }
 
-func bufferAndEtagFrom(body io.ReadCloser) (buffer *bytes.Buffer, eTag string) {
-	defer body.Close()
-	var buf bytes.Buffer
+// bufferAndEtagFrom buffers the body in a temporary file, rewound and ready to be read.
+// The caller is responsible for closing and removing the file.
+func bufferAndEtagFrom(body io.Reader) (buffer *os.File, eTag string, e error) {
+	buffer, e = ioutil.TempFile("", "bits-response")
+	if e != nil {
+		return nil, "", errors.Wrap(e, "Could not create temporary file")
+	}
 	sha := sha1.New()
-	_, e := io.Copy(io.MultiWriter(&buf, sha), body)
-	util.PanicOnError(e)
-	eTag = hex.EncodeToString(sha.Sum(nil))
-	buffer = &buf
-	return
+	_, e = io.Copy(io.MultiWriter(buffer, sha), body)
+	if e == nil {
+		_, e = buffer.Seek(0, io.SeekStart)
+	}
+	if e != nil {
+		buffer.Close()
+		os.Remove(buffer.Name())
+		return nil, "", errors.Wrap(e, "Could not buffer blob")
+	}
+	return buffer, hex.EncodeToString(sha.Sum(nil)), nil
 }
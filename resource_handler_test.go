@@ -5,17 +5,21 @@ import (
 	"io/ioutil"
 	"reflect"
 
+	"github.com/benbjohnson/clock"
 	"github.com/petergtz/pegomock"
 
 	bitsgo "github.com/cloudfoundry-incubator/bits-service"
 
 	. "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/blobstores/decorator"
+	inmemory "github.com/cloudfoundry-incubator/bits-service/blobstores/inmemory"
 	"github.com/cloudfoundry-incubator/bits-service/httputil"
 
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"time"
 
 	"io"
 
@@ -45,7 +49,7 @@ var _ = Describe("ResourceHandler", func() {
 			It("translates NoSpaceLeftError into StatusInsufficientStorage", func() {
 				When(blobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(NewNoSpaceLeftError())
 
-				handler.AddOrReplace(responseWriter,
+				serve(handler.AddOrReplace, responseWriter,
 					newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
 					map[string]string{})
 
@@ -53,6 +57,59 @@ var _ = Describe("ResourceHandler", func() {
 			})
 		})
 
+		Context("entity too large for resource blobstore", func() {
+			It("does not retry and translates EntityTooLargeError into StatusRequestEntityTooLarge", func() {
+				When(blobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(NewEntityTooLargeError(8, 5))
+
+				serve(handler.AddOrReplace, responseWriter,
+					newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+					map[string]string{})
+
+				Expect(responseWriter.Code).To(Equal(http.StatusRequestEntityTooLarge))
+				blobstore.VerifyWasCalledOnce().Put(AnyString(), anyReadSeeker())
+			})
+		})
+
+		Context("resource blobstore throttles requests", func() {
+			It("translates ThrottledError into StatusTooManyRequests with Retry-After", func() {
+				When(blobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(NewThrottledError(fmt.Errorf("slow down"), 3*time.Second))
+
+				serve(handler.AddOrReplace, responseWriter,
+					newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+					map[string]string{})
+
+				Expect(responseWriter.Code).To(Equal(http.StatusTooManyRequests))
+				Expect(responseWriter.Header().Get("Retry-After")).To(Equal("3"))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":429000,"description":"Too many requests to blobstore"}`))
+			})
+		})
+
+		Context("resource blobstore is unavailable", func() {
+			It("translates UnavailableError into StatusServiceUnavailable with Retry-After", func() {
+				When(blobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(NewUnavailableError(fmt.Errorf("circuit open"), 1500*time.Millisecond))
+
+				serve(handler.AddOrReplace, responseWriter,
+					newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+					map[string]string{})
+
+				Expect(responseWriter.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(responseWriter.Header().Get("Retry-After")).To(Equal("2"))
+			})
+		})
+
+		Context("resource blobstore denies access", func() {
+			It("translates PermissionDeniedError into StatusForbidden", func() {
+				When(blobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(NewPermissionDeniedError(fmt.Errorf("access denied")))
+
+				serve(handler.AddOrReplace, responseWriter,
+					newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+					map[string]string{})
+
+				Expect(responseWriter.Code).To(Equal(http.StatusForbidden))
+				Expect(responseWriter.Header().Get("Retry-After")).To(BeEmpty())
+			})
+		})
+
 		Context("resource is a package", func() {
 			BeforeEach(func() {
 				handler = NewResourceHandlerWithUpdater(blobstore, appStashBlobstore, updater, "package", NewMockMetricsService(), 0, false, nil)
@@ -62,7 +119,7 @@ var _ = Describe("ResourceHandler", func() {
 				It("translates NoSpaceLeftError into StatusInsufficientStorage", func() {
 					When(appStashBlobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(NewNoSpaceLeftError())
 
-					handler.AddOrReplace(responseWriter,
+					serve(handler.AddOrReplace, responseWriter,
 						newTestRequest("package", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
 						map[string]string{})
 
@@ -72,7 +129,7 @@ var _ = Describe("ResourceHandler", func() {
 
 			Context("package payload is not a valid zip file", func() {
 				It("returns a HTTP status UnprocessableEntity ", func() {
-					handler.AddOrReplace(responseWriter,
+					serve(handler.AddOrReplace, responseWriter,
 						newTestRequest("package", "some-filename", "not a zip file"),
 						map[string]string{"identifier": "someguid"})
 
@@ -95,7 +152,7 @@ var _ = Describe("ResourceHandler", func() {
 				q, e := url.ParseQuery("async=true")
 				Expect(e).NotTo(HaveOccurred())
 				req.URL.RawQuery = q.Encode()
-				handler.AddOrReplace(responseWriter,
+				serve(handler.AddOrReplace, responseWriter,
 					req,
 					map[string]string{})
 
@@ -123,7 +180,7 @@ var _ = Describe("ResourceHandler", func() {
 			It("returns a response with body and StatusOK", func() {
 				When(blobstore.GetOrRedirect(AnyString())).ThenReturn(ioutil.NopCloser(strings.NewReader("hello")), "", nil)
 
-				handler.Get(responseWriter, newGetRequestWithOptionalIfNoneModify(""), nil)
+				serve(handler.Get, responseWriter, newGetRequestWithOptionalIfNoneModify(""), nil)
 
 				Expect(responseWriter.Code).To(Equal(http.StatusOK))
 				Expect(responseWriter.Body.String()).To(Equal("hello"))
@@ -134,7 +191,7 @@ var _ = Describe("ResourceHandler", func() {
 			BeforeEach(func() {
 				When(blobstore.GetOrRedirect(AnyString())).ThenReturn(ioutil.NopCloser(strings.NewReader("hello")), "", nil)
 
-				handler.Get(responseWriter, newGetRequestWithOptionalIfNoneModify(""), nil)
+				serve(handler.Get, responseWriter, newGetRequestWithOptionalIfNoneModify(""), nil)
 
 				Expect(responseWriter.Code).To(Equal(http.StatusOK))
 			})
@@ -145,7 +202,7 @@ var _ = Describe("ResourceHandler", func() {
 
 					responseWriterFollowUpRequest := httptest.NewRecorder()
 
-					handler.Get(
+					serve(handler.Get,
 						responseWriterFollowUpRequest,
 						newGetRequestWithOptionalIfNoneModify(responseWriter.HeaderMap.Get("ETag")),
 						nil)
@@ -165,7 +222,7 @@ var _ = Describe("ResourceHandler", func() {
 
 					responseWriterFollowUpRequest := httptest.NewRecorder()
 
-					handler.Get(
+					serve(handler.Get,
 						responseWriterFollowUpRequest,
 						newGetRequestWithOptionalIfNoneModify(responseWriter.HeaderMap.Get("ETag")),
 						nil)
@@ -175,12 +232,127 @@ var _ = Describe("ResourceHandler", func() {
 				})
 			})
 		})
+
+		Context("blobstore stores digests", func() {
+			BeforeEach(func() {
+				handler = NewResourceHandler(&digestingMockBlobstore{blobstore, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}, appStashBlobstore, "test-resource", NewMockMetricsService(), 0, false)
+			})
+
+			It("streams the body, since the ETag is known upfront, and aborts the connection when reading fails", func() {
+				When(blobstore.GetOrRedirect(AnyString())).ThenReturn(ioutil.NopCloser(io.MultiReader(strings.NewReader("hel"), brokenReader{})), "", nil)
+
+				Expect(recoveredFrom(func() {
+					serve(handler.Get, responseWriter, newGetRequestWithOptionalIfNoneModify(""), nil)
+				})).To(Equal(http.ErrAbortHandler))
+
+				Expect(responseWriter.Code).To(Equal(http.StatusOK))
+				Expect(responseWriter.Body.String()).To(Equal("hel"))
+				Expect(responseWriter.Header().Get("ETag")).To(Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+			})
+		})
+
+		Context("blobstore does not store digests", func() {
+			It("reads the complete body before responding, since it needs it to compute the ETag", func() {
+				When(blobstore.GetOrRedirect(AnyString())).ThenReturn(ioutil.NopCloser(io.MultiReader(strings.NewReader("hel"), brokenReader{})), "", nil)
+
+				serve(handler.Get, responseWriter, newGetRequestWithOptionalIfNoneModify(""), nil)
+
+				Expect(responseWriter.Code).To(Equal(http.StatusInternalServerError))
+				Expect(responseWriter.Body.String()).NotTo(ContainSubstring("hel"))
+			})
+		})
+	})
+
+	Context("blobstore stores digests", func() {
+		BeforeEach(func() {
+			digestingBlobstore := decorator.ForBlobstoreWithChecksumVerification(inmemory.NewBlobstore(), NewMockMetricsService(), "test-resource")
+			Expect(digestingBlobstore.Put("some-guid", strings.NewReader("hello"))).To(Succeed())
+			handler = NewResourceHandler(digestingBlobstore, appStashBlobstore, "test-resource", NewMockMetricsService(), 0, false)
+		})
+
+		It("returns the stored digest as Digest and ETag on GET", func() {
+			serve(handler.Get, responseWriter, newGetRequestWithOptionalIfNoneModify(""), map[string]string{"identifier": "some-guid"})
+
+			Expect(responseWriter.Code).To(Equal(http.StatusOK))
+			Expect(responseWriter.Body.String()).To(Equal("hello"))
+			Expect(responseWriter.Header().Get("Digest")).To(Equal("SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="))
+			Expect(responseWriter.Header().Get("ETag")).To(Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+		})
+
+		It("returns the stored digest as Digest and ETag on HEAD", func() {
+			serve(handler.Head, responseWriter, httptest.NewRequest("HEAD", "/some-guid", nil), map[string]string{"identifier": "some-guid"})
+
+			Expect(responseWriter.Code).To(Equal(http.StatusOK))
+			Expect(responseWriter.Header().Get("Digest")).To(Equal("SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="))
+			Expect(responseWriter.Header().Get("ETag")).To(Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+		})
+
+		It("aborts the connection when the blob turns out to be corrupt while streaming it", func() {
+			backend := inmemory.NewBlobstore()
+			digestingBlobstore := decorator.ForBlobstoreWithChecksumVerification(backend, NewMockMetricsService(), "test-resource")
+			Expect(digestingBlobstore.Put("some-guid", strings.NewReader("hello"))).To(Succeed())
+			backend.Entries["some-guid"] = []byte("hellO")
+			handler = NewResourceHandler(digestingBlobstore, appStashBlobstore, "test-resource", NewMockMetricsService(), 0, false)
+
+			Expect(recoveredFrom(func() {
+				serve(handler.Get, responseWriter, newGetRequestWithOptionalIfNoneModify(""), map[string]string{"identifier": "some-guid"})
+			})).To(Equal(http.ErrAbortHandler))
+
+			Expect(responseWriter.Code).To(Equal(http.StatusOK))
+			Expect(responseWriter.Header().Get("ETag")).To(Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+		})
+
+		It("returns the stored digest when eviction is enabled", func() {
+			digestingBlobstore := decorator.ForBlobstoreWithChecksumVerification(inmemory.NewBlobstore(), NewMockMetricsService(), "buildpack_cache")
+			Expect(digestingBlobstore.Put("some-guid", strings.NewReader("hello"))).To(Succeed())
+			evictingBlobstore := decorator.ForBlobstoreWithEviction(digestingBlobstore, NewMockMetricsService(), "buildpack_cache", 0, 0, time.Hour, clock.NewMock())
+			handler = NewResourceHandler(evictingBlobstore, appStashBlobstore, "buildpack_cache", NewMockMetricsService(), 0, false)
+
+			serve(handler.Head, responseWriter, httptest.NewRequest("HEAD", "/some-guid", nil), map[string]string{"identifier": "some-guid"})
+
+			Expect(responseWriter.Code).To(Equal(http.StatusOK))
+			Expect(responseWriter.Header().Get("Digest")).To(Equal("SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="))
+		})
+	})
+
+	Context("Delete droplet with droplet version history", func() {
+		var (
+			dropletBlobstore *inmemory.Blobstore
+			artifactDeleter  *recordingArtifactDeleter
+			history          *bitsgo.DropletVersionHistory
+		)
+
+		BeforeEach(func() {
+			dropletBlobstore = inmemory.NewBlobstore()
+			artifactDeleter = &recordingArtifactDeleter{}
+			history = bitsgo.NewDropletVersionHistory(dropletBlobstore, 2, artifactDeleter)
+			handler = NewResourceHandlerWithArtifactDeleter(dropletBlobstore, appStashBlobstore, "droplet", NewMockMetricsService(), 0, false, artifactDeleter).
+				WithDropletVersionHistory(history)
+			Expect(dropletBlobstore.Put("droplet1/hash1", strings.NewReader("droplet"))).To(Succeed())
+			Expect(history.Record("the-app", "droplet1", "hash1")).To(Succeed())
+		})
+
+		It("keeps droplet and OCI artifacts when the droplet is part of the app's history", func() {
+			serve(handler.Delete, responseWriter, httptest.NewRequest("DELETE", "/droplets/droplet1/hash1?app_guid=the-app", nil), map[string]string{"identifier": "droplet1/hash1"})
+
+			Expect(responseWriter.Code).To(Equal(http.StatusNoContent))
+			Expect(dropletBlobstore.Exists("droplet1/hash1")).To(BeTrue())
+			Expect(artifactDeleter.deleted).To(BeEmpty())
+		})
+
+		It("deletes droplet and OCI artifacts when no app_guid is provided", func() {
+			serve(handler.Delete, responseWriter, httptest.NewRequest("DELETE", "/droplets/droplet1/hash1", nil), map[string]string{"identifier": "droplet1/hash1"})
+
+			Expect(responseWriter.Code).To(Equal(http.StatusNoContent))
+			Expect(dropletBlobstore.Exists("droplet1/hash1")).To(BeFalse())
+			Expect(artifactDeleter.deleted).To(Equal([]string{"droplet1/hash1"}))
+		})
 	})
 
 	Context("Updater", func() {
 		Context("No errors", func() {
 			It("calls updater and blobstore in the right order", func() {
-				handler.AddOrReplace(responseWriter,
+				serve(handler.AddOrReplace, responseWriter,
 					newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
 					map[string]string{"identifier": "someguid"})
 
@@ -202,7 +374,7 @@ var _ = Describe("ResourceHandler", func() {
 				It("does not upload the resource, returns BadRequest", func() {
 					When(updater.NotifyProcessingUpload(AnyString())).ThenReturn(NewStateForbiddenError())
 
-					handler.AddOrReplace(responseWriter,
+					serve(handler.AddOrReplace, responseWriter,
 						newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
 						map[string]string{"identifier": "someguid"})
 
@@ -216,14 +388,15 @@ var _ = Describe("ResourceHandler", func() {
 			})
 
 			Context("NotifyUploadSucceeded returns an error", func() {
-				It("has uploaded the resource, panics", func() {
+				It("has uploaded the resource, returns StatusInternalServerError", func() {
 					When(updater.NotifyUploadSucceeded(AnyString(), AnyString(), AnyString())).ThenReturn(fmt.Errorf("Some error"))
 
-					Expect(func() {
-						handler.AddOrReplace(responseWriter,
-							newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
-							map[string]string{"identifier": "someguid"})
-					}).To(Panic())
+					serve(handler.AddOrReplace, responseWriter,
+						newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+						map[string]string{"identifier": "someguid"})
+
+					Expect(responseWriter.Code).To(Equal(http.StatusInternalServerError))
+					Expect(responseWriter.Body.String()).To(MatchJSON(`{"code":10001,"description":"Internal Server Error"}`))
 
 					updater.VerifyWasCalled(Never()).NotifyUploadFailed(AnyString(), anyError())
 					blobstore.VerifyWasCalledOnce().Put(EqString("someguid"), anyReadSeeker())
@@ -233,7 +406,7 @@ var _ = Describe("ResourceHandler", func() {
 					It("has uploaded the resource, returns StatusConflict", func() {
 						When(updater.NotifyUploadSucceeded(AnyString(), AnyString(), AnyString())).ThenReturn(bitsgo.NewNotFoundError())
 
-						handler.AddOrReplace(responseWriter,
+						serve(handler.AddOrReplace, responseWriter,
 							newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
 							map[string]string{"identifier": "someguid"})
 
@@ -245,15 +418,15 @@ var _ = Describe("ResourceHandler", func() {
 			})
 
 			Context("NotifyUploadFailed returns an error", func() {
-				It("panics", func() {
+				It("returns StatusInternalServerError", func() {
 					When(blobstore.Put(AnyString(), anyReadSeeker())).ThenReturn(fmt.Errorf("Some blobstore error"))
 					When(updater.NotifyUploadFailed(AnyString(), anyError())).ThenReturn(fmt.Errorf("Some error"))
 
-					Expect(func() {
-						handler.AddOrReplace(responseWriter,
-							newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
-							map[string]string{"identifier": "someguid"})
-					}).To(Panic())
+					serve(handler.AddOrReplace, responseWriter,
+						newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+						map[string]string{"identifier": "someguid"})
+
+					Expect(responseWriter.Code).To(Equal(http.StatusInternalServerError))
 
 					inOrderContext := new(InOrderContext)
 					updater.VerifyWasCalledInOrder(Once(), inOrderContext).NotifyProcessingUpload("someguid")
@@ -266,15 +439,14 @@ var _ = Describe("ResourceHandler", func() {
 
 		Context("replies with an unexpected error", func() {
 			Context("NotifyProcessingUpload returns unexpected error", func() {
-				It("does not upload the resource, panics", func() {
+				It("does not upload the resource, returns StatusInternalServerError", func() {
 					When(updater.NotifyProcessingUpload(AnyString())).ThenReturn(fmt.Errorf("Unexpected error"))
 
-					Expect(func() {
-						handler.AddOrReplace(responseWriter,
-							newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
-							map[string]string{"identifier": "someguid"})
-					}).To(Panic())
+					serve(handler.AddOrReplace, responseWriter,
+						newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
+						map[string]string{"identifier": "someguid"})
 
+					Expect(responseWriter.Code).To(Equal(http.StatusInternalServerError))
 					updater.VerifyWasCalled(Never()).NotifyUploadFailed(AnyString(), anyError())
 					updater.VerifyWasCalled(Never()).NotifyUploadSucceeded(AnyString(), AnyString(), AnyString())
 					blobstore.VerifyWasCalled(Never()).Put(AnyString(), anyReadSeeker())
@@ -288,7 +460,7 @@ var _ = Describe("ResourceHandler", func() {
 				It("does not upload the resource, returns ResourceNotFound", func() {
 					When(updater.NotifyProcessingUpload(AnyString())).ThenReturn(bitsgo.NewNotFoundError())
 
-					handler.AddOrReplace(responseWriter,
+					serve(handler.AddOrReplace, responseWriter,
 						newTestRequest("test-resource", "some-filename", CreateZip(map[string]string{"file1": "content1"}).String()),
 						map[string]string{"identifier": "someguid"})
 
@@ -303,6 +475,36 @@ var _ = Describe("ResourceHandler", func() {
 	})
 })
 
+// serve calls handler the way the routes do, i.e. errors are written by WriteErrorResponse.
+func serve(handler func(http.ResponseWriter, *http.Request, map[string]string) error, responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+	e := handler(responseWriter, request, params)
+	if e != nil {
+		WriteErrorResponse(responseWriter, request, e)
+	}
+}
+
+// recoveredFrom returns the value f panicked with, or nil.
+func recoveredFrom(f func()) (recovered interface{}) {
+	defer func() { recovered = recover() }()
+	f()
+	return nil
+}
+
+type digestingMockBlobstore struct {
+	*MockBlobstore
+	digest string
+}
+
+func (blobstore *digestingMockBlobstore) Digest(path string) (string, error) {
+	return blobstore.digest, nil
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
 func anyReadSeeker() io.ReadSeeker {
 	RegisterMatcher(NewAnyMatcher(reflect.TypeOf((*io.ReadSeeker)(nil)).Elem()))
 	return nil
@@ -4,8 +4,10 @@ import (
 	"net/http"
 
 	bitsgo "github.com/cloudfoundry-incubator/bits-service"
+	"github.com/cloudfoundry-incubator/bits-service/inventory"
 	"github.com/cloudfoundry-incubator/bits-service/middlewares"
 	registry "github.com/cloudfoundry-incubator/bits-service/oci_registry"
+	"github.com/cloudfoundry-incubator/bits-service/reconciler"
 	"github.com/cloudfoundry-incubator/bits-service/util"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
@@ -21,6 +23,8 @@ func SetUpAllRoutes(privateHost, publicHost, registryHost string, basicAuthMiddl
 	appstashHandler *bitsgo.AppStashHandler,
 	packageHandler, buildpackHandler, dropletHandler, buildpackCacheHandler *bitsgo.ResourceHandler,
 	ociImageHandler *registry.ImageHandler,
+	inventoryReporter *inventory.Reporter,
+	orphanReconciler *reconciler.Reconciler,
 ) *mux.Router {
 
 	rootRouter := mux.NewRouter()
@@ -33,9 +37,18 @@ func SetUpAllRoutes(privateHost, publicHost, registryHost string, basicAuthMiddl
 	SetUpAppStashRoutes(internalRouter, appstashHandler)
 	SetUpPackageRoutes(internalRouter, packageHandler)
 	SetUpBuildpackRoutes(internalRouter, buildpackHandler)
+	SetUpDropletVersionRoutes(internalRouter, dropletHandler)
 	SetUpDropletRoutes(internalRouter, dropletHandler)
+	SetUpBuildpackCacheListingRoutes(internalRouter, buildpackCacheHandler)
 	SetUpBuildpackCacheRoutes(internalRouter, buildpackCacheHandler)
 
+	if inventoryReporter != nil {
+		SetUpInventoryRoute(internalRouter, basicAuthMiddleware, inventoryReporter)
+	}
+	if orphanReconciler != nil {
+		SetUpReconciliationRoute(internalRouter, basicAuthMiddleware, orphanReconciler)
+	}
+
 	publicRouter := rootRouter.Host(publicHost).Subrouter()
 	publicRouter.Use(middlewares.GorillaMiddlewareFrom(signatureVerificationMiddleware))
 
@@ -58,9 +71,9 @@ func SetUpAllRoutes(privateHost, publicHost, registryHost string, basicAuthMiddl
 }
 
 func SetUpAppStashRoutes(router *mux.Router, appStashHandler *bitsgo.AppStashHandler) {
-	router.Path("/app_stash/entries").Methods("POST").HandlerFunc(appStashHandler.PostEntries)
-	router.Path("/app_stash/matches").Methods("POST").HandlerFunc(appStashHandler.PostMatches)
-	router.Path("/app_stash/bundles").Methods("POST").HandlerFunc(appStashHandler.PostBundles)
+	router.Path("/app_stash/entries").Methods("POST").Handler(bitsgo.HandlerFunc(appStashHandler.PostEntries))
+	router.Path("/app_stash/matches").Methods("POST").Handler(bitsgo.HandlerFunc(appStashHandler.PostMatches))
+	router.Path("/app_stash/bundles").Methods("POST").Handler(bitsgo.HandlerFunc(appStashHandler.PostBundles))
 }
 
 func SetUpPackageRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHandler) {
@@ -68,33 +81,45 @@ func SetUpPackageRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHand
 }
 
 func SetUpBuildpackRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHandler) {
-	router.Path("/buildpacks").Methods("POST").HandlerFunc(delegateTo(resourceHandler.AddBuildpack))
+	router.Path("/buildpacks").Methods("POST").Handler(delegateTo(resourceHandler.AddBuildpack))
 	// TODO: why do we need a version with a / in the end
-	router.Path("/buildpacks/").Methods("POST").HandlerFunc(delegateTo(resourceHandler.AddBuildpack))
-	router.Path("/buildpacks/{identifier}/metadata").Methods("GET").HandlerFunc(delegateTo(resourceHandler.BuildpackMetadata))
+	router.Path("/buildpacks/").Methods("POST").Handler(delegateTo(resourceHandler.AddBuildpack))
+	router.Path("/buildpacks/{identifier}/metadata").Methods("GET").Handler(delegateTo(resourceHandler.BuildpackMetadata))
 	setUpDefaultMethodRoutes(router.Path("/buildpacks/{identifier}").Subrouter(), resourceHandler)
 }
 
 func SetUpDropletRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHandler) {
-	router.Path("/droplets/{identifier:[a-z0-9\\-]+}").Methods("PUT").HandlerFunc(delegateTo(resourceHandler.AddOrReplaceWithDigestInHeader))
+	router.Path("/droplets/{identifier:[a-z0-9\\-]+}").Methods("PUT").Handler(delegateTo(resourceHandler.AddOrReplaceWithDigestInHeader))
 	setUpDefaultMethodRoutes(
 		router.Path("/droplets/{identifier:.+}").Subrouter(), // TODO we could probably be more specific in the regex
 		resourceHandler)
 }
 
+func SetUpDropletVersionRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHandler) {
+	router.Path("/droplet_versions/{app_guid:[a-z0-9\\-]+}").Methods("GET").Handler(delegateTo(resourceHandler.ListDropletVersions))
+	router.Path("/droplet_versions/{app_guid:[a-z0-9\\-]+}/{droplet_guid:[a-z0-9\\-]+}/{hash:[a-z0-9]+}/promote").Methods("POST").Handler(delegateTo(resourceHandler.PromoteDropletVersion))
+}
+
+// SetUpBuildpackCacheListingRoutes must be set up before SetUpBuildpackCacheRoutes, because the latter matches any entry path.
+func SetUpBuildpackCacheListingRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHandler) {
+	router.Path("/buildpack_cache/entries").Methods("GET").Handler(delegateTo(resourceHandler.ListBuildpackCacheEntries))
+	router.Path("/buildpack_cache/entries/").Methods("GET").Handler(delegateTo(resourceHandler.ListBuildpackCacheEntries))
+	router.Path("/buildpack_cache/entries/{identifier}").Methods("GET").Handler(delegateTo(resourceHandler.ListBuildpackCacheEntries))
+}
+
 func SetUpBuildpackCacheRoutes(router *mux.Router, resourceHandler *bitsgo.ResourceHandler) {
-	router.Path("/buildpack_cache/entries").Methods("DELETE").HandlerFunc(delegateTo(resourceHandler.DeleteDir))
-	router.Path("/buildpack_cache/entries/").Methods("DELETE").HandlerFunc(delegateTo(resourceHandler.DeleteDir))
-	router.Path("/buildpack_cache/entries/{identifier}").Methods("DELETE").HandlerFunc(delegateTo(resourceHandler.DeleteDir))
+	router.Path("/buildpack_cache/entries").Methods("DELETE").Handler(delegateTo(resourceHandler.DeleteDir))
+	router.Path("/buildpack_cache/entries/").Methods("DELETE").Handler(delegateTo(resourceHandler.DeleteDir))
+	router.Path("/buildpack_cache/entries/{identifier}").Methods("DELETE").Handler(delegateTo(resourceHandler.DeleteDir))
 	setUpDefaultMethodRoutes(router.Path("/buildpack_cache/entries/{identifier:.*}").Subrouter(), resourceHandler)
 }
 
 func setUpDefaultMethodRoutes(router *mux.Router, handler *bitsgo.ResourceHandler) {
-	router.Methods("PUT").HeadersRegexp("Content-Type", "multipart/form-data").HandlerFunc(delegateTo(handler.AddOrReplace))
-	router.Methods("PUT").HandlerFunc(delegateTo(handler.CopySourceGuid))
-	router.Methods("HEAD").HandlerFunc(delegateTo(handler.Head))
-	router.Methods("GET").HandlerFunc(delegateTo(handler.Get))
-	router.Methods("DELETE").HandlerFunc(delegateTo(handler.Delete))
+	router.Methods("PUT").HeadersRegexp("Content-Type", "multipart/form-data").Handler(delegateTo(handler.AddOrReplace))
+	router.Methods("PUT").Handler(delegateTo(handler.CopySourceGuid))
+	router.Methods("HEAD").Handler(delegateTo(handler.Head))
+	router.Methods("GET").Handler(delegateTo(handler.Get))
+	router.Methods("DELETE").Handler(delegateTo(handler.Delete))
 	setRouteNotFoundStatusCode(router, http.StatusMethodNotAllowed)
 }
 
@@ -120,17 +145,25 @@ func SetUpSignRoute(router *mux.Router,
 	})
 }
 
+func SetUpInventoryRoute(router *mux.Router, basicAuthMiddleware *middlewares.BasicAuthMiddleware, inventoryReporter *inventory.Reporter) {
+	router.Path("/inventory").Methods("GET").Handler(negroni.New(basicAuthMiddleware, negroni.Wrap(bitsgo.HandlerFunc(inventoryReporter.ServeLatestReport))))
+}
+
+func SetUpReconciliationRoute(router *mux.Router, basicAuthMiddleware *middlewares.BasicAuthMiddleware, orphanReconciler *reconciler.Reconciler) {
+	router.Path("/reconciliation").Methods("GET").Handler(negroni.New(basicAuthMiddleware, negroni.Wrap(bitsgo.HandlerFunc(orphanReconciler.ServeLatestResult))))
+}
+
 func wrapWith(basicAuthMiddleware *middlewares.BasicAuthMiddleware, handler *bitsgo.SignResourceHandler) http.Handler {
 	return negroni.New(
 		basicAuthMiddleware,
-		negroni.Wrap(http.HandlerFunc(delegateWithQueryParamsExtractedTo(handler.Sign))),
+		negroni.Wrap(delegateWithQueryParamsExtractedTo(handler.Sign)),
 	)
 }
 
-func wrapWithImageHandler(basicAuthMiddleware *middlewares.BasicAuthMiddleware, handler func(http.ResponseWriter, *http.Request)) http.Handler {
+func wrapWithImageHandler(basicAuthMiddleware *middlewares.BasicAuthMiddleware, handler bitsgo.HandlerFunc) http.Handler {
 	return negroni.New(
 		basicAuthMiddleware,
-		negroni.Wrap(http.HandlerFunc(handler)),
+		negroni.Wrap(handler),
 	)
 }
 
@@ -140,17 +173,17 @@ func setRouteNotFoundStatusCode(router *mux.Router, statusCode int) {
 	})
 }
 
-func delegateTo(delegate func(http.ResponseWriter, *http.Request, map[string]string)) func(http.ResponseWriter, *http.Request) {
-	return func(responseWriter http.ResponseWriter, request *http.Request) {
-		delegate(responseWriter, request, mux.Vars(request))
+func delegateTo(delegate func(http.ResponseWriter, *http.Request, map[string]string) error) bitsgo.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) error {
+		return delegate(responseWriter, request, mux.Vars(request))
 	}
 }
 
-func delegateWithQueryParamsExtractedTo(delegate func(http.ResponseWriter, *http.Request, map[string]string)) func(http.ResponseWriter, *http.Request) {
-	return func(responseWriter http.ResponseWriter, request *http.Request) {
+func delegateWithQueryParamsExtractedTo(delegate func(http.ResponseWriter, *http.Request, map[string]string) error) bitsgo.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) error {
 		// TODO: make this more generic
 		mux.Vars(request)["verb"] = request.URL.Query().Get("verb")
-		delegate(responseWriter, request, mux.Vars(request))
+		return delegate(responseWriter, request, mux.Vars(request))
 	}
 }
 
@@ -195,9 +195,56 @@ var _ = Describe("routes", func() {
 
 	Describe("/buildpack_cache/entries", func() {
 		BeforeEach(func() {
-			SetUpBuildpackCacheRoutes(
-				router,
-				bitsgo.NewResourceHandler(decorator.ForBlobstoreWithPathPartitioning(decorator.ForBlobstoreWithPathPrefixing(blobstore, "buildpack_cache/")), appstashBlobstore, "buildpack_cache", statsd.NewMetricsService(), 0, false))
+			handler := bitsgo.NewResourceHandler(decorator.ForBlobstoreWithPathPartitioning(decorator.ForBlobstoreWithPathPrefixing(blobstore, "buildpack_cache/")), appstashBlobstore, "buildpack_cache", statsd.NewMetricsService(), 0, false)
+			SetUpBuildpackCacheListingRoutes(router, handler)
+			SetUpBuildpackCacheRoutes(router, handler)
+		})
+
+		Context("GET /buildpack_cache/entries/{app_guid}", func() {
+			It("lists the stacks cached for the app", func() {
+				blobstoreEntries["buildpack_cache/th/eg/theguid/stack1"] = []byte("content1")
+				blobstoreEntries["buildpack_cache/th/eg/theguid/stack2"] = []byte("content22")
+				blobstoreEntries["buildpack_cache/ot/he/otherguid/stack1"] = []byte("content")
+				blobstoreEntries["th/eg/theguid/somedroplethash"] = []byte("droplet content")
+
+				router.ServeHTTP(responseWriter, httptest.NewRequest("GET", "/buildpack_cache/entries/theguid", nil))
+
+				Expect(responseWriter.Code).To(Equal(http.StatusOK))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"entries": [
+						{"app_guid": "theguid", "stack": "stack1", "size": 8, "last_modified": "0001-01-01T00:00:00Z"},
+						{"app_guid": "theguid", "stack": "stack2", "size": 9, "last_modified": "0001-01-01T00:00:00Z"}
+					],
+					"total_count": 2,
+					"total_size": 17
+				}`))
+			})
+
+			It("returns an empty list when nothing is cached for the app", func() {
+				router.ServeHTTP(responseWriter, httptest.NewRequest("GET", "/buildpack_cache/entries/theguid", nil))
+
+				Expect(responseWriter.Code).To(Equal(http.StatusOK))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{"entries": [], "total_count": 0, "total_size": 0}`))
+			})
+		})
+
+		Context("GET /buildpack_cache/entries", func() {
+			It("lists the entries of all apps with totals", func() {
+				blobstoreEntries["buildpack_cache/th/eg/theguid/stack1"] = []byte("content1")
+				blobstoreEntries["buildpack_cache/ot/he/otherguid/stack1"] = []byte("content")
+
+				router.ServeHTTP(responseWriter, httptest.NewRequest("GET", "/buildpack_cache/entries", nil))
+
+				Expect(responseWriter.Code).To(Equal(http.StatusOK))
+				Expect(responseWriter.Body.String()).To(MatchJSON(`{
+					"entries": [
+						{"app_guid": "otherguid", "stack": "stack1", "size": 7, "last_modified": "0001-01-01T00:00:00Z"},
+						{"app_guid": "theguid", "stack": "stack1", "size": 8, "last_modified": "0001-01-01T00:00:00Z"}
+					],
+					"total_count": 2,
+					"total_size": 15
+				}`))
+			})
 		})
 
 		Context("GET /buildpack_cache/entries/{app_guid}/{stack_name}", func() {
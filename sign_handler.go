@@ -6,10 +6,11 @@ import (
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
 )
 
 type ResourceSigner interface {
-	Sign(resource string, method string, expirationTime time.Time) (signedURL string)
+	Sign(resource string, method string, expirationTime time.Time) (signedURL string, err error)
 }
 
 type SignResourceHandler struct {
@@ -25,7 +26,7 @@ func NewSignResourceHandler(getResourceSigner, putResourceSigner ResourceSigner)
 	}
 }
 
-func (handler *SignResourceHandler) Sign(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) {
+func (handler *SignResourceHandler) Sign(responseWriter http.ResponseWriter, request *http.Request, params map[string]string) error {
 	method := params["verb"]
 	var signer ResourceSigner
 
@@ -39,11 +40,13 @@ func (handler *SignResourceHandler) Sign(responseWriter http.ResponseWriter, req
 	case "put", "post":
 		signer = handler.putResourceSigner
 	default:
-		responseWriter.WriteHeader(http.StatusBadRequest)
-		responseWriter.Write([]byte("Invalid verb: " + method))
-		return
+		return newBadRequestError("Invalid verb: %v", method)
 	}
 
-	signature := signer.Sign(params["resource"], method, handler.clock.Now().Add(1*time.Hour))
+	signature, e := signer.Sign(params["resource"], method, handler.clock.Now().Add(1*time.Hour))
+	if e != nil {
+		return errors.Wrapf(e, "Could not sign %v", params["resource"])
+	}
 	fmt.Fprint(responseWriter, signature)
+	return nil
 }
@@ -6,6 +6,8 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/cloudfoundry-incubator/bits-service"
 	"github.com/cloudfoundry-incubator/bits-service/httputil"
 	. "github.com/petergtz/pegomock"
@@ -29,12 +31,18 @@ var _ = Describe("SignResourceHandler", func() {
 		recorder = httptest.NewRecorder()
 	})
 
+	sign := func(handler *bitsgo.SignResourceHandler, request *http.Request, params map[string]string) {
+		bitsgo.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) error {
+			return handler.Sign(responseWriter, request, params)
+		}).ServeHTTP(recorder, request)
+	}
+
 	It("Signs a GET URL", func() {
-		When(getSigner.Sign(AnyString(), AnyString(), AnyTime())).ThenReturn("Some get signature")
+		When(getSigner.Sign(AnyString(), AnyString(), AnyTime())).ThenReturn("Some get signature", nil)
 		handler := bitsgo.NewSignResourceHandler(getSigner, putSigner)
 		request := httputil.NewRequest("GET", "/foo", nil).Build()
 
-		handler.Sign(recorder, request, map[string]string{"verb": "get", "resource": "bar"})
+		sign(handler, request, map[string]string{"verb": "get", "resource": "bar"})
 		Expect(recorder.Code).To(Equal(http.StatusOK))
 		Expect(recorder.Body.String()).To(Equal("Some get signature"))
 	})
@@ -44,20 +52,31 @@ var _ = Describe("SignResourceHandler", func() {
 			handler := bitsgo.NewSignResourceHandler(getSigner, putSigner)
 			request := httputil.NewRequest("", "/does", nil).Build()
 
-			handler.Sign(recorder, request, map[string]string{"verb": "something invalid", "resource": "foobar"})
+			sign(handler, request, map[string]string{"verb": "something invalid", "resource": "foobar"})
 			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
-			Expect(recorder.Body.String()).To(Equal("Invalid verb: something invalid"))
+			Expect(recorder.Body.String()).To(ContainSubstring("Invalid verb: something invalid"))
 		})
 	})
 
 	It("Signs a PUT URL", func() {
-		When(putSigner.Sign(AnyString(), AnyString(), AnyTime())).ThenReturn("Some put signature")
+		When(putSigner.Sign(AnyString(), AnyString(), AnyTime())).ThenReturn("Some put signature", nil)
 
 		handler := bitsgo.NewSignResourceHandler(getSigner, putSigner)
 		request := httputil.NewRequest("PUT", "/bar", nil).Build()
 
-		handler.Sign(recorder, request, map[string]string{"verb": "put", "resource": "foobar"})
+		sign(handler, request, map[string]string{"verb": "put", "resource": "foobar"})
 		Expect(recorder.Code).To(Equal(http.StatusOK))
 		Expect(recorder.Body.String()).To(Equal("Some put signature"))
 	})
+
+	It("Responds with an internal server error when signing fails", func() {
+		When(getSigner.Sign(AnyString(), AnyString(), AnyTime())).ThenReturn("", errors.New("Some signing error"))
+
+		handler := bitsgo.NewSignResourceHandler(getSigner, putSigner)
+		request := httputil.NewRequest("GET", "/foo", nil).Build()
+
+		sign(handler, request, map[string]string{"verb": "get", "resource": "bar"})
+		Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("Some signing error"))
+	})
 })
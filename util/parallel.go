@@ -0,0 +1,42 @@
+package util
+
+import "sync"
+
+// InParallel calls f for 0 to n-1 with at most concurrency calls running at the same time and returns the first error.
+// After an error, no further calls are started.
+func InParallel(n int, concurrency int, f func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg         sync.WaitGroup
+		mutex      sync.Mutex
+		firstError error
+	)
+	slots := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		mutex.Lock()
+		failed := firstError != nil
+		mutex.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			e := f(i)
+			if e != nil {
+				mutex.Lock()
+				if firstError == nil {
+					firstError = e
+				}
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstError
+}